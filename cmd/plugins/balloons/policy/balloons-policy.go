@@ -17,13 +17,18 @@ package balloons
 import (
 	"fmt"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"unicode"
 
 	cfgapi "github.com/containers/nri-plugins/pkg/apis/config/v1alpha1/resmgr/policy/balloons"
 	"github.com/containers/nri-plugins/pkg/cpuallocator"
 	"github.com/containers/nri-plugins/pkg/kubernetes"
 	logger "github.com/containers/nri-plugins/pkg/log"
 	"github.com/containers/nri-plugins/pkg/resmgr/cache"
+	"github.com/containers/nri-plugins/pkg/resmgr/control"
 	cpucontrol "github.com/containers/nri-plugins/pkg/resmgr/control/cpu"
 	"github.com/containers/nri-plugins/pkg/resmgr/events"
 	policy "github.com/containers/nri-plugins/pkg/resmgr/policy"
@@ -55,6 +60,13 @@ const (
 	virtDevReservedCpus = "reserved CPUs"
 )
 
+// allocatorPresets are the CPU allocator options of allocatorPreset
+// names in balloon types.
+var allocatorPresets = map[cfgapi.AllocatorPreset]func() cpuTreeAllocatorOptions{
+	cfgapi.PresetLatencyOptimized:    LatencyOptimizedOptions,
+	cfgapi.PresetThroughputOptimized: ThroughputOptimizedOptions,
+}
+
 // balloons contains configuration and runtime attributes of the balloons policy
 type balloons struct {
 	options      *policy.BackendOptions // configuration common to all policies
@@ -65,12 +77,73 @@ type balloons struct {
 	freeCpus     cpuset.CPUSet          // CPUs to be included in growing or new ballons
 	cpuTree      *cpuTreeNode           // system CPU topology
 	cpuTreeAlloc *cpuTreeAllocator      // CPU allocator from system CPU topology
+	deviceHints  *deviceHintCache       // CPUs close to devices, shared by allocators
 
 	reservedBalloonDef *BalloonDef // reserved balloon definition, pointer to bpoptions.BalloonDefs[x]
 	defaultBalloonDef  *BalloonDef // default balloon definition, pointer to bpoptions.BalloonDefs[y]
 	balloons           []*Balloon  // balloon instances: reserved, default and user-defined
 
 	cpuAllocator cpuallocator.CPUAllocator // CPU allocator used by the policy
+	subscribers  allocationSubscribers     // callbacks notified of balloon CPU changes
+	restoredCpus map[string]cpuset.CPUSet  // CPUs held by containers before a restart
+}
+
+// AllocationSubscriber is a callback notified when the CPUs of a
+// balloon change. oldCpus are empty for a new balloon, and newCpus are
+// empty for a deleted balloon. It is called synchronously from the
+// policy after the change has been applied, so it must not block or
+// call back
+// into the policy. Subscribers that need to do more work should hand
+// the event off to a goroutine or a buffered channel.
+type AllocationSubscriber func(balloonName string, oldCpus, newCpus cpuset.CPUSet)
+
+// allocationSubscribers is a set of registered AllocationSubscribers.
+type allocationSubscribers struct {
+	sync.Mutex
+	nextID int
+	subs   map[int]AllocationSubscriber
+}
+
+// subscribe registers fn and returns a function that unregisters it.
+func (as *allocationSubscribers) subscribe(fn AllocationSubscriber) func() {
+	as.Lock()
+	defer as.Unlock()
+	if as.subs == nil {
+		as.subs = map[int]AllocationSubscriber{}
+	}
+	id := as.nextID
+	as.nextID++
+	as.subs[id] = fn
+	return func() {
+		as.Lock()
+		defer as.Unlock()
+		delete(as.subs, id)
+	}
+}
+
+// notify calls all registered subscribers in registration order.
+func (as *allocationSubscribers) notify(balloonName string, oldCpus, newCpus cpuset.CPUSet) {
+	as.Lock()
+	ids := make([]int, 0, len(as.subs))
+	for id := range as.subs {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	fns := make([]AllocationSubscriber, 0, len(ids))
+	for _, id := range ids {
+		fns = append(fns, as.subs[id])
+	}
+	as.Unlock()
+	for _, fn := range fns {
+		fn(balloonName, oldCpus, newCpus)
+	}
+}
+
+// SubscribeAllocations registers fn to be called after a balloon has
+// been created, resized or deleted. Multiple subscribers may be
+// registered. The returned function unsubscribes fn.
+func (p *balloons) SubscribeAllocations(fn AllocationSubscriber) (unsubscribe func()) {
+	return p.subscribers.subscribe(fn)
 }
 
 // Balloon contains attributes of a balloon instance
@@ -161,6 +234,7 @@ func (p *balloons) Setup(policyOptions *policy.BackendOptions) error {
 	p.options = policyOptions
 	p.cch = policyOptions.Cache
 	p.cpuAllocator = cpuallocator.NewCPUAllocator(policyOptions.System)
+	p.deviceHints = newDeviceHintCache()
 
 	log.Info("setting up %s policy...", PolicyName)
 	if p.cpuTree, err = NewCpuTreeFromSystem(); err != nil {
@@ -190,10 +264,90 @@ func (p *balloons) Description() string {
 
 // Start prepares this policy for accepting allocation/release requests.
 func (p *balloons) Start() error {
+	if devs := p.hintedDevices(); len(devs) > 0 && p.cpuTree != nil {
+		log.Debug("prewarming topology hints of devices %v", devs)
+		go p.cpuTree.NewAllocator(cpuTreeAllocatorOptions{deviceHints: p.deviceHints}).PrewarmDeviceHints(devs)
+	}
+	p.holdRestoredCpus(control.EffectiveCpusets(p.cch))
 	log.Info("%s policy started", PolicyName)
 	return nil
 }
 
+// holdRestoredCpus removes CPUs that containers are still running on
+// after a restart from free CPUs. Containers are reassigned to balloons
+// one by one when the policy is synchronized, and until then new and
+// growing balloons must not take the CPUs of containers that are not
+// reassigned yet.
+func (p *balloons) holdRestoredCpus(cpusets map[string]cpuset.CPUSet) {
+	p.restoredCpus = map[string]cpuset.CPUSet{}
+	for id, cpus := range cpusets {
+		cpus = cpus.Intersection(p.freeCpus)
+		if cpus.Size() == 0 {
+			continue
+		}
+		log.Debug("holding CPUs %s of restored container %s", cpus, id)
+		p.restoredCpus[id] = cpus
+	}
+	for _, cpus := range p.restoredCpus {
+		p.freeCpus = p.freeCpus.Difference(cpus)
+	}
+}
+
+// releaseRestoredCpus returns CPUs held for a restored container to
+// free CPUs, unless other restored containers still hold them.
+func (p *balloons) releaseRestoredCpus(id string) {
+	cpus, ok := p.restoredCpus[id]
+	if !ok {
+		return
+	}
+	delete(p.restoredCpus, id)
+	for _, held := range p.restoredCpus {
+		cpus = cpus.Difference(held)
+	}
+	p.freeCpus = p.freeCpus.Union(cpus)
+}
+
+// hintedDevices returns all devices that balloons prefer to be close
+// to or far from.
+func (p *balloons) hintedDevices() []string {
+	return hintedDevices(p.bpoptions.BalloonDefs)
+}
+
+// hintedDevices returns all devices that balloon types prefer to be
+// close to or far from.
+func hintedDevices(blnDefs []*BalloonDef) []string {
+	devs := []string{}
+	addDevs := func(blnDevs []string) {
+		for _, dev := range blnDevs {
+			if dev != virtDevReservedCpus && !slices.Contains(devs, dev) {
+				devs = append(devs, dev)
+			}
+		}
+	}
+	for _, blnDef := range blnDefs {
+		addDevs(blnDef.PreferCloseToDevices)
+		addDevs(blnDef.PreferFarFromDevices)
+	}
+	return devs
+}
+
+// validateDevices checks that the devices balloon types prefer to be
+// close to or far from exist. Missing devices are only warned about if
+// the configuration is lenient, then their topology hints are resolved
+// when they are needed, so devices may appear later.
+func (p *balloons) validateDevices(bpoptions *BalloonsOptions) error {
+	devs := hintedDevices(bpoptions.BalloonDefs)
+	if len(devs) == 0 || p.cpuTree == nil {
+		return nil
+	}
+	err := p.cpuTree.NewAllocator(cpuTreeAllocatorOptions{deviceHints: p.deviceHints}).ValidateDevices(devs)
+	if err != nil && bpoptions.LenientDevices {
+		log.Warnf("ignoring missing devices: %v", err)
+		return nil
+	}
+	return err
+}
+
 // Sync synchronizes the active policy state.
 func (p *balloons) Sync(add []cache.Container, del []cache.Container) error {
 	log.Debug("synchronizing state...")
@@ -210,11 +364,18 @@ func (p *balloons) Sync(add []cache.Container, del []cache.Container) error {
 			log.Warnf("allocating resources for Sync produced an error: %v", err)
 		}
 	}
+
+	// Containers that were not reassigned are gone, stop holding
+	// their CPUs.
+	for id := range p.restoredCpus {
+		p.releaseRestoredCpus(id)
+	}
 	return nil
 }
 
 // AllocateResources is a resource allocation request for this policy.
 func (p *balloons) AllocateResources(c cache.Container) error {
+	p.releaseRestoredCpus(c.GetID())
 	if c.PreserveCpuResources() {
 		log.Infof("not handling resources of container %s, preserving CPUs %q and memory %q", c.PrettyName(), c.GetCpusetCpus(), c.GetCpusetMems())
 		return nil
@@ -240,7 +401,18 @@ func (p *balloons) AllocateResources(c cache.Container) error {
 	// would mean no CPU pinning and balloon's containers would
 	// run on any CPUs.
 	if bln.AvailMilliCpus() < max(1, reqMilliCpus) {
-		p.resizeBalloon(bln, max(1, reqMilliCpus))
+		// Reject the container before it is created if the
+		// balloon cannot grow to fit it, either now or ever.
+		if err := p.checkCpuReservation(bln, max(1, reqMilliCpus)); err != nil {
+			if bln.ContainerCount() == 0 {
+				p.freeBalloon(bln)
+			}
+			return balloonsError("balloon allocation for container %s failed: %w", c.PrettyName(),
+				&cpucontrol.VetoError{Container: c.PrettyName(), Reason: err})
+		}
+		if err := p.resizeBalloon(bln, max(1, reqMilliCpus)); err != nil {
+			log.Errorf("failed to resize %s for container %s: %v", bln, c.PrettyName(), err)
+		}
 	}
 	p.assignContainer(c, bln)
 	if log.DebugEnabled() {
@@ -381,9 +553,18 @@ func (p *balloons) balloonDefByName(defName string) *BalloonDef {
 func (p *balloons) chooseBalloonDef(c cache.Container) (*BalloonDef, error) {
 	// Case 1: BalloonDef is defined by annotation.
 	if blnDefName, ok := c.GetEffectiveAnnotation(balloonKey); ok {
+		if err := validateBalloonAnnotation(blnDefName); err != nil {
+			return nil, balloonsError("container %s rejected: invalid %s annotation: %v",
+				c.PrettyName(), balloonKey, err)
+		}
 		blnDef := p.balloonDefByName(blnDefName)
 		if blnDef == nil {
-			return nil, balloonsError("no balloon for annotation %q", blnDefName)
+			names := make([]string, 0, len(p.bpoptions.BalloonDefs))
+			for _, blnDef := range p.bpoptions.BalloonDefs {
+				names = append(names, blnDef.Name)
+			}
+			return nil, balloonsError("container %s rejected: no balloon for annotation %q, known balloons: %s",
+				c.PrettyName(), blnDefName, strings.Join(names, ", "))
 		}
 		return blnDef, nil
 	}
@@ -550,15 +731,40 @@ func (p *balloons) newBalloon(blnDef *BalloonDef, confCpus bool) (*Balloon, erro
 	// Configure cpuTreeAllocator for this balloon. The reserved
 	// balloon always prefers to be close to the virtual device
 	// that is close to ReservedResources CPUs. All other balloon
-	// types prefer to be far from those CPUs.
+	// types prefer to be far from those CPUs, and they never
+	// get any of them.
 	allocatorOptions := cpuTreeAllocatorOptions{
 		topologyBalancing:           p.bpoptions.AllocatorTopologyBalancing,
 		preferSpreadOnPhysicalCores: p.bpoptions.PreferSpreadOnPhysicalCores,
+		preferPackSiblings:          p.bpoptions.PreferPackSiblings,
 		preferCloseToDevices:        blnDef.PreferCloseToDevices,
 		preferFarFromDevices:        blnDef.PreferFarFromDevices,
 		virtDevCpusets: map[string][]cpuset.CPUSet{
 			virtDevReservedCpus: {p.reserved},
 		},
+		deviceHints:       p.deviceHints,
+		cpuAllocator:      p.cpuAllocator,
+		allocatorPriority: blnDef.AllocatorPriority.Value(),
+		onDeviceHints: func(results []deviceHintResult) {
+			for _, result := range results {
+				if result.Status() != deviceHintApplied {
+					log.Infof("balloon type %s: %s", blnDef.Name, result)
+				}
+			}
+		},
+	}
+	if blnDef != p.reservedBalloonDef {
+		allocatorOptions.reservedCpus = p.reserved
+	}
+	if preset, ok := allocatorPresets[blnDef.AllocatorPreset]; ok {
+		presetOptions := preset()
+		allocatorOptions.topologyBalancing = presetOptions.topologyBalancing
+		allocatorOptions.preferSpreadOnPhysicalCores = presetOptions.preferSpreadOnPhysicalCores
+		allocatorOptions.preferPackSiblings = presetOptions.preferPackSiblings
+		allocatorOptions.preferHighFreq = presetOptions.preferHighFreq
+		allocatorOptions.preferEmptiestPackage = presetOptions.preferEmptiestPackage
+		allocatorOptions.singleNumaOnly = presetOptions.singleNumaOnly
+		allocatorOptions.requireWholeCores = presetOptions.requireWholeCores
 	}
 	if blnDef.AllocatorTopologyBalancing != nil {
 		allocatorOptions.topologyBalancing = *blnDef.AllocatorTopologyBalancing
@@ -566,18 +772,44 @@ func (p *balloons) newBalloon(blnDef *BalloonDef, confCpus bool) (*Balloon, erro
 	if blnDef.PreferSpreadOnPhysicalCores != nil {
 		allocatorOptions.preferSpreadOnPhysicalCores = *blnDef.PreferSpreadOnPhysicalCores
 	}
+	if blnDef.PreferPackSiblings != nil {
+		allocatorOptions.preferPackSiblings = *blnDef.PreferPackSiblings
+	}
+	if blnDef.PreferHighFreq != nil {
+		allocatorOptions.preferHighFreq = *blnDef.PreferHighFreq
+	}
+	if blnDef.PreferEmptiestPackage != nil {
+		allocatorOptions.preferEmptiestPackage = *blnDef.PreferEmptiestPackage
+	}
+	allocatorOptions.requireCacheIds = blnDef.RequireCacheIds
+	allocatorOptions.singlePackageOnly = blnDef.SinglePackageOnly
+	if blnDef.SingleNumaOnly != nil {
+		allocatorOptions.singleNumaOnly = *blnDef.SingleNumaOnly
+	}
+	if blnDef.RequireWholeCores != nil {
+		allocatorOptions.requireWholeCores = *blnDef.RequireWholeCores
+	}
+	allocatorOptions.requireNohzFull = blnDef.RequireNohzFull
+	allocatorOptions.preferIdleSibling = blnDef.PreferIdleSibling
+	allocatorOptions.preferContiguousIds = blnDef.PreferContiguousIds
+	if blnDef != p.reservedBalloonDef && blnDef != p.defaultBalloonDef {
+		// CPUs of other balloons are dedicated to their
+		// containers. Leave out the boot CPU unless it is
+		// explicitly allowed.
+		allowBootCpu := p.bpoptions.AllowBootCpu
+		if blnDef.AllowBootCpu != nil {
+			allowBootCpu = *blnDef.AllowBootCpu
+		}
+		allocatorOptions.avoidBootCpu = !allowBootCpu
+	}
 	cpuTreeAlloc := p.cpuTree.NewAllocator(allocatorOptions)
 
 	// Allocate CPUs
-	addFromCpus, _, err := cpuTreeAlloc.ResizeCpus(cpuset.New(), p.freeCpus, blnDef.MinCpus)
-	if err != nil {
-		return nil, balloonsError("failed to choose a cpuset for allocating MinCpus: %d from free cpus %q", blnDef.MinCpus, p.freeCpus)
-	}
-	cpus, err = p.cpuAllocator.AllocateCpus(&addFromCpus, blnDef.MinCpus, blnDef.AllocatorPriority.Value())
+	cpus, freeCpus, err := cpuTreeAlloc.Allocate(cpuset.New(), p.freeCpus, blnDef.MinCpus)
 	if err != nil {
-		return nil, balloonsError("could not allocate minCpus (%d) for balloon %s[%d]: %w", blnDef.MinCpus, blnDef.Name, freeInstance, err)
+		return nil, balloonsError("could not allocate minCpus (%d) for balloon %s[%d] from free cpus %q: %w", blnDef.MinCpus, blnDef.Name, freeInstance, p.freeCpus, err)
 	}
-	p.freeCpus = p.freeCpus.Difference(cpus)
+	p.freeCpus = freeCpus
 	bln := &Balloon{
 		Def:            blnDef,
 		Instance:       freeInstance,
@@ -594,6 +826,7 @@ func (p *balloons) newBalloon(blnDef *BalloonDef, confCpus bool) (*Balloon, erro
 			return nil, err
 		}
 	}
+	p.subscribers.notify(bln.PrettyName(), cpuset.New(), bln.Cpus)
 	return bln, nil
 }
 
@@ -609,7 +842,9 @@ func (p *balloons) deleteBalloon(bln *Balloon) {
 	p.balloons = remainingBalloons
 	p.forgetCpuClass(bln)
 	p.freeCpus = p.freeCpus.Union(bln.Cpus)
+	origCpus := bln.Cpus
 	p.cpuAllocator.ReleaseCpus(&bln.Cpus, bln.Cpus.Size(), bln.Def.AllocatorPriority.Value())
+	p.subscribers.notify(bln.PrettyName(), origCpus, cpuset.New())
 }
 
 // freeBalloon clears a balloon and deletes it if allowed.
@@ -651,6 +886,7 @@ func (p *balloons) chooseBalloonInstance(blnDef *BalloonDef, fm FillMethod, c ca
 		}
 		undoFuncs = append(undoFuncs, func() {
 			p.freeCpus = p.freeCpus.Union(newBln.Cpus)
+			p.subscribers.notify(newBln.PrettyName(), newBln.Cpus, cpuset.New())
 		})
 		if newBln.MaxAvailMilliCpus(p.freeCpus) < reqMilliCpus {
 			// New balloon cannot be inflated to fit new
@@ -751,6 +987,20 @@ func (p *balloons) chooseBalloonInstance(blnDef *BalloonDef, fm FillMethod, c ca
 	return nil, nil
 }
 
+// validateBalloonAnnotation checks that a balloon annotation value
+// is a single balloon name.
+func validateBalloonAnnotation(value string) error {
+	if value == "" {
+		return fmt.Errorf("empty balloon name")
+	}
+	if i := strings.IndexFunc(value, func(r rune) bool {
+		return unicode.IsSpace(r) || r == ','
+	}); i >= 0 {
+		return fmt.Errorf("%q is not a single balloon name", value)
+	}
+	return nil
+}
+
 func namespaceMatches(namespace string, patterns []string) bool {
 	for _, pattern := range patterns {
 		ret, err := filepath.Match(pattern, namespace)
@@ -984,6 +1234,40 @@ func (p *balloons) validateConfig(bpoptions *BalloonsOptions) error {
 			return balloonsError("MinBalloons (%d) > MaxBalloons (%d) in balloon type %q",
 				blnDef.MinCpus, blnDef.MaxCpus, blnDef.Name)
 		}
+		spread := bpoptions.PreferSpreadOnPhysicalCores
+		pack := bpoptions.PreferPackSiblings
+		wholeCores := false
+		if blnDef.AllocatorPreset != cfgapi.PresetNone {
+			preset, ok := allocatorPresets[blnDef.AllocatorPreset]
+			if !ok {
+				return balloonsError("unknown allocatorPreset %q in balloon type %q",
+					blnDef.AllocatorPreset, blnDef.Name)
+			}
+			presetOptions := preset()
+			spread = presetOptions.preferSpreadOnPhysicalCores
+			pack = presetOptions.preferPackSiblings
+			wholeCores = presetOptions.requireWholeCores
+		}
+		if blnDef.PreferSpreadOnPhysicalCores != nil {
+			spread = *blnDef.PreferSpreadOnPhysicalCores
+		}
+		if blnDef.PreferPackSiblings != nil {
+			pack = *blnDef.PreferPackSiblings
+		}
+		if blnDef.RequireWholeCores != nil {
+			wholeCores = *blnDef.RequireWholeCores
+		}
+		if spread && pack {
+			return balloonsError("preferSpreadOnPhysicalCores and preferPackSiblings cannot be both set in balloon type %q",
+				blnDef.Name)
+		}
+		if wholeCores && p.cpuTree != nil {
+			threads := p.cpuTree.NewAllocator(cpuTreeAllocatorOptions{}).threadsPerCore()
+			if blnDef.MinCpus%threads != 0 || blnDef.MaxCpus%threads != 0 {
+				return balloonsError("MinCpus (%d) and MaxCpus (%d) must be multiples of %d threads per core with requireWholeCores in balloon type %q",
+					blnDef.MinCpus, blnDef.MaxCpus, threads, blnDef.Name)
+			}
+		}
 		if blnDef.Name == reservedBalloonDefName {
 			if blnDef.MinBalloons < 0 || blnDef.MinBalloons > 1 {
 				return balloonsError("invalid configuration: exactly one %q balloon expected but MinBalloons=%d",
@@ -1030,6 +1314,9 @@ func (p *balloons) setConfig(bpoptions *BalloonsOptions) error {
 	if err = p.validateConfig(bpoptions); err != nil {
 		return balloonsError("invalid configuration: %w", err)
 	}
+	if err = p.validateDevices(bpoptions); err != nil {
+		return balloonsError("invalid configuration: %w", err)
+	}
 	p.fillFarFromDevices(bpoptions.BalloonDefs)
 
 	// Preparation and configuration validation is now done
@@ -1039,6 +1326,7 @@ func (p *balloons) setConfig(bpoptions *BalloonsOptions) error {
 	p.defaultBalloonDef = defaultBalloonDef
 	p.balloons = []*Balloon{}
 	p.freeCpus = p.allowed.Clone()
+	p.restoredCpus = nil
 	p.bpoptions = bpoptions
 
 	// Create balloon instances in the order of AllocatorPriority.
@@ -1121,6 +1409,29 @@ func (p *balloons) fillBuiltinBalloonDefs(bpoptions *BalloonsOptions) (*BalloonD
 	// ReservedResources.cpus and explicit "reserved" balloon type
 	// definitions.
 	amount, kind := bpoptions.ReservedResources.Get(cfgapi.CPU)
+	if shape := bpoptions.ReservedShape; shape != nil {
+		// Reserved CPUs of the shape are handled like an
+		// explicitly specified reserved cpuset.
+		cset, err := reservedCpusByShape(p.cpuTree, shape, p.allowed)
+		if err != nil {
+			return nil, nil, balloonsError("invalid reservedShape: %v", err)
+		}
+		switch kind {
+		case cfgapi.AmountCPUSet:
+			return nil, nil, balloonsError("reservedShape cannot be used with ReservedResources cpuset %s", amount)
+		case cfgapi.AmountQuantity:
+			qty, err := amount.ParseQuantity()
+			if err != nil {
+				return nil, nil, balloonsError("failed to parse reserved CPU quantity '%s': %v", amount, err)
+			}
+			if reserveCnt := (int(qty.MilliValue()) + 999) / 1000; reserveCnt != cset.Size() {
+				return nil, nil, balloonsError("mismatching reservedShape CPUs: %d and ReservedResources cpus: %d mCPU",
+					cset.Size(), qty.MilliValue())
+			}
+		}
+		log.Info("reserved CPUs of shape %+v: %s", *shape, cset)
+		amount, kind = cfgapi.Amount(cset.String()), cfgapi.AmountCPUSet
+	}
 	switch kind {
 	case cfgapi.AmountCPUSet:
 		// Explicitly specified reserved cpuset. Raise
@@ -1189,6 +1500,59 @@ func (p *balloons) fillBuiltinBalloonDefs(bpoptions *BalloonsOptions) (*BalloonD
 	return reservedBalloonDef, defaultBalloonDef, nil
 }
 
+// reservedCpusByShape returns allowed CPUs of a reserved CPU shape:
+// the same number of whole cores or CPUs from every element on the
+// topology level of the shape. Whole cores are taken in topology
+// order, CPUs are chosen by the CPU tree allocator.
+func reservedCpusByShape(tree *cpuTreeNode, shape *ReservedShape, allowed cpuset.CPUSet) (cpuset.CPUSet, error) {
+	if tree == nil {
+		return cpuset.New(), fmt.Errorf("CPU topology not available")
+	}
+	switch {
+	case shape.Cores > 0 && shape.Cpus > 0:
+		return cpuset.New(), fmt.Errorf("only one of cores (%d) and cpus (%d) can be set", shape.Cores, shape.Cpus)
+	case shape.Cores <= 0 && shape.Cpus <= 0:
+		return cpuset.New(), fmt.Errorf("either cores or cpus must be set")
+	}
+	elements := tree.FindAll(func(tn *cpuTreeNode) bool {
+		return tn.level == shape.TopologyLevel
+	})
+	if len(elements) == 0 {
+		return cpuset.New(), fmt.Errorf("no %q topology level in the CPU tree", shape.TopologyLevel)
+	}
+	reserved := cpuset.New()
+	for _, elt := range elements {
+		freeCpus := elt.cpus.Intersection(allowed)
+		if shape.Cpus > 0 {
+			cpus, _, err := elt.NewAllocator(cpuTreeAllocatorOptions{}).Allocate(cpuset.New(), freeCpus, shape.Cpus)
+			if err != nil {
+				return cpuset.New(), fmt.Errorf("cannot reserve %d CPUs from %s %s: %w",
+					shape.Cpus, elt.level, elt.name, err)
+			}
+			reserved = reserved.Union(cpus)
+			continue
+		}
+		cores := 0
+		for _, tna := range elt.ToAttributedSlice(cpuset.New(), freeCpus,
+			func(tna *cpuTreeNodeAttributes) bool {
+				return tna.t.level != CPUTopologyLevelThread
+			}) {
+			if cores == shape.Cores {
+				break
+			}
+			if tna.t.level == CPUTopologyLevelCore && tna.freeCpuCount == tna.t.cpus.Size() {
+				reserved = reserved.Union(tna.t.cpus)
+				cores++
+			}
+		}
+		if cores < shape.Cores {
+			return cpuset.New(), fmt.Errorf("cannot reserve %d whole cores from %s %s, only %d available",
+				shape.Cores, elt.level, elt.name, cores)
+		}
+	}
+	return reserved, nil
+}
+
 // fillFarFromDevices adds BalloonDefs implicit device anti-affinities
 // towards devices that other BalloonDefs prefer to be close to.
 func (p *balloons) fillFarFromDevices(blnDefs []*BalloonDef) {
@@ -1255,9 +1619,10 @@ func (p *balloons) availableMilliCpus(balloon *Balloon) int64 {
 	return cpuAvail - cpuRequested
 }
 
-// resizeBalloon changes the CPUs allocated for a balloon, if allowed.
-func (p *balloons) resizeBalloon(bln *Balloon, newMilliCpus int) error {
-	oldCpuCount := bln.Cpus.Size()
+// balloonCpuCount returns the number of CPUs a balloon needs to fit
+// newMilliCpus, limited by the balloon's MinCpus and MaxCpus, and
+// rounded up to whole cores if the balloon requires them.
+func balloonCpuCount(bln *Balloon, newMilliCpus int) int {
 	newCpuCount := (newMilliCpus + 999) / 1000
 	if bln.Def.MaxCpus > NoLimit && newCpuCount > bln.Def.MaxCpus {
 		newCpuCount = bln.Def.MaxCpus
@@ -1265,6 +1630,37 @@ func (p *balloons) resizeBalloon(bln *Balloon, newMilliCpus int) error {
 	if bln.Def.MinCpus > 0 && newCpuCount < bln.Def.MinCpus {
 		newCpuCount = bln.Def.MinCpus
 	}
+	if bln.cpuTreeAlloc != nil && bln.cpuTreeAlloc.options.requireWholeCores {
+		// MinCpus and MaxCpus are whole cores, too, so
+		// rounding up does not exceed MaxCpus.
+		threads := bln.cpuTreeAlloc.threadsPerCore()
+		newCpuCount = (newCpuCount + threads - 1) / threads * threads
+	}
+	return newCpuCount
+}
+
+// checkCpuReservation does a dry-run resize of a balloon to verify
+// that it can grow to fit newMilliCpus, respecting the same reserved
+// and other constraints as the real resize. It does not change the
+// balloon or free CPUs.
+func (p *balloons) checkCpuReservation(bln *Balloon, newMilliCpus int) error {
+	if bln.Def == p.reservedBalloonDef {
+		return nil
+	}
+	cpuCountDelta := balloonCpuCount(bln, newMilliCpus) - bln.Cpus.Size()
+	if cpuCountDelta <= 0 {
+		return nil
+	}
+	if _, _, err := bln.cpuTreeAlloc.ResizeCpus(bln.Cpus, p.freeCpus, cpuCountDelta); err != nil {
+		return balloonsError("cannot reserve %d more CPUs for %s: %w", cpuCountDelta, bln, err)
+	}
+	return nil
+}
+
+// resizeBalloon changes the CPUs allocated for a balloon, if allowed.
+func (p *balloons) resizeBalloon(bln *Balloon, newMilliCpus int) error {
+	oldCpuCount := bln.Cpus.Size()
+	newCpuCount := balloonCpuCount(bln, newMilliCpus)
 	log.Debugf("resize %s to fit %d mCPU", bln, newMilliCpus)
 	log.Debugf("- change size from %d to %d full cpus", oldCpuCount, newCpuCount)
 	log.Debugf("- free cpus: %q", p.freeCpus)
@@ -1272,45 +1668,39 @@ func (p *balloons) resizeBalloon(bln *Balloon, newMilliCpus int) error {
 		return nil
 	}
 	cpuCountDelta := newCpuCount - oldCpuCount
+	origCpus := bln.Cpus
 	p.forgetCpuClass(bln)
 	defer p.useCpuClass(bln)
 	if cpuCountDelta > 0 {
 		// Inflate the balloon.
-		addFromCpus, _, err := bln.cpuTreeAlloc.ResizeCpus(bln.Cpus, p.freeCpus, cpuCountDelta)
-		if err != nil {
-			return balloonsError("resize/inflate: failed to choose a cpuset for allocating additional %d CPUs: %w", cpuCountDelta, err)
-		}
-		log.Debugf("- allocating %d CPUs from %q", cpuCountDelta, addFromCpus)
-		newCpus, err := p.cpuAllocator.AllocateCpus(&addFromCpus, newCpuCount-oldCpuCount, bln.Def.AllocatorPriority.Value())
+		newBlnCpus, newFreeCpus, err := bln.cpuTreeAlloc.Allocate(bln.Cpus, p.freeCpus, cpuCountDelta)
 		if err != nil {
 			return balloonsError("resize/inflate: allocating %d CPUs for %s failed: %w", cpuCountDelta, bln, err)
 		}
 		oldBlnCpus := bln.Cpus
 		oldFreeCpus := p.freeCpus
-		p.freeCpus = p.freeCpus.Difference(newCpus)
-		bln.Cpus = bln.Cpus.Union(newCpus)
+		newCpus := newBlnCpus.Difference(oldBlnCpus)
+		p.freeCpus = newFreeCpus
+		bln.Cpus = newBlnCpus
 		log.Debugf("- allocated, changed cpus: balloon from %q to %q, free from %q to %q", oldBlnCpus, bln.Cpus, oldFreeCpus, p.freeCpus)
 		p.updatePinning(p.shareIdleCpus(p.freeCpus, newCpus)...)
 	} else {
 		// Deflate the balloon.
-		_, removeFromCpus, err := bln.cpuTreeAlloc.ResizeCpus(bln.Cpus, p.freeCpus, cpuCountDelta)
-		if err != nil {
-			return balloonsError("resize/deflate: failed to choose a cpuset for releasing %d CPUs: %w", -cpuCountDelta, err)
-		}
-		log.Debugf("- releasing %d CPUs from cpuset %q", -cpuCountDelta, removeFromCpus)
-		_, err = p.cpuAllocator.ReleaseCpus(&removeFromCpus, -cpuCountDelta, bln.Def.AllocatorPriority.Value())
+		newBlnCpus, newFreeCpus, err := bln.cpuTreeAlloc.Allocate(bln.Cpus, p.freeCpus, cpuCountDelta)
 		if err != nil {
 			return balloonsError("resize/deflate: releasing %d CPUs from %s failed: %w", -cpuCountDelta, bln, err)
 		}
 		oldBlnCpus := bln.Cpus
 		oldFreeCpus := p.freeCpus
-		p.freeCpus = p.freeCpus.Union(removeFromCpus)
-		bln.Cpus = bln.Cpus.Difference(removeFromCpus)
+		removeFromCpus := oldBlnCpus.Difference(newBlnCpus)
+		p.freeCpus = newFreeCpus
+		bln.Cpus = newBlnCpus
 		log.Debugf("- released, changed cpus: balloon from %q to %q, free from %q to %q", oldBlnCpus, bln.Cpus, oldFreeCpus, p.freeCpus)
 		p.updatePinning(p.shareIdleCpus(removeFromCpus, cpuset.New())...)
 	}
 	log.Debugf("- resize successful: %s, freecpus: %#s", bln, p.freeCpus)
 	p.updatePinning(bln)
+	p.subscribers.notify(bln.PrettyName(), origCpus, bln.Cpus)
 	return nil
 }
 
@@ -15,7 +15,13 @@
 package balloons
 
 import (
+	"reflect"
 	"testing"
+
+	"github.com/containers/nri-plugins/pkg/cpuallocator"
+	"github.com/containers/nri-plugins/pkg/resmgr/cache"
+	policy "github.com/containers/nri-plugins/pkg/resmgr/policy"
+	"github.com/containers/nri-plugins/pkg/utils/cpuset"
 )
 
 func TestChangesBalloons(t *testing.T) {
@@ -94,3 +100,512 @@ func TestChangesBalloons(t *testing.T) {
 		})
 	}
 }
+
+func TestReservedCpusByShape(t *testing.T) {
+	// NUMA nodes: p0d0n0 0-7, p0d0n1 8-15, p1d0n0 16-23, p1d0n1 24-31
+	tree, _ := newCpuTreeFromInt5([5]int{2, 1, 2, 4, 2})
+	allowed := tree.Cpus().Difference(cpuset.New(0, 9))
+	tcases := []struct {
+		name        string
+		shape       ReservedShape
+		expectCpus  cpuset.CPUSet
+		expectError bool
+	}{
+		{
+			name:       "one whole core per NUMA node",
+			shape:      ReservedShape{TopologyLevel: CPUTopologyLevelNuma, Cores: 1},
+			expectCpus: cpuset.New(2, 3, 10, 11, 16, 17, 24, 25),
+		},
+		{
+			name:       "two whole cores per package",
+			shape:      ReservedShape{TopologyLevel: CPUTopologyLevelPackage, Cores: 2},
+			expectCpus: cpuset.New(2, 3, 4, 5, 16, 17, 18, 19),
+		},
+		{
+			name:  "one CPU per NUMA node",
+			shape: ReservedShape{TopologyLevel: CPUTopologyLevelNuma, Cpus: 1},
+		},
+		{
+			name:        "too many cores",
+			shape:       ReservedShape{TopologyLevel: CPUTopologyLevelNuma, Cores: 4},
+			expectError: true,
+		},
+		{
+			name:        "both cores and cpus",
+			shape:       ReservedShape{TopologyLevel: CPUTopologyLevelNuma, Cores: 1, Cpus: 1},
+			expectError: true,
+		},
+		{
+			name:        "no CPUs",
+			shape:       ReservedShape{TopologyLevel: CPUTopologyLevelNuma},
+			expectError: true,
+		},
+	}
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			cpus, err := reservedCpusByShape(tree, &tc.shape, allowed)
+			if tc.expectError {
+				if err == nil {
+					t.Fatalf("expected error, got cpus %s", cpus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("reservedCpusByShape failed: %v", err)
+			}
+			if !allowed.Union(cpus).Equals(allowed) {
+				t.Errorf("reserved cpus %s not allowed", cpus)
+			}
+			if !tc.expectCpus.IsEmpty() && !cpus.Equals(tc.expectCpus) {
+				t.Errorf("expected cpus %s, got %s", tc.expectCpus, cpus)
+			}
+			elements := tree.FindAll(func(tn *cpuTreeNode) bool { return tn.level == tc.shape.TopologyLevel })
+			perElement := cpus.Size() / len(elements)
+			for _, elt := range elements {
+				if n := elt.cpus.Intersection(cpus).Size(); n != perElement {
+					t.Errorf("expected %d reserved cpus in %s, got %d", perElement, elt.name, n)
+				}
+			}
+		})
+	}
+}
+
+func TestAllocationSubscribers(t *testing.T) {
+	p := &balloons{}
+	type event struct {
+		name    string
+		oldCpus cpuset.CPUSet
+		newCpus cpuset.CPUSet
+	}
+	var first, second []event
+	unsubFirst := p.SubscribeAllocations(func(name string, oldCpus, newCpus cpuset.CPUSet) {
+		first = append(first, event{name, oldCpus, newCpus})
+	})
+	p.SubscribeAllocations(func(name string, oldCpus, newCpus cpuset.CPUSet) {
+		second = append(second, event{name, oldCpus, newCpus})
+	})
+
+	p.subscribers.notify("default[0]", cpuset.New(1), cpuset.New(1, 2))
+	if len(first) != 1 || len(second) != 1 {
+		t.Fatalf("expected both subscribers notified once, got %d and %d", len(first), len(second))
+	}
+	if ev := first[0]; ev.name != "default[0]" || !ev.oldCpus.Equals(cpuset.New(1)) || !ev.newCpus.Equals(cpuset.New(1, 2)) {
+		t.Errorf("unexpected event %+v", ev)
+	}
+
+	unsubFirst()
+	unsubFirst()
+	p.subscribers.notify("default[0]", cpuset.New(1, 2), cpuset.New(2))
+	if len(first) != 1 {
+		t.Errorf("unsubscribed callback notified, got %d events", len(first))
+	}
+	if len(second) != 2 {
+		t.Errorf("expected 2 events for remaining subscriber, got %d", len(second))
+	}
+}
+
+func TestAllocationSubscribersNewAndDelete(t *testing.T) {
+	sys := newFakeSystemFromInt5([5]int{1, 1, 1, 2, 2})
+	tree, err := newCpuTreeFromSys(sys, nil)
+	if err != nil {
+		t.Fatalf("newCpuTreeFromSys failed: %v", err)
+	}
+	cch, err := cache.NewCache(cache.Options{CacheDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewCache failed: %v", err)
+	}
+	defaultDef := &BalloonDef{Name: "default"}
+	p := &balloons{
+		options:            &policy.BackendOptions{System: sys},
+		bpoptions:          &BalloonsOptions{},
+		cch:                cch,
+		cpuTree:            tree,
+		cpuAllocator:       cpuallocator.NewCPUAllocator(sys),
+		freeCpus:           tree.Cpus(),
+		reservedBalloonDef: &BalloonDef{Name: reservedBalloonDefName},
+		defaultBalloonDef:  defaultDef,
+	}
+	type event struct {
+		name    string
+		oldCpus cpuset.CPUSet
+		newCpus cpuset.CPUSet
+	}
+	var events []event
+	p.SubscribeAllocations(func(name string, oldCpus, newCpus cpuset.CPUSet) {
+		events = append(events, event{name, oldCpus, newCpus})
+	})
+
+	bln, err := p.newBalloon(&BalloonDef{Name: "big", MinCpus: 2}, false)
+	if err != nil {
+		t.Fatalf("newBalloon failed: %v", err)
+	}
+	p.balloons = append(p.balloons, bln)
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event for a new balloon, got %v", events)
+	}
+	if ev := events[0]; ev.name != "big[0]" || !ev.oldCpus.IsEmpty() || ev.newCpus.Size() != 2 || !ev.newCpus.Equals(bln.Cpus) {
+		t.Errorf("unexpected event for a new balloon %+v", ev)
+	}
+
+	cpus := bln.Cpus
+	p.freeBalloon(bln)
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events after deleting the balloon, got %v", events)
+	}
+	if ev := events[1]; ev.name != "big[0]" || !ev.oldCpus.Equals(cpus) || !ev.newCpus.IsEmpty() {
+		t.Errorf("unexpected event for a deleted balloon %+v", ev)
+	}
+	if len(p.balloons) != 0 || !p.freeCpus.Equals(tree.Cpus()) {
+		t.Errorf("expected balloon deleted and its CPUs free, got balloons %v, free CPUs %s", p.balloons, p.freeCpus)
+	}
+}
+
+func TestValidateBalloonAnnotation(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		valid bool
+	}{
+		{"big-pool", true},
+		{"reserved", true},
+		{"", false},
+		{" big-pool", false},
+		{"big pool", false},
+		{"big-pool,small-pool", false},
+		{"big-pool\n", false},
+	} {
+		err := validateBalloonAnnotation(tc.value)
+		if (err == nil) != tc.valid {
+			t.Errorf("%q: expected valid %v, got error %v", tc.value, tc.valid, err)
+		}
+	}
+}
+
+func TestCheckCpuReservation(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 2, 2, 2})
+	p := &balloons{
+		reservedBalloonDef: &BalloonDef{Name: reservedBalloonDefName},
+		freeCpus:           cpuset.New(2, 3, 4, 5),
+	}
+	bln := &Balloon{
+		Def:          &BalloonDef{Name: "big", MaxCpus: NoLimit},
+		Cpus:         cpuset.New(0, 1),
+		cpuTreeAlloc: tree.NewAllocator(cpuTreeAllocatorOptions{}),
+	}
+	for _, tc := range []struct {
+		milliCpus int
+		ok        bool
+	}{
+		{2000, true},
+		{6000, true},
+		{7000, false},
+		{9000, false},
+	} {
+		err := p.checkCpuReservation(bln, tc.milliCpus)
+		if (err == nil) != tc.ok {
+			t.Errorf("%d mCPU: expected ok %v, got error %v", tc.milliCpus, tc.ok, err)
+		}
+	}
+	if !bln.Cpus.Equals(cpuset.New(0, 1)) || !p.freeCpus.Equals(cpuset.New(2, 3, 4, 5)) {
+		t.Errorf("dry-run changed CPUs: balloon %s, free %s", bln.Cpus, p.freeCpus)
+	}
+
+	bln.Def.MaxCpus = 4
+	if err := p.checkCpuReservation(bln, 9000); err != nil {
+		t.Errorf("expected request capped at maxCpus to fit, got error %v", err)
+	}
+	bln.Def = p.reservedBalloonDef
+	if err := p.checkCpuReservation(bln, 9000); err != nil {
+		t.Errorf("expected no check for the reserved balloon, got error %v", err)
+	}
+}
+
+func TestNewBalloonBootCpu(t *testing.T) {
+	sys := newFakeSystemFromInt5([5]int{1, 1, 1, 2, 2})
+	sys.bootCpu = 1
+	tree, err := newCpuTreeFromSys(sys, nil)
+	if err != nil {
+		t.Fatalf("newCpuTreeFromSys failed: %v", err)
+	}
+	allowed := true
+	for _, tc := range []struct {
+		name         string
+		def          string
+		allowBootCpu *bool
+		expectedBoot bool
+	}{
+		{"default balloon", "default", nil, true},
+		{"dedicated balloon", "dedicated", nil, false},
+		{"dedicated balloon, boot CPU allowed", "dedicated", &allowed, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			defaultDef := &BalloonDef{Name: "default", MinCpus: 3}
+			dedicatedDef := &BalloonDef{Name: "dedicated", MinCpus: 3, AllowBootCpu: tc.allowBootCpu}
+			p := &balloons{
+				options:            &policy.BackendOptions{System: sys},
+				bpoptions:          &BalloonsOptions{},
+				cpuTree:            tree,
+				cpuAllocator:       cpuallocator.NewCPUAllocator(sys),
+				freeCpus:           tree.Cpus(),
+				reservedBalloonDef: &BalloonDef{Name: reservedBalloonDefName},
+				defaultBalloonDef:  defaultDef,
+			}
+			blnDef := dedicatedDef
+			if tc.def == "default" {
+				blnDef = defaultDef
+			}
+			bln, err := p.newBalloon(blnDef, false)
+			if err != nil {
+				t.Fatalf("newBalloon failed: %v", err)
+			}
+			if bln.Cpus.Contains(1) != tc.expectedBoot {
+				t.Errorf("boot CPU 1 allocated: %v, expected %v, got cpus %s",
+					bln.Cpus.Contains(1), tc.expectedBoot, bln.Cpus)
+			}
+		})
+	}
+}
+
+func TestNewBalloonAllocatorOptions(t *testing.T) {
+	sys := newFakeSystemFromInt5([5]int{1, 1, 2, 2, 2})
+	tree, err := newCpuTreeFromSys(sys, nil)
+	if err != nil {
+		t.Fatalf("newCpuTreeFromSys failed: %v", err)
+	}
+	yes, no := true, false
+	for _, tc := range []struct {
+		name     string
+		def      BalloonDef
+		option   func(options cpuTreeAllocatorOptions) any
+		expected any
+	}{
+		{
+			name:     "preferHighFreq",
+			def:      BalloonDef{PreferHighFreq: &yes},
+			option:   func(o cpuTreeAllocatorOptions) any { return o.preferHighFreq },
+			expected: true,
+		},
+		{
+			name:     "preferEmptiestPackage",
+			def:      BalloonDef{PreferEmptiestPackage: &yes},
+			option:   func(o cpuTreeAllocatorOptions) any { return o.preferEmptiestPackage },
+			expected: true,
+		},
+		{
+			name:     "requireCacheIDs",
+			def:      BalloonDef{RequireCacheIds: []int{0}},
+			option:   func(o cpuTreeAllocatorOptions) any { return o.requireCacheIds },
+			expected: []int{0},
+		},
+		{
+			name:     "singlePackageOnly",
+			def:      BalloonDef{SinglePackageOnly: true},
+			option:   func(o cpuTreeAllocatorOptions) any { return o.singlePackageOnly },
+			expected: true,
+		},
+		{
+			name:     "singleNumaOnly",
+			def:      BalloonDef{SingleNumaOnly: &yes},
+			option:   func(o cpuTreeAllocatorOptions) any { return o.singleNumaOnly },
+			expected: true,
+		},
+		{
+			name:     "requireWholeCores",
+			def:      BalloonDef{RequireWholeCores: &yes},
+			option:   func(o cpuTreeAllocatorOptions) any { return o.requireWholeCores },
+			expected: true,
+		},
+		{
+			name:     "requireNohzFull",
+			def:      BalloonDef{RequireNohzFull: true},
+			option:   func(o cpuTreeAllocatorOptions) any { return o.requireNohzFull },
+			expected: true,
+		},
+		{
+			name:     "preferIdleSibling",
+			def:      BalloonDef{PreferIdleSibling: true},
+			option:   func(o cpuTreeAllocatorOptions) any { return o.preferIdleSibling },
+			expected: true,
+		},
+		{
+			name:     "preferContiguousIDs",
+			def:      BalloonDef{PreferContiguousIds: true},
+			option:   func(o cpuTreeAllocatorOptions) any { return o.preferContiguousIds },
+			expected: true,
+		},
+		{
+			name: "latency-optimized preset",
+			def:  BalloonDef{AllocatorPreset: "latency-optimized"},
+			option: func(o cpuTreeAllocatorOptions) any {
+				return []bool{o.topologyBalancing, o.requireWholeCores, o.singleNumaOnly, o.preferHighFreq}
+			},
+			expected: []bool{false, true, true, true},
+		},
+		{
+			name: "latency-optimized preset without whole cores",
+			def:  BalloonDef{AllocatorPreset: "latency-optimized", RequireWholeCores: &no},
+			option: func(o cpuTreeAllocatorOptions) any {
+				return []bool{o.topologyBalancing, o.requireWholeCores, o.singleNumaOnly, o.preferHighFreq}
+			},
+			expected: []bool{false, false, true, true},
+		},
+		{
+			name: "throughput-optimized preset without balancing",
+			def:  BalloonDef{AllocatorPreset: "throughput-optimized", AllocatorTopologyBalancing: &no},
+			option: func(o cpuTreeAllocatorOptions) any {
+				return []bool{o.topologyBalancing, o.preferSpreadOnPhysicalCores, o.preferEmptiestPackage}
+			},
+			expected: []bool{false, true, true},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &balloons{
+				options:            &policy.BackendOptions{System: sys},
+				bpoptions:          &BalloonsOptions{AllocatorTopologyBalancing: true},
+				cpuTree:            tree,
+				cpuAllocator:       cpuallocator.NewCPUAllocator(sys),
+				freeCpus:           tree.Cpus(),
+				reservedBalloonDef: &BalloonDef{Name: reservedBalloonDefName},
+				defaultBalloonDef:  &BalloonDef{Name: defaultBalloonDefName},
+			}
+			tc.def.Name = "test"
+			bln, err := p.newBalloon(&tc.def, false)
+			if err != nil {
+				t.Fatalf("newBalloon failed: %v", err)
+			}
+			if got := tc.option(bln.cpuTreeAlloc.options); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected allocator option %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestWholeCoreBalloons(t *testing.T) {
+	sys := newFakeSystemFromInt5([5]int{1, 1, 2, 4, 2})
+	tree, err := newCpuTreeFromSys(sys, nil)
+	if err != nil {
+		t.Fatalf("newCpuTreeFromSys failed: %v", err)
+	}
+	cch, err := cache.NewCache(cache.Options{CacheDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewCache failed: %v", err)
+	}
+	p := &balloons{
+		options:            &policy.BackendOptions{System: sys},
+		bpoptions:          &BalloonsOptions{},
+		cch:                cch,
+		cpuTree:            tree,
+		cpuAllocator:       cpuallocator.NewCPUAllocator(sys),
+		freeCpus:           tree.Cpus(),
+		reservedBalloonDef: &BalloonDef{Name: reservedBalloonDefName},
+		defaultBalloonDef:  &BalloonDef{Name: defaultBalloonDefName},
+	}
+	yes := true
+	invalid := &BalloonsOptions{BalloonDefs: []*BalloonDef{
+		{Name: "cores", RequireWholeCores: &yes, MinCpus: 3},
+	}}
+	if err := p.validateConfig(invalid); err == nil {
+		t.Errorf("expected error from MinCpus that is not whole cores")
+	}
+	preset := &BalloonsOptions{BalloonDefs: []*BalloonDef{
+		{Name: "latency", AllocatorPreset: "latency-optimized", MinCpus: 3},
+	}}
+	if err := p.validateConfig(preset); err == nil {
+		t.Errorf("expected error from MinCpus that is not whole cores with latency-optimized preset")
+	}
+	unknown := &BalloonsOptions{BalloonDefs: []*BalloonDef{
+		{Name: "unknown", AllocatorPreset: "fastest"},
+	}}
+	if err := p.validateConfig(unknown); err == nil {
+		t.Errorf("expected error from unknown allocatorPreset")
+	}
+	blnDef := &BalloonDef{Name: "cores", RequireWholeCores: &yes, MinCpus: 2, MaxCpus: 6}
+	if err := p.validateConfig(&BalloonsOptions{BalloonDefs: []*BalloonDef{blnDef}}); err != nil {
+		t.Fatalf("validateConfig failed: %v", err)
+	}
+	bln, err := p.newBalloon(blnDef, false)
+	if err != nil {
+		t.Fatalf("newBalloon failed: %v", err)
+	}
+	for _, tc := range []struct {
+		milliCpus int
+		expected  int
+	}{
+		{0, 2},
+		{2500, 4},
+		{4000, 4},
+		{7000, 6},
+	} {
+		if count := balloonCpuCount(bln, tc.milliCpus); count != tc.expected {
+			t.Errorf("expected %d CPUs for %d mCPU, got %d", tc.expected, tc.milliCpus, count)
+		}
+	}
+	if err := p.resizeBalloon(bln, 2500); err != nil {
+		t.Fatalf("resizeBalloon failed: %v", err)
+	}
+	if bln.Cpus.Size() != 4 {
+		t.Errorf("expected 4 CPUs, got %s", bln.Cpus)
+	}
+}
+
+func TestRestoredCpus(t *testing.T) {
+	sys := newFakeSystemFromInt5([5]int{1, 1, 2, 4, 2})
+	tree, err := newCpuTreeFromSys(sys, nil)
+	if err != nil {
+		t.Fatalf("newCpuTreeFromSys failed: %v", err)
+	}
+	cch, err := cache.NewCache(cache.Options{CacheDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewCache failed: %v", err)
+	}
+	p := &balloons{
+		options:            &policy.BackendOptions{System: sys},
+		bpoptions:          &BalloonsOptions{},
+		cch:                cch,
+		cpuTree:            tree,
+		cpuAllocator:       cpuallocator.NewCPUAllocator(sys),
+		freeCpus:           tree.Cpus(),
+		reservedBalloonDef: &BalloonDef{Name: reservedBalloonDefName},
+		defaultBalloonDef:  &BalloonDef{Name: defaultBalloonDefName},
+	}
+	allCpus := tree.Cpus()
+	p.holdRestoredCpus(map[string]cpuset.CPUSet{
+		"a":    cpuset.New(2, 3),
+		"b":    cpuset.New(3, 4),
+		"gone": cpuset.New(5, 6, 7, 8, 9, 10, 11, 12, 13),
+	})
+	held := cpuset.New(2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13)
+	if !p.freeCpus.Equals(allCpus.Difference(held)) {
+		t.Fatalf("expected held CPUs %s not to be free, got free CPUs %s", held, p.freeCpus)
+	}
+
+	// New balloons must not take CPUs of containers that are not
+	// reassigned yet.
+	blnDef := &BalloonDef{Name: "new"}
+	bln, err := p.newBalloon(blnDef, false)
+	if err != nil {
+		t.Fatalf("newBalloon failed: %v", err)
+	}
+	if err := p.resizeBalloon(bln, 2000); err != nil {
+		t.Fatalf("resizeBalloon failed: %v", err)
+	}
+	if bln.Cpus.Size() != 2 || !bln.Cpus.Intersection(held).IsEmpty() {
+		t.Errorf("expected 2 CPUs that are not held, got %s", bln.Cpus)
+	}
+	if err := p.resizeBalloon(bln, 0); err != nil {
+		t.Fatalf("resizeBalloon failed: %v", err)
+	}
+
+	// CPUs shared with a container that is not reassigned yet stay held.
+	p.releaseRestoredCpus("a")
+	if !p.freeCpus.Contains(2) || p.freeCpus.Contains(3) {
+		t.Errorf("expected CPU 2 free and CPU 3 held, got free CPUs %s", p.freeCpus)
+	}
+
+	// Containers that are gone after a sync no longer hold CPUs.
+	if err := p.Sync(nil, nil); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if !p.freeCpus.Equals(allCpus) {
+		t.Errorf("expected all CPUs %s free after sync, got %s", allCpus, p.freeCpus)
+	}
+}
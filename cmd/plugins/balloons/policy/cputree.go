@@ -15,11 +15,21 @@
 package balloons
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
+	"reflect"
+	"runtime"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/containers/nri-plugins/pkg/cgroups"
+	"github.com/containers/nri-plugins/pkg/cpuallocator"
 	system "github.com/containers/nri-plugins/pkg/sysfs"
 	"github.com/containers/nri-plugins/pkg/topology"
 	"github.com/containers/nri-plugins/pkg/utils/cpuset"
@@ -33,6 +43,28 @@ type cpuTreeNode struct {
 	children []*cpuTreeNode
 	cpus     cpuset.CPUSet // union of CPUs of child nodes
 	sys      system.System
+	// maxFreqKHz is the maximum frequency of core and thread
+	// nodes, 0 if unknown.
+	maxFreqKHz uint64
+	// cacheId is the id of the last-level cache of thread nodes,
+	// -1 if unknown.
+	cacheId int
+	// cacheIds are the ids of data and unified caches of thread
+	// nodes by cache level, nil if unknown.
+	cacheIds map[int]int
+	// capacity is the compute capacity of thread nodes relative
+	// to the most capable CPU (1024), 0 if unknown.
+	capacity uint64
+	// nohzFull is true for thread nodes of tickless (nohz_full)
+	// CPUs.
+	nohzFull bool
+	// id is the topology id of the node on its level: package,
+	// die, NUMA node, core (first thread) or thread id. -1 if
+	// unknown.
+	id int
+	// memoryBytes is the total memory of NUMA nodes, 0 if
+	// unknown or not discovered.
+	memoryBytes uint64
 }
 
 // cpuTreeNodeAttributes contains various attributes of a CPU tree
@@ -51,6 +83,19 @@ type cpuTreeNodeAttributes struct {
 	currentCpuCounts []int
 	freeCpuCount     int
 	freeCpuCounts    []int
+	levels           []CPUTopologyLevel
+}
+
+// freeCpuCountAt returns the number of free CPUs in the ancestor (or
+// the node itself) at the given topology level, or -1 if the node has
+// no such ancestor.
+func (tna *cpuTreeNodeAttributes) freeCpuCountAt(level CPUTopologyLevel) int {
+	for tdepth, l := range tna.levels {
+		if l == level {
+			return tna.freeCpuCounts[tdepth]
+		}
+	}
+	return -1
 }
 
 // cpuTreeAllocator allocates CPUs from the branch of a CPU tree
@@ -59,6 +104,21 @@ type cpuTreeAllocator struct {
 	options           cpuTreeAllocatorOptions
 	root              *cpuTreeNode
 	cacheCloseCpuSets map[string][]cpuset.CPUSet
+	// topologyRoot is the root of the original tree. It differs
+	// from root if the allocator uses a tree where levels are
+	// split.
+	topologyRoot *cpuTreeNode
+	// partitionableCpus are CPUs that can be put into isolated
+	// cpuset partitions, nil if not discovered yet.
+	partitionableCpus *cpuset.CPUSet
+	// cpuLastUsed contains the time when CPUs were last
+	// allocated, if preferLeastRecentlyUsed is set.
+	cpuLastUsed map[int]time.Time
+	// debugCall is true in copies of the allocator that log
+	// the details of a single call regardless of log level.
+	debugCall bool
+	// bootCpu is the boot CPU of the tree, -1 if not in the tree.
+	bootCpu int
 }
 
 // cpuTreeAllocatorOptions contains parameters for the CPU allocator
@@ -72,6 +132,430 @@ type cpuTreeAllocatorOptions struct {
 	preferCloseToDevices        []string
 	preferFarFromDevices        []string
 	virtDevCpusets              map[string][]cpuset.CPUSet
+	// reservedCpus are never allocated, released or considered
+	// in topology hints by the allocator.
+	reservedCpus cpuset.CPUSet
+	// preferHighFreq true breaks ties between otherwise equally
+	// good allocation choices by preferring CPUs with higher
+	// maximum frequency.
+	preferHighFreq bool
+	// preferEmptiestPackage true confines allocations to the
+	// package with most free CPUs if that package alone can
+	// satisfy the allocation.
+	preferEmptiestPackage bool
+	// requireCacheIds, if not empty, allows allocating only
+	// CPUs whose last-level cache id is in the list.
+	requireCacheIds []int
+	// verify true checks invariants of the result of every
+	// ResizeCpus call, and returns an error if they are
+	// violated. This is meant for testing the allocator.
+	verify bool
+	// onAllocationFailure, if set, is called when allocating
+	// delta CPUs fails due to insufficient free CPUs.
+	onAllocationFailure func(delta int, freeCpus cpuset.CPUSet)
+	// onDeviceHints, if set, is called with the outcome of
+	// topology hints of every preferred device when allocating
+	// CPUs close to or far from devices.
+	onDeviceHints func(results []deviceHintResult)
+	// releaseLoneThreadsFirst true, together with
+	// preferSpreadOnPhysicalCores, releases CPUs whose
+	// hyperthreads are already free before breaking up cores
+	// that are fully in use. This re-consolidates cores instead
+	// of keeping one thread per core.
+	releaseLoneThreadsFirst bool
+	// singlePackageOnly true never lets CPUs span more than one
+	// package. Allocating fails rather than spills over to
+	// another package.
+	singlePackageOnly bool
+	// shrinkReluctance is the number of CPUs that may be kept
+	// over-provisioned instead of releasing them. Releases
+	// are reduced by this many CPUs.
+	shrinkReluctance int
+	// deviceHints caches CPUs close to devices. It can be
+	// shared by many allocators. If nil, the allocator uses a
+	// private cache.
+	deviceHints *deviceHintCache
+	// preferNumaNodes lists ids of NUMA nodes, like those where
+	// memory is already bound to, where CPUs are allocated from
+	// if there are enough free CPUs.
+	preferNumaNodes []int
+	// preemptibleCpus contains CPUs held by others that could be
+	// reclaimed. If there are not enough free CPUs to allocate
+	// from, ResizeCpus reports the best preemptible CPUs for
+	// completing the allocation in a cpuPreemptionError.
+	preemptibleCpus cpuset.CPUSet
+	// preferPartitionable prefers allocating CPUs that can be
+	// put into isolated cpuset partitions, and releasing those
+	// that cannot.
+	preferPartitionable bool
+	// preferPackSiblings prefers allocating free hyperthread
+	// siblings of already allocated CPUs. This is the opposite
+	// of preferSpreadOnPhysicalCores, and they cannot be used
+	// together.
+	preferPackSiblings bool
+	// preferEmptyWholeNode prefers releasing CPUs from the NUMA
+	// node that is closest to becoming completely free, so that
+	// whole nodes become available for large allocations.
+	preferEmptyWholeNode bool
+	// sizeByCapacity interprets deltas in ResizeCpus and Allocate
+	// in CPU capacity units instead of number of CPUs. See
+	// cpuCapacityScale.
+	sizeByCapacity bool
+	// perNodeHeadroom is the number of CPUs that allocations
+	// try to keep free in every NUMA node. A node is considered
+	// full if allocating from it would leave fewer free CPUs,
+	// unless no node could otherwise satisfy the allocation.
+	perNodeHeadroom int
+	// freeCpusProvider, if set, returns the current free CPUs
+	// when freeCpusFromProvider is passed as the freeCpus
+	// argument of ResizeCpus or Allocate. An explicitly given
+	// freeCpus set always takes precedence over the provider.
+	freeCpusProvider func() cpuset.CPUSet
+	// nodePressure, if set, returns the memory pressure of a
+	// NUMA node. Allocations avoid NUMA nodes whose pressure
+	// exceeds nodePressureThreshold if there are equally good
+	// alternatives in other NUMA nodes.
+	nodePressure          func(nodeID int) float64
+	nodePressureThreshold float64
+	// preferLeastRecentlyUsed allocates, among equally good free
+	// CPUs, those that have been allocated least recently. This
+	// rotates load over CPUs to even out wear and thermals.
+	preferLeastRecentlyUsed bool
+	// preferContiguousIds allocates, among equally good free
+	// CPUs, those that form the longest run of consecutive CPU
+	// ids together with current CPUs. This is only a tie-breaker
+	// after topology ranking, and preferLeastRecentlyUsed takes
+	// precedence over it.
+	preferContiguousIds bool
+	// requireWholeCores allocates and releases only whole
+	// physical cores. Deltas must be multiples of the number of
+	// threads per core, and only cores whose all threads are
+	// free are allocated.
+	requireWholeCores bool
+	// singleNumaOnly true never lets CPUs span more than one
+	// NUMA node. Allocating fails rather than spills over to
+	// another NUMA node.
+	singleNumaOnly bool
+	// requireNohzFull allows allocating only tickless
+	// (nohz_full) CPUs, and fails if there are not enough of
+	// them.
+	requireNohzFull bool
+	// exclusivity, if set, is the mode of CPUs the allocator
+	// allocates. Only free CPUs whose mode in cpuModes is the
+	// same or none are allocated, so that exclusive and shared
+	// CPUs never mix. Allocate records the modes of allocated
+	// and released CPUs in cpuModes.
+	exclusivity cpuMode
+	// avoidBootCpu leaves the boot CPU (see BootCpu) out of
+	// allocations. Taking the boot CPU away from housekeeping
+	// work that the kernel cannot move elsewhere may destabilize
+	// the system.
+	avoidBootCpu bool
+	// cpuModes tracks modes of CPUs. It can be shared by many
+	// allocators. If nil, the allocator uses a private map.
+	cpuModes *cpuModeMap
+	// peerCurrentCpus are the current CPUs of neighbor balloons
+	// that draw from the same free CPUs. Allocations prefer
+	// nodes away from them, leaving growth room to the peers.
+	// This is a soft preference: peer CPUs are not excluded.
+	peerCurrentCpus []cpuset.CPUSet
+	// requireCloseToDevices makes preferCloseToDevices
+	// mandatory: allocating fails with an
+	// ErrDeviceLocalityUnsatisfiable if the CPUs cannot be
+	// allocated close to every device with topology hints.
+	requireCloseToDevices bool
+	// preferIdleSibling allocates, if possible, CPUs whose
+	// hyperthread siblings are free, one thread per core, so
+	// that the siblings do not contend with the allocated
+	// CPUs. Unlike requireWholeCores this is a soft preference
+	// and allocates partial cores.
+	preferIdleSibling bool
+	// cpuVeto, if set, returns true for CPUs that must not be
+	// allocated, like CPUs quarantined due to hardware errors.
+	// Vetoed CPUs are never allocated, and they are released
+	// before other CPUs.
+	cpuVeto func(cpu int) bool
+	// preferReleaseOverlapping, if not empty, releases CPUs in
+	// this set, like housekeeping CPUs, before other CPUs.
+	//
+	// Release biases are applied in this order: vetoed CPUs are
+	// released first, then CPUs in preferReleaseOverlapping.
+	// Among the CPUs chosen by them, device hints release CPUs
+	// least close to preferCloseToDevices, and the rest of the
+	// options, like releaseLoneThreadsFirst and
+	// preferEmptyWholeNode, choose among those.
+	preferReleaseOverlapping cpuset.CPUSet
+	// securityDomain, if set, is the security domain of the
+	// CPUs being allocated, like a tenant. Free CPUs whose
+	// hyperthread siblings are allocated to another domain in
+	// cpuSecurityDomains are not allocated.
+	//
+	// Threat model: with SMT active, sibling threads share the
+	// core's caches, buffers and execution units, and some
+	// CPU vulnerabilities let a thread leak data of its
+	// sibling unless SMT is disabled (see
+	// sysfs.SMTVulnerable). Keeping domains on separate cores
+	// stops such leaks between domains, but not within a
+	// domain, nor through resources shared by all cores, like
+	// the last-level cache. Allocated CPUs without a domain
+	// are trusted by all domains.
+	//
+	// If there are not enough free CPUs without siblings in
+	// other domains, allocating fails rather than places
+	// domains on the same core.
+	securityDomain     string
+	cpuSecurityDomains map[int]string
+	// balloon is the name of the balloon whose CPUs the
+	// allocator allocates. It is recorded in Decisions.
+	balloon string
+	// onCommit, if set, is called with every Decision that
+	// Allocate commits, for instance to write it into a
+	// write-ahead log. Replay restores the state of the
+	// allocator from logged Decisions.
+	onCommit func(Decision)
+	// cpuAllocator, if set, picks the exact CPUs that Allocate
+	// allocates and releases among the CPUs returned by
+	// ResizeCpus, preferring CPUs of allocatorPriority. This is
+	// the choice the balloons policy makes. If nil, Allocate
+	// picks CPUs in the order of CPU ids.
+	cpuAllocator      cpuallocator.CPUAllocator
+	allocatorPriority cpuallocator.CPUPriority
+}
+
+// LatencyOptimizedOptions returns allocator options for latency
+// sensitive workloads, like databases serving OLTP queries:
+//   - requireWholeCores: no other workload runs on the hyperthread
+//     siblings of allocated CPUs. Sizes must be multiples of the
+//     number of threads per core. preferIdleSibling is not set, as
+//     it would allocate partial cores.
+//   - singleNumaOnly: memory accesses stay local to the NUMA node of
+//     the CPUs. Allocating fails rather than spans NUMA nodes.
+//   - preferHighFreq: among equally good CPUs, those with higher
+//     maximum frequency are allocated.
+//
+// The returned options can be adjusted further.
+func LatencyOptimizedOptions() cpuTreeAllocatorOptions {
+	return cpuTreeAllocatorOptions{
+		requireWholeCores: true,
+		singleNumaOnly:    true,
+		preferHighFreq:    true,
+	}
+}
+
+// ThroughputOptimizedOptions returns allocator options for workloads
+// that value aggregate throughput over latency, like batch jobs:
+//   - topologyBalancing: CPUs are allocated from the branches with
+//     most free CPUs, balancing load over packages, dies and NUMA
+//     nodes.
+//   - preferSpreadOnPhysicalCores: CPUs are spread over physical
+//     cores before using their hyperthread siblings.
+//   - preferEmptiestPackage: allocations are confined to the package
+//     with most free CPUs if that package alone can satisfy them,
+//     avoiding cross-package traffic.
+//
+// The returned options can be adjusted further.
+func ThroughputOptimizedOptions() cpuTreeAllocatorOptions {
+	return cpuTreeAllocatorOptions{
+		topologyBalancing:           true,
+		preferSpreadOnPhysicalCores: true,
+		preferEmptiestPackage:       true,
+	}
+}
+
+// KubeletCompatOptions returns allocator options whose placement
+// mirrors the kubelet static CPU manager policy with the
+// full-pcpus-only option and the single-numa-node topology manager
+// policy: CPUs are allocated as whole physical cores, packed into a
+// single NUMA node, and device topology is not taken into account.
+//
+// Known differences to the kubelet:
+//   - The kubelet allocates CPUs once per container, while balloons
+//     grow and shrink. Shrinking releases whole cores, but which
+//     ones is decided by the balloons allocator.
+//   - The kubelet picks the NUMA node from merged topology hints of
+//     all hint providers, like device plugins and the memory
+//     manager. These options only consider free CPUs, preferring
+//     the fullest NUMA node that fits the allocation, which matches
+//     the kubelet only when CPUs are the sole hint provider.
+//   - The kubelet takes CPUs by lowest id within a core and socket,
+//     the balloons allocator by its topology tree, which gives the
+//     same cores unless CPU ids are not ordered by topology.
+//   - Reserved CPUs are those in reservedCpus of the options, not
+//     the kubelet's reservedSystemCPUs.
+func KubeletCompatOptions() cpuTreeAllocatorOptions {
+	return cpuTreeAllocatorOptions{
+		topologyBalancing: false,
+		requireWholeCores: true,
+		singleNumaOnly:    true,
+	}
+}
+
+// freeCpusFromProvider is a sentinel freeCpus argument that makes
+// the allocator query free CPUs from the freeCpusProvider in
+// allocator options at the time of the call.
+var freeCpusFromProvider = cpuset.New(-1)
+
+// ErrRequestExceedsCapacity is returned when resizing would need more
+// CPUs than the allocator can allocate at all, even if every CPU was
+// free. Unlike a shortage of free CPUs, this cannot be resolved by
+// trying again later.
+var ErrRequestExceedsCapacity = errors.New("request exceeds CPU capacity")
+
+// cpuCapacityScale is the capacity of the most capable CPU in the
+// system, as in the kernel's cpu_capacity. Capacities of other CPUs
+// are relative to it: a CPU with capacity 512 has half of the compute
+// capacity of the most capable CPU. CPUs with unknown capacity have
+// cpuCapacityScale capacity.
+const cpuCapacityScale = 1024
+
+// cpuPreemptionError is returned when there are not enough free CPUs
+// for an allocation, but the allocation could be completed by
+// reclaiming preemptible CPUs.
+type cpuPreemptionError struct {
+	// err is the original allocation error.
+	err error
+	// preemptCpus contains the preemptible CPUs that need to be
+	// reclaimed.
+	preemptCpus cpuset.CPUSet
+	// addFromCpus contains the CPUs, both free and preemptible,
+	// from which the allocation would be made.
+	addFromCpus cpuset.CPUSet
+}
+
+func (e *cpuPreemptionError) Error() string {
+	return fmt.Sprintf("%v, could preempt CPUs %q", e.err, e.preemptCpus)
+}
+
+func (e *cpuPreemptionError) Unwrap() error {
+	return e.err
+}
+
+// ErrDeviceLocalityUnsatisfiable is returned when CPUs are required
+// to be close to devices, but there are not enough free CPUs close to
+// some of the devices.
+type ErrDeviceLocalityUnsatisfiable struct {
+	// Devices are the paths of devices without enough free
+	// CPUs close to them.
+	Devices []string
+	// RequestedCpus is the number of CPUs that was requested.
+	RequestedCpus int
+}
+
+func (e *ErrDeviceLocalityUnsatisfiable) Error() string {
+	return fmt.Sprintf("not enough free CPUs close to device(s) %s to allocate %d CPUs",
+		strings.Join(e.Devices, ", "), e.RequestedCpus)
+}
+
+// deviceHintCache caches topology hint CPUs of devices so that sysfs
+// is read only once per device. It is safe for concurrent use.
+type deviceHintCache struct {
+	sync.Mutex
+	closeCpuSets map[string][]cpuset.CPUSet
+}
+
+// newDeviceHintCache returns an empty device hint cache.
+func newDeviceHintCache() *deviceHintCache {
+	return &deviceHintCache{
+		closeCpuSets: map[string][]cpuset.CPUSet{},
+	}
+}
+
+// get returns cached CPUs close to dev, resolving and caching them
+// with resolve if needed. Devices are resolved without holding the
+// lock, so that reading sysfs for one device does not block getting
+// others. If dev is resolved concurrently, the first result is cached.
+func (c *deviceHintCache) get(dev string, resolve func(string) []cpuset.CPUSet) []cpuset.CPUSet {
+	c.Lock()
+	closeCpuSets, ok := c.closeCpuSets[dev]
+	c.Unlock()
+	if ok {
+		return closeCpuSets
+	}
+	closeCpuSets = resolve(dev)
+	c.Lock()
+	defer c.Unlock()
+	if cached, ok := c.closeCpuSets[dev]; ok {
+		return cached
+	}
+	c.closeCpuSets[dev] = closeCpuSets
+	return closeCpuSets
+}
+
+// cpuMode tells how a CPU is used: exclusively by a single balloon
+// or shared by many workloads in a pool.
+type cpuMode int
+
+const (
+	// cpuModeNone is the mode of CPUs not used in either way.
+	cpuModeNone cpuMode = iota
+	// cpuModeExclusive is the mode of dedicated CPUs.
+	cpuModeExclusive
+	// cpuModeShared is the mode of CPUs in a shared pool.
+	cpuModeShared
+)
+
+func (m cpuMode) String() string {
+	switch m {
+	case cpuModeNone:
+		return "none"
+	case cpuModeExclusive:
+		return "exclusive"
+	case cpuModeShared:
+		return "shared"
+	}
+	return fmt.Sprintf("cpuMode(%d)", int(m))
+}
+
+// cpuModeMap tracks modes of CPUs. It is safe for concurrent use.
+type cpuModeMap struct {
+	sync.Mutex
+	modes map[int]cpuMode
+}
+
+// newCpuModeMap returns a map with initial CPU modes.
+func newCpuModeMap(modes map[int]cpuMode) *cpuModeMap {
+	m := &cpuModeMap{
+		modes: map[int]cpuMode{},
+	}
+	for cpu, mode := range modes {
+		if mode != cpuModeNone {
+			m.modes[cpu] = mode
+		}
+	}
+	return m
+}
+
+// Mode returns the mode of a CPU.
+func (m *cpuModeMap) Mode(cpu int) cpuMode {
+	m.Lock()
+	defer m.Unlock()
+	return m.modes[cpu]
+}
+
+// Cpus returns the CPUs in a mode other than cpuModeNone.
+func (m *cpuModeMap) Cpus(mode cpuMode) cpuset.CPUSet {
+	m.Lock()
+	defer m.Unlock()
+	cpus := []int{}
+	for cpu, cpuMode := range m.modes {
+		if cpuMode == mode {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpuset.New(cpus...)
+}
+
+// set sets the mode of cpus.
+func (m *cpuModeMap) set(cpus cpuset.CPUSet, mode cpuMode) {
+	m.Lock()
+	defer m.Unlock()
+	for _, cpu := range cpus.UnsortedList() {
+		if mode == cpuModeNone {
+			delete(m.modes, cpu)
+		} else {
+			m.modes[cpu] = mode
+		}
+	}
 }
 
 var emptyCpuSet = cpuset.New()
@@ -85,16 +569,34 @@ func (t *cpuTreeNode) String() string {
 }
 
 func (t *cpuTreeNode) PrettyPrint() string {
+	lines, _ := t.prettyPrintLines()
+	return strings.Join(lines, "\n")
+}
+
+// prettyPrintLines returns the lines of PrettyPrint and the node
+// printed on each line.
+func (t *cpuTreeNode) prettyPrintLines() ([]string, []*cpuTreeNode) {
 	origDepth := t.Depth()
 	lines := []string{}
+	nodes := []*cpuTreeNode{}
 	t.DepthFirstWalk(func(tn *cpuTreeNode) error {
-		lines = append(lines,
-			fmt.Sprintf("%s%s: %q cpus: %s",
-				strings.Repeat(" ", (tn.Depth()-origDepth)*4),
-				tn.level, tn.name, tn.cpus))
+		line := fmt.Sprintf("%s%s: %q cpus: %s",
+			strings.Repeat(" ", (tn.Depth()-origDepth)*4),
+			tn.level, tn.name, tn.cpus)
+		if tn.maxFreqKHz > 0 {
+			line += fmt.Sprintf(" maxfreq: %d kHz", tn.maxFreqKHz)
+		}
+		if tn.cacheId >= 0 {
+			line += fmt.Sprintf(" llc: %d", tn.cacheId)
+		}
+		if tn.capacity > 0 {
+			line += fmt.Sprintf(" capacity: %d", tn.capacity)
+		}
+		lines = append(lines, line)
+		nodes = append(nodes, tn)
 		return nil
 	})
-	return strings.Join(lines, "\n")
+	return lines, nodes
 }
 
 func (t *cpuTreeNode) system() system.System {
@@ -104,6 +606,20 @@ func (t *cpuTreeNode) system() system.System {
 	return t.parent.system()
 }
 
+// BootCpu returns the CPU the kernel booted on, or -1 if it is not in
+// the tree. Trees that are not created from a system, like simulated
+// trees in tests, have no boot CPU.
+func (t *cpuTreeNode) BootCpu() int {
+	sys := t.system()
+	if sys == nil {
+		return -1
+	}
+	if cpu := sys.BootCPU(); cpu >= 0 && t.Cpus().Contains(cpu) {
+		return cpu
+	}
+	return -1
+}
+
 // String returns cpuTreeNodeAttributes as a string.
 func (tna cpuTreeNodeAttributes) String() string {
 	return fmt.Sprintf("%s{%d,%v,%d,%d}", tna.t.name, tna.depth,
@@ -114,8 +630,10 @@ func (tna cpuTreeNodeAttributes) String() string {
 // NewCpuTree returns a named CPU tree node.
 func NewCpuTree(name string) *cpuTreeNode {
 	return &cpuTreeNode{
-		name: name,
-		cpus: cpuset.New(),
+		name:    name,
+		cpus:    cpuset.New(),
+		cacheId: -1,
+		id:      -1,
 	}
 }
 
@@ -130,11 +648,18 @@ func (t *cpuTreeNode) CopyTree() *cpuTreeNode {
 
 func (t *cpuTreeNode) CopyNode() *cpuTreeNode {
 	newNode := cpuTreeNode{
-		name:     t.name,
-		level:    t.level,
-		parent:   t.parent,
-		children: t.children,
-		cpus:     t.cpus,
+		name:        t.name,
+		level:       t.level,
+		parent:      t.parent,
+		children:    t.children,
+		cpus:        t.cpus,
+		maxFreqKHz:  t.maxFreqKHz,
+		capacity:    t.capacity,
+		cacheId:     t.cacheId,
+		cacheIds:    t.cacheIds,
+		nohzFull:    t.nohzFull,
+		id:          t.id,
+		memoryBytes: t.memoryBytes,
 	}
 	return &newNode
 }
@@ -153,6 +678,35 @@ func (t *cpuTreeNode) AddChild(child *cpuTreeNode) {
 	t.children = append(t.children, child)
 }
 
+// Prune removes all branches with no CPUs below a CPU tree node, and
+// returns the number of removed nodes. The node itself is never
+// removed, even if it has no CPUs.
+func (t *cpuTreeNode) Prune() int {
+	removed := 0
+	children := t.children[:0]
+	for _, child := range t.children {
+		if child.cpus.IsEmpty() {
+			removed += child.size()
+			child.parent = nil
+			continue
+		}
+		removed += child.Prune()
+		children = append(children, child)
+	}
+	clear(t.children[len(children):])
+	t.children = children
+	return removed
+}
+
+// size returns the number of nodes in a CPU tree.
+func (t *cpuTreeNode) size() int {
+	n := 1
+	for _, child := range t.children {
+		n += child.size()
+	}
+	return n
+}
+
 // AddCpus adds CPUs to a CPU tree node and all its parents.
 func (t *cpuTreeNode) AddCpus(cpus cpuset.CPUSet) {
 	t.cpus = t.cpus.Union(cpus)
@@ -166,6 +720,46 @@ func (t *cpuTreeNode) Cpus() cpuset.CPUSet {
 	return t.cpus
 }
 
+// MaxFreqKHz returns the maximum frequency of a CPU tree node in
+// kHz. The frequency is discovered for core and thread nodes. Other
+// nodes return the highest frequency found among their children. 0
+// means the frequency is unknown.
+func (t *cpuTreeNode) MaxFreqKHz() uint64 {
+	if t.maxFreqKHz > 0 || len(t.children) == 0 {
+		return t.maxFreqKHz
+	}
+	maxFreq := uint64(0)
+	for _, child := range t.children {
+		if childFreq := child.MaxFreqKHz(); childFreq > maxFreq {
+			maxFreq = childFreq
+		}
+	}
+	return maxFreq
+}
+
+// packageNode returns the package node of this node, that is this
+// node or its ancestor on the package level. Returns nil if the node
+// is above the package level.
+func (t *cpuTreeNode) packageNode() *cpuTreeNode {
+	for tn := t; tn != nil; tn = tn.parent {
+		if tn.level == CPUTopologyLevelPackage {
+			return tn
+		}
+	}
+	return nil
+}
+
+// numaNode returns the NUMA node of a node at or below the NUMA
+// level, or nil.
+func (t *cpuTreeNode) numaNode() *cpuTreeNode {
+	for tn := t; tn != nil; tn = tn.parent {
+		if tn.level == CPUTopologyLevelNuma {
+			return tn
+		}
+	}
+	return nil
+}
+
 // SiblingIndex returns the index of this node among its parents
 // children. Returns -1 for the root node, -2 if this node is not
 // listed among the children of its parent.
@@ -181,23 +775,238 @@ func (t *cpuTreeNode) SiblingIndex() int {
 	return -2
 }
 
-func (t *cpuTreeNode) FindLeafWithCpu(cpu int) *cpuTreeNode {
-	var found *cpuTreeNode
+// Leaves returns leaf nodes (threads) of the subtree rooted at this
+// node in left-to-right order.
+func (t *cpuTreeNode) Leaves() []*cpuTreeNode {
+	return t.FindAll(func(tn *cpuTreeNode) bool {
+		return len(tn.children) == 0
+	})
+}
+
+// CacheGroups returns groups of CPUs in the subtree rooted at this
+// node that share a cache of a level, for instance level 2 for L2
+// caches. Groups are ordered by their lowest CPU. Returns an empty
+// slice if cache information of the level is not available.
+func (t *cpuTreeNode) CacheGroups(level int) []cpuset.CPUSet {
+	groups := map[int]cpuset.CPUSet{}
+	for _, leaf := range t.Leaves() {
+		if id, ok := leaf.cacheIds[level]; ok {
+			groups[id] = groups[id].Union(leaf.cpus)
+		}
+	}
+	cacheGroups := make([]cpuset.CPUSet, 0, len(groups))
+	for _, cpus := range groups {
+		cacheGroups = append(cacheGroups, cpus)
+	}
+	sort.Slice(cacheGroups, func(i, j int) bool {
+		return cacheGroups[i].List()[0] < cacheGroups[j].List()[0]
+	})
+	return cacheGroups
+}
+
+// NearestFreeCpu returns the free CPU that is topologically closest to
+// the target CPU in the subtree rooted at this node. The target itself
+// is the closest, then its hyperthread siblings, CPUs sharing the L2
+// cache, the same NUMA node, die, package and finally any CPU. Ties
+// are broken by the lowest CPU id. Returns false if the target is not
+// in the subtree or none of its CPUs is free.
+func (t *cpuTreeNode) NearestFreeCpu(target int, freeCpus cpuset.CPUSet) (int, bool) {
+	leaves := t.FindAll(func(tn *cpuTreeNode) bool {
+		return len(tn.children) == 0 && tn.cpus.Contains(target)
+	})
+	if len(leaves) == 0 {
+		return -1, false
+	}
+	leaf := leaves[0]
+	lowestFree := func(cpus cpuset.CPUSet) (int, bool) {
+		if free := cpus.Intersection(freeCpus); !free.IsEmpty() {
+			return free.List()[0], true
+		}
+		return -1, false
+	}
+	if freeCpus.Contains(target) {
+		return target, true
+	}
+	for tn := leaf.parent; tn != nil; tn = tn.parent {
+		if cpu, ok := lowestFree(tn.cpus); ok {
+			return cpu, true
+		}
+		if tn.level != CPUTopologyLevelCore {
+			continue
+		}
+		if l2, ok := leaf.cacheIds[2]; ok {
+			l2Cpus := cpuset.New()
+			for _, other := range t.Leaves() {
+				if id, ok := other.cacheIds[2]; ok && id == l2 {
+					l2Cpus = l2Cpus.Union(other.cpus)
+				}
+			}
+			if cpu, ok := lowestFree(l2Cpus); ok {
+				return cpu, true
+			}
+		}
+	}
+	return -1, false
+}
+
+// LeafCpus returns the union of CPUs of all leaf nodes of the subtree
+// rooted at this node. This equals to Cpus() of the node.
+func (t *cpuTreeNode) LeafCpus() cpuset.CPUSet {
+	cpus := cpuset.New()
+	for _, leaf := range t.Leaves() {
+		cpus = cpus.Union(leaf.cpus)
+	}
+	return cpus
+}
+
+// Equal returns true if the trees rooted at this and the other node
+// have the same nodes with the same CPUs.
+func (t *cpuTreeNode) Equal(other *cpuTreeNode) bool {
+	return len(t.Diff(other)) == 0
+}
+
+// Diff returns human-readable differences between trees rooted at
+// this and the other node: nodes that are only in the other tree
+// are added, nodes that are only in this tree are removed. Nodes are
+// matched by name.
+func (t *cpuTreeNode) Diff(other *cpuTreeNode) []string {
+	diffs := []string{}
+	otherNodes := map[string]*cpuTreeNode{}
+	if other != nil {
+		for _, on := range other.FindAll(func(*cpuTreeNode) bool { return true }) {
+			otherNodes[on.name] = on
+		}
+	}
+	nodes := map[string]struct{}{}
 	t.DepthFirstWalk(func(tn *cpuTreeNode) error {
-		if len(tn.children) > 0 {
-			return nil
+		nodes[tn.name] = struct{}{}
+		on, ok := otherNodes[tn.name]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("removed %s %q cpus: %s", tn.level, tn.name, tn.cpus))
+		case on.level != tn.level:
+			diffs = append(diffs, fmt.Sprintf("changed %q level: %s -> %s", tn.name, tn.level, on.level))
+		case !on.cpus.Equals(tn.cpus):
+			diffs = append(diffs, fmt.Sprintf("changed %s %q cpus: %s -> %s", tn.level, tn.name, tn.cpus, on.cpus))
 		}
-		for _, cpuHere := range tn.cpus.List() {
-			if cpu == cpuHere {
-				found = tn
-				return WalkStop
+		return nil
+	})
+	if other != nil {
+		other.DepthFirstWalk(func(on *cpuTreeNode) error {
+			if _, ok := nodes[on.name]; !ok {
+				diffs = append(diffs, fmt.Sprintf("added %s %q cpus: %s", on.level, on.name, on.cpus))
 			}
+			return nil
+		})
+	}
+	return diffs
+}
+
+// Find returns the first node in depth-first order in the subtree
+// rooted at this node for which pred returns true, or nil if there
+// is no such node.
+func (t *cpuTreeNode) Find(pred func(*cpuTreeNode) bool) *cpuTreeNode {
+	var found *cpuTreeNode
+	t.DepthFirstWalk(func(tn *cpuTreeNode) error {
+		if pred(tn) {
+			found = tn
+			return WalkStop
+		}
+		return nil
+	})
+	return found
+}
+
+// FindAll returns all nodes in depth-first order in the subtree
+// rooted at this node for which pred returns true.
+func (t *cpuTreeNode) FindAll(pred func(*cpuTreeNode) bool) []*cpuTreeNode {
+	found := []*cpuTreeNode{}
+	t.DepthFirstWalk(func(tn *cpuTreeNode) error {
+		if pred(tn) {
+			found = append(found, tn)
+		}
+		return nil
+	})
+	return found
+}
+
+// NodesAtLevel returns the nodes of a topology level in the subtree
+// rooted at this node in depth-first order. Nodes below a returned
+// node are not visited, so nodes on the same level under it, like
+// the classes of a split level, are not returned.
+func (t *cpuTreeNode) NodesAtLevel(level CPUTopologyLevel) []*cpuTreeNode {
+	found := []*cpuTreeNode{}
+	t.DepthFirstWalk(func(tn *cpuTreeNode) error {
+		if tn.level != level {
+			return nil
 		}
-		return nil // not found here, no more children to search
+		found = append(found, tn)
+		return WalkSkipChildren
 	})
 	return found
 }
 
+// FindLeafWithCpu returns the leaf node that contains a CPU, or nil
+// if the CPU is not in the tree.
+func (t *cpuTreeNode) FindLeafWithCpu(cpu int) *cpuTreeNode {
+	return t.Find(func(tn *cpuTreeNode) bool {
+		return len(tn.children) == 0 && tn.cpus.Contains(cpu)
+	})
+}
+
+// CoreSiblings returns the CPUs of the physical core that contains a
+// CPU, including the CPU itself. If the tree has no core level above
+// the CPU, only the CPU is returned. If the CPU is not in the tree,
+// the result is empty.
+func (t *cpuTreeNode) CoreSiblings(cpu int) cpuset.CPUSet {
+	leaf := t.FindLeafWithCpu(cpu)
+	if leaf == nil {
+		log.Debugf("core siblings: cpu %d not in tree %s", cpu, t.name)
+		return cpuset.New()
+	}
+	for node := leaf; node != nil; node = node.parent {
+		if node.level == CPUTopologyLevelCore {
+			return node.cpus
+		}
+	}
+	return leaf.cpus
+}
+
+// NohzFullCpus returns the tickless (nohz_full) CPUs of the tree.
+func (t *cpuTreeNode) NohzFullCpus() cpuset.CPUSet {
+	cpus := cpuset.New()
+	for _, leaf := range t.Leaves() {
+		if leaf.nohzFull {
+			cpus = cpus.Union(leaf.cpus)
+		}
+	}
+	return cpus
+}
+
+// MaxBalloonsOfSize returns how many disjoint sets of size CPUs can
+// be taken from the CPUs of the tree so that no set crosses the
+// boundary of a topology element on the given level. Hyperthreads
+// are counted as CPUs, and all CPUs of the tree are assumed to be
+// available. Each element on the level holds its CPU count divided
+// by size sets, the rest of its CPUs are left over. If the tree
+// itself is on or below the level, it counts as a single element.
+// Last-level caches are not a topology level, use the level that
+// matches them on the system, like die or NUMA node.
+func (t *cpuTreeNode) MaxBalloonsOfSize(size int, level CPUTopologyLevel) int {
+	if size <= 0 {
+		return 0
+	}
+	count := 0
+	t.DepthFirstWalk(func(tn *cpuTreeNode) error {
+		if tn.level.Value() >= level.Value() {
+			count += tn.cpus.Size() / size
+			return WalkSkipChildren
+		}
+		return nil
+	})
+	return count
+}
+
 // WalkSkipChildren error returned from a DepthFirstWalk handler
 // prevents walking deeper in the tree. The caller of the
 // DepthFirstWalk will get no error.
@@ -232,42 +1041,167 @@ func (t *cpuTreeNode) DepthFirstWalk(handler func(*cpuTreeNode) error) error {
 // CpuLocations returns a slice where each element contains names of
 // topology elements over which a set of CPUs spans. Example:
 // systemNode.CpuLocations(cpuset:0,99) = [["system"],["p0", "p1"], ["p0d0", "p1d0"], ...]
+//
+// The first element contains the level of the node itself. Use
+// CpuLocationsAbsolute if elements should be indexed by topology
+// level regardless of the node.
 func (t *cpuTreeNode) CpuLocations(cpus cpuset.CPUSet) [][]string {
-	names := make([][]string, int(CPUTopologyLevelCount)-t.level.Value())
+	return t.cpuLocations(cpus, t.level.Value())
+}
+
+// CpuLocationsAbsolute is like CpuLocations, but the index of an
+// element is the topology level (system=0, package=1, ...) of the
+// topology elements in it. Levels above the node are nil. Example:
+// numaNode.CpuLocationsAbsolute(cpuset:0,1) = [nil, nil, nil, ["p0d0n0"], ...]
+func (t *cpuTreeNode) CpuLocationsAbsolute(cpus cpuset.CPUSet) [][]string {
+	return t.cpuLocations(cpus, CPUTopologyLevel(CPUTopologyLevelSystem).Value())
+}
+
+func (t *cpuTreeNode) cpuLocations(cpus cpuset.CPUSet, firstLevel int) [][]string {
+	names := make([][]string, int(CPUTopologyLevelCount)-firstLevel)
 	t.DepthFirstWalk(func(tn *cpuTreeNode) error {
 		if tn.cpus.Intersection(cpus).Size() == 0 {
 			return WalkSkipChildren
 		}
-		levelIndex := tn.level.Value() - t.level.Value()
+		levelIndex := tn.level.Value() - firstLevel
 		names[levelIndex] = append(names[levelIndex], tn.name)
 		return nil
 	})
 	return names
 }
 
+// cpuTreeNameFunc returns the name of a CPU tree node on a topology
+// level. ids are the package, die, NUMA node, core and thread ids of
+// the node, as far as they are defined on the level. The core id is
+// the id of the first thread of the core.
+type cpuTreeNameFunc func(level CPUTopologyLevel, ids ...int) string
+
+// defaultCpuTreeName returns names like "p0d0n0cpu12t12".
+func defaultCpuTreeName(level CPUTopologyLevel, ids ...int) string {
+	prefixes := []string{"p", "d", "n", "cpu", "t"}
+	name := ""
+	for i, id := range ids {
+		name += fmt.Sprintf("%s%d", prefixes[i], id)
+	}
+	return name
+}
+
 // NewCpuTreeFromSystem returns the root node of the topology tree
 // constructed from the underlying system.
 func NewCpuTreeFromSystem() (*cpuTreeNode, error) {
-	sys, err := system.DiscoverSystem(system.DiscoverCPUTopology)
+	return NewCpuTreeFromSystemWithNames(nil)
+}
+
+// NewCpuTreeFromSystemWithNames returns the root node of the topology
+// tree constructed from the underlying system, using nameFunc for
+// naming the nodes. nil nameFunc gives the default names. Names of
+// nodes must be unique.
+func NewCpuTreeFromSystemWithNames(nameFunc cpuTreeNameFunc) (*cpuTreeNode, error) {
+	return NewCpuTreeFromSystemWithFlags(nameFunc, system.DiscoverNone)
+}
+
+// NewCpuTreeFromSystemWithFlags returns the root node of the topology
+// tree constructed from the underlying system like
+// NewCpuTreeFromSystemWithNames, discovering the details in flags in
+// addition to CPU topology. With DiscoverMemTopology the memory of
+// NUMA nodes is discovered, too.
+func NewCpuTreeFromSystemWithFlags(nameFunc cpuTreeNameFunc, flags system.DiscoveryFlag) (*cpuTreeNode, error) {
+	sys, err := system.DiscoverSystem(system.DiscoverCPUTopology | flags)
 	if err != nil {
 		return nil, err
 	}
+	tree, err := newCpuTreeFromSys(sys, nameFunc)
+	if err != nil {
+		return nil, err
+	}
+	if flags&system.DiscoverMemTopology != 0 {
+		tree.discoverNodeMemory()
+	}
+	return tree, nil
+}
+
+// discoverNodeMemory stores the total memory of NUMA nodes in the
+// tree. Memory of nodes whose memory info cannot be read is left
+// unknown.
+func (t *cpuTreeNode) discoverNodeMemory() {
+	for _, tn := range t.NodesAtLevel(CPUTopologyLevelNuma) {
+		if node := t.sys.Node(tn.id); node != nil {
+			if info, err := node.MemoryInfo(); err != nil {
+				log.Debugf("memory of NUMA node %d unknown: %v", tn.id, err)
+			} else if info != nil {
+				tn.memoryBytes = info.MemTotal
+			}
+		}
+	}
+}
+
+// NodeMemoryBytes returns the total memory of the NUMA node of a
+// node at or below the NUMA level, and the sum of the memory of
+// NUMA nodes under a node above the NUMA level. 0 means that the
+// memory is unknown, or it was not discovered.
+func (t *cpuTreeNode) NodeMemoryBytes() uint64 {
+	if numa := t.numaNode(); numa != nil {
+		return numa.memoryBytes
+	}
+	total := uint64(0)
+	for _, child := range t.children {
+		total += child.NodeMemoryBytes()
+	}
+	return total
+}
+
+// newCpuTreeFromSys returns the root node of the topology tree
+// constructed from a system. Offline threads are left out of the
+// tree, and so are cores without online threads. This way cores with
+// SMT disabled look the same as true single-thread cores. Online CPUs
+// without thread sibling information are added as single-thread
+// cores. Online CPUs that are not in any NUMA node are an error, so
+// that no allocatable CPU is missing from the tree.
+func newCpuTreeFromSys(sys system.System, nameFunc cpuTreeNameFunc) (*cpuTreeNode, error) {
+	if nameFunc == nil {
+		nameFunc = defaultCpuTreeName
+	}
+	names := map[string]struct{}{"system": {}}
+	uniqueName := func(level CPUTopologyLevel, ids ...int) (string, error) {
+		name := nameFunc(level, ids...)
+		if _, ok := names[name]; ok {
+			return "", fmt.Errorf("duplicate CPU tree node name %q on level %s %v", name, level, ids)
+		}
+		names[name] = struct{}{}
+		return name, nil
+	}
 	// TODO: split deep nested loops into functions
 	sysTree := NewCpuTree("system")
 	sysTree.sys = sys
 	sysTree.level = CPUTopologyLevelSystem
+	nohzFullCpus := sys.NohzFullCPUs()
 	for _, packageID := range sys.PackageIDs() {
-		packageTree := NewCpuTree(fmt.Sprintf("p%d", packageID))
+		name, err := uniqueName(CPUTopologyLevelPackage, packageID)
+		if err != nil {
+			return nil, err
+		}
+		packageTree := NewCpuTree(name)
 		packageTree.level = CPUTopologyLevelPackage
+		packageTree.id = packageID
 		cpuPackage := sys.Package(packageID)
 		sysTree.AddChild(packageTree)
 		for _, dieID := range cpuPackage.DieIDs() {
-			dieTree := NewCpuTree(fmt.Sprintf("p%dd%d", packageID, dieID))
+			name, err := uniqueName(CPUTopologyLevelDie, packageID, dieID)
+			if err != nil {
+				return nil, err
+			}
+			dieTree := NewCpuTree(name)
 			dieTree.level = CPUTopologyLevelDie
+			dieTree.id = dieID
 			packageTree.AddChild(dieTree)
 			for _, nodeID := range cpuPackage.DieNodeIDs(dieID) {
-				nodeTree := NewCpuTree(fmt.Sprintf("p%dd%dn%d", packageID, dieID, nodeID))
+				name, err := uniqueName(CPUTopologyLevelNuma, packageID, dieID, nodeID)
+				if err != nil {
+					return nil, err
+				}
+				nodeTree := NewCpuTree(name)
 				nodeTree.level = CPUTopologyLevelNuma
+				nodeTree.id = nodeID
 				dieTree.AddChild(nodeTree)
 				node := sys.Node(nodeID)
 				threadsSeen := map[int]struct{}{}
@@ -275,60 +1209,288 @@ func NewCpuTreeFromSystem() (*cpuTreeNode, error) {
 					if _, alreadySeen := threadsSeen[cpuID]; alreadySeen {
 						continue
 					}
-					cpuTree := NewCpuTree(fmt.Sprintf("p%dd%dn%dcpu%d", packageID, dieID, nodeID, cpuID))
+					onlineThreads := []int{}
+					for _, threadID := range sys.CPU(cpuID).ThreadCPUSet().List() {
+						threadsSeen[threadID] = struct{}{}
+						if sys.CPU(threadID).Online() {
+							onlineThreads = append(onlineThreads, threadID)
+						}
+					}
+					if len(onlineThreads) == 0 {
+						continue
+					}
+					name, err := uniqueName(CPUTopologyLevelCore, packageID, dieID, nodeID, cpuID)
+					if err != nil {
+						return nil, err
+					}
+					cpuTree := NewCpuTree(name)
 
 					cpuTree.level = CPUTopologyLevelCore
+					cpuTree.id = cpuID
 					nodeTree.AddChild(cpuTree)
-					cpu := sys.CPU(cpuID)
-					for _, threadID := range cpu.ThreadCPUSet().List() {
-						threadsSeen[threadID] = struct{}{}
-						threadTree := NewCpuTree(fmt.Sprintf("p%dd%dn%dcpu%dt%d", packageID, dieID, nodeID, cpuID, threadID))
+					for _, threadID := range onlineThreads {
+						name, err := uniqueName(CPUTopologyLevelThread, packageID, dieID, nodeID, cpuID, threadID)
+						if err != nil {
+							return nil, err
+						}
+						threadTree := NewCpuTree(name)
 						threadTree.level = CPUTopologyLevelThread
+						threadTree.id = threadID
+						threadTree.maxFreqKHz = sys.CPU(threadID).FrequencyRange().Max()
+						threadTree.capacity = sys.CPU(threadID).Capacity()
+						if llcs := sys.CPU(threadID).GetLastLevelCaches(); len(llcs) > 0 {
+							threadTree.cacheId = llcs[0].ID()
+						}
+						threadTree.cacheIds = cacheIdsByLevel(sys.CPU(threadID))
+						threadTree.nohzFull = nohzFullCpus.Contains(threadID)
+						if threadTree.maxFreqKHz > cpuTree.maxFreqKHz {
+							cpuTree.maxFreqKHz = threadTree.maxFreqKHz
+						}
 						cpuTree.AddChild(threadTree)
 						threadTree.AddCpus(cpuset.New(threadID))
 					}
 				}
+				// Online CPUs of the node that are not in
+				// the tree lack thread sibling information.
+				// Add each of them as a single-thread core.
+				for _, cpuID := range node.CPUSet().Difference(nodeTree.cpus).List() {
+					if !sys.CPU(cpuID).Online() {
+						continue
+					}
+					if err := addFallbackCore(nodeTree, sys, cpuID, func(level CPUTopologyLevel, ids ...int) (string, error) {
+						return uniqueName(level, append([]int{packageID, dieID, nodeID}, ids...)...)
+					}); err != nil {
+						return nil, err
+					}
+				}
 			}
 		}
 	}
+	orphans := []int{}
+	for _, cpuID := range sys.CPUIDs() {
+		if sys.CPU(cpuID).Online() && !sysTree.cpus.Contains(cpuID) {
+			orphans = append(orphans, cpuID)
+		}
+	}
+	if len(orphans) > 0 {
+		return nil, fmt.Errorf("online CPUs %q are not in any NUMA node of the CPU tree", cpuset.New(orphans...))
+	}
 	return sysTree, nil
 }
 
-// ToAttributedSlice returns a CPU tree node and recursively all its
-// child nodes in a slice that contains nodes with their attributes
-// for allocation/releasing comparison.
-// - currentCpus is the set of CPUs that can be freed in coming operation
-// - freeCpus is the set of CPUs that can be allocated in coming operation
-// - filter(tna) returns false if the node can be ignored
-func (t *cpuTreeNode) ToAttributedSlice(
-	currentCpus, freeCpus cpuset.CPUSet,
-	filter func(*cpuTreeNodeAttributes) bool) []cpuTreeNodeAttributes {
-	tnas := []cpuTreeNodeAttributes{}
-	currentCpuCounts := []int{}
-	freeCpuCounts := []int{}
-	t.toAttributedSlice(currentCpus, freeCpus, filter, &tnas, 0, currentCpuCounts, freeCpuCounts)
-	return tnas
+// addFallbackCore adds an online CPU whose thread siblings are unknown
+// as a single-thread core under a NUMA node.
+func addFallbackCore(nodeTree *cpuTreeNode, sys system.System, cpuID int, uniqueName func(CPUTopologyLevel, ...int) (string, error)) error {
+	log.Warnf("CPU %d: missing thread sibling information, adding it as a single-thread core", cpuID)
+	name, err := uniqueName(CPUTopologyLevelCore, cpuID)
+	if err != nil {
+		return err
+	}
+	cpuTree := NewCpuTree(name)
+	cpuTree.level = CPUTopologyLevelCore
+	cpuTree.id = cpuID
+	nodeTree.AddChild(cpuTree)
+	if name, err = uniqueName(CPUTopologyLevelThread, cpuID, cpuID); err != nil {
+		return err
+	}
+	threadTree := NewCpuTree(name)
+	threadTree.level = CPUTopologyLevelThread
+	threadTree.id = cpuID
+	threadTree.maxFreqKHz = sys.CPU(cpuID).FrequencyRange().Max()
+	threadTree.capacity = sys.CPU(cpuID).Capacity()
+	cpuTree.maxFreqKHz = threadTree.maxFreqKHz
+	if llcs := sys.CPU(cpuID).GetLastLevelCaches(); len(llcs) > 0 {
+		threadTree.cacheId = llcs[0].ID()
+	}
+	threadTree.cacheIds = cacheIdsByLevel(sys.CPU(cpuID))
+	threadTree.nohzFull = sys.NohzFullCPUs().Contains(cpuID)
+	cpuTree.AddChild(threadTree)
+	threadTree.AddCpus(cpuset.New(cpuID))
+	return nil
 }
 
-func (t *cpuTreeNode) toAttributedSlice(
-	currentCpus, freeCpus cpuset.CPUSet,
-	filter func(*cpuTreeNodeAttributes) bool,
-	tnas *[]cpuTreeNodeAttributes,
-	depth int,
-	currentCpuCounts []int,
-	freeCpuCounts []int) {
-	currentCpusHere := t.cpus.Intersection(currentCpus)
-	freeCpusHere := t.cpus.Intersection(freeCpus)
-	currentCpuCountHere := currentCpusHere.Size()
-	currentCpuCountsHere := make([]int, len(currentCpuCounts)+1, len(currentCpuCounts)+1)
-	copy(currentCpuCountsHere, currentCpuCounts)
+// cacheIdsByLevel returns the ids of data and unified caches of a
+// CPU by cache level.
+func cacheIdsByLevel(cpu system.CPU) map[int]int {
+	var ids map[int]int
+	for _, c := range cpu.GetCaches() {
+		if c.Type() == system.InstructionCache {
+			continue
+		}
+		if ids == nil {
+			ids = map[int]int{}
+		}
+		ids[c.Level()] = c.ID()
+	}
+	return ids
+}
+
+// cpuTreeSnapshotVersion is the version of the CPU tree snapshot
+// format. Loading a snapshot of another version fails.
+const cpuTreeSnapshotVersion = 1
+
+// cpuTreeSnapshot is the serialized form of a CPU tree.
+type cpuTreeSnapshot struct {
+	Version int                  `json:"version"`
+	Root    *cpuTreeNodeSnapshot `json:"root"`
+}
+
+// cpuTreeNodeSnapshot is the serialized form of a CPU tree node. Only
+// leaf nodes store CPUs, CPUs of other nodes are unions of CPUs of
+// their children.
+type cpuTreeNodeSnapshot struct {
+	Name       string                 `json:"name"`
+	Level      CPUTopologyLevel       `json:"level"`
+	ID         int                    `json:"id"`
+	MaxFreqKHz uint64                 `json:"maxFreqKHz,omitempty"`
+	Capacity   uint64                 `json:"capacity,omitempty"`
+	CacheID    int                    `json:"cacheId"`
+	CacheIDs   map[int]int            `json:"cacheIds,omitempty"`
+	NohzFull   bool                   `json:"nohzFull,omitempty"`
+	Cpus       string                 `json:"cpus,omitempty"`
+	Children   []*cpuTreeNodeSnapshot `json:"children,omitempty"`
+}
+
+func (t *cpuTreeNode) snapshot() *cpuTreeNodeSnapshot {
+	s := &cpuTreeNodeSnapshot{
+		Name:       t.name,
+		Level:      t.level,
+		ID:         t.id,
+		MaxFreqKHz: t.maxFreqKHz,
+		Capacity:   t.capacity,
+		CacheID:    t.cacheId,
+		CacheIDs:   t.cacheIds,
+		NohzFull:   t.nohzFull,
+	}
+	if len(t.children) == 0 {
+		s.Cpus = t.cpus.String()
+	}
+	for _, child := range t.children {
+		s.Children = append(s.Children, child.snapshot())
+	}
+	return s
+}
+
+// SaveSnapshot writes the CPU tree rooted at this node to a file in
+// JSON. The tree can be reconstructed with LoadCpuTreeSnapshot.
+func (t *cpuTreeNode) SaveSnapshot(path string) error {
+	data, err := json.MarshalIndent(cpuTreeSnapshot{
+		Version: cpuTreeSnapshotVersion,
+		Root:    t.snapshot(),
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal CPU tree snapshot: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to save CPU tree snapshot: %w", err)
+	}
+	return nil
+}
+
+// LoadCpuTreeSnapshot returns the root node of a CPU tree read from a
+// file written by SaveSnapshot. The returned tree is not associated
+// with a system, so allocators on it cannot use device hints.
+func LoadCpuTreeSnapshot(path string) (*cpuTreeNode, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load CPU tree snapshot: %w", err)
+	}
+	snapshot := cpuTreeSnapshot{}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to parse CPU tree snapshot %q: %w", path, err)
+	}
+	if snapshot.Version != cpuTreeSnapshotVersion {
+		return nil, fmt.Errorf("unsupported CPU tree snapshot version %d in %q, expected %d",
+			snapshot.Version, path, cpuTreeSnapshotVersion)
+	}
+	if snapshot.Root == nil {
+		return nil, fmt.Errorf("CPU tree snapshot %q has no root", path)
+	}
+	root := NewCpuTree(snapshot.Root.Name)
+	if err := root.loadSnapshot(snapshot.Root); err != nil {
+		return nil, fmt.Errorf("invalid CPU tree snapshot %q: %w", path, err)
+	}
+	return root, nil
+}
+
+// loadSnapshot sets attributes of this node and creates its children
+// from a snapshot. CPUs of leaf nodes are added to all their parents.
+func (t *cpuTreeNode) loadSnapshot(s *cpuTreeNodeSnapshot) error {
+	t.level = s.Level
+	t.id = s.ID
+	t.maxFreqKHz = s.MaxFreqKHz
+	t.capacity = s.Capacity
+	t.cacheId = s.CacheID
+	t.cacheIds = s.CacheIDs
+	t.nohzFull = s.NohzFull
+	if len(s.Children) == 0 {
+		cpus, err := cpuset.Parse(s.Cpus)
+		if err != nil {
+			return fmt.Errorf("node %q: invalid cpus %q: %w", s.Name, s.Cpus, err)
+		}
+		t.AddCpus(cpus)
+		return nil
+	}
+	for _, cs := range s.Children {
+		if cs == nil {
+			return fmt.Errorf("node %q: nil child", s.Name)
+		}
+		child := NewCpuTree(cs.Name)
+		t.AddChild(child)
+		if err := child.loadSnapshot(cs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ToAttributedSlice returns a CPU tree node and recursively all its
+// child nodes in a slice that contains nodes with their attributes
+// for allocation/releasing comparison.
+// - currentCpus is the set of CPUs that can be freed in coming operation
+// - freeCpus is the set of CPUs that can be allocated in coming operation
+// - filter(tna) returns false if the node can be ignored
+func (t *cpuTreeNode) ToAttributedSlice(
+	currentCpus, freeCpus cpuset.CPUSet,
+	filter func(*cpuTreeNodeAttributes) bool) []cpuTreeNodeAttributes {
+	return t.toAttributedSliceBuf(&cpuTreeAttrBuffer{}, currentCpus, freeCpus, filter)
+}
+
+// toAttributedSliceBuf is ToAttributedSlice using scratch space from
+// buf. The returned slice, and the count and level slices of its
+// elements, are valid only until buf is released.
+func (t *cpuTreeNode) toAttributedSliceBuf(
+	buf *cpuTreeAttrBuffer,
+	currentCpus, freeCpus cpuset.CPUSet,
+	filter func(*cpuTreeNodeAttributes) bool) []cpuTreeNodeAttributes {
+	t.toAttributedSlice(buf, currentCpus, freeCpus, filter, 0, nil, nil, nil)
+	return buf.tnas
+}
+
+func (t *cpuTreeNode) toAttributedSlice(
+	buf *cpuTreeAttrBuffer,
+	currentCpus, freeCpus cpuset.CPUSet,
+	filter func(*cpuTreeNodeAttributes) bool,
+	depth int,
+	currentCpuCounts []int,
+	freeCpuCounts []int,
+	levels []CPUTopologyLevel) {
+	currentCpusHere := intersectCpus(t.cpus, currentCpus)
+	freeCpusHere := intersectCpus(t.cpus, freeCpus)
+	currentCpuCountHere := currentCpusHere.Size()
+	currentCpuCountsHere := buf.ints(len(currentCpuCounts) + 1)
+	copy(currentCpuCountsHere, currentCpuCounts)
 	currentCpuCountsHere[depth] = currentCpuCountHere
 
 	freeCpuCountHere := freeCpusHere.Size()
-	freeCpuCountsHere := make([]int, len(freeCpuCounts)+1, len(freeCpuCounts)+1)
+	freeCpuCountsHere := buf.ints(len(freeCpuCounts) + 1)
 	copy(freeCpuCountsHere, freeCpuCounts)
 	freeCpuCountsHere[depth] = freeCpuCountHere
 
+	levelsHere := buf.levelSlice(len(levels) + 1)
+	copy(levelsHere, levels)
+	levelsHere[depth] = t.level
+
 	tna := cpuTreeNodeAttributes{
 		t:                t,
 		depth:            depth,
@@ -338,19 +1500,88 @@ func (t *cpuTreeNode) toAttributedSlice(
 		currentCpuCounts: currentCpuCountsHere,
 		freeCpuCount:     freeCpuCountHere,
 		freeCpuCounts:    freeCpuCountsHere,
+		levels:           levelsHere,
 	}
 
 	if filter != nil && !filter(&tna) {
 		return
 	}
 
-	*tnas = append(*tnas, tna)
+	buf.tnas = append(buf.tnas, tna)
 	for _, child := range t.children {
-		child.toAttributedSlice(currentCpus, freeCpus, filter,
-			tnas, depth+1, currentCpuCountsHere, freeCpuCountsHere)
+		child.toAttributedSlice(buf, currentCpus, freeCpus, filter,
+			depth+1, currentCpuCountsHere, freeCpuCountsHere, levelsHere)
 	}
 }
 
+// intersectCpus returns the intersection of node CPUs and a set of
+// CPUs. CPU sets are immutable, so the common cases of an empty set or
+// a node completely inside the set avoid allocating a new set.
+func intersectCpus(nodeCpus, cpus cpuset.CPUSet) cpuset.CPUSet {
+	if cpus.IsEmpty() {
+		return cpus
+	}
+	if nodeCpus.IsSubsetOf(cpus) {
+		return nodeCpus
+	}
+	return nodeCpus.Intersection(cpus)
+}
+
+// cpuTreeAttrBuffer is scratch space for building attributed slices
+// of a CPU tree. The per-node count and level slices are carved from
+// shared backing arrays instead of being allocated one by one.
+type cpuTreeAttrBuffer struct {
+	tnas   []cpuTreeNodeAttributes
+	counts []int
+	levels []CPUTopologyLevel
+}
+
+// cpuTreeAttrBufferPool recycles attributed slice buffers between
+// resizes.
+var cpuTreeAttrBufferPool = sync.Pool{
+	New: func() any { return &cpuTreeAttrBuffer{} },
+}
+
+// getCpuTreeAttrBuffer returns an empty buffer from the pool.
+func getCpuTreeAttrBuffer() *cpuTreeAttrBuffer {
+	return cpuTreeAttrBufferPool.Get().(*cpuTreeAttrBuffer)
+}
+
+// release resets the buffer and returns it to the pool. Nothing
+// obtained from the buffer may be used after this.
+func (buf *cpuTreeAttrBuffer) release() {
+	// Drop references to tree nodes and CPU sets.
+	clear(buf.tnas)
+	buf.tnas = buf.tnas[:0]
+	buf.counts = buf.counts[:0]
+	buf.levels = buf.levels[:0]
+	cpuTreeAttrBufferPool.Put(buf)
+}
+
+// ints returns a slice of n ints from the buffer. The slice is capped
+// so that appending to it cannot overwrite other slices.
+func (buf *cpuTreeAttrBuffer) ints(n int) []int {
+	l := len(buf.counts)
+	if cap(buf.counts)-l < n {
+		// Earlier slices keep referring to the old backing array.
+		buf.counts = make([]int, 0, max(max(2*cap(buf.counts), n), 64))
+		l = 0
+	}
+	buf.counts = buf.counts[:l+n]
+	return buf.counts[l : l+n : l+n]
+}
+
+// levelSlice returns a slice of n topology levels from the buffer.
+func (buf *cpuTreeAttrBuffer) levelSlice(n int) []CPUTopologyLevel {
+	l := len(buf.levels)
+	if cap(buf.levels)-l < n {
+		buf.levels = make([]CPUTopologyLevel, 0, max(max(2*cap(buf.levels), n), 64))
+		l = 0
+	}
+	buf.levels = buf.levels[:l+n]
+	return buf.levels[l : l+n : l+n]
+}
+
 // SplitLevel returns the root node of a new CPU tree where all
 // branches of a topology level have been split into new classes.
 func (t *cpuTreeNode) SplitLevel(splitLevel CPUTopologyLevel, cpuClassifier func(int) int) *cpuTreeNode {
@@ -383,23 +1614,12 @@ func (t *cpuTreeNode) SplitLevel(splitLevel CPUTopologyLevel, cpuClassifier func
 				newChild := child.CopyTree()
 				newChild.DepthFirstWalk(func(cn *cpuTreeNode) error {
 					cn.cpus = cn.cpus.Intersection(cpuMask)
-					if cn.cpus.Size() == 0 && cn.parent != nil {
-						// all cpus masked
-						// out: cut out this
-						// branch
-						newSiblings := []*cpuTreeNode{}
-						for _, child := range cn.parent.children {
-							if child != cn {
-								newSiblings = append(newSiblings, child)
-							}
-						}
-						cn.parent.children = newSiblings
-						return WalkSkipChildren
-					}
 					return nil
 				})
 				newNode.AddChild(newChild)
 			}
+			// Cut out branches whose all cpus were masked out.
+			newNode.Prune()
 		}
 		return WalkSkipChildren
 	})
@@ -407,17 +1627,27 @@ func (t *cpuTreeNode) SplitLevel(splitLevel CPUTopologyLevel, cpuClassifier func
 }
 
 // NewAllocator returns new CPU allocator for allocating CPUs from a
-// CPU tree branch.
+// CPU tree branch. The allocator of a branch below the root, like a
+// package or a NUMA node, never allocates or releases CPUs outside
+// the branch, even if they are given to it as free or current CPUs.
 func (t *cpuTreeNode) NewAllocator(options cpuTreeAllocatorOptions) *cpuTreeAllocator {
 	ta := &cpuTreeAllocator{
-		root:    t,
-		options: options,
+		root:         t,
+		topologyRoot: t,
+		options:      options,
+		bootCpu:      t.BootCpu(),
 	}
 	if options.virtDevCpusets == nil {
 		ta.cacheCloseCpuSets = map[string][]cpuset.CPUSet{}
 	} else {
 		ta.cacheCloseCpuSets = options.virtDevCpusets
 	}
+	if options.deviceHints == nil {
+		ta.options.deviceHints = newDeviceHintCache()
+	}
+	if options.cpuModes == nil {
+		ta.options.cpuModes = newCpuModeMap(nil)
+	}
 	if options.preferSpreadOnPhysicalCores {
 		newTree := t.SplitLevel(CPUTopologyLevelNuma,
 			// CPU classifier: class of the CPU equals to
@@ -449,6 +1679,10 @@ func (ta *cpuTreeAllocator) sorterAllocate(tnas []cpuTreeNodeAttributes) func(in
 			// After this currentCpus will increase.
 			// Maximize the maximal amount of currentCpus
 			// as high level in the topology as possible.
+			// The core level comes after package, die and
+			// NUMA node levels, so among equally good NUMA
+			// nodes a free hyperthread next to a current CPU
+			// fills that core before opening a new one.
 			if tnas[i].currentCpuCounts[tdepth] != tnas[j].currentCpuCounts[tdepth] {
 				return tnas[i].currentCpuCounts[tdepth] > tnas[j].currentCpuCounts[tdepth]
 			}
@@ -465,6 +1699,16 @@ func (ta *cpuTreeAllocator) sorterAllocate(tnas []cpuTreeNodeAttributes) func(in
 				}
 			}
 		}
+		if ta.options.preferHighFreq {
+			if freqI, freqJ := tnas[i].t.MaxFreqKHz(), tnas[j].t.MaxFreqKHz(); freqI != freqJ {
+				return freqI > freqJ
+			}
+		}
+		if ta.options.preferLeastRecentlyUsed {
+			if usedI, usedJ := ta.lastUsed(tnas[i].freeCpus), ta.lastUsed(tnas[j].freeCpus); !usedI.Equal(usedJ) {
+				return usedI.Before(usedJ)
+			}
+		}
 		return tnas[i].t.name < tnas[j].t.name
 	}
 }
@@ -511,8 +1755,15 @@ func (ta *cpuTreeAllocator) sorterRelease(tnas []cpuTreeNodeAttributes) func(int
 //
 // Parameters:
 //   - currentCpus: a set of CPUs to/from which CPUs would be added/removed.
-//   - freeCpus: a set of CPUs available CPUs.
+//   - freeCpus: a set of CPUs available CPUs. If freeCpus is
+//     freeCpusFromProvider, free CPUs are queried from the
+//     freeCpusProvider in allocator options instead.
 //   - delta: number of CPUs to add (if positive) or remove (if negative).
+//     If sizeByCapacity is set in allocator options, delta is the
+//     capacity to add or remove in units of cpuCapacityScale. Added
+//     capacity is rounded up to the smallest set of CPUs that has at
+//     least delta capacity, and removed capacity is rounded down: at
+//     most abs(delta) capacity is removed.
 //
 // Return values:
 //   - addFromCpus contains free CPUs from which delta CPUs can be
@@ -520,34 +1771,1200 @@ func (ta *cpuTreeAllocator) sorterRelease(tnas []cpuTreeNodeAttributes) func(int
 //     delta: there is room for other allocation logic to select from
 //     these CPUs.
 //   - removeFromCpus contains CPUs in currentCpus set from which
-//     abs(delta) CPUs can be freed.
+//     abs(delta) CPUs can be freed. If shrinkReluctance is set in
+//     allocator options, releases are reduced by shrinkReluctance
+//     CPUs and removeFromCpus contains exactly the CPUs to be
+//     freed. Then a removeFromCpus smaller than abs(delta) means
+//     that the caller should free only the CPUs in it, and an empty
+//     removeFromCpus means that nothing should be freed.
+//   - If sizeByCapacity is set, addFromCpus and removeFromCpus
+//     contain exactly the CPUs to be allocated and freed.
+//   - If preferLeastRecentlyUsed is set, addFromCpus contains
+//     exactly the delta least recently used CPUs among equally good
+//     choices.
+//   - Otherwise, if preferContiguousIds is set, addFromCpus contains
+//     exactly the delta CPUs among equally good choices that form
+//     the longest runs of consecutive ids with currentCpus.
+//
+// Neither of the returned sets contains any of the reservedCpus in
+// allocator options, nor CPUs outside the branch of the allocator.
 func (ta *cpuTreeAllocator) ResizeCpus(currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error) {
-	resizers := []cpuResizerFunc{
-		ta.resizeCpusOnlyIfNecessary,
-		ta.resizeCpusWithDevices,
-		ta.resizeCpusOneAtATime,
-		ta.resizeCpusMaxLocalSet,
-		ta.resizeCpusNow}
-	return ta.nextCpuResizer(resizers, currentCpus, freeCpus, delta)
+	freeCpus, err := ta.resolveFreeCpus(freeCpus)
+	if err != nil {
+		return emptyCpuSet, emptyCpuSet, err
+	}
+	currentCpus, freeCpus = ta.usableCpus(currentCpus), ta.usableCpus(freeCpus)
+	if ta.options.sizeByCapacity {
+		return ta.resizeCpusByCapacity(currentCpus, freeCpus, delta)
+	}
+	return ta.resizeCpuCount(currentCpus, freeCpus, delta)
+}
+
+// ResizeCpusDebug resizes like ResizeCpus, and logs the details of
+// the resize, like the steps of the resizer chain, at info level.
+// Other calls are not affected, and the log level is not changed.
+// This helps debugging the allocations of a single balloon without
+// debug logs of all of them.
+func (ta *cpuTreeAllocator) ResizeCpusDebug(currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error) {
+	debugTa := *ta
+	debugTa.debugCall = true
+	debugTa.debugf("resize(%q, %q, %d)", currentCpus, freeCpus, delta)
+	addFromCpus, removeFromCpus, err := debugTa.ResizeCpus(currentCpus, freeCpus, delta)
+	debugTa.debugf("resize(%q, %q, %d) = %q, %q, %v", currentCpus, freeCpus, delta, addFromCpus, removeFromCpus, err)
+	return addFromCpus, removeFromCpus, err
+}
+
+// debugf logs the details of allocator calls. They are logged at
+// info level in ResizeCpusDebug, otherwise at debug level.
+func (ta *cpuTreeAllocator) debugf(format string, args ...interface{}) {
+	if ta.debugCall {
+		log.Infof("[resize debug] "+format, args...)
+		return
+	}
+	log.Debugf(format, args...)
+}
+
+// usableCpus returns those cpus that the allocator may allocate or
+// release: CPUs in the branch of the allocator, except reservedCpus.
+func (ta *cpuTreeAllocator) usableCpus(cpus cpuset.CPUSet) cpuset.CPUSet {
+	if !cpus.IsSubsetOf(ta.topologyRoot.cpus) {
+		cpus = cpus.Intersection(ta.topologyRoot.cpus)
+	}
+	if ta.options.reservedCpus.Size() > 0 {
+		cpus = cpus.Difference(ta.options.reservedCpus)
+	}
+	return cpus
+}
+
+// resolveFreeCpus returns the free CPUs from the freeCpusProvider if
+// freeCpus is the freeCpusFromProvider sentinel, otherwise freeCpus.
+func (ta *cpuTreeAllocator) resolveFreeCpus(freeCpus cpuset.CPUSet) (cpuset.CPUSet, error) {
+	if !freeCpus.Equals(freeCpusFromProvider) {
+		return freeCpus, nil
+	}
+	if ta.options.freeCpusProvider == nil {
+		return emptyCpuSet, fmt.Errorf("free CPUs requested from a provider, but no provider is set")
+	}
+	return ta.options.freeCpusProvider(), nil
+}
+
+// resizeCpuCount returns CPUs from which delta CPUs can be allocated
+// or released.
+func (ta *cpuTreeAllocator) resizeCpuCount(currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error) {
+	if delta < 0 && ta.options.shrinkReluctance > 0 {
+		return ta.resizeCpusReluctantly(currentCpus, freeCpus, delta)
+	}
+	resizers := ta.resizers(ta.resizeCpusNow)
+	addFromCpus, removeFromCpus, err := ta.nextCpuResizer(resizers, currentCpus, freeCpus, delta)
+	if err == nil && delta > 0 && ta.options.preferLeastRecentlyUsed {
+		addFromCpus = ta.leastRecentlyUsed(addFromCpus, delta)
+	} else if err == nil && delta > 0 && ta.options.preferContiguousIds {
+		addFromCpus = contiguousIds(currentCpus, addFromCpus, delta)
+	}
+	if err == nil && ta.options.verify {
+		err = verifyResize(currentCpus, freeCpus, delta, addFromCpus, removeFromCpus)
+	}
+	return addFromCpus, removeFromCpus, err
+}
+
+// leastRecentlyUsed returns n CPUs of cpus that were allocated least
+// recently. Never allocated CPUs come first, ties are broken by CPU id.
+func (ta *cpuTreeAllocator) leastRecentlyUsed(cpus cpuset.CPUSet, n int) cpuset.CPUSet {
+	if cpus.Size() <= n {
+		return cpus
+	}
+	lru := cpus.List()
+	sort.SliceStable(lru, func(i, j int) bool {
+		return ta.cpuLastUsed[lru[i]].Before(ta.cpuLastUsed[lru[j]])
+	})
+	return cpuset.New(lru[:n]...)
+}
+
+// contiguousIds returns n CPUs of cpus that form the longest runs of
+// consecutive CPU ids together with currentCpus. CPUs are picked one
+// run at a time, ties are broken by the lowest id.
+func contiguousIds(currentCpus, cpus cpuset.CPUSet, n int) cpuset.CPUSet {
+	if cpus.Size() <= n {
+		return cpus
+	}
+	picked := []int{}
+	current := currentCpus
+	left := cpus
+	for len(picked) < n {
+		bestLen, bestRun := -1, []int(nil)
+		for _, start := range left.List() {
+			// Extend the run down through current CPUs, and up
+			// through current and candidate CPUs until enough
+			// candidates have been taken.
+			first := start
+			for current.Contains(first - 1) {
+				first--
+			}
+			run := []int{}
+			last := start
+			for id := start; len(picked)+len(run) < n || current.Contains(id); id++ {
+				if left.Contains(id) && len(picked)+len(run) < n {
+					run = append(run, id)
+				} else if !current.Contains(id) {
+					break
+				}
+				last = id
+			}
+			if runLen := last - first + 1; runLen > bestLen {
+				bestLen, bestRun = runLen, run
+			}
+		}
+		picked = append(picked, bestRun...)
+		current = current.Union(cpuset.New(bestRun...))
+		left = left.Difference(cpuset.New(bestRun...))
+	}
+	return cpuset.New(picked...)
+}
+
+// lastUsed returns the latest time when any of cpus was allocated.
+func (ta *cpuTreeAllocator) lastUsed(cpus cpuset.CPUSet) time.Time {
+	latest := time.Time{}
+	for _, cpu := range cpus.UnsortedList() {
+		if t := ta.cpuLastUsed[cpu]; t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
+
+// MarkCpusUsed records that cpus have been allocated now. Allocate
+// does this automatically, callers that allocate CPUs returned by
+// ResizeCpus should call it for preferLeastRecentlyUsed to work.
+func (ta *cpuTreeAllocator) MarkCpusUsed(cpus cpuset.CPUSet) {
+	ta.markCpusUsedAt(cpus, time.Now())
+}
+
+// markCpusUsedAt records that cpus were allocated at time t.
+func (ta *cpuTreeAllocator) markCpusUsedAt(cpus cpuset.CPUSet, t time.Time) {
+	if ta.cpuLastUsed == nil {
+		ta.cpuLastUsed = map[int]time.Time{}
+	}
+	for _, cpu := range cpus.UnsortedList() {
+		ta.cpuLastUsed[cpu] = t
+	}
+}
+
+// CpuLastUsed returns the times when CPUs were last allocated. CPUs
+// that have never been allocated are not included.
+func (ta *cpuTreeAllocator) CpuLastUsed() map[int]time.Time {
+	lastUsed := make(map[int]time.Time, len(ta.cpuLastUsed))
+	for cpu, t := range ta.cpuLastUsed {
+		lastUsed[cpu] = t
+	}
+	return lastUsed
+}
+
+// SetCpuLastUsed sets the times when CPUs were last allocated, for
+// instance to restore them after a restart.
+func (ta *cpuTreeAllocator) SetCpuLastUsed(lastUsed map[int]time.Time) {
+	ta.cpuLastUsed = make(map[int]time.Time, len(lastUsed))
+	for cpu, t := range lastUsed {
+		ta.cpuLastUsed[cpu] = t
+	}
+}
+
+// resizeCpusByCapacity returns exactly the CPUs to be added or
+// removed in order to change capacity of currentCpus by delta
+// capacity units. CPUs are chosen one at a time by the CPU resizers,
+// so all allocator options apply to every chosen CPU.
+func (ta *cpuTreeAllocator) resizeCpusByCapacity(currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error) {
+	addCpus, removeCpus := cpuset.New(), cpuset.New()
+	switch {
+	case delta > 0:
+		added := 0
+		for added < delta {
+			addFromCpus, _, err := ta.resizeCpuCount(currentCpus, freeCpus, 1)
+			if err != nil {
+				return emptyCpuSet, emptyCpuSet, fmt.Errorf("failed to allocate capacity %d (allocated %d): %w", delta, added, err)
+			}
+			if addFromCpus.IsEmpty() {
+				return emptyCpuSet, emptyCpuSet, fmt.Errorf("not enough free CPUs to allocate capacity %d (allocated %d)", delta, added)
+			}
+			cpu := addFromCpus.List()[0]
+			added += ta.cpuCapacity(cpu)
+			addCpus = addCpus.Union(cpuset.New(cpu))
+			currentCpus = currentCpus.Union(cpuset.New(cpu))
+			freeCpus = freeCpus.Difference(cpuset.New(cpu))
+		}
+		ta.debugf("- allocating capacity %d: %d on cpus %s", delta, added, addCpus)
+	case delta < 0:
+		release := -delta - ta.options.shrinkReluctance
+		released := 0
+		for released < release && !currentCpus.IsEmpty() {
+			_, removeFromCpus, err := ta.nextCpuResizer(ta.resizers(ta.resizeCpusNow), currentCpus, freeCpus, -1)
+			if err != nil {
+				return emptyCpuSet, emptyCpuSet, fmt.Errorf("failed to release capacity %d (released %d): %w", -delta, released, err)
+			}
+			// Release the first CPU preferred by the resizers that
+			// does not release too much capacity, or any other
+			// such CPU if all preferred ones are too big.
+			cpu := -1
+			for _, candidate := range append(removeFromCpus.List(), currentCpus.List()...) {
+				if released+ta.cpuCapacity(candidate) <= release {
+					cpu = candidate
+					break
+				}
+			}
+			if cpu == -1 {
+				break
+			}
+			released += ta.cpuCapacity(cpu)
+			removeCpus = removeCpus.Union(cpuset.New(cpu))
+			currentCpus = currentCpus.Difference(cpuset.New(cpu))
+			freeCpus = freeCpus.Union(cpuset.New(cpu))
+		}
+		ta.debugf("- releasing capacity %d: %d on cpus %s", -delta, released, removeCpus)
+	}
+	return addCpus, removeCpus, nil
+}
+
+// cpuCapacity returns the capacity of a CPU.
+func (ta *cpuTreeAllocator) cpuCapacity(cpu int) int {
+	if leaf := ta.topologyRoot.FindLeafWithCpu(cpu); leaf != nil && leaf.capacity > 0 {
+		return int(leaf.capacity)
+	}
+	return cpuCapacityScale
+}
+
+// resizeCpusReluctantly releases abs(delta)-shrinkReluctance CPUs,
+// or nothing if the balloon is not over-provisioned by more than
+// shrinkReluctance CPUs.
+func (ta *cpuTreeAllocator) resizeCpusReluctantly(currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error) {
+	release := -delta - ta.options.shrinkReluctance
+	if release <= 0 {
+		ta.debugf("- keeping %d over-provisioned CPUs, shrink reluctance %d", -delta, ta.options.shrinkReluctance)
+		return emptyCpuSet, emptyCpuSet, nil
+	}
+	ta.debugf("- releasing %d instead of %d CPUs, shrink reluctance %d", release, -delta, ta.options.shrinkReluctance)
+	resizers := ta.resizers(ta.resizeCpusNow)
+	addFromCpus, removeFromCpus, err := ta.nextCpuResizer(resizers, currentCpus, freeCpus, -release)
+	if err == nil && ta.options.verify {
+		err = verifyResize(currentCpus, freeCpus, -release, addFromCpus, removeFromCpus)
+	}
+	if err != nil {
+		return addFromCpus, removeFromCpus, err
+	}
+	if removeFromCpus.Size() > release {
+		removeFromCpus = cpuset.New(removeFromCpus.List()[:release]...)
+	}
+	return addFromCpus, removeFromCpus, nil
+}
+
+// resizers returns the chain of CPU resizers ending with the
+// terminal resizer.
+func (ta *cpuTreeAllocator) resizers(terminal cpuResizerFunc) []cpuResizerFunc {
+	// Stages of options that are not set would only pass
+	// resizing on to the next stage, so they are left out of
+	// the chain.
+	opts := ta.options
+	optional := func(enabled bool, resizer cpuResizerFunc) []cpuResizerFunc {
+		if enabled {
+			return []cpuResizerFunc{resizer}
+		}
+		return nil
+	}
+	return slices.Concat(
+		optional(opts.cpuVeto != nil, ta.resizeCpusWithVeto),
+		optional(len(opts.requireCacheIds) > 0, ta.resizeCpusWithCacheIds),
+		optional(opts.exclusivity != cpuModeNone, ta.resizeCpusWithExclusivity),
+		optional(opts.avoidBootCpu && ta.bootCpu >= 0, ta.resizeCpusAvoidBootCpu),
+		optional(opts.requireNohzFull, ta.resizeCpusNohzFull),
+		optional(opts.securityDomain != "", ta.resizeCpusWithSecurityDomain),
+		optional(opts.requireWholeCores, ta.resizeCpusWholeCores),
+		[]cpuResizerFunc{ta.resizeCpusOnlyIfNecessary},
+		optional(!opts.preferReleaseOverlapping.IsEmpty(), ta.resizeCpusPreferReleaseOverlapping),
+		[]cpuResizerFunc{ta.resizeCpusWithDevices},
+		optional(opts.preferPartitionable, ta.resizeCpusPartitionable),
+		optional(opts.preferEmptiestPackage, ta.resizeCpusInEmptiestPackage),
+		optional(opts.preferPackSiblings, ta.resizeCpusPackSiblings),
+		optional(opts.preferEmptyWholeNode, ta.resizeCpusEmptyWholeNode),
+		[]cpuResizerFunc{
+			ta.resizeCpusOneAtATime,
+			ta.resizeCpusMaxLocalSet,
+			terminal})
+}
+
+// ResizeExplanation tells how the stages of the resizer chain narrowed
+// down free CPUs into the CPUs to allocate from in a resize.
+type ResizeExplanation struct {
+	// Stages are the names of the resizers in the chain, in
+	// the order they are consulted.
+	Stages []string
+	// Retained maps every CPU in addFromCpus to the stages that
+	// narrowed down free CPUs but kept the CPU.
+	Retained map[int][]string
+	// Excluded maps every other free CPU to the stage that
+	// excluded it.
+	Excluded map[int]string
+}
+
+// ExplainResize resizes like ResizeCpus, and explains for every free
+// CPU which stages of the resizer chain retained or excluded it. Only
+// allocations (delta > 0) are explained. Stages that are consulted
+// many times, like when allocating one CPU at a time, are explained
+// by all free CPUs they are consulted with.
+func (ta *cpuTreeAllocator) ExplainResize(currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, *ResizeExplanation, error) {
+	freeCpus, err := ta.resolveFreeCpus(freeCpus)
+	if err != nil {
+		return emptyCpuSet, emptyCpuSet, nil, err
+	}
+	currentCpus, freeCpus = ta.usableCpus(currentCpus), ta.usableCpus(freeCpus)
+	resizers := ta.resizers(ta.resizeCpusNow)
+	explanation := &ResizeExplanation{
+		Retained: map[int][]string{},
+		Excluded: map[int]string{},
+	}
+	// stageFreeCpus[i] are the free CPUs stage i was consulted with.
+	stageFreeCpus := make([]cpuset.CPUSet, len(resizers))
+	explained := make([]cpuResizerFunc, len(resizers))
+	for i, resizer := range resizers {
+		explanation.Stages = append(explanation.Stages, resizerName(resizer))
+		stageFreeCpus[i] = cpuset.New()
+		explained[i] = func(rs []cpuResizerFunc, currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error) {
+			stageFreeCpus[i] = stageFreeCpus[i].Union(freeCpus)
+			// Keep the rest of the chain explained.
+			return resizer(explained[i+1:], currentCpus, freeCpus, delta)
+		}
+	}
+	addFromCpus, removeFromCpus, err := ta.nextCpuResizer(explained, currentCpus, freeCpus, delta)
+	if err != nil || delta <= 0 {
+		return addFromCpus, removeFromCpus, explanation, err
+	}
+	// A stage retains what the next stage is consulted with, the
+	// terminal stage what it returns.
+	retainedCpus := func(i int) cpuset.CPUSet {
+		if i+1 < len(stageFreeCpus) {
+			return stageFreeCpus[i+1]
+		}
+		return addFromCpus
+	}
+	for i, stage := range explanation.Stages {
+		in, out := stageFreeCpus[i], retainedCpus(i)
+		if in.IsEmpty() || out.Equals(in) {
+			continue
+		}
+		for _, cpu := range in.List() {
+			if !out.Contains(cpu) {
+				if _, ok := explanation.Excluded[cpu]; !ok {
+					explanation.Excluded[cpu] = stage
+				}
+			} else if addFromCpus.Contains(cpu) {
+				explanation.Retained[cpu] = append(explanation.Retained[cpu], stage)
+			}
+		}
+	}
+	return addFromCpus, removeFromCpus, explanation, nil
+}
+
+// resizerName returns the name of a resizer function without the
+// package and receiver, like resizeCpusMaxLocalSet.
+func resizerName(resizer cpuResizerFunc) string {
+	name := runtime.FuncForPC(reflect.ValueOf(resizer).Pointer()).Name()
+	name = name[strings.LastIndex(name, ".")+1:]
+	return strings.TrimSuffix(name, "-fm")
+}
+
+// EligibleFreeCpus returns the free CPUs that survive all filters
+// and hints of the resizer chain when resizing currentCpus by delta
+// (delta > 0) CPUs. Comparing the result to freeCpus shows which
+// CPUs were excluded by reserved CPUs, device hints, cache ids and
+// other options. No CPUs are selected for allocation.
+func (ta *cpuTreeAllocator) EligibleFreeCpus(currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, error) {
+	freeCpus, err := ta.resolveFreeCpus(freeCpus)
+	if err != nil {
+		return emptyCpuSet, err
+	}
+	currentCpus, freeCpus = ta.usableCpus(currentCpus), ta.usableCpus(freeCpus)
+	eligibleCpus := cpuset.New()
+	record := func(resizers []cpuResizerFunc, currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error) {
+		eligibleCpus = eligibleCpus.Union(freeCpus)
+		return freeCpus, currentCpus, nil
+	}
+	if _, _, err := ta.nextCpuResizer(ta.resizers(record), currentCpus, freeCpus, delta); err != nil {
+		return eligibleCpus, err
+	}
+	return eligibleCpus, nil
+}
+
+// ResizeCpusToward is like ResizeCpus, but when releasing CPUs
+// (delta < 0) it prefers releasing those currentCpus that are in the
+// same topology elements as towardCpus. This helps freeing CPUs next
+// to the CPUs of a neighbor that is going to grow.
+func (ta *cpuTreeAllocator) ResizeCpusToward(currentCpus, freeCpus, towardCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error) {
+	if delta >= 0 || towardCpus.IsEmpty() {
+		return ta.ResizeCpus(currentCpus, freeCpus, delta)
+	}
+	currentCpus = ta.usableCpus(currentCpus)
+	if currentCpus.Size() <= -delta {
+		return ta.ResizeCpus(currentCpus, freeCpus, delta)
+	}
+	// Score current CPUs by the number of topology elements
+	// they share with towardCpus. The deeper in the topology,
+	// the closer to towardCpus.
+	towardNames := map[string]struct{}{}
+	for _, names := range ta.root.CpuLocations(towardCpus) {
+		for _, name := range names {
+			towardNames[name] = struct{}{}
+		}
+	}
+	cpuScore := map[int]int{}
+	for _, cpu := range currentCpus.UnsortedList() {
+		for _, names := range ta.root.CpuLocations(cpuset.New(cpu)) {
+			for _, name := range names {
+				if _, ok := towardNames[name]; ok {
+					cpuScore[cpu]++
+				}
+			}
+		}
+	}
+	closestCpus := currentCpus.List()
+	sort.SliceStable(closestCpus, func(i, j int) bool {
+		return cpuScore[closestCpus[i]] > cpuScore[closestCpus[j]]
+	})
+	// Release CPUs that are closer to towardCpus than the
+	// -delta'th closest CPU for sure. Let ResizeCpus choose
+	// among equally close CPUs.
+	minScore := cpuScore[closestCpus[-delta-1]]
+	releaseForSure := cpuset.New()
+	releaseMaybe := cpuset.New()
+	for _, cpu := range closestCpus {
+		switch {
+		case cpuScore[cpu] > minScore:
+			releaseForSure = releaseForSure.Union(cpuset.New(cpu))
+		case cpuScore[cpu] == minScore:
+			releaseMaybe = releaseMaybe.Union(cpuset.New(cpu))
+		}
+	}
+	ta.debugf("  - toward cpus %q: release for sure: %q and %d more from: %q",
+		towardCpus, releaseForSure, -delta-releaseForSure.Size(), releaseMaybe)
+	_, removeFromMaybe, err := ta.ResizeCpus(releaseMaybe, freeCpus, delta+releaseForSure.Size())
+	if err != nil {
+		return freeCpus, currentCpus, err
+	}
+	// Do not include possible extra CPUs from removeFromMaybe
+	// to make sure that all CPUs closest to towardCpus will be
+	// released.
+	for _, cpu := range removeFromMaybe.List() {
+		if releaseForSure.Size() >= -delta {
+			break
+		}
+		releaseForSure = releaseForSure.Union(cpuset.New(cpu))
+	}
+	return freeCpus, releaseForSure, nil
+}
+
+// verifyResize checks that the result of resizing CPUs is consistent
+// with the input.
+func verifyResize(currentCpus, freeCpus cpuset.CPUSet, delta int, addFromCpus, removeFromCpus cpuset.CPUSet) error {
+	if !addFromCpus.IsSubsetOf(freeCpus) {
+		return fmt.Errorf("internal error: CPUs to allocate from %q not subset of free CPUs %q", addFromCpus, freeCpus)
+	}
+	if !removeFromCpus.IsSubsetOf(currentCpus) {
+		return fmt.Errorf("internal error: CPUs to release from %q not subset of current CPUs %q", removeFromCpus, currentCpus)
+	}
+	if overlap := addFromCpus.Intersection(removeFromCpus); !overlap.IsEmpty() {
+		return fmt.Errorf("internal error: CPUs %q both to allocate and to release", overlap)
+	}
+	if delta > 0 && addFromCpus.Size() < delta {
+		return fmt.Errorf("internal error: too few CPUs (%q) to allocate %d CPUs from", addFromCpus, delta)
+	}
+	if delta < 0 && removeFromCpus.Size() < -delta {
+		return fmt.Errorf("internal error: too few CPUs (%q) to release %d CPUs from", removeFromCpus, -delta)
+	}
+	return nil
+}
+
+// Allocate adds delta CPUs to (if positive) or removes -delta CPUs
+// from (if negative) the current set of CPUs. Unlike ResizeCpus,
+// Allocate selects the exact CPUs and returns updated current and
+// free CPU sets. CPUs are selected from the sets returned by
+// ResizeCpus by cpuAllocator in allocator options, or in the order of
+// CPU ids if it is not set: allocator preferences consider all CPUs
+// in these sets equally good. If sizeByCapacity is set in allocator
+// options, delta is in capacity units like in ResizeCpus.
+func (ta *cpuTreeAllocator) Allocate(currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error) {
+	resolvedFreeCpus, err := ta.resolveFreeCpus(freeCpus)
+	if err != nil {
+		return currentCpus, freeCpus, err
+	}
+	freeCpus = resolvedFreeCpus
+	newCpus, newFreeCpus, err := ta.planAllocation(currentCpus, freeCpus, delta)
+	if err != nil {
+		return currentCpus, freeCpus, err
+	}
+	ta.commitAllocation(ta.options.balloon, currentCpus, newCpus, delta)
+	return newCpus, newFreeCpus, nil
+}
+
+// planAllocation selects the exact CPUs like Allocate, but does not
+// change the state of the allocator, like CPU modes and the times
+// when CPUs were last used, nor does it commit the decision.
+func (ta *cpuTreeAllocator) planAllocation(currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error) {
+	addFromCpus, removeFromCpus, err := ta.ResizeCpus(currentCpus, freeCpus, delta)
+	if err != nil {
+		return currentCpus, freeCpus, err
+	}
+	if ta.options.sizeByCapacity {
+		return currentCpus.Union(addFromCpus).Difference(removeFromCpus), freeCpus.Difference(addFromCpus).Union(removeFromCpus), nil
+	}
+	switch {
+	case delta > 0:
+		if addFromCpus.Size() < delta {
+			return currentCpus, freeCpus, fmt.Errorf("internal error: expected at least %d CPUs to allocate from, got %q", delta, addFromCpus)
+		}
+		addCpus, err := ta.pickCpus(addFromCpus, delta, false)
+		if err != nil {
+			return currentCpus, freeCpus, err
+		}
+		return currentCpus.Union(addCpus), freeCpus.Difference(addCpus), nil
+	case delta < 0:
+		release := -delta
+		if ta.options.shrinkReluctance > 0 && removeFromCpus.Size() < release {
+			// Reluctant shrink released fewer CPUs.
+			release = removeFromCpus.Size()
+		}
+		if removeFromCpus.Size() < release {
+			return currentCpus, freeCpus, fmt.Errorf("internal error: expected at least %d CPUs to release from, got %q", release, removeFromCpus)
+		}
+		removeCpus, err := ta.pickCpus(removeFromCpus, release, true)
+		if err != nil {
+			return currentCpus, freeCpus, err
+		}
+		return currentCpus.Difference(removeCpus), freeCpus.Union(removeCpus), nil
+	}
+	return currentCpus, freeCpus, nil
+}
+
+// commitAllocation records the modes and, if preferLeastRecentlyUsed
+// is set, the times of use of CPUs that a planned allocation changed
+// from currentCpus to newCpus, and commits the decision for balloon.
+func (ta *cpuTreeAllocator) commitAllocation(balloon string, currentCpus, newCpus cpuset.CPUSet, delta int) {
+	if delta == 0 {
+		return
+	}
+	addCpus := newCpus.Difference(currentCpus)
+	removeCpus := currentCpus.Difference(newCpus)
+	now := time.Now()
+	if ta.options.preferLeastRecentlyUsed && !ta.options.sizeByCapacity {
+		ta.markCpusUsedAt(addCpus, now)
+	}
+	ta.markCpuModes(addCpus, removeCpus)
+	ta.commit(balloon, delta, newCpus, now)
+}
+
+// pickCpus returns n CPUs of cpus to be allocated, or to be released
+// if release is true. If cpuAllocator is set in allocator options,
+// it picks the CPUs like the balloons policy does. Otherwise CPUs
+// with the lowest ids are picked.
+func (ta *cpuTreeAllocator) pickCpus(cpus cpuset.CPUSet, n int, release bool) (cpuset.CPUSet, error) {
+	if ta.options.cpuAllocator == nil {
+		return cpuset.New(cpus.List()[:n]...), nil
+	}
+	if release {
+		// ReleaseCpus leaves the released CPUs in cpus.
+		if _, err := ta.options.cpuAllocator.ReleaseCpus(&cpus, n, ta.options.allocatorPriority); err != nil {
+			return emptyCpuSet, fmt.Errorf("failed to pick %d CPUs to release: %w", n, err)
+		}
+		return cpus, nil
+	}
+	addCpus, err := ta.options.cpuAllocator.AllocateCpus(&cpus, n, ta.options.allocatorPriority)
+	if err != nil {
+		return emptyCpuSet, fmt.Errorf("failed to pick %d CPUs to allocate: %w", n, err)
+	}
+	return addCpus, nil
+}
+
+// Decision is a resize of the CPUs of a balloon committed by Allocate.
+type Decision struct {
+	// Balloon is the name of the balloon that was resized.
+	Balloon string
+	// Delta is the requested change in the number of CPUs, or
+	// in capacity units if sizeByCapacity is set.
+	Delta int
+	// Cpus are the CPUs of the balloon after the resize.
+	Cpus cpuset.CPUSet
+	// Mode is the mode of the CPUs of the balloon.
+	Mode cpuMode
+	// Time is when the decision was committed.
+	Time time.Time
+}
+
+// commit passes a decision to resize CPUs of balloon to the onCommit
+// callback.
+func (ta *cpuTreeAllocator) commit(balloon string, delta int, cpus cpuset.CPUSet, now time.Time) {
+	if ta.options.onCommit == nil {
+		return
+	}
+	ta.options.onCommit(Decision{
+		Balloon: balloon,
+		Delta:   delta,
+		Cpus:    cpus,
+		Mode:    ta.options.exclusivity,
+		Time:    now,
+	})
+}
+
+// Replay rebuilds the state of the allocator from decisions, in the
+// order they were committed, and returns the CPUs of every balloon
+// after the last decision. Balloons resized to no CPUs are left out.
+// Replay restores CPU modes and, if preferLeastRecentlyUsed is set,
+// the times when CPUs were last allocated to the balloon of the
+// allocator. The onCommit callback is not called. Replay fails if
+// decisions give a CPU to two balloons.
+func (ta *cpuTreeAllocator) Replay(decisions []Decision) (map[string]cpuset.CPUSet, error) {
+	balloonCpus := map[string]cpuset.CPUSet{}
+	for i, d := range decisions {
+		oldCpus := balloonCpus[d.Balloon]
+		addCpus := d.Cpus.Difference(oldCpus)
+		removeCpus := oldCpus.Difference(d.Cpus)
+		for name, cpus := range balloonCpus {
+			if name == d.Balloon {
+				continue
+			}
+			if overlap := cpus.Intersection(addCpus); !overlap.IsEmpty() {
+				return nil, fmt.Errorf("decision %d: cpus %s of balloon %q are in balloon %q", i, overlap, d.Balloon, name)
+			}
+		}
+		if d.Mode != cpuModeNone {
+			ta.options.cpuModes.set(removeCpus, cpuModeNone)
+			ta.options.cpuModes.set(addCpus, d.Mode)
+		}
+		if ta.options.preferLeastRecentlyUsed && d.Balloon == ta.options.balloon {
+			ta.markCpusUsedAt(addCpus, d.Time)
+		}
+		if d.Cpus.IsEmpty() {
+			delete(balloonCpus, d.Balloon)
+		} else {
+			balloonCpus[d.Balloon] = d.Cpus
+		}
+	}
+	return balloonCpus, nil
+}
+
+// ResizeRequest is a request to resize a set of CPUs in ResizeMany.
+type ResizeRequest struct {
+	// Balloon is the name of the balloon whose CPUs are resized.
+	// It is recorded in Decisions. If empty, the balloon in
+	// allocator options is recorded.
+	Balloon string
+	// CurrentCpus are the CPUs of the set before resizing.
+	CurrentCpus cpuset.CPUSet
+	// Delta is the number of CPUs to add (if positive) or remove
+	// (if negative).
+	Delta int
+}
+
+// ResizeResult is the result of a ResizeRequest in ResizeMany.
+type ResizeResult struct {
+	// Cpus are the CPUs of the set after resizing.
+	Cpus cpuset.CPUSet
+	// AddedCpus are the CPUs that were added to the set.
+	AddedCpus cpuset.CPUSet
+	// RemovedCpus are the CPUs that were removed from the set.
+	RemovedCpus cpuset.CPUSet
+}
+
+// ResizeMany resizes several disjoint sets of CPUs together. All
+// releases are done first, so that allocations can use the released
+// CPUs. Then allocations are done from the largest to the smallest,
+// so that large allocations get the best local free CPUs before they
+// are fragmented by small ones. Results are in the same order as
+// requests. No CPU is in more than one result. Resizes are planned
+// first and committed, like by Allocate, only after all of them
+// succeed: if any request fails, no results are returned and the
+// state of the allocator is not changed.
+func (ta *cpuTreeAllocator) ResizeMany(requests []ResizeRequest, freeCpus cpuset.CPUSet) ([]ResizeResult, error) {
+	freeCpus, err := ta.resolveFreeCpus(freeCpus)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]ResizeResult, len(requests))
+	// planned are indices of requests in the order they were
+	// planned, and they are committed in the same order.
+	planned := []int{}
+	assigned := cpuset.New()
+	for i, req := range requests {
+		if overlap := assigned.Intersection(req.CurrentCpus); !overlap.IsEmpty() {
+			return nil, fmt.Errorf("resize request %d: cpus %s are in other requests", i, overlap)
+		}
+		if overlap := freeCpus.Intersection(req.CurrentCpus); !overlap.IsEmpty() {
+			return nil, fmt.Errorf("resize request %d: cpus %s are free", i, overlap)
+		}
+		assigned = assigned.Union(req.CurrentCpus)
+		results[i] = ResizeResult{
+			Cpus:        req.CurrentCpus,
+			AddedCpus:   cpuset.New(),
+			RemovedCpus: cpuset.New(),
+		}
+	}
+	for i, req := range requests {
+		if req.Delta >= 0 {
+			continue
+		}
+		cpus, newFreeCpus, err := ta.planAllocation(req.CurrentCpus, freeCpus, req.Delta)
+		if err != nil {
+			return nil, fmt.Errorf("resize request %d: failed to release %d CPUs: %w", i, -req.Delta, err)
+		}
+		results[i].Cpus = cpus
+		results[i].RemovedCpus = req.CurrentCpus.Difference(cpus)
+		freeCpus = newFreeCpus
+		planned = append(planned, i)
+	}
+	order := []int{}
+	for i, req := range requests {
+		if req.Delta > 0 {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return requests[order[i]].Delta > requests[order[j]].Delta
+	})
+	for _, i := range order {
+		req := requests[i]
+		cpus, newFreeCpus, err := ta.planAllocation(req.CurrentCpus, freeCpus, req.Delta)
+		if err != nil {
+			return nil, fmt.Errorf("resize request %d: failed to allocate %d CPUs: %w", i, req.Delta, err)
+		}
+		results[i].Cpus = cpus
+		results[i].AddedCpus = cpus.Difference(req.CurrentCpus)
+		freeCpus = newFreeCpus
+		planned = append(planned, i)
+	}
+	assigned = cpuset.New()
+	for i, result := range results {
+		if overlap := assigned.Intersection(result.Cpus); !overlap.IsEmpty() {
+			return nil, fmt.Errorf("internal error: resize result %d: cpus %s assigned twice", i, overlap)
+		}
+		assigned = assigned.Union(result.Cpus)
+	}
+	for _, i := range planned {
+		balloon := requests[i].Balloon
+		if balloon == "" {
+			balloon = ta.options.balloon
+		}
+		ta.commitAllocation(balloon, requests[i].CurrentCpus, results[i].Cpus, requests[i].Delta)
+	}
+	return results, nil
+}
+
+// Move is a step in a migration plan. Balloon releases Release CPUs
+// and then acquires Acquire CPUs.
+type Move struct {
+	Balloon string
+	Release cpuset.CPUSet
+	Acquire cpuset.CPUSet
+}
+
+// MigrationPlan returns moves that change the CPUs of balloons from
+// allocation from to allocation to. Balloons missing from one of the
+// allocations have no CPUs in it. Moves are ordered so that every
+// acquired CPU has been released by its earlier holder, so no CPU is
+// held by two balloons at any step. A balloon moves in a single step
+// if it can. If balloons wait for each others' CPUs, like when two
+// balloons swap CPUs, the wait is broken by a move that only
+// releases CPUs, and the balloon acquires its new CPUs in a later
+// move. Balloons are moved in the order of their names when there is
+// a choice. Allocations in which a CPU is in many balloons are an
+// error.
+func MigrationPlan(from, to map[string]cpuset.CPUSet) ([]Move, error) {
+	names := []string{}
+	for name := range from {
+		names = append(names, name)
+	}
+	for name := range to {
+		if _, ok := from[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	owners := map[int]string{}
+	for _, allocation := range []map[string]cpuset.CPUSet{to, from} {
+		clear(owners)
+		for _, name := range names {
+			for _, cpu := range allocation[name].List() {
+				if other, ok := owners[cpu]; ok {
+					return nil, fmt.Errorf("cpu %d in both balloon %q and %q", cpu, other, name)
+				}
+				owners[cpu] = name
+			}
+		}
+	}
+	// owners now holds the owners of CPUs in from.
+	release := map[string]cpuset.CPUSet{}
+	acquire := map[string]cpuset.CPUSet{}
+	pending := []string{}
+	for _, name := range names {
+		release[name] = from[name].Difference(to[name])
+		acquire[name] = to[name].Difference(from[name])
+		if !release[name].IsEmpty() || !acquire[name].IsEmpty() {
+			pending = append(pending, name)
+		}
+	}
+
+	moves := []Move{}
+	move := func(name string, acquireCpus cpuset.CPUSet) {
+		for _, cpu := range release[name].List() {
+			delete(owners, cpu)
+		}
+		for _, cpu := range acquireCpus.List() {
+			owners[cpu] = name
+		}
+		moves = append(moves, Move{
+			Balloon: name,
+			Release: release[name],
+			Acquire: acquireCpus,
+		})
+		release[name] = cpuset.New()
+		acquire[name] = acquire[name].Difference(acquireCpus)
+	}
+	// blocker returns the balloon holding the first CPU that a
+	// balloon is waiting for, or "" if the balloon is not waiting.
+	blocker := func(name string) string {
+		for _, cpu := range acquire[name].List() {
+			if owner, ok := owners[cpu]; ok && owner != name {
+				return owner
+			}
+		}
+		return ""
+	}
+	for len(pending) > 0 {
+		i := slices.IndexFunc(pending, func(name string) bool { return blocker(name) == "" })
+		if i >= 0 {
+			if name := pending[i]; !release[name].IsEmpty() || !acquire[name].IsEmpty() {
+				move(name, acquire[name])
+			}
+			pending = slices.Delete(pending, i, i+1)
+			continue
+		}
+		// Every pending balloon waits for CPUs of another
+		// pending balloon. Those CPUs are not in the to
+		// allocation of their holder, so releasing them breaks
+		// the wait.
+		move(blocker(pending[0]), cpuset.New())
+	}
+	return moves, nil
+}
+
+type cpuResizerFunc func(resizers []cpuResizerFunc, currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error)
+
+func (ta *cpuTreeAllocator) nextCpuResizer(resizers []cpuResizerFunc, currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error) {
+	if len(resizers) == 0 {
+		return freeCpus, currentCpus, fmt.Errorf("internal error: a CPU resizer consulted next resizer but there was no one left")
+	}
+	remainingResizers := resizers[1:]
+	ta.debugf("- resizer-%d(%q, %q, %d)", len(remainingResizers), currentCpus, freeCpus, delta)
+	addFrom, removeFrom, err := resizers[0](remainingResizers, currentCpus, freeCpus, delta)
+	return addFrom, removeFrom, err
+}
+
+// resizeCpusNow does not call next resizer. Instead it keeps all CPU
+// allocations from freeCpus and CPU releases from currentCpus equally
+// good. This is the terminal block of resizers chain.
+func (ta *cpuTreeAllocator) resizeCpusNow(resizers []cpuResizerFunc, currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error) {
+	return freeCpus, currentCpus, nil
+}
+
+// resizeCpusWithVeto never allocates CPUs vetoed by cpuVeto, and
+// releases vetoed CPUs before any other CPUs.
+func (ta *cpuTreeAllocator) resizeCpusWithVeto(resizers []cpuResizerFunc, currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error) {
+	if ta.options.cpuVeto == nil || delta == 0 {
+		return ta.nextCpuResizer(resizers, currentCpus, freeCpus, delta)
+	}
+	if delta > 0 {
+		return ta.nextCpuResizer(resizers, currentCpus, freeCpus.Difference(ta.vetoedCpus(freeCpus)), delta)
+	}
+	return ta.releasePreferring(resizers, ta.vetoedCpus(currentCpus), currentCpus, freeCpus, delta)
+}
+
+// resizeCpusPreferReleaseOverlapping releases CPUs that overlap with
+// preferReleaseOverlapping before other CPUs.
+func (ta *cpuTreeAllocator) resizeCpusPreferReleaseOverlapping(resizers []cpuResizerFunc, currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error) {
+	if delta >= 0 || ta.options.preferReleaseOverlapping.IsEmpty() {
+		return ta.nextCpuResizer(resizers, currentCpus, freeCpus, delta)
+	}
+	return ta.releasePreferring(resizers, currentCpus.Intersection(ta.options.preferReleaseOverlapping), currentCpus, freeCpus, delta)
+}
+
+// releasePreferring releases -delta CPUs, taking them from preferred
+// CPUs in currentCpus first. If there are enough preferred CPUs, the
+// rest of the resizer chain chooses among them. Otherwise all of them
+// are released, together with CPUs chosen by the rest of the chain
+// from other currentCpus.
+func (ta *cpuTreeAllocator) releasePreferring(resizers []cpuResizerFunc, preferred, currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error) {
+	if preferred.IsEmpty() {
+		return ta.nextCpuResizer(resizers, currentCpus, freeCpus, delta)
+	}
+	if preferred.Size() >= -delta {
+		return ta.nextCpuResizer(resizers, preferred, freeCpus, delta)
+	}
+	// Return exactly the CPUs to release, otherwise callers could
+	// pick other CPUs than the preferred ones.
+	delta += preferred.Size()
+	addFromCpus, removeFromCpus, err := ta.nextCpuResizer(resizers, currentCpus.Difference(preferred), freeCpus.Union(preferred), delta)
+	if err != nil {
+		return addFromCpus, removeFromCpus, err
+	}
+	if removeFromCpus.Size() > -delta {
+		removeFromCpus = cpuset.New(removeFromCpus.List()[:-delta]...)
+	}
+	return addFromCpus, removeFromCpus.Union(preferred), nil
+}
+
+// vetoedCpus returns the CPUs in cpus vetoed by cpuVeto.
+func (ta *cpuTreeAllocator) vetoedCpus(cpus cpuset.CPUSet) cpuset.CPUSet {
+	vetoed := []int{}
+	for _, cpu := range cpus.UnsortedList() {
+		if ta.options.cpuVeto(cpu) {
+			vetoed = append(vetoed, cpu)
+		}
+	}
+	return cpuset.New(vetoed...)
+}
+
+// resizeCpusWithCacheIds allows allocating only CPUs whose last-level
+// cache id is one of requireCacheIds, and fails if there are not
+// enough such free CPUs.
+func (ta *cpuTreeAllocator) resizeCpusWithCacheIds(resizers []cpuResizerFunc, currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error) {
+	if len(ta.options.requireCacheIds) == 0 || delta <= 0 {
+		return ta.nextCpuResizer(resizers, currentCpus, freeCpus, delta)
+	}
+	cacheCpus := cpuset.New()
+	for _, leaf := range ta.root.Leaves() {
+		if slices.Contains(ta.options.requireCacheIds, leaf.cacheId) {
+			cacheCpus = cacheCpus.Union(leaf.cpus)
+		}
+	}
+	cacheFreeCpus := freeCpus.Intersection(cacheCpus)
+	if cacheFreeCpus.Size() < delta {
+		ta.allocationFailed(delta, cacheFreeCpus)
+		return cacheFreeCpus, emptyCpuSet, fmt.Errorf("not enough free CPUs (%d) with required cache ids %v to resize current CPU set from %d to %d CPUs", cacheFreeCpus.Size(), ta.options.requireCacheIds, currentCpus.Size(), currentCpus.Size()+delta)
+	}
+	return ta.nextCpuResizer(resizers, currentCpus, cacheFreeCpus, delta)
+}
+
+// resizeCpusWithExclusivity allows allocating only CPUs whose mode is
+// none or the exclusivity of the allocator, and fails if there are not
+// enough such free CPUs.
+func (ta *cpuTreeAllocator) resizeCpusWithExclusivity(resizers []cpuResizerFunc, currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error) {
+	if ta.options.exclusivity == cpuModeNone || delta <= 0 {
+		return ta.nextCpuResizer(resizers, currentCpus, freeCpus, delta)
+	}
+	other := cpuModeShared
+	if ta.options.exclusivity == cpuModeShared {
+		other = cpuModeExclusive
+	}
+	modeFreeCpus := freeCpus.Difference(ta.options.cpuModes.Cpus(other))
+	if modeFreeCpus.Size() < delta {
+		ta.allocationFailed(delta, modeFreeCpus)
+		return modeFreeCpus, emptyCpuSet, fmt.Errorf("not enough free CPUs (%d) not in %s use to resize current CPU set from %d to %d CPUs", modeFreeCpus.Size(), other, currentCpus.Size(), currentCpus.Size()+delta)
+	}
+	return ta.nextCpuResizer(resizers, currentCpus, modeFreeCpus, delta)
+}
+
+// AttributionMap returns the topology tree printed like PrettyPrint,
+// with the owner of every leaf CPU in an aligned column. The owner is
+// the name of the balloon whose CPUs include the CPU, RESERVED for
+// reserved CPUs of the allocator, or FREE. Names of all balloons are
+// listed if more than one includes the CPU.
+func (ta *cpuTreeAllocator) AttributionMap(balloons map[string]cpuset.CPUSet) string {
+	lines, nodes := ta.topologyRoot.prettyPrintLines()
+	names := make([]string, 0, len(balloons))
+	for name := range balloons {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	width := 0
+	for i, tn := range nodes {
+		if len(tn.children) == 0 {
+			width = max(width, len(lines[i]))
+		}
+	}
+	for i, tn := range nodes {
+		if len(tn.children) != 0 {
+			continue
+		}
+		owners := []string{}
+		for _, name := range names {
+			if !balloons[name].Intersection(tn.cpus).IsEmpty() {
+				owners = append(owners, name)
+			}
+		}
+		owner := strings.Join(owners, ",")
+		if owner == "" {
+			owner = "FREE"
+			if !ta.options.reservedCpus.Intersection(tn.cpus).IsEmpty() {
+				owner = "RESERVED"
+			}
+		}
+		lines[i] = fmt.Sprintf("%-*s  %s", width, lines[i], owner)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// resizeCpusAvoidBootCpu leaves the boot CPU out of free CPUs if
+// avoidBootCpu is set, and fails if there are not enough other free
+// CPUs.
+func (ta *cpuTreeAllocator) resizeCpusAvoidBootCpu(resizers []cpuResizerFunc, currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error) {
+	if !ta.options.avoidBootCpu || delta <= 0 || !freeCpus.Contains(ta.bootCpu) {
+		return ta.nextCpuResizer(resizers, currentCpus, freeCpus, delta)
+	}
+	ta.debugf("not allocating boot CPU %d, see avoidBootCpu", ta.bootCpu)
+	nonBootFreeCpus := freeCpus.Difference(cpuset.New(ta.bootCpu))
+	if nonBootFreeCpus.Size() < delta {
+		ta.allocationFailed(delta, nonBootFreeCpus)
+		return nonBootFreeCpus, emptyCpuSet, fmt.Errorf("not enough free CPUs (%d) other than boot CPU %d to resize current CPU set from %d to %d CPUs", nonBootFreeCpus.Size(), ta.bootCpu, currentCpus.Size(), currentCpus.Size()+delta)
+	}
+	return ta.nextCpuResizer(resizers, currentCpus, nonBootFreeCpus, delta)
+}
+
+// resizeCpusNohzFull allows allocating only tickless CPUs if
+// requireNohzFull is set, and fails if there are not enough free
+// tickless CPUs.
+func (ta *cpuTreeAllocator) resizeCpusNohzFull(resizers []cpuResizerFunc, currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error) {
+	if !ta.options.requireNohzFull || delta <= 0 {
+		return ta.nextCpuResizer(resizers, currentCpus, freeCpus, delta)
+	}
+	nohzFreeCpus := freeCpus.Intersection(ta.topologyRoot.NohzFullCpus())
+	if nohzFreeCpus.Size() < delta {
+		ta.allocationFailed(delta, nohzFreeCpus)
+		return nohzFreeCpus, emptyCpuSet, fmt.Errorf("not enough free tickless (nohz_full) CPUs (%d) to resize current CPU set from %d to %d CPUs", nohzFreeCpus.Size(), currentCpus.Size(), currentCpus.Size()+delta)
+	}
+	return ta.nextCpuResizer(resizers, currentCpus, nohzFreeCpus, delta)
+}
+
+// resizeCpusWithSecurityDomain allocates only CPUs whose hyperthread
+// siblings are not allocated to another security domain, and fails if
+// there are not enough such free CPUs.
+func (ta *cpuTreeAllocator) resizeCpusWithSecurityDomain(resizers []cpuResizerFunc, currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error) {
+	if ta.options.securityDomain == "" || delta <= 0 {
+		return ta.nextCpuResizer(resizers, currentCpus, freeCpus, delta)
+	}
+	foreignCores := cpuset.New()
+	for _, core := range ta.topologyRoot.NodesAtLevel(CPUTopologyLevelCore) {
+		for _, cpu := range core.cpus.Difference(freeCpus).Difference(currentCpus).UnsortedList() {
+			if domain := ta.options.cpuSecurityDomains[cpu]; domain != "" && domain != ta.options.securityDomain {
+				foreignCores = foreignCores.Union(core.cpus)
+				break
+			}
+		}
+	}
+	domainFreeCpus := freeCpus.Difference(foreignCores)
+	if domainFreeCpus.Size() < delta {
+		ta.allocationFailed(delta, domainFreeCpus)
+		return domainFreeCpus, emptyCpuSet, fmt.Errorf("not enough free CPUs (%d) without siblings in other security domains than %q to resize current CPU set from %d to %d CPUs", domainFreeCpus.Size(), ta.options.securityDomain, currentCpus.Size(), currentCpus.Size()+delta)
+	}
+	return ta.nextCpuResizer(resizers, currentCpus, domainFreeCpus, delta)
+}
+
+// CpuMode returns the current mode of a CPU.
+func (ta *cpuTreeAllocator) CpuMode(cpu int) cpuMode {
+	return ta.options.cpuModes.Mode(cpu)
+}
+
+// markCpuModes records the modes of CPUs added to and removed from
+// CPUs allocated with exclusivity.
+func (ta *cpuTreeAllocator) markCpuModes(addCpus, removeCpus cpuset.CPUSet) {
+	if ta.options.exclusivity == cpuModeNone {
+		return
+	}
+	ta.options.cpuModes.set(addCpus, ta.options.exclusivity)
+	ta.options.cpuModes.set(removeCpus, cpuModeNone)
+}
+
+// resizeCpusWholeCores allocates and releases only whole physical
+// cores if requireWholeCores is set.
+func (ta *cpuTreeAllocator) resizeCpusWholeCores(resizers []cpuResizerFunc, currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error) {
+	if !ta.options.requireWholeCores || delta == 0 {
+		return ta.nextCpuResizer(resizers, currentCpus, freeCpus, delta)
+	}
+	if threads := ta.threadsPerCore(); delta%threads != 0 {
+		return emptyCpuSet, emptyCpuSet, fmt.Errorf("cannot resize by %d CPUs: whole cores of %d threads required", delta, threads)
+	}
+	if delta > 0 {
+		coreFreeCpus := ta.wholeCoreCpus(freeCpus)
+		if coreFreeCpus.Size() < delta {
+			ta.allocationFailed(delta, coreFreeCpus)
+			return coreFreeCpus, emptyCpuSet, fmt.Errorf("not enough free whole cores (%d CPUs) to resize current CPU set from %d to %d CPUs", coreFreeCpus.Size(), currentCpus.Size(), currentCpus.Size()+delta)
+		}
+		addFrom, removeFrom, err := ta.nextCpuResizer(resizers, currentCpus, coreFreeCpus, delta)
+		if err != nil {
+			return addFrom, removeFrom, err
+		}
+		addCpus := ta.firstWholeCores(addFrom, delta)
+		if addCpus.Size() != delta {
+			return addFrom, removeFrom, fmt.Errorf("cannot find %d CPUs of whole cores to allocate from %s", delta, addFrom)
+		}
+		return addCpus, removeFrom, nil
+	}
+	coreCurrentCpus := ta.wholeCoreCpus(currentCpus)
+	if coreCurrentCpus.Size() < -delta {
+		return emptyCpuSet, coreCurrentCpus, fmt.Errorf("not enough whole cores (%d CPUs) to release %d CPUs", coreCurrentCpus.Size(), -delta)
+	}
+	addFrom, removeFrom, err := ta.nextCpuResizer(resizers, coreCurrentCpus, freeCpus, delta)
+	if err != nil {
+		return addFrom, removeFrom, err
+	}
+	removeCpus := ta.firstWholeCores(removeFrom, -delta)
+	if removeCpus.Size() != -delta {
+		return addFrom, removeFrom, fmt.Errorf("cannot find %d CPUs of whole cores to release from %s", -delta, removeFrom)
+	}
+	return addFrom, removeCpus, nil
 }
 
-type cpuResizerFunc func(resizers []cpuResizerFunc, currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error)
+// threadsPerCore returns the largest number of threads in a physical
+// core.
+func (ta *cpuTreeAllocator) threadsPerCore() int {
+	threads := 1
+	ta.topologyRoot.DepthFirstWalk(func(tn *cpuTreeNode) error {
+		if tn.level == CPUTopologyLevelCore {
+			threads = max(threads, tn.cpus.Size())
+			return WalkSkipChildren
+		}
+		return nil
+	})
+	return threads
+}
 
-func (ta *cpuTreeAllocator) nextCpuResizer(resizers []cpuResizerFunc, currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error) {
-	if len(resizers) == 0 {
-		return freeCpus, currentCpus, fmt.Errorf("internal error: a CPU resizer consulted next resizer but there was no one left")
+// wholeCoreCpus returns those cpus whose all core siblings are in
+// cpus.
+func (ta *cpuTreeAllocator) wholeCoreCpus(cpus cpuset.CPUSet) cpuset.CPUSet {
+	coreCpus := cpuset.New()
+	for _, cpu := range cpus.UnsortedList() {
+		if siblings := ta.topologyRoot.CoreSiblings(cpu); siblings.IsSubsetOf(cpus) {
+			coreCpus = coreCpus.Union(siblings)
+		}
 	}
-	remainingResizers := resizers[1:]
-	log.Debugf("- resizer-%d(%q, %q, %d)", len(remainingResizers), currentCpus, freeCpus, delta)
-	addFrom, removeFrom, err := resizers[0](remainingResizers, currentCpus, freeCpus, delta)
-	return addFrom, removeFrom, err
+	return coreCpus
 }
 
-// resizeCpusNow does not call next resizer. Instead it keeps all CPU
-// allocations from freeCpus and CPU releases from currentCpus equally
-// good. This is the terminal block of resizers chain.
-func (ta *cpuTreeAllocator) resizeCpusNow(resizers []cpuResizerFunc, currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error) {
-	return freeCpus, currentCpus, nil
+// firstWholeCores returns up to n CPUs of whole cores in cpus, taking
+// cores in the order of their lowest CPU id.
+func (ta *cpuTreeAllocator) firstWholeCores(cpus cpuset.CPUSet, n int) cpuset.CPUSet {
+	taken := cpuset.New()
+	for _, cpu := range cpus.List() {
+		if taken.Contains(cpu) {
+			continue
+		}
+		siblings := ta.topologyRoot.CoreSiblings(cpu)
+		if !siblings.IsSubsetOf(cpus) || taken.Size()+siblings.Size() > n {
+			continue
+		}
+		taken = taken.Union(siblings)
+	}
+	return taken
+}
+
+// allocationFailed notifies the onAllocationFailure callback, if any,
+// about failing to allocate delta CPUs from freeCpus.
+func (ta *cpuTreeAllocator) allocationFailed(delta int, freeCpus cpuset.CPUSet) {
+	if ta.options.onAllocationFailure != nil {
+		ta.options.onAllocationFailure(delta, freeCpus)
+	}
 }
 
 // resizeCpusOnlyIfNecessary is the fast path for making trivial
@@ -558,9 +2975,18 @@ func (ta *cpuTreeAllocator) resizeCpusOnlyIfNecessary(resizers []cpuResizerFunc,
 		// Nothing to do.
 		return emptyCpuSet, emptyCpuSet, nil
 	case delta > 0:
+		if capacity := ta.topologyRoot.cpus.Difference(ta.options.reservedCpus).Size(); currentCpus.Size()+delta > capacity {
+			ta.allocationFailed(delta, freeCpus)
+			return freeCpus, emptyCpuSet, fmt.Errorf("%w: not enough free CPUs even if all %d allocatable CPUs were free to resize current CPU set from %d to %d CPUs", ErrRequestExceedsCapacity, capacity, currentCpus.Size(), currentCpus.Size()+delta)
+		}
 		if freeCpus.Size() < delta {
-			return freeCpus, emptyCpuSet, fmt.Errorf("not enough free CPUs (%d) to resize current CPU set from %d to %d CPUs", freeCpus.Size(), currentCpus.Size(), currentCpus.Size()+delta)
-		} else if freeCpus.Size() == delta {
+			ta.allocationFailed(delta, freeCpus)
+			err := fmt.Errorf("not enough free CPUs (%d) to resize current CPU set from %d to %d CPUs", freeCpus.Size(), currentCpus.Size(), currentCpus.Size()+delta)
+			if ta.options.preemptibleCpus.Size() > 0 {
+				return ta.preemptionCandidates(resizers, currentCpus, freeCpus, delta, err)
+			}
+			return freeCpus, emptyCpuSet, err
+		} else if freeCpus.Size() == delta && !ta.options.singlePackageOnly && !ta.options.singleNumaOnly {
 			// Allocate all the remaining free CPUs.
 			return freeCpus, emptyCpuSet, nil
 		}
@@ -575,6 +3001,217 @@ func (ta *cpuTreeAllocator) resizeCpusOnlyIfNecessary(resizers []cpuResizerFunc,
 	return ta.nextCpuResizer(resizers, currentCpus, freeCpus, delta)
 }
 
+// preemptionCandidates finds the best CPUs for allocating delta CPUs
+// from both free and preemptible CPUs. It returns err as is if
+// preemptible CPUs do not help, otherwise a cpuPreemptionError with
+// the preemptible CPUs that would need to be reclaimed.
+func (ta *cpuTreeAllocator) preemptionCandidates(resizers []cpuResizerFunc, currentCpus, freeCpus cpuset.CPUSet, delta int, err error) (cpuset.CPUSet, cpuset.CPUSet, error) {
+	preemptibleCpus := ta.options.preemptibleCpus.
+		Difference(currentCpus).
+		Difference(freeCpus).
+		Difference(ta.options.reservedCpus)
+	if freeCpus.Size()+preemptibleCpus.Size() < delta {
+		return freeCpus, emptyCpuSet, err
+	}
+	addFromCpus, _, perr := ta.nextCpuResizer(resizers, currentCpus, freeCpus.Union(preemptibleCpus), delta)
+	if perr != nil {
+		ta.debugf("no preemption candidates: %v", perr)
+		return freeCpus, emptyCpuSet, err
+	}
+	// Allocate all free CPUs among candidates, complete with
+	// preemptible ones.
+	preemptCount := delta - addFromCpus.Intersection(freeCpus).Size()
+	preemptFromCpus := addFromCpus.Intersection(preemptibleCpus).List()
+	if preemptCount > len(preemptFromCpus) {
+		return freeCpus, emptyCpuSet, err
+	}
+	return freeCpus, emptyCpuSet, &cpuPreemptionError{
+		err:         err,
+		preemptCpus: cpuset.New(preemptFromCpus[:preemptCount]...),
+		addFromCpus: addFromCpus,
+	}
+}
+
+// FragmentationScore returns how fragmented the allocated currentCpus
+// and the remaining freeCpus are. It is the sum of the fragmentation
+// of both sets. Fragmentation of a set S of CPUs is
+//
+//	sum(used(L)) / sum(ideal(L)) - 1
+//
+// where L goes over package, die, NUMA node and core levels of the
+// tree, used(L) is the number of nodes at level L that contain CPUs in
+// S, and ideal(L) is the minimum number of nodes at level L that can
+// hold |S| CPUs. Fragmentation of a compact set, and of an empty set,
+// is 0. The more topology domains the CPUs are scattered across
+// compared to a compact layout, the higher the score.
+func (ta *cpuTreeAllocator) FragmentationScore(currentCpus, freeCpus cpuset.CPUSet) float64 {
+	return ta.fragmentation(currentCpus) + ta.fragmentation(freeCpus)
+}
+
+// Rebalance proposes a more compact replacement of the same size for
+// currentCpus that may have been fragmented by incremental resizes.
+// The proposal is the best fit for currentCpus.Size() CPUs allocated
+// at once from currentCpus and freeCpus. moved is true if the proposed
+// CPUs are less fragmented than currentCpus, see FragmentationScore.
+// Otherwise currentCpus is returned as is. The returned set always has
+// exactly as many CPUs as currentCpus, also with sizeByCapacity.
+func (ta *cpuTreeAllocator) Rebalance(currentCpus, freeCpus cpuset.CPUSet) (newCpus cpuset.CPUSet, moved bool) {
+	n := currentCpus.Size()
+	if n == 0 {
+		return currentCpus, false
+	}
+	freeCpus, err := ta.resolveFreeCpus(freeCpus)
+	if err != nil {
+		ta.debugf("rebalance %s: %v", currentCpus, err)
+		return currentCpus, false
+	}
+	bestFit := *ta
+	bestFit.options.sizeByCapacity = false
+	addFromCpus, _, err := bestFit.ResizeCpus(cpuset.New(), currentCpus.Union(freeCpus), n)
+	if err != nil || addFromCpus.Size() < n {
+		ta.debugf("rebalance %s: no best fit for %d CPUs: %v", currentCpus, n, err)
+		return currentCpus, false
+	}
+	newCpus = cpuset.New(addFromCpus.List()[:n]...)
+	if newCpus.Equals(currentCpus) || ta.fragmentation(newCpus) >= ta.fragmentation(currentCpus) {
+		return currentCpus, false
+	}
+	return newCpus, true
+}
+
+// fragmentation returns the fragmentation of cpus, see
+// FragmentationScore.
+func (ta *cpuTreeAllocator) fragmentation(cpus cpuset.CPUSet) float64 {
+	if cpus.IsEmpty() {
+		return 0
+	}
+	levelNodeSizes := map[CPUTopologyLevel][]int{}
+	levelUsed := map[CPUTopologyLevel]int{}
+	ta.topologyRoot.DepthFirstWalk(func(tn *cpuTreeNode) error {
+		switch tn.level {
+		case CPUTopologyLevelPackage, CPUTopologyLevelDie, CPUTopologyLevelNuma, CPUTopologyLevelCore:
+			levelNodeSizes[tn.level] = append(levelNodeSizes[tn.level], tn.cpus.Size())
+			if !tn.cpus.Intersection(cpus).IsEmpty() {
+				levelUsed[tn.level]++
+			}
+		}
+		return nil
+	})
+	used, ideal := 0, 0
+	for level, sizes := range levelNodeSizes {
+		used += levelUsed[level]
+		// The minimum number of nodes to hold all cpus:
+		// take the largest nodes first.
+		sort.Sort(sort.Reverse(sort.IntSlice(sizes)))
+		count := 0
+		for _, size := range sizes {
+			ideal++
+			count += size
+			if count >= cpus.Size() {
+				break
+			}
+		}
+	}
+	if ideal == 0 {
+		return 0
+	}
+	return float64(used)/float64(ideal) - 1
+}
+
+// PartitionableCpus returns the CPUs that can be put into new isolated
+// cpuset partitions: effective CPUs of the root cgroup that are not
+// already isolated in other partitions. The set is empty with cgroup v1,
+// which has no cpuset partitions, and on kernels without isolated
+// partitions.
+func (ta *cpuTreeAllocator) PartitionableCpus() cpuset.CPUSet {
+	if ta.partitionableCpus == nil {
+		cpus := cpuset.New()
+		if !cgroups.IsV2() {
+			ta.debugf("no partitionable CPUs: cpuset partitions need cgroup v2")
+		} else if partCpus, err := cgroups.GetCPUSetPartitionableCPUs(cgroups.GetMountDir()); err != nil {
+			ta.debugf("no partitionable CPUs: %v", err)
+		} else {
+			cpus = partCpus
+		}
+		ta.partitionableCpus = &cpus
+	}
+	return *ta.partitionableCpus
+}
+
+// resizeCpusPartitionable prefers allocating CPUs from those freeCpus
+// that can be put into isolated cpuset partitions, and releasing those
+// currentCpus that cannot. It does nothing if there are no
+// partitionable CPUs.
+func (ta *cpuTreeAllocator) resizeCpusPartitionable(resizers []cpuResizerFunc, currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error) {
+	if !ta.options.preferPartitionable || ta.PartitionableCpus().IsEmpty() {
+		return ta.nextCpuResizer(resizers, currentCpus, freeCpus, delta)
+	}
+	partitionableCpus := ta.PartitionableCpus()
+	if delta > 0 {
+		if partFreeCpus := freeCpus.Intersection(partitionableCpus); partFreeCpus.Size() >= delta {
+			return ta.nextCpuResizer(resizers, currentCpus, partFreeCpus, delta)
+		}
+	} else if delta < 0 {
+		if nonPartCurrentCpus := currentCpus.Difference(partitionableCpus); nonPartCurrentCpus.Size() >= -delta {
+			return ta.nextCpuResizer(resizers, nonPartCurrentCpus, freeCpus, delta)
+		}
+	}
+	return ta.nextCpuResizer(resizers, currentCpus, freeCpus, delta)
+}
+
+// deviceHintStatus tells how topology hints of a device were used
+// when allocating CPUs.
+type deviceHintStatus string
+
+const (
+	// deviceHintApplied: all hints of the device were applied.
+	deviceHintApplied deviceHintStatus = "applied"
+	// deviceHintPartiallyApplied: some hints of the device were
+	// applied, others dropped.
+	deviceHintPartiallyApplied deviceHintStatus = "partially applied"
+	// deviceHintDropped: all hints of the device were dropped,
+	// because there were not enough free CPUs in common with
+	// earlier applied hints.
+	deviceHintDropped deviceHintStatus = "dropped"
+)
+
+// deviceHintResult is the outcome of the topology hints of a device
+// in an allocation.
+type deviceHintResult struct {
+	// DevicePath is the path of the device.
+	DevicePath string
+	// RequestedCpus is the number of CPUs being allocated.
+	RequestedCpus int
+	// Hints is the number of hinted CPU sets of the device.
+	Hints int
+	// AppliedHints is the number of hints that were applied.
+	AppliedHints int
+	// DroppedCommonFreeCpus is the largest number of free CPUs
+	// that a dropped hint had in common with the CPUs allowed
+	// by earlier hints.
+	DroppedCommonFreeCpus int
+}
+
+// Status returns how the hints of the device were used.
+func (r deviceHintResult) Status() deviceHintStatus {
+	switch r.AppliedHints {
+	case r.Hints:
+		return deviceHintApplied
+	case 0:
+		return deviceHintDropped
+	}
+	return deviceHintPartiallyApplied
+}
+
+// String is a stringer for deviceHintResult.
+func (r deviceHintResult) String() string {
+	if r.Status() == deviceHintApplied {
+		return fmt.Sprintf("device %s: hints applied", r.DevicePath)
+	}
+	return fmt.Sprintf("device %s: hints %s, %d/%d hints applied, only %d of %d requested CPUs free within dropped hints",
+		r.DevicePath, r.Status(), r.AppliedHints, r.Hints, r.DroppedCommonFreeCpus, r.RequestedCpus)
+}
+
 // resizeCpusWithDevices prefers allocating CPUs from those freeCpus
 // that are topologically close to preferred devices, and releasing
 // those currentCpus that are not.
@@ -583,14 +3220,18 @@ func (ta *cpuTreeAllocator) resizeCpusWithDevices(resizers []cpuResizerFunc, cur
 	// Applying the first cpusets in it are prioritized over ones
 	// after them.
 	allCloseCpuSets := [][]cpuset.CPUSet{}
+	// hintDevices[i] is the device path of allCloseCpuSets[i].
+	hintDevices := []string{}
 	for _, devPath := range ta.options.preferCloseToDevices {
 		if closeCpuSets := ta.topologyHintCpus(devPath); len(closeCpuSets) > 0 {
 			allCloseCpuSets = append(allCloseCpuSets, closeCpuSets)
+			hintDevices = append(hintDevices, devPath)
 		}
 	}
 	for _, devPath := range ta.options.preferFarFromDevices {
 		for _, farCpuSet := range ta.topologyHintCpus(devPath) {
 			allCloseCpuSets = append(allCloseCpuSets, []cpuset.CPUSet{freeCpus.Difference(farCpuSet)})
+			hintDevices = append(hintDevices, devPath)
 		}
 	}
 	if len(allCloseCpuSets) == 0 {
@@ -605,21 +3246,43 @@ func (ta *cpuTreeAllocator) resizeCpusWithDevices(resizers []cpuResizerFunc, cur
 		remainingFreeCpus := freeCpus
 		appliedHints := 0
 		totalHints := 0
-		for _, closeCpuSets := range allCloseCpuSets {
+		results := []deviceHintResult{}
+		for i, closeCpuSets := range allCloseCpuSets {
+			if len(results) == 0 || results[len(results)-1].DevicePath != hintDevices[i] {
+				results = append(results, deviceHintResult{
+					DevicePath:    hintDevices[i],
+					RequestedCpus: delta,
+				})
+			}
+			result := &results[len(results)-1]
 			for _, cpus := range closeCpuSets {
 				totalHints++
+				result.Hints++
 				newRemainingFreeCpus := remainingFreeCpus.Intersection(cpus)
 				if newRemainingFreeCpus.Size() >= delta {
 					appliedHints++
-					log.Debugf("  - take hinted cpus %q, common free %q", cpus, newRemainingFreeCpus)
+					result.AppliedHints++
+					ta.debugf("  - take hinted cpus %q, common free %q", cpus, newRemainingFreeCpus)
 					remainingFreeCpus = newRemainingFreeCpus
 				} else {
-					log.Debugf("  - drop hinted cpus %q, not enough common free in %q", cpus, newRemainingFreeCpus)
+					result.DroppedCommonFreeCpus = max(result.DroppedCommonFreeCpus, newRemainingFreeCpus.Size())
+					ta.debugf("  - drop hinted cpus %q, not enough common free in %q", cpus, newRemainingFreeCpus)
 				}
 			}
 		}
-		log.Debugf("  - original free cpus %q, took %d/%d hints, remaining free: %q",
+		ta.debugf("  - original free cpus %q, took %d/%d hints, remaining free: %q",
 			freeCpus, appliedHints, totalHints, remainingFreeCpus)
+		for _, result := range results {
+			ta.debugf("  - %s", result)
+		}
+		if ta.options.onDeviceHints != nil {
+			ta.options.onDeviceHints(results)
+		}
+		if ta.options.requireCloseToDevices {
+			if err := ta.unsatisfiedDevices(results, delta); err != nil {
+				return freeCpus, currentCpus, err
+			}
+		}
 		return ta.nextCpuResizer(resizers, currentCpus, remainingFreeCpus, delta)
 	} else if delta < 0 {
 		// Free N=-delta CPUs from currentCpus based on topology hints.
@@ -636,8 +3299,8 @@ func (ta *cpuTreeAllocator) resizeCpusWithDevices(resizers []cpuResizerFunc, cur
 				}
 			}
 		}
-		leastHintedCpus := currentCpus.UnsortedList()
-		sort.Slice(leastHintedCpus, func(i, j int) bool {
+		leastHintedCpus := currentCpus.List()
+		sort.SliceStable(leastHintedCpus, func(i, j int) bool {
 			return currentCpuHints[leastHintedCpus[i]] < currentCpuHints[leastHintedCpus[j]]
 		})
 		maxHints := currentCpuHints[leastHintedCpus[-delta]]
@@ -651,7 +3314,7 @@ func (ta *cpuTreeAllocator) resizeCpusWithDevices(resizers []cpuResizerFunc, cur
 			}
 		}
 		remainingDelta := delta + currentToFreeForSure.Size()
-		log.Debugf("  - device hints: from cpus %q: free for sure: %q and %d more from: %q",
+		ta.debugf("  - device hints: from cpus %q: free for sure: %q and %d more from: %q",
 			currentCpus, currentToFreeForSure, -remainingDelta, currentToFreeMaybe)
 		_, freeFromMaybe, err := ta.nextCpuResizer(resizers, currentToFreeMaybe, freeCpus, remainingDelta)
 		// Do not include possible extra CPUs from
@@ -668,21 +3331,399 @@ func (ta *cpuTreeAllocator) resizeCpusWithDevices(resizers []cpuResizerFunc, cur
 	return freeCpus, currentCpus, nil
 }
 
-// Fetch cached topology hint, return error only once per bad dev
+// resizeCpusInEmptiestPackage confines allocating CPUs to the package
+// with most free CPUs, if the package has at least delta free
+// CPUs. Otherwise CPUs are allocated across packages as usual.
+func (ta *cpuTreeAllocator) resizeCpusInEmptiestPackage(resizers []cpuResizerFunc, currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error) {
+	if !ta.options.preferEmptiestPackage || delta <= 0 {
+		return ta.nextCpuResizer(resizers, currentCpus, freeCpus, delta)
+	}
+	emptiestFreeCpus := cpuset.New()
+	for _, tn := range ta.root.NodesAtLevel(CPUTopologyLevelPackage) {
+		if pkgFreeCpus := tn.cpus.Intersection(freeCpus); pkgFreeCpus.Size() > emptiestFreeCpus.Size() {
+			emptiestFreeCpus = pkgFreeCpus
+		}
+	}
+	if emptiestFreeCpus.Size() < delta {
+		ta.debugf("  - no package has %d free cpus, allocating across packages", delta)
+		return ta.nextCpuResizer(resizers, currentCpus, freeCpus, delta)
+	}
+	ta.debugf("  - allocating from emptiest package, free cpus %q", emptiestFreeCpus)
+	return ta.nextCpuResizer(resizers, currentCpus, emptiestFreeCpus, delta)
+}
+
+// unsatisfiedDevices returns an ErrDeviceLocalityUnsatisfiable naming
+// the devices in preferCloseToDevices whose topology hints all had to
+// be dropped, or nil if CPUs can be allocated close to all devices.
+func (ta *cpuTreeAllocator) unsatisfiedDevices(results []deviceHintResult, delta int) error {
+	devices := []string{}
+	for _, result := range results {
+		if result.Status() == deviceHintDropped && slices.Contains(ta.options.preferCloseToDevices, result.DevicePath) {
+			devices = append(devices, result.DevicePath)
+		}
+	}
+	if len(devices) == 0 {
+		return nil
+	}
+	return &ErrDeviceLocalityUnsatisfiable{
+		Devices:       devices,
+		RequestedCpus: delta,
+	}
+}
+
+// Fetch cached topology hint, return error only once per bad dev.
+// dev is either a path or a network interface name, like "eth0".
+// If a hint has no CPUs, like for devices that only have numa_node in
+// sysfs, CPUs of the hinted NUMA nodes in the tree are used instead.
 func (ta *cpuTreeAllocator) topologyHintCpus(dev string) []cpuset.CPUSet {
 	if closeCpuSets, ok := ta.cacheCloseCpuSets[dev]; ok {
 		return closeCpuSets
 	}
-	topologyHints, err := topology.NewTopologyHints(dev)
+	closeCpuSets := ta.options.deviceHints.get(dev, ta.resolveTopologyHintCpus)
+	ta.cacheCloseCpuSets[dev] = closeCpuSets
+	return closeCpuSets
+}
+
+// PrewarmDeviceHints resolves topology hints of devices into the
+// device hint cache of the allocator, so that the first allocation
+// close to or far from a device does not need to read sysfs. Failures
+// are logged and cached like in allocations. PrewarmDeviceHints is
+// safe to call concurrently with allocations that share the cache.
+func (ta *cpuTreeAllocator) PrewarmDeviceHints(devices []string) {
+	for _, dev := range devices {
+		closeCpuSets := ta.options.deviceHints.get(dev, ta.resolveTopologyHintCpus)
+		ta.debugf("prewarmed device %q topology hints: %v", dev, closeCpuSets)
+	}
+}
+
+// deviceSysfsPaths returns the sysfs paths of a device. The device is
+// either a sysfs path, a filesystem path, like a mount point, or a
+// network interface name. A filesystem path resolves to the block
+// devices backing the filesystem.
+func deviceSysfsPaths(dev string) ([]string, error) {
+	if !strings.Contains(dev, "/") {
+		// Not a path, expect a network interface name.
+		devPath := "/sys/class/net/" + dev + "/device"
+		log.Debugf("device %q: using network interface device %q", dev, devPath)
+		return []string{devPath}, nil
+	}
+	if !isFilesystemPath(dev) {
+		return []string{dev}, nil
+	}
+	devPaths, err := topology.FindBlockDevices(dev)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find block devices of %q: %w", dev, err)
+	}
+	log.Debugf("device %q: using block devices %q backing the filesystem", dev, devPaths)
+	return devPaths, nil
+}
+
+// isFilesystemPath returns true if dev is a path outside sysfs.
+func isFilesystemPath(dev string) bool {
+	return strings.Contains(dev, "/") && !strings.HasPrefix(dev, "/sys/")
+}
+
+// deviceTopologyHints returns the topology hints of all sysfs paths
+// of a device.
+func deviceTopologyHints(dev string) (topology.Hints, error) {
+	devPaths, err := deviceSysfsPaths(dev)
+	if err != nil {
+		return nil, err
+	}
+	hints := topology.Hints{}
+	for _, devPath := range devPaths {
+		devHints, err := topology.NewTopologyHints(devPath)
+		if err != nil {
+			return nil, err
+		}
+		hints = topology.MergeTopologyHints(hints, devHints)
+	}
+	return hints, nil
+}
+
+// ValidateDevices checks that devices, like those in
+// preferCloseToDevices and preferFarFromDevices, exist in sysfs.
+// Virtual devices in allocator options are always valid. The
+// returned error lists all missing devices.
+func (ta *cpuTreeAllocator) ValidateDevices(devices []string) error {
+	errs := []error{}
+	for _, dev := range devices {
+		if _, ok := ta.options.virtDevCpusets[dev]; ok {
+			continue
+		}
+		if _, err := deviceTopologyHints(dev); err != nil {
+			errs = append(errs, fmt.Errorf("device %q not found: %w", dev, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// resolveTopologyHintCpus reads the topology hints of a device and
+// returns the CPUs close to it. Errors are logged and result in no
+// CPUs. The hints of the devices backing a filesystem path, like the
+// devices of an LVM volume, are combined into a single union.
+func (ta *cpuTreeAllocator) resolveTopologyHintCpus(dev string) []cpuset.CPUSet {
+	closeCpuSets := []cpuset.CPUSet{}
+	topologyHints, err := deviceTopologyHints(dev)
 	if err != nil {
 		log.Errorf("failed to find topology of device %q: %v", dev, err)
-		ta.cacheCloseCpuSets[dev] = []cpuset.CPUSet{}
 	} else {
-		for _, topologyHint := range topologyHints {
-			ta.cacheCloseCpuSets[dev] = append(ta.cacheCloseCpuSets[dev], cpuset.MustParse(topologyHint.CPUs))
+		for _, topologyHint := range orderedTopologyHints(topologyHints) {
+			if topologyHint.CPUs == "" {
+				// Device has only numa_node. The topology
+				// package reports it in Sockets if the
+				// parent devices have no CPUs either.
+				numas := topologyHint.NUMAs
+				if numas == "" {
+					numas = topologyHint.Sockets
+				}
+				cpus, err := ta.numaNodeCpus(numas)
+				if err != nil {
+					log.Errorf("bad NUMA node hint %q for device %q: %v", numas, dev, err)
+					continue
+				}
+				ta.debugf("device %q: using cpus %q of NUMA nodes %q as topology hint", dev, cpus, numas)
+				closeCpuSets = append(closeCpuSets, cpus)
+				continue
+			}
+			ta.debugf("device %q: using cpus %q as topology hint", dev, topologyHint.CPUs)
+			closeCpuSets = append(closeCpuSets, cpuset.MustParse(topologyHint.CPUs))
+		}
+	}
+	if isFilesystemPath(dev) && len(closeCpuSets) > 1 {
+		union := cpuset.New()
+		for _, cpus := range closeCpuSets {
+			union = union.Union(cpus)
+		}
+		ta.debugf("device %q: using union %q of hints of backing devices", dev, union)
+		closeCpuSets = []cpuset.CPUSet{union}
+	}
+	return closeCpuSets
+}
+
+// orderedTopologyHints returns topology hints in a stable order, so
+// that allocations with conflicting hints of a device, like hints of
+// devices it depends on, always give the same result. Hints are
+// ordered by provider.
+func orderedTopologyHints(hints topology.Hints) []topology.Hint {
+	providers := make([]string, 0, len(hints))
+	for provider := range hints {
+		providers = append(providers, provider)
+	}
+	sort.Strings(providers)
+	ordered := make([]topology.Hint, 0, len(hints))
+	for _, provider := range providers {
+		ordered = append(ordered, hints[provider])
+	}
+	return ordered
+}
+
+// LocalDevices returns those devices in devPaths whose topology hints
+// intersect with cpus. This helps verifying that CPUs were allocated
+// close to the devices they were supposed to be close to.
+func (ta *cpuTreeAllocator) LocalDevices(devPaths []string, cpus cpuset.CPUSet) []string {
+	localDevs := []string{}
+	for _, devPath := range devPaths {
+		for _, hintCpus := range ta.topologyHintCpus(devPath) {
+			if !hintCpus.Intersection(cpus).IsEmpty() {
+				localDevs = append(localDevs, devPath)
+				break
+			}
+		}
+	}
+	return localDevs
+}
+
+// numaNodeCpus returns CPUs of NUMA nodes in the tree. numas is a
+// list of NUMA node ids, for instance "0,2-3".
+func (ta *cpuTreeAllocator) numaNodeCpus(numas string) (cpuset.CPUSet, error) {
+	numaIds, err := cpuset.Parse(numas)
+	if err != nil {
+		return emptyCpuSet, err
+	}
+	cpus := cpuset.New()
+	for _, tn := range ta.root.NodesAtLevel(CPUTopologyLevelNuma) {
+		if numaIds.Contains(tn.id) {
+			cpus = cpus.Union(tn.cpus)
+		}
+	}
+	return cpus, nil
+}
+
+// preferredNumaNodeIndex returns the index of the first node in
+// sorted tnas that is within preferNumaNodes, or -1 if there is
+// none. Nodes in tnas are expected to have enough free CPUs.
+func (ta *cpuTreeAllocator) preferredNumaNodeIndex(tnas []cpuTreeNodeAttributes) int {
+	numaIds := make([]string, 0, len(ta.options.preferNumaNodes))
+	for _, id := range ta.options.preferNumaNodes {
+		numaIds = append(numaIds, strconv.Itoa(id))
+	}
+	preferredCpus, err := ta.numaNodeCpus(strings.Join(numaIds, ","))
+	if err != nil || preferredCpus.IsEmpty() {
+		ta.debugf("no CPUs in preferred NUMA nodes %v", ta.options.preferNumaNodes)
+		return -1
+	}
+	i := slices.IndexFunc(tnas, func(tna cpuTreeNodeAttributes) bool {
+		return tna.t.cpus.IsSubsetOf(preferredCpus)
+	})
+	if i < 0 {
+		ta.debugf("not enough free CPUs in preferred NUMA nodes %v", ta.options.preferNumaNodes)
+	}
+	return i
+}
+
+// unpressuredIndex returns the index of the first node in sorted tnas
+// that is as good as tnas[0], but not in a NUMA node under memory
+// pressure. Returns 0 if tnas[0] is not under pressure or there is no
+// such alternative. Nodes above the NUMA level are never considered
+// to be under pressure.
+func (ta *cpuTreeAllocator) unpressuredIndex(tnas []cpuTreeNodeAttributes) int {
+	pressured := func(tna *cpuTreeNodeAttributes) bool {
+		numa := tna.t.numaNode()
+		return numa != nil && ta.options.nodePressure(numa.id) > ta.options.nodePressureThreshold
+	}
+	if len(tnas) == 0 || !pressured(&tnas[0]) {
+		return 0
+	}
+	for i := 1; i < len(tnas) && tnas[i].sameRank(&tnas[0]); i++ {
+		if !pressured(&tnas[i]) {
+			ta.debugf("avoiding NUMA node of %s under memory pressure, using %s", tnas[0].t.name, tnas[i].t.name)
+			return i
+		}
+	}
+	return 0
+}
+
+// peerAvoidingIndex returns the index of the node in sorted tnas that
+// is as local to current CPUs as tnas[0], but is adjacent to the fewest
+// CPUs of peer balloons. A node is adjacent to peer CPUs in its parent
+// node, as peers are likely to grow there. Returns 0 if tnas[0] is the
+// best choice.
+func (ta *cpuTreeAllocator) peerAvoidingIndex(tnas []cpuTreeNodeAttributes) int {
+	peerCpus := cpuset.New().Union(ta.options.peerCurrentCpus...)
+	adjacency := func(tna *cpuTreeNodeAttributes) int {
+		neighborhood := tna.t
+		if neighborhood.parent != nil {
+			neighborhood = neighborhood.parent
+		}
+		return neighborhood.cpus.Intersection(peerCpus).Size()
+	}
+	if len(tnas) == 0 {
+		return 0
+	}
+	best, bestAdjacency := 0, adjacency(&tnas[0])
+	for i := 1; i < len(tnas) && bestAdjacency > 0; i++ {
+		if tnas[i].depth != tnas[0].depth || !slices.Equal(tnas[i].currentCpuCounts, tnas[0].currentCpuCounts) {
+			continue
+		}
+		if a := adjacency(&tnas[i]); a < bestAdjacency {
+			best, bestAdjacency = i, a
+		}
+	}
+	if best > 0 {
+		ta.debugf("avoiding peer CPUs next to %s, using %s", tnas[0].t.name, tnas[best].t.name)
+	}
+	return best
+}
+
+// sameRank returns true if the nodes differ only by names in
+// allocation comparison.
+func (tna *cpuTreeNodeAttributes) sameRank(other *cpuTreeNodeAttributes) bool {
+	return tna.depth == other.depth &&
+		slices.Equal(tna.currentCpuCounts, other.currentCpuCounts) &&
+		slices.Equal(tna.freeCpuCounts, other.freeCpuCounts) &&
+		tna.t.MaxFreqKHz() == other.t.MaxFreqKHz()
+}
+
+// resizeCpusPackSiblings allocates hyperthreads of the same physical
+// core after each other: once a thread of a core is allocated, its
+// free siblings are allocated before any other CPU. When starting a
+// new core, a core with all threads free is preferred.
+func (ta *cpuTreeAllocator) resizeCpusPackSiblings(resizers []cpuResizerFunc, currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error) {
+	if !ta.options.preferPackSiblings || delta <= 0 {
+		return ta.nextCpuResizer(resizers, currentCpus, freeCpus, delta)
+	}
+	if ta.options.preferSpreadOnPhysicalCores {
+		return freeCpus, emptyCpuSet, fmt.Errorf("preferPackSiblings and preferSpreadOnPhysicalCores cannot be used together")
+	}
+	addFrom := cpuset.New()
+	for addFrom.Size() < delta {
+		siblings := ta.coreSiblingCpus(currentCpus).Intersection(freeCpus)
+		if siblings.IsEmpty() {
+			addFromSuperset, _, err := ta.nextCpuResizer(resizers, currentCpus, freeCpus, delta-addFrom.Size())
+			if err != nil {
+				return addFromSuperset, emptyCpuSet, err
+			}
+			siblings = addFromSuperset
+			for _, cpu := range addFromSuperset.List() {
+				if ta.coreSiblingCpus(cpuset.New(cpu)).IsSubsetOf(freeCpus) {
+					siblings = cpuset.New(cpu)
+					break
+				}
+			}
+		}
+		addCpu := cpuset.New(siblings.List()[0])
+		addFrom = addFrom.Union(addCpu)
+		currentCpus = currentCpus.Union(addCpu)
+		freeCpus = freeCpus.Difference(addCpu)
+	}
+	return addFrom, emptyCpuSet, nil
+}
+
+// resizeCpusEmptyWholeNode releases CPUs from the NUMA node that is
+// closest to becoming completely free. Nodes are scored by the number
+// of CPUs that remain in use, by anyone, after releasing as many of
+// the requested CPUs as possible from the node. If the node has fewer
+// current CPUs than are released, all of them are released and the
+// rest are chosen from other nodes the same way.
+func (ta *cpuTreeAllocator) resizeCpusEmptyWholeNode(resizers []cpuResizerFunc, currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error) {
+	if !ta.options.preferEmptyWholeNode || delta >= 0 {
+		return ta.nextCpuResizer(resizers, currentCpus, freeCpus, delta)
+	}
+	var bestNode *cpuTreeNode
+	bestInUse, bestCurrent := 0, 0
+	for _, node := range ta.topologyRoot.NodesAtLevel(CPUTopologyLevelNuma) {
+		nodeCurrent := node.cpus.Intersection(currentCpus).Size()
+		if nodeCurrent == 0 {
+			continue
+		}
+		inUse := node.cpus.Size() - node.cpus.Intersection(freeCpus).Size() - min(nodeCurrent, -delta)
+		if bestNode == nil || inUse < bestInUse || (inUse == bestInUse && nodeCurrent < bestCurrent) {
+			bestNode, bestInUse, bestCurrent = node, inUse, nodeCurrent
+		}
+	}
+	if bestNode == nil {
+		return ta.nextCpuResizer(resizers, currentCpus, freeCpus, delta)
+	}
+	nodeCpus := bestNode.cpus.Intersection(currentCpus)
+	ta.debugf("- releasing from node %s, %d CPUs remain in use", bestNode.name, bestInUse)
+	if nodeCpus.Size() >= -delta {
+		return ta.nextCpuResizer(resizers, nodeCpus, freeCpus, delta)
+	}
+	// Release all current CPUs of the node, and the rest from
+	// other nodes.
+	restDelta := delta + nodeCpus.Size()
+	addFrom, restRemoveFrom, err := ta.resizeCpusEmptyWholeNode(resizers, currentCpus.Difference(nodeCpus), freeCpus.Union(nodeCpus), restDelta)
+	if err != nil {
+		return addFrom, restRemoveFrom, err
+	}
+	if restRemoveFrom.Size() > -restDelta {
+		restRemoveFrom = cpuset.New(restRemoveFrom.List()[:-restDelta]...)
+	}
+	return addFrom, nodeCpus.Union(restRemoveFrom), nil
+}
+
+// coreSiblingCpus returns all hyperthreads of the physical cores of
+// cpus.
+func (ta *cpuTreeAllocator) coreSiblingCpus(cpus cpuset.CPUSet) cpuset.CPUSet {
+	siblings := cpuset.New()
+	for _, cpu := range cpus.UnsortedList() {
+		if siblings.Contains(cpu) {
+			continue
 		}
+		siblings = siblings.Union(ta.topologyRoot.CoreSiblings(cpu))
 	}
-	return ta.cacheCloseCpuSets[dev]
+	return siblings
 }
 
 func (ta *cpuTreeAllocator) resizeCpusOneAtATime(resizers []cpuResizerFunc, currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error) {
@@ -699,6 +3740,9 @@ func (ta *cpuTreeAllocator) resizeCpusOneAtATime(resizers []cpuResizerFunc, curr
 		// set by adding one CPU at a time.
 		addFrom := cpuset.New()
 		for n := 0; n < delta; n++ {
+			if err := ta.checkIterations(n); err != nil {
+				return addFromSuperset, removeFromSuperset, err
+			}
 			addSingleFrom, _, err := ta.nextCpuResizer(resizers, currentCpus, freeCpus, 1)
 			if err != nil {
 				return addFromSuperset, removeFromSuperset, err
@@ -724,7 +3768,16 @@ func (ta *cpuTreeAllocator) resizeCpusOneAtATime(resizers []cpuResizerFunc, curr
 	removeFrom := cpuset.New()
 	addFrom := cpuset.New()
 	for n := 0; n < -delta; n++ {
-		_, removeSingleFrom, err := ta.nextCpuResizer(resizers, currentCpus, freeCpus, -1)
+		if err := ta.checkIterations(n); err != nil {
+			return addFrom, removeFrom, err
+		}
+		removeCandidates := currentCpus
+		if ta.options.preferSpreadOnPhysicalCores && ta.options.releaseLoneThreadsFirst {
+			if loneCpus := ta.loneThreadCpus(currentCpus, freeCpus); !loneCpus.IsEmpty() {
+				removeCandidates = loneCpus
+			}
+		}
+		_, removeSingleFrom, err := ta.nextCpuResizer(resizers, removeCandidates, freeCpus, -1)
 		if err != nil {
 			return addFrom, removeFrom, err
 		}
@@ -747,8 +3800,73 @@ func (ta *cpuTreeAllocator) resizeCpusOneAtATime(resizers []cpuResizerFunc, curr
 	return addFrom, removeFrom, nil
 }
 
+// checkIterations returns an internal error if a loop that allocates
+// or releases one CPU at a time is about to run its n'th round, but
+// every CPU in the system has already been handled. This stops a
+// misbehaving resizer from making the loop spin.
+func (ta *cpuTreeAllocator) checkIterations(n int) error {
+	if maxIterations := ta.topologyRoot.cpus.Size(); n >= maxIterations {
+		return fmt.Errorf("internal error: resizing one CPU at a time exceeded %d rounds, "+
+			"the number of CPUs in the system", maxIterations)
+	}
+	return nil
+}
+
+// hasHeadroom returns true if allocating delta CPUs from a node
+// leaves at least headroom free CPUs in the NUMA node of the node. For
+// nodes above the NUMA level, the headroom of all NUMA nodes in the
+// branch is required in total.
+func (ta *cpuTreeAllocator) hasHeadroom(tna *cpuTreeNodeAttributes, delta, headroom int) bool {
+	if numaFree := tna.freeCpuCountAt(CPUTopologyLevelNuma); numaFree >= 0 {
+		return numaFree-delta >= headroom
+	}
+	numaNodes := len(tna.t.FindAll(func(tn *cpuTreeNode) bool {
+		return tn.level == CPUTopologyLevelNuma
+	}))
+	return tna.freeCpuCount-delta >= headroom*numaNodes
+}
+
+// idleSiblingCpus returns the first thread of every physical core
+// whose all threads are in freeCpus.
+func (ta *cpuTreeAllocator) idleSiblingCpus(freeCpus cpuset.CPUSet) cpuset.CPUSet {
+	idleCpus := []int{}
+	for _, core := range ta.topologyRoot.NodesAtLevel(CPUTopologyLevelCore) {
+		if core.cpus.IsEmpty() || !core.cpus.IsSubsetOf(freeCpus) {
+			continue
+		}
+		idleCpus = append(idleCpus, core.cpus.List()[0])
+	}
+	return cpuset.New(idleCpus...)
+}
+
+// loneThreadCpus returns those currentCpus whose physical core has
+// free CPUs.
+func (ta *cpuTreeAllocator) loneThreadCpus(currentCpus, freeCpus cpuset.CPUSet) cpuset.CPUSet {
+	loneCpus := cpuset.New()
+	for _, core := range ta.topologyRoot.NodesAtLevel(CPUTopologyLevelCore) {
+		if core.cpus.Intersection(freeCpus).IsEmpty() {
+			continue
+		}
+		loneCpus = loneCpus.Union(core.cpus.Intersection(currentCpus))
+	}
+	return loneCpus
+}
+
 func (ta *cpuTreeAllocator) resizeCpusMaxLocalSet(resizers []cpuResizerFunc, currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error) {
-	tnas := ta.root.ToAttributedSlice(currentCpus, freeCpus,
+	if delta > 0 && ta.options.preferIdleSibling {
+		if idleCpus := ta.idleSiblingCpus(freeCpus); idleCpus.Size() >= delta {
+			freeCpus = idleCpus
+		} else {
+			ta.debugf("only %d CPUs with idle siblings, cannot allocate %d CPUs from them", idleCpus.Size(), delta)
+		}
+	}
+	headroom := 0
+	if delta > 0 {
+		headroom = ta.options.perNodeHeadroom
+	}
+	buf := getCpuTreeAttrBuffer()
+	defer buf.release()
+	tnas := ta.root.toAttributedSliceBuf(buf, currentCpus, freeCpus,
 		func(tna *cpuTreeNodeAttributes) bool {
 			// filter out branches with insufficient cpus
 			if delta > 0 && tna.freeCpuCount-delta < 0 {
@@ -761,6 +3879,32 @@ func (ta *cpuTreeAllocator) resizeCpusMaxLocalSet(resizers []cpuResizerFunc, cur
 			}
 			return true
 		})
+	if headroom > 0 {
+		withHeadroom := slices.DeleteFunc(slices.Clone(tnas), func(tna cpuTreeNodeAttributes) bool {
+			return !ta.hasHeadroom(&tna, delta, headroom)
+		})
+		if len(withHeadroom) > 0 {
+			tnas = withHeadroom
+		} else {
+			ta.debugf("no NUMA node can allocate %d CPUs and keep %d CPUs free, ignoring headroom", delta, headroom)
+		}
+	}
+	if delta > 0 && ta.options.singlePackageOnly {
+		// Nodes above the package level cannot be filtered out
+		// while walking the tree, otherwise packages would be
+		// skipped, too. Drop them and nodes in packages other
+		// than the package of current cpus now.
+		tnas = slices.DeleteFunc(tnas, func(tna cpuTreeNodeAttributes) bool {
+			pkg := tna.t.packageNode()
+			return pkg == nil || !currentCpus.IsSubsetOf(pkg.cpus)
+		})
+	}
+	if delta > 0 && ta.options.singleNumaOnly {
+		tnas = slices.DeleteFunc(tnas, func(tna cpuTreeNodeAttributes) bool {
+			numa := tna.t.numaNode()
+			return numa == nil || !currentCpus.IsSubsetOf(numa.cpus)
+		})
+	}
 
 	// Sort based on attributes
 	if delta > 0 {
@@ -768,7 +3912,31 @@ func (ta *cpuTreeAllocator) resizeCpusMaxLocalSet(resizers []cpuResizerFunc, cur
 	} else {
 		sort.Slice(tnas, ta.sorterRelease(tnas))
 	}
+	if delta > 0 && ta.options.nodePressure != nil {
+		if i := ta.unpressuredIndex(tnas); i > 0 {
+			tnas[0] = tnas[i]
+		}
+	}
+	if delta > 0 && len(ta.options.peerCurrentCpus) > 0 {
+		if i := ta.peerAvoidingIndex(tnas); i > 0 {
+			tnas[0] = tnas[i]
+		}
+	}
+	if delta > 0 && len(ta.options.preferNumaNodes) > 0 {
+		if i := ta.preferredNumaNodeIndex(tnas); i > 0 {
+			tnas[0] = tnas[i]
+		}
+	}
 	if len(tnas) == 0 {
+		if delta > 0 {
+			ta.allocationFailed(delta, freeCpus)
+			if ta.options.singlePackageOnly {
+				return freeCpus, currentCpus, fmt.Errorf("not enough free CPUs in a single package to allocate %d CPUs", delta)
+			}
+			if ta.options.singleNumaOnly {
+				return freeCpus, currentCpus, fmt.Errorf("not enough free CPUs in a single NUMA node to allocate %d CPUs", delta)
+			}
+		}
 		return freeCpus, currentCpus, fmt.Errorf("not enough free CPUs")
 	}
 	return ta.nextCpuResizer(resizers, tnas[0].currentCpus, tnas[0].freeCpus, delta)
@@ -15,12 +15,23 @@
 package balloons
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/containers/nri-plugins/pkg/cgroups"
+	"github.com/containers/nri-plugins/pkg/cpuallocator"
+	system "github.com/containers/nri-plugins/pkg/sysfs"
+	"github.com/containers/nri-plugins/pkg/topology"
 	"github.com/containers/nri-plugins/pkg/utils/cpuset"
+	"github.com/intel/goresctrl/pkg/sst"
+	"golang.org/x/sys/unix"
 )
 
 type cpuInTopology struct {
@@ -65,6 +76,182 @@ func (csit cpusInTopology) dumps(nameCpus map[string]cpuset.CPUSet) string {
 	return strings.Join(lines, "\n")
 }
 
+// fakeSystem implements the parts of system.System that are needed
+// for constructing a CPU tree and a CPU allocator. Calling other
+// methods panics.
+type fakeSystem struct {
+	system.System
+	pkgs     map[int]*fakePackage
+	nodes    map[int]*fakeNode
+	cpus     map[int]*fakeCpu
+	nohzFull cpuset.CPUSet
+	bootCpu  int
+}
+
+type fakePackage struct {
+	system.CPUPackage
+	dieNodes map[int][]int
+	cpus     cpuset.CPUSet
+}
+
+type fakeNode struct {
+	system.Node
+	cpus    cpuset.CPUSet
+	memInfo *system.MemInfo
+}
+
+type fakeCpu struct {
+	system.CPU
+	pkg      int
+	threads  cpuset.CPUSet
+	online   bool
+	freq     system.CPUFreq
+	capacity uint64
+}
+
+func (s *fakeSystem) PackageIDs() []int {
+	ids := []int{}
+	for id := range s.pkgs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func (s *fakeSystem) CPUIDs() []int {
+	ids := []int{}
+	for id := range s.cpus {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func (s *fakeSystem) NodeIDs() []int {
+	ids := []int{}
+	for id := range s.nodes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func (s *fakeSystem) OnlineCPUs() cpuset.CPUSet {
+	ids := []int{}
+	for id, cpu := range s.cpus {
+		if cpu.online {
+			ids = append(ids, id)
+		}
+	}
+	return cpuset.New(ids...)
+}
+
+func (s *fakeSystem) OfflineCPUs() cpuset.CPUSet {
+	ids := []int{}
+	for id, cpu := range s.cpus {
+		if !cpu.online {
+			ids = append(ids, id)
+		}
+	}
+	return cpuset.New(ids...)
+}
+
+func (s *fakeSystem) Offlined() cpuset.CPUSet { return s.OfflineCPUs() }
+func (s *fakeSystem) CoreKinds() []system.CoreKind {
+	return []system.CoreKind{system.PerformanceCore}
+}
+func (s *fakeSystem) CoreKindCPUs(kind system.CoreKind) cpuset.CPUSet {
+	if kind == system.PerformanceCore {
+		return s.OnlineCPUs()
+	}
+	return cpuset.New()
+}
+
+func (s *fakeSystem) Package(id int) system.CPUPackage { return s.pkgs[id] }
+func (s *fakeSystem) Node(id int) system.Node          { return s.nodes[id] }
+func (s *fakeSystem) CPU(id int) system.CPU            { return s.cpus[id] }
+func (s *fakeSystem) NohzFullCPUs() cpuset.CPUSet      { return s.nohzFull }
+func (s *fakeSystem) BootCPU() int                     { return s.bootCpu }
+
+func (p *fakePackage) DieIDs() []int {
+	ids := []int{}
+	for id := range p.dieNodes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func (p *fakePackage) DieNodeIDs(id int) []int                           { return p.dieNodes[id] }
+func (p *fakePackage) CPUSet() cpuset.CPUSet                             { return p.cpus }
+func (p *fakePackage) LogicalDieClusterIDs(id int) []int                 { return nil }
+func (p *fakePackage) LogicalDieClusterCPUSet(die, cl int) cpuset.CPUSet { return cpuset.New() }
+func (p *fakePackage) SstInfo() *sst.SstPackageInfo                      { return nil }
+func (n *fakeNode) CPUSet() cpuset.CPUSet                                { return n.cpus }
+func (n *fakeNode) MemoryInfo() (*system.MemInfo, error) {
+	if n.memInfo == nil {
+		return nil, fmt.Errorf("no memory info")
+	}
+	return n.memInfo, nil
+}
+func (c *fakeCpu) ThreadCPUSet() cpuset.CPUSet { return c.threads }
+func (c *fakeCpu) Online() bool                { return c.online }
+func (c *fakeCpu) PackageID() int              { return c.pkg }
+func (c *fakeCpu) CoreKind() system.CoreKind   { return system.PerformanceCore }
+func (c *fakeCpu) BaseFrequency() uint64       { return 0 }
+func (c *fakeCpu) EPP() system.EPP             { return system.EPPUnknown }
+func (c *fakeCpu) FrequencyRange() system.CPUFreq {
+	return c.freq
+}
+func (c *fakeCpu) GetLastLevelCaches() []*system.Cache {
+	return nil
+}
+func (c *fakeCpu) GetCaches() []*system.Cache {
+	return nil
+}
+func (c *fakeCpu) Capacity() uint64 {
+	return c.capacity
+}
+
+// newFakeSystemFromInt5 returns a fake system with pdnct[0] packages,
+// pdnct[1] dies per package, pdnct[2] NUMA nodes per die, pdnct[3]
+// cores per node and pdnct[4] threads per core. CPU and NUMA node ids
+// are assigned in this order, starting from 0. All CPUs are online,
+// and CPU 0 is the boot CPU.
+func newFakeSystemFromInt5(pdnct [5]int) *fakeSystem {
+	sys := &fakeSystem{
+		pkgs:  map[int]*fakePackage{},
+		nodes: map[int]*fakeNode{},
+		cpus:  map[int]*fakeCpu{},
+	}
+	cpuID, nodeID := 0, 0
+	for packageID := 0; packageID < pdnct[0]; packageID++ {
+		pkg := &fakePackage{dieNodes: map[int][]int{}, cpus: cpuset.New()}
+		sys.pkgs[packageID] = pkg
+		for dieID := 0; dieID < pdnct[1]; dieID++ {
+			for numaID := 0; numaID < pdnct[2]; numaID++ {
+				pkg.dieNodes[dieID] = append(pkg.dieNodes[dieID], nodeID)
+				node := &fakeNode{cpus: cpuset.New()}
+				sys.nodes[nodeID] = node
+				nodeID++
+				for coreID := 0; coreID < pdnct[3]; coreID++ {
+					threads := cpuset.New()
+					for threadID := 0; threadID < pdnct[4]; threadID++ {
+						threads = threads.Union(cpuset.New(cpuID + threadID))
+					}
+					for _, id := range threads.List() {
+						sys.cpus[id] = &fakeCpu{pkg: packageID, threads: threads, online: true}
+					}
+					node.cpus = node.cpus.Union(threads)
+					pkg.cpus = pkg.cpus.Union(threads)
+					cpuID += pdnct[4]
+				}
+			}
+		}
+	}
+	return sys
+}
+
 func newCpuTreeFromInt5(pdnct [5]int) (*cpuTreeNode, cpusInTopology) {
 	pkgs := pdnct[0]
 	dies := pdnct[1]
@@ -72,28 +259,35 @@ func newCpuTreeFromInt5(pdnct [5]int) (*cpuTreeNode, cpusInTopology) {
 	cores := pdnct[3]
 	threads := pdnct[4]
 	cpuID := 0
+	numaNodeID := 0
 	sysTree := NewCpuTree("system")
 	sysTree.level = CPUTopologyLevelSystem
 	csit := cpusInTopology{}
 	for packageID := 0; packageID < pkgs; packageID++ {
 		packageTree := NewCpuTree(fmt.Sprintf("p%d", packageID))
 		packageTree.level = CPUTopologyLevelPackage
+		packageTree.id = packageID
 		sysTree.AddChild(packageTree)
 		for dieID := 0; dieID < dies; dieID++ {
 			dieTree := NewCpuTree(fmt.Sprintf("p%dd%d", packageID, dieID))
 			dieTree.level = CPUTopologyLevelDie
+			dieTree.id = dieID
 			packageTree.AddChild(dieTree)
 			for numaID := 0; numaID < numas; numaID++ {
 				numaTree := NewCpuTree(fmt.Sprintf("p%dd%dn%d", packageID, dieID, numaID))
 				numaTree.level = CPUTopologyLevelNuma
+				numaTree.id = numaNodeID
+				numaNodeID++
 				dieTree.AddChild(numaTree)
 				for coreID := 0; coreID < cores; coreID++ {
 					coreTree := NewCpuTree(fmt.Sprintf("p%dd%dn%dc%02d", packageID, dieID, numaID, coreID))
 					coreTree.level = CPUTopologyLevelCore
+					coreTree.id = cpuID
 					numaTree.AddChild(coreTree)
 					for threadID := 0; threadID < threads; threadID++ {
 						threadTree := NewCpuTree(fmt.Sprintf("p%dd%dn%dc%02dt%d", packageID, dieID, numaID, coreID, threadID))
 						threadTree.level = CPUTopologyLevelThread
+						threadTree.id = cpuID
 						coreTree.AddChild(threadTree)
 						threadTree.AddCpus(cpuset.New(cpuID))
 						csit[cpuID] = cpuInTopology{
@@ -709,6 +903,36 @@ func TestWalk(t *testing.T) {
 	})
 }
 
+func TestFind(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{2, 2, 2, 4, 2})
+	numa := tree.Find(func(tn *cpuTreeNode) bool {
+		return tn.level == CPUTopologyLevelNuma && tn.cpus.Contains(20)
+	})
+	if numa == nil || numa.name != "p0d1n0" {
+		t.Errorf("expected to find p0d1n0, got %v", numa)
+	}
+	if found := tree.Find(func(tn *cpuTreeNode) bool { return tn.cpus.Contains(1000) }); found != nil {
+		t.Errorf("expected to find nothing, got %s", found)
+	}
+	cores := tree.children[1].FindAll(func(tn *cpuTreeNode) bool {
+		return tn.level == CPUTopologyLevelCore
+	})
+	if len(cores) != 16 {
+		t.Errorf("expected 16 cores in package p1, got %d", len(cores))
+	}
+	for i := 1; i < len(cores); i++ {
+		if cores[i-1].cpus.List()[0] > cores[i].cpus.List()[0] {
+			t.Errorf("expected cores in depth-first order, got %s before %s", cores[i-1], cores[i])
+		}
+	}
+	if found := tree.FindAll(func(tn *cpuTreeNode) bool { return false }); len(found) != 0 {
+		t.Errorf("expected to find nothing, got %v", found)
+	}
+	if leaf := tree.FindLeafWithCpu(63); leaf == nil || leaf.name != "p1d1n1c03t1" {
+		t.Errorf("expected leaf p1d1n1c03t1 with cpu 63, got %v", leaf)
+	}
+}
+
 func TestCpuLocations(t *testing.T) {
 	tree, _ := newCpuTreeFromInt5([5]int{2, 2, 2, 4, 2})
 	cpus := cpuset.New(0, 1, 3, 4, 16)
@@ -736,6 +960,142 @@ func TestCpuLocations(t *testing.T) {
 	}
 }
 
+func TestCpuLocationsAbsolute(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{2, 2, 2, 4, 2})
+	cpus := cpuset.New(0, 1, 3, 4, 16)
+	numa := tree.children[0].children[0].children[0]
+	for _, tc := range []struct {
+		name string
+		node *cpuTreeNode
+	}{
+		{"root", tree},
+		{"numa", numa},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			locations := tc.node.CpuLocationsAbsolute(cpus)
+			if len(locations) != 6 {
+				t.Fatalf("expected 6 levels, got %d", len(locations))
+			}
+			for level := 0; level < tc.node.Depth(); level++ {
+				if locations[level] != nil {
+					t.Errorf("expected nil at level %d above the node, got %v", level, locations[level])
+				}
+			}
+			if got := locations[3]; len(got) == 0 || got[0] != "p0d0n0" {
+				t.Errorf("expected p0d0n0 first at numa level, got %v", got)
+			}
+			if got := locations[5]; len(got) == 0 || got[0] != "p0d0n0c00t0" {
+				t.Errorf("expected p0d0n0c00t0 first at thread level, got %v", got)
+			}
+		})
+	}
+	relative := numa.CpuLocations(cpus)
+	absolute := numa.CpuLocationsAbsolute(cpus)
+	offset := numa.Depth()
+	for i := range relative {
+		if strings.Join(relative[i], ",") != strings.Join(absolute[i+offset], ",") {
+			t.Errorf("relative level %d %v differs from absolute level %d %v",
+				i, relative[i], i+offset, absolute[i+offset])
+		}
+	}
+}
+
+func TestLeaves(t *testing.T) {
+	tree, csit := newCpuTreeFromInt5([5]int{2, 2, 2, 4, 2})
+	leaves := tree.Leaves()
+	if len(leaves) != len(csit) {
+		t.Fatalf("expected %d leaves, got %d", len(csit), len(leaves))
+	}
+	for i, leaf := range leaves {
+		if len(leaf.children) != 0 {
+			t.Errorf("expected leaf, got node %s with children", leaf)
+		}
+		if !leaf.cpus.Equals(cpuset.New(i)) {
+			t.Errorf("expected leaf %d to have cpu %d, got %s", i, i, leaf.cpus)
+		}
+	}
+	numa := tree.children[1].children[0].children[1]
+	numaLeaves := numa.Leaves()
+	if len(numaLeaves) != 8 {
+		t.Errorf("expected 8 leaves in %s, got %d", numa, len(numaLeaves))
+	}
+	if numaLeaves[0].name != "p1d0n1c00t0" || numaLeaves[7].name != "p1d0n1c03t1" {
+		t.Errorf("unexpected leaf order in %s: first %s, last %s", numa, numaLeaves[0], numaLeaves[7])
+	}
+	for _, tn := range []*cpuTreeNode{tree, tree.children[0], numa, numaLeaves[3]} {
+		if !tn.LeafCpus().Equals(tn.Cpus()) {
+			t.Errorf("expected LeafCpus() %s to equal Cpus() %s of %s", tn.LeafCpus(), tn.Cpus(), tn)
+		}
+	}
+}
+
+func TestNodesAtLevel(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{2, 2, 2, 4, 2})
+	nodeNames := func(nodes []*cpuTreeNode) string {
+		names := []string{}
+		for _, tn := range nodes {
+			names = append(names, tn.name)
+		}
+		return strings.Join(names, " ")
+	}
+	numa := tree.children[1].children[0].children[1]
+	split := tree.SplitLevel(CPUTopologyLevelNuma, func(cpu int) int { return cpu % 2 })
+
+	for _, tc := range []struct {
+		name     string
+		tree     *cpuTreeNode
+		level    CPUTopologyLevel
+		expected string
+	}{
+		{
+			name:     "packages",
+			tree:     tree,
+			level:    CPUTopologyLevelPackage,
+			expected: "p0 p1",
+		},
+		{
+			name:     "NUMA nodes",
+			tree:     tree,
+			level:    CPUTopologyLevelNuma,
+			expected: "p0d0n0 p0d0n1 p0d1n0 p0d1n1 p1d0n0 p1d0n1 p1d1n0 p1d1n1",
+		},
+		{
+			name:     "cores in a NUMA node",
+			tree:     numa,
+			level:    CPUTopologyLevelCore,
+			expected: "p1d0n1c00 p1d0n1c01 p1d0n1c02 p1d0n1c03",
+		},
+		{
+			name:     "level of the node itself",
+			tree:     numa,
+			level:    CPUTopologyLevelNuma,
+			expected: "p1d0n1",
+		},
+		{
+			name:     "level above the node",
+			tree:     numa,
+			level:    CPUTopologyLevelPackage,
+			expected: "",
+		},
+		{
+			name:     "split level without classes",
+			tree:     split,
+			level:    CPUTopologyLevelNuma,
+			expected: "p0d0n0 p0d0n1 p0d1n0 p0d1n1 p1d0n0 p1d0n1 p1d1n0 p1d1n1",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := nodeNames(tc.tree.NodesAtLevel(tc.level))
+			if got != tc.expected {
+				t.Errorf("expected nodes %q, got %q", tc.expected, got)
+			}
+			if again := nodeNames(tc.tree.NodesAtLevel(tc.level)); again != got {
+				t.Errorf("unstable order: %q, then %q", got, again)
+			}
+		})
+	}
+}
+
 func TestSplitLevel(t *testing.T) {
 	root, _ := newCpuTreeFromInt5([5]int{2, 2, 2, 4, 2})
 	newRoot := root.SplitLevel(CPUTopologyLevelNuma,
@@ -767,3 +1127,3162 @@ func TestSplitLevel(t *testing.T) {
 		t.Logf("newRoot:\n%s\n", newRoot.PrettyPrint())
 	}
 }
+
+func TestAllocate(t *testing.T) {
+	tree, csit := newCpuTreeFromInt5([5]int{2, 1, 2, 4, 2})
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{})
+	currentCpus := cpuset.New()
+	freeCpus := tree.Cpus()
+	for _, delta := range []int{3, 2, -4, 0, 6} {
+		newCurrentCpus, newFreeCpus, err := treeA.Allocate(currentCpus, freeCpus, delta)
+		if err != nil {
+			t.Fatalf("Allocate(%s, %s, %d) failed: %v", currentCpus, freeCpus, delta, err)
+		}
+		if newCurrentCpus.Size() != currentCpus.Size()+delta {
+			t.Errorf("Allocate(%s, %s, %d): expected %d current CPUs, got %s",
+				currentCpus, freeCpus, delta, currentCpus.Size()+delta, newCurrentCpus)
+		}
+		if newCurrentCpus.Union(newFreeCpus).Size() != tree.Cpus().Size() ||
+			newCurrentCpus.Intersection(newFreeCpus).Size() != 0 {
+			t.Errorf("Allocate(%s, %s, %d): current %s and free %s do not partition all CPUs",
+				currentCpus, freeCpus, delta, newCurrentCpus, newFreeCpus)
+		}
+		currentCpus, freeCpus = newCurrentCpus, newFreeCpus
+		verifySame(t, "package", currentCpus, csit)
+	}
+	if _, _, err := treeA.Allocate(currentCpus, freeCpus, freeCpus.Size()+1); err == nil {
+		t.Errorf("expected error when allocating more than free CPUs")
+	}
+}
+
+// highIdCpuAllocator picks CPUs with the highest ids and records the
+// priorities it was asked to prefer.
+type highIdCpuAllocator struct {
+	prefer []cpuallocator.CPUPriority
+}
+
+func (a *highIdCpuAllocator) AllocateCpus(from *cpuset.CPUSet, cnt int, prefer cpuallocator.CPUPriority) (cpuset.CPUSet, error) {
+	a.prefer = append(a.prefer, prefer)
+	cpus := from.List()
+	result := cpuset.New(cpus[len(cpus)-cnt:]...)
+	*from = from.Difference(result)
+	return result, nil
+}
+
+func (a *highIdCpuAllocator) ReleaseCpus(from *cpuset.CPUSet, cnt int, prefer cpuallocator.CPUPriority) (cpuset.CPUSet, error) {
+	a.prefer = append(a.prefer, prefer)
+	cpus := from.List()
+	kept := cpuset.New(cpus[:len(cpus)-cnt]...)
+	*from = from.Difference(kept)
+	return kept, nil
+}
+
+func (a *highIdCpuAllocator) GetCPUPriorities() map[cpuallocator.CPUPriority]cpuset.CPUSet {
+	return nil
+}
+
+func TestAllocateWithCpuAllocator(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 1, 4, 2})
+	ca := &highIdCpuAllocator{}
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{
+		cpuAllocator:      ca,
+		allocatorPriority: cpuallocator.PriorityLow,
+	})
+	// ResizeCpus considers all free CPUs equally good for three
+	// CPUs, the CPU allocator picks those with the highest ids.
+	currentCpus, freeCpus, err := treeA.Allocate(cpuset.New(), tree.Cpus(), 3)
+	if err != nil {
+		t.Fatalf("Allocate(3) failed: %v", err)
+	}
+	if !currentCpus.Equals(cpuset.New(5, 6, 7)) || !freeCpus.Equals(cpuset.New(0, 1, 2, 3, 4)) {
+		t.Errorf("expected CPUs 5-7 picked by the CPU allocator, got current %s free %s", currentCpus, freeCpus)
+	}
+	currentCpus, freeCpus, err = treeA.Allocate(currentCpus, freeCpus, -2)
+	if err != nil {
+		t.Fatalf("Allocate(-2) failed: %v", err)
+	}
+	if currentCpus.Size() != 1 || freeCpus.Size() != 7 {
+		t.Errorf("expected 2 CPUs released, got current %s free %s", currentCpus, freeCpus)
+	}
+	for _, prefer := range ca.prefer {
+		if prefer != cpuallocator.PriorityLow {
+			t.Errorf("expected CPU allocator to prefer %s, got %s", cpuallocator.PriorityLow, prefer)
+		}
+	}
+	if len(ca.prefer) != 2 {
+		t.Errorf("expected 2 calls to the CPU allocator, got %d", len(ca.prefer))
+	}
+}
+
+func TestPreferHighFreq(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 2, 2, 2})
+	// Make cores on the second NUMA node faster than the rest.
+	for _, tn := range tree.Leaves() {
+		tn.maxFreqKHz = 2000000
+		if strings.HasPrefix(tn.name, "p0d0n1") {
+			tn.maxFreqKHz = 3000000
+		}
+	}
+	if freq := tree.MaxFreqKHz(); freq != 3000000 {
+		t.Errorf("expected system max frequency 3000000 kHz, got %d", freq)
+	}
+	for _, tc := range []struct {
+		preferHighFreq bool
+		expectCpus     cpuset.CPUSet
+	}{
+		{false, cpuset.New(0, 1)},
+		{true, cpuset.New(4, 5)},
+	} {
+		treeA := tree.NewAllocator(cpuTreeAllocatorOptions{preferHighFreq: tc.preferHighFreq})
+		addFrom, _, err := treeA.ResizeCpus(cpuset.New(), tree.Cpus(), 2)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !addFrom.Equals(tc.expectCpus) {
+			t.Errorf("preferHighFreq=%v: expected to allocate from %s, got %s",
+				tc.preferHighFreq, tc.expectCpus, addFrom)
+		}
+	}
+}
+
+func TestReservedCpus(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{2, 1, 2, 2, 2})
+	reserved := cpuset.New(0, 1, 5, 8)
+	for _, tc := range []struct {
+		name    string
+		options cpuTreeAllocatorOptions
+	}{
+		{"pack", cpuTreeAllocatorOptions{}},
+		{"spread", cpuTreeAllocatorOptions{topologyBalancing: true}},
+		{"spread on physical cores", cpuTreeAllocatorOptions{preferSpreadOnPhysicalCores: true}},
+		{"close to reserved", cpuTreeAllocatorOptions{preferCloseToDevices: []string{"/sys/cpus:0-7"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.reservedCpus = reserved
+			treeA := tree.NewAllocator(tc.options)
+			for _, dev := range tc.options.preferCloseToDevices {
+				treeA.cacheCloseCpuSets[dev] = []cpuset.CPUSet{
+					cpuset.MustParse(dev[len("/sys/cpus:"):]),
+				}
+			}
+			currentCpus := cpuset.New()
+			freeCpus := tree.Cpus()
+			for _, delta := range []int{1, 3, 2, -2, 6, -5} {
+				addFrom, removeFrom, err := treeA.ResizeCpus(currentCpus, freeCpus, delta)
+				if err != nil {
+					t.Fatalf("ResizeCpus(%s, %s, %d) failed: %v", currentCpus, freeCpus, delta, err)
+				}
+				if addFrom.Intersection(reserved).Size() > 0 || removeFrom.Intersection(reserved).Size() > 0 {
+					t.Errorf("ResizeCpus(%s, %s, %d): reserved cpus %s in addFrom %s or removeFrom %s",
+						currentCpus, freeCpus, delta, reserved, addFrom, removeFrom)
+				}
+				if currentCpus, freeCpus, err = treeA.Allocate(currentCpus, freeCpus, delta); err != nil {
+					t.Fatalf("Allocate(%s, %s, %d) failed: %v", currentCpus, freeCpus, delta, err)
+				}
+			}
+			// Releasing must not touch reserved CPUs in currentCpus.
+			currentCpus = currentCpus.Union(reserved)
+			_, removeFrom, _ := treeA.ResizeCpus(currentCpus, freeCpus, -1)
+			if removeFrom.Intersection(reserved).Size() > 0 {
+				t.Errorf("reserved cpus %s in removeFrom %s", reserved, removeFrom)
+			}
+			// Allocating all non-reserved free CPUs is possible, one more is not.
+			freeCpus = freeCpus.Union(reserved)
+			if _, _, err := treeA.ResizeCpus(currentCpus, freeCpus, freeCpus.Size()-reserved.Size()+1); err == nil {
+				t.Errorf("expected error when allocating reserved CPUs")
+			}
+		})
+	}
+}
+
+func TestOfflineThreads(t *testing.T) {
+	// SMT disabled: every core has an online and an offline thread.
+	smtOff := newFakeSystemFromInt5([5]int{1, 1, 2, 4, 2})
+	for id, cpu := range smtOff.cpus {
+		cpu.online = id%2 == 0
+	}
+	// Reference: true single-thread cores with the same CPU ids.
+	singleThread := newFakeSystemFromInt5([5]int{1, 1, 2, 4, 2})
+	for id, cpu := range singleThread.cpus {
+		cpu.threads = cpuset.New(id)
+		cpu.online = id%2 == 0
+	}
+	smtOffTree, err := newCpuTreeFromSys(smtOff, nil)
+	if err != nil {
+		t.Fatalf("failed to create tree: %v", err)
+	}
+	singleThreadTree, err := newCpuTreeFromSys(singleThread, nil)
+	if err != nil {
+		t.Fatalf("failed to create tree: %v", err)
+	}
+	onlineCpus := cpuset.New(0, 2, 4, 6, 8, 10, 12, 14)
+	if !smtOffTree.Cpus().Equals(onlineCpus) {
+		t.Errorf("expected tree cpus %s, got %s", onlineCpus, smtOffTree.Cpus())
+	}
+	for _, leaf := range smtOffTree.Leaves() {
+		if leaf.SiblingIndex() != 0 {
+			t.Errorf("expected sibling index 0 for %s, got %d", leaf, leaf.SiblingIndex())
+		}
+	}
+	smtOffA := smtOffTree.NewAllocator(cpuTreeAllocatorOptions{preferSpreadOnPhysicalCores: true})
+	singleThreadA := singleThreadTree.NewAllocator(cpuTreeAllocatorOptions{preferSpreadOnPhysicalCores: true})
+	smtOffCurrent, smtOffFree := cpuset.New(), smtOffTree.Cpus()
+	singleThreadCurrent, singleThreadFree := cpuset.New(), singleThreadTree.Cpus()
+	for _, delta := range []int{1, 2, 3, -2, 4, -6} {
+		var err error
+		if smtOffCurrent, smtOffFree, err = smtOffA.Allocate(smtOffCurrent, smtOffFree, delta); err != nil {
+			t.Fatalf("SMT off: Allocate(%d) failed: %v", delta, err)
+		}
+		if singleThreadCurrent, singleThreadFree, err = singleThreadA.Allocate(singleThreadCurrent, singleThreadFree, delta); err != nil {
+			t.Fatalf("single thread: Allocate(%d) failed: %v", delta, err)
+		}
+		if !smtOffCurrent.Equals(singleThreadCurrent) {
+			t.Errorf("after Allocate(%d) expected SMT off cpus %s to equal single thread cpus %s",
+				delta, smtOffCurrent, singleThreadCurrent)
+		}
+	}
+}
+
+func TestPreferEmptiestPackage(t *testing.T) {
+	tree, csit := newCpuTreeFromInt5([5]int{2, 1, 2, 4, 2})
+	// Package p0 has 12 free CPUs, but they are spread over NUMA
+	// nodes. Package p1 has 14 free CPUs.
+	freeCpus := tree.Cpus().Difference(cpuset.New(0, 1, 8, 9, 16, 17))
+	for _, tc := range []struct {
+		name          string
+		delta         int
+		expectPackage string
+	}{
+		{"fits in emptiest package", 4, "p1"},
+		{"fills emptiest package", 14, "p1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			treeA := tree.NewAllocator(cpuTreeAllocatorOptions{preferEmptiestPackage: true})
+			currentCpus, _, err := treeA.Allocate(cpuset.New(), freeCpus, tc.delta)
+			if err != nil {
+				t.Fatalf("Allocate(%d) failed: %v", tc.delta, err)
+			}
+			verifyOn(t, tc.expectPackage, currentCpus, csit)
+		})
+	}
+	t.Run("does not fit in any package", func(t *testing.T) {
+		treeA := tree.NewAllocator(cpuTreeAllocatorOptions{preferEmptiestPackage: true})
+		currentCpus, _, err := treeA.Allocate(cpuset.New(), freeCpus, 20)
+		if err != nil {
+			t.Fatalf("Allocate(20) failed: %v", err)
+		}
+		if currentCpus.Size() != 20 || tree.children[0].cpus.Intersection(currentCpus).Size() == 0 {
+			t.Errorf("expected 20 cpus from both packages, got %s", currentCpus)
+		}
+	})
+}
+
+func TestCpuTreeNames(t *testing.T) {
+	sys := newFakeSystemFromInt5([5]int{2, 1, 2, 2, 2})
+	tree, err := newCpuTreeFromSys(sys, nil)
+	if err != nil {
+		t.Fatalf("failed to create tree: %v", err)
+	}
+	if name := tree.FindLeafWithCpu(13).name; name != "p1d0n3cpu12t13" {
+		t.Errorf("expected default name p1d0n3cpu12t13, got %q", name)
+	}
+
+	socketNames := func(level CPUTopologyLevel, ids ...int) string {
+		switch level {
+		case CPUTopologyLevelPackage:
+			return fmt.Sprintf("socket%d", ids[0])
+		case CPUTopologyLevelDie:
+			return fmt.Sprintf("socket%d.die%d", ids[0], ids[1])
+		case CPUTopologyLevelNuma:
+			return fmt.Sprintf("numa%d", ids[2])
+		case CPUTopologyLevelCore:
+			return fmt.Sprintf("core%d", ids[3])
+		}
+		return fmt.Sprintf("cpu%d", ids[4])
+	}
+	tree, err = newCpuTreeFromSys(sys, socketNames)
+	if err != nil {
+		t.Fatalf("failed to create tree with custom names: %v", err)
+	}
+	leaf := tree.FindLeafWithCpu(13)
+	if leaf.name != "cpu13" || leaf.parent.name != "core12" || leaf.parent.parent.name != "numa3" {
+		t.Errorf("unexpected custom names %q, %q, %q", leaf.name, leaf.parent.name, leaf.parent.parent.name)
+	}
+	splitTree := tree.SplitLevel(CPUTopologyLevelNuma, func(cpu int) int { return cpu % 2 })
+	for _, class := range splitTree.FindLeafWithCpu(13).parent.parent.parent.children {
+		if !strings.HasPrefix(class.name, "numa3class") {
+			t.Errorf("expected split class name to build on numa3, got %q", class.name)
+		}
+	}
+
+	if _, err = newCpuTreeFromSys(sys, func(level CPUTopologyLevel, ids ...int) string {
+		return string(level)
+	}); err == nil {
+		t.Errorf("expected error from duplicate names")
+	}
+}
+
+func TestRequireCacheIds(t *testing.T) {
+	tree, csit := newCpuTreeFromInt5([5]int{2, 1, 2, 4, 2})
+	// Every NUMA node has its own last-level cache, ids 10..13.
+	for _, leaf := range tree.Leaves() {
+		cit := csit[leaf.cpus.List()[0]]
+		leaf.cacheId = 10 + cit.packageID*2 + cit.numaID
+	}
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{requireCacheIds: []int{11, 12}})
+	freeCpus := tree.Cpus()
+	currentCpus, freeCpus, err := treeA.Allocate(cpuset.New(), freeCpus, 12)
+	if err != nil {
+		t.Fatalf("Allocate(12) failed: %v", err)
+	}
+	verifyNotOn(t, "p0d0n0", currentCpus, csit)
+	verifyNotOn(t, "p1d0n1", currentCpus, csit)
+	if _, _, err := treeA.Allocate(currentCpus, freeCpus, 5); err == nil {
+		t.Errorf("expected error when required cache ids have only 4 free CPUs")
+	} else if !strings.Contains(err.Error(), "cache ids") {
+		t.Errorf("expected error to mention cache ids, got %v", err)
+	}
+	if currentCpus, _, err = treeA.Allocate(currentCpus, freeCpus, -12); err != nil || currentCpus.Size() != 0 {
+		t.Errorf("expected releasing all CPUs to succeed, got %s, %v", currentCpus, err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{2, 2, 2, 4, 2})
+	for _, options := range []cpuTreeAllocatorOptions{
+		{verify: true},
+		{verify: true, topologyBalancing: true},
+		{verify: true, preferSpreadOnPhysicalCores: true},
+		{verify: true, preferEmptiestPackage: true},
+	} {
+		treeA := tree.NewAllocator(options)
+		currentCpus, freeCpus := cpuset.New(), tree.Cpus()
+		for _, delta := range []int{1, 5, 3, -2, 17, -20, 30, -3} {
+			var err error
+			if currentCpus, freeCpus, err = treeA.Allocate(currentCpus, freeCpus, delta); err != nil {
+				t.Fatalf("options %+v: Allocate(%d) failed: %v", options, delta, err)
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		name                        string
+		delta                       int
+		addFromCpus, removeFromCpus cpuset.CPUSet
+	}{
+		{"allocate from non-free", 1, cpuset.New(0), cpuset.New()},
+		{"release from non-current", -1, cpuset.New(), cpuset.New(4)},
+		{"too few to allocate from", 2, cpuset.New(4), cpuset.New()},
+		{"too few to release from", -2, cpuset.New(), cpuset.New(0)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := verifyResize(cpuset.New(0, 1), cpuset.New(4, 5), tc.delta, tc.addFromCpus, tc.removeFromCpus); err == nil {
+				t.Errorf("expected verification error")
+			}
+		})
+	}
+}
+
+func TestNumaNodeHints(t *testing.T) {
+	sysRoot := t.TempDir()
+	devPath := "/sys/devices/pci0000:00/0000:00:01.0"
+	if err := os.MkdirAll(filepath.Join(sysRoot, devPath), 0755); err != nil {
+		t.Fatalf("failed to create device directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(sysRoot, devPath, "numa_node"), []byte("2\n"), 0644); err != nil {
+		t.Fatalf("failed to create numa_node: %v", err)
+	}
+	topology.SetSysRoot(sysRoot)
+	defer topology.SetSysRoot("")
+
+	tree, csit := newCpuTreeFromInt5([5]int{2, 1, 2, 4, 2})
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{preferCloseToDevices: []string{devPath}})
+	hints := treeA.topologyHintCpus(devPath)
+	if len(hints) != 1 || !hints[0].Equals(tree.children[1].children[0].children[0].cpus) {
+		t.Fatalf("expected cpus of NUMA node 2 as hint, got %v", hints)
+	}
+	currentCpus, _, err := treeA.Allocate(cpuset.New(), tree.Cpus(), 3)
+	if err != nil {
+		t.Fatalf("Allocate(3) failed: %v", err)
+	}
+	verifyOn(t, "p1d0n0", currentCpus, csit)
+}
+
+func TestMountPointHints(t *testing.T) {
+	dataDir := t.TempDir()
+	var st unix.Stat_t
+	if err := unix.Stat(dataDir, &st); err != nil {
+		t.Fatalf("failed to stat %s: %v", dataDir, err)
+	}
+	major, minor := unix.Major(uint64(st.Dev)), unix.Minor(uint64(st.Dev))
+	if major == 0 {
+		t.Skipf("%s is not on a block device", dataDir)
+	}
+
+	sysRoot := t.TempDir()
+	pciPath := "/sys/devices/pci0000:00/0000:00:01.0"
+	devPath := pciPath + "/nvme/nvme0/nvme0n1"
+	if err := os.MkdirAll(filepath.Join(sysRoot, devPath), 0755); err != nil {
+		t.Fatalf("failed to create device directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(sysRoot, pciPath, "local_cpulist"), []byte("8-15\n"), 0644); err != nil {
+		t.Fatalf("failed to create local_cpulist: %v", err)
+	}
+	blockDir := filepath.Join(sysRoot, "/sys/dev/block")
+	if err := os.MkdirAll(blockDir, 0755); err != nil {
+		t.Fatalf("failed to create block device directory: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(sysRoot, devPath), filepath.Join(blockDir, fmt.Sprintf("%d:%d", major, minor))); err != nil {
+		t.Fatalf("failed to create block device link: %v", err)
+	}
+	topology.SetSysRoot(sysRoot)
+	defer topology.SetSysRoot("")
+
+	tree, _ := newCpuTreeFromInt5([5]int{2, 1, 2, 4, 2})
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{preferCloseToDevices: []string{dataDir}})
+	if err := treeA.ValidateDevices([]string{dataDir}); err != nil {
+		t.Errorf("expected mount point %s to be a valid device, got %v", dataDir, err)
+	}
+	if err := treeA.ValidateDevices([]string{filepath.Join(dataDir, "missing")}); err == nil {
+		t.Errorf("expected missing path to be an invalid device")
+	}
+	hints := treeA.topologyHintCpus(dataDir)
+	if len(hints) != 1 || !hints[0].Equals(cpuset.MustParse("8-15")) {
+		t.Fatalf("expected cpus 8-15 of the backing device as hint, got %v", hints)
+	}
+	cpus, _, err := treeA.Allocate(cpuset.New(), tree.Cpus(), 2)
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	if !cpus.IsSubsetOf(cpuset.MustParse("8-15")) {
+		t.Errorf("expected cpus close to the backing device, got %s", cpus)
+	}
+}
+
+func TestOnAllocationFailure(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 2, 4, 2})
+	failures := []int{}
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{
+		onAllocationFailure: func(delta int, freeCpus cpuset.CPUSet) {
+			failures = append(failures, delta)
+		},
+	})
+	freeCpus := tree.Cpus()
+	currentCpus, freeCpus, err := treeA.Allocate(cpuset.New(), freeCpus, 10)
+	if err != nil || len(failures) != 0 {
+		t.Fatalf("expected successful allocation without callbacks, got err %v, failures %v", err, failures)
+	}
+	if _, _, err = treeA.Allocate(currentCpus, freeCpus, 7); err == nil {
+		t.Errorf("expected allocation to fail")
+	}
+	if _, _, err = treeA.Allocate(currentCpus, freeCpus, -11); err == nil {
+		t.Errorf("expected release to fail")
+	}
+	if len(failures) != 1 || failures[0] != 7 {
+		t.Errorf("expected exactly one failure callback with delta 7, got %v", failures)
+	}
+}
+
+func TestResizeCpusToward(t *testing.T) {
+	tree, csit := newCpuTreeFromInt5([5]int{2, 1, 2, 4, 2})
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{})
+	// Current CPUs: one core from every NUMA node.
+	currentCpus := cpuset.New(0, 1, 8, 9, 16, 17, 24, 25)
+	freeCpus := tree.Cpus().Difference(currentCpus).Difference(cpuset.New(18, 19, 20, 21, 22, 23))
+	for _, tc := range []struct {
+		name        string
+		towardCpus  cpuset.CPUSet
+		delta       int
+		expectOn    string
+		expectCount int
+	}{
+		{"toward NUMA node", cpuset.New(20, 21), -2, "p1d0n0", 2},
+		{"toward package", cpuset.New(30), -4, "p1", 4},
+		{"toward core", cpuset.New(9), -1, "p0d0n1c00", 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, removeFrom, err := treeA.ResizeCpusToward(currentCpus, freeCpus, tc.towardCpus, tc.delta)
+			if err != nil {
+				t.Fatalf("ResizeCpusToward failed: %v", err)
+			}
+			if removeFrom.Size() != tc.expectCount || !removeFrom.IsSubsetOf(currentCpus) {
+				t.Errorf("expected %d cpus from %s, got %s", tc.expectCount, currentCpus, removeFrom)
+			}
+			verifyOn(t, tc.expectOn, removeFrom, csit)
+		})
+	}
+
+	// The closest CPUs 24-25 have higher ids than the CPUs 16-17
+	// that are as close as each other. All closest CPUs must be
+	// released, the rest are chosen among the equally close ones.
+	_, removeFrom, err := treeA.ResizeCpusToward(currentCpus, freeCpus, cpuset.New(30), -3)
+	if err != nil {
+		t.Fatalf("ResizeCpusToward failed: %v", err)
+	}
+	if removeFrom.Size() != 3 || !cpuset.New(24, 25).IsSubsetOf(removeFrom) {
+		t.Errorf("expected cpus 24-25 and one of 16-17 to be released, got %s", removeFrom)
+	}
+	verifyOn(t, "p1", removeFrom, csit)
+}
+
+func TestSpreadReleaseLoneThreadsFirst(t *testing.T) {
+	tree, csit := newCpuTreeFromInt5([5]int{1, 1, 2, 4, 2})
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{
+		preferSpreadOnPhysicalCores: true,
+		releaseLoneThreadsFirst:     true,
+	})
+	// All cores of NUMA node p0d0n0 are fully used, except for
+	// the core of the lone thread 2.
+	currentCpus := cpuset.New(0, 1, 2, 4, 5, 6, 7, 8, 9, 10, 11)
+	freeCpus := tree.Cpus().Difference(currentCpus)
+	_, removeFrom, err := treeA.ResizeCpus(currentCpus, freeCpus, -1)
+	if err != nil {
+		t.Fatalf("ResizeCpus(-1) failed: %v", err)
+	}
+	verifySame(t, "thread", removeFrom, csit)
+	verifyOn(t, "p0d0n0c01t0", removeFrom, csit)
+	// When releasing more CPUs than there are lone threads,
+	// threads that become lone are released next.
+	_, removeFrom, err = treeA.ResizeCpus(currentCpus, freeCpus, -3)
+	if err != nil {
+		t.Fatalf("ResizeCpus(-3) failed: %v", err)
+	}
+	if !removeFrom.Contains(2) {
+		t.Errorf("expected lone thread cpu2 to be released first, got %s", removeFrom)
+	}
+	cores := map[string]int{}
+	for _, cpu := range removeFrom.List() {
+		cores[csit[cpu].coreName]++
+	}
+	if len(cores) != 2 {
+		t.Errorf("expected releasing 3 cpus from 2 cores, got %s", removeFrom)
+	}
+}
+
+func TestLocalDevices(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{2, 1, 2, 2, 2})
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{})
+	devs := []string{"/sys/cpus:0-3", "/sys/cpus:4-7", "/sys/cpus:8-15", "/sys/devices/nohints"}
+	for _, dev := range devs[:3] {
+		treeA.cacheCloseCpuSets[dev] = []cpuset.CPUSet{cpuset.MustParse(dev[len("/sys/cpus:"):])}
+	}
+	treeA.cacheCloseCpuSets[devs[3]] = []cpuset.CPUSet{}
+	for _, tc := range []struct {
+		cpus       cpuset.CPUSet
+		expectDevs []string
+	}{
+		{cpuset.New(0, 1), []string{"/sys/cpus:0-3"}},
+		{cpuset.New(3, 4, 8), []string{"/sys/cpus:0-3", "/sys/cpus:4-7", "/sys/cpus:8-15"}},
+		{cpuset.New(), []string{}},
+	} {
+		localDevs := treeA.LocalDevices(devs, tc.cpus)
+		if strings.Join(localDevs, " ") != strings.Join(tc.expectDevs, " ") {
+			t.Errorf("expected devices %v local to cpus %s, got %v", tc.expectDevs, tc.cpus, localDevs)
+		}
+	}
+}
+
+func TestEqualDiff(t *testing.T) {
+	sys := newFakeSystemFromInt5([5]int{1, 1, 2, 2, 2})
+	tree, err := newCpuTreeFromSys(sys, nil)
+	if err != nil {
+		t.Fatalf("failed to create tree: %v", err)
+	}
+	same, _ := newCpuTreeFromSys(sys, nil)
+	if !tree.Equal(same) || len(tree.Diff(same)) != 0 {
+		t.Errorf("expected identical trees to be equal, got diff %v", tree.Diff(same))
+	}
+
+	sys.cpus[7].online = false
+	cpuRemoved, _ := newCpuTreeFromSys(sys, nil)
+	sys.cpus[7].online = true
+	if tree.Equal(cpuRemoved) {
+		t.Errorf("expected trees to differ after removing cpu7")
+	}
+	diff := strings.Join(tree.Diff(cpuRemoved), "\n")
+	for _, expected := range []string{
+		`removed thread "p0d0n1cpu6t7"`,
+		`changed core "p0d0n1cpu6" cpus: 6-7 -> 6`,
+		`changed system "system" cpus: 0-7 -> 0-6`,
+	} {
+		if !strings.Contains(diff, expected) {
+			t.Errorf("expected diff to contain %q, got:\n%s", expected, diff)
+		}
+	}
+
+	numaAdded, _ := newCpuTreeFromSys(newFakeSystemFromInt5([5]int{1, 1, 3, 2, 2}), nil)
+	diff = strings.Join(tree.Diff(numaAdded), "\n")
+	for _, expected := range []string{
+		`added numa "p0d0n2" cpus: 8-11`,
+		`added thread "p0d0n2cpu10t11" cpus: 11`,
+		`changed package "p0" cpus: 0-7 -> 0-11`,
+	} {
+		if !strings.Contains(diff, expected) {
+			t.Errorf("expected diff to contain %q, got:\n%s", expected, diff)
+		}
+	}
+	if strings.Contains(diff, "removed") {
+		t.Errorf("expected no removed nodes, got:\n%s", diff)
+	}
+}
+
+func TestNetworkInterfaceHints(t *testing.T) {
+	sysRoot := t.TempDir()
+	pciPath := "/sys/devices/pci0000:00/0000:00:02.0"
+	if err := os.MkdirAll(filepath.Join(sysRoot, pciPath), 0755); err != nil {
+		t.Fatalf("failed to create device directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(sysRoot, pciPath, "local_cpulist"), []byte("4-7\n"), 0644); err != nil {
+		t.Fatalf("failed to create local_cpulist: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(sysRoot, "/sys/class/net/eth0"), 0755); err != nil {
+		t.Fatalf("failed to create interface directory: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(sysRoot, pciPath), filepath.Join(sysRoot, "/sys/class/net/eth0/device")); err != nil {
+		t.Fatalf("failed to create device symlink: %v", err)
+	}
+	topology.SetSysRoot(sysRoot)
+	defer topology.SetSysRoot("")
+
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 2, 2, 2})
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{})
+	if hints := treeA.topologyHintCpus("eth0"); len(hints) != 1 || !hints[0].Equals(cpuset.New(4, 5, 6, 7)) {
+		t.Errorf("expected cpus 4-7 as eth0 hint, got %v", hints)
+	}
+	if hints := treeA.topologyHintCpus("nosuch0"); len(hints) != 0 {
+		t.Errorf("expected no hints for missing interface, got %v", hints)
+	}
+	if _, ok := treeA.cacheCloseCpuSets["nosuch0"]; !ok {
+		t.Errorf("expected missing interface to be cached")
+	}
+}
+
+func TestSinglePackageOnly(t *testing.T) {
+	tree, csit := newCpuTreeFromInt5([5]int{2, 1, 2, 4, 2})
+	freeCpus := tree.Cpus()
+	for _, tc := range []struct {
+		name              string
+		singlePackageOnly bool
+		expectErr         bool
+	}{
+		{"spills to second package", false, false},
+		{"fails rather than spills", true, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			treeA := tree.NewAllocator(cpuTreeAllocatorOptions{singlePackageOnly: tc.singlePackageOnly})
+			currentCpus, freeCpus, err := treeA.Allocate(cpuset.New(), freeCpus, 12)
+			if err != nil {
+				t.Fatalf("Allocate(12) failed: %v", err)
+			}
+			verifySame(t, "package", currentCpus, csit)
+			currentCpus, _, err = treeA.Allocate(currentCpus, freeCpus, 6)
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("expected error, got cpus %s", currentCpus)
+				} else if !strings.Contains(err.Error(), "single package") {
+					t.Errorf("expected single package error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Allocate(6) failed: %v", err)
+			}
+			// 18 CPUs cannot fit in one 16-CPU package.
+			if currentCpus.Size() != 18 {
+				t.Errorf("expected 18 cpus, got %s", currentCpus)
+			}
+		})
+	}
+	// The whole second package can be allocated at once, but not
+	// one CPU more.
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{singlePackageOnly: true})
+	freeCpus = tree.Cpus().Difference(cpuset.New(0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14))
+	currentCpus, _, err := treeA.Allocate(cpuset.New(), freeCpus, 16)
+	if err != nil {
+		t.Fatalf("Allocate(16) failed: %v", err)
+	}
+	verifyOn(t, "p1", currentCpus, csit)
+	if _, _, err := treeA.Allocate(cpuset.New(), freeCpus, 17); err == nil {
+		t.Errorf("expected error when allocating 17 cpus with singlePackageOnly")
+	}
+}
+
+func TestEligibleFreeCpus(t *testing.T) {
+	tree, csit := newCpuTreeFromInt5([5]int{2, 1, 2, 4, 2})
+	allCpus := tree.Cpus()
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{
+		reservedCpus:      cpuset.New(0, 1),
+		singlePackageOnly: true,
+	})
+	currentCpus := cpuset.New(2)
+	freeCpus := allCpus.Difference(currentCpus)
+	eligibleCpus, err := treeA.EligibleFreeCpus(currentCpus, freeCpus, 2)
+	if err != nil {
+		t.Fatalf("EligibleFreeCpus failed: %v", err)
+	}
+	if eligibleCpus.Size() < 2 {
+		t.Errorf("expected at least 2 eligible cpus, got %s", eligibleCpus)
+	}
+	if !eligibleCpus.IsSubsetOf(freeCpus) {
+		t.Errorf("eligible cpus %s are not a subset of free cpus %s", eligibleCpus, freeCpus)
+	}
+	if eligibleCpus.Contains(0) || eligibleCpus.Contains(1) {
+		t.Errorf("reserved cpus in eligible cpus %s", eligibleCpus)
+	}
+	verifyOn(t, "p0", eligibleCpus, csit)
+	// Allocation picks from eligible CPUs.
+	addFrom, _, err := treeA.ResizeCpus(currentCpus, freeCpus, 2)
+	if err != nil {
+		t.Fatalf("ResizeCpus failed: %v", err)
+	}
+	if !addFrom.IsSubsetOf(eligibleCpus) {
+		t.Errorf("ResizeCpus returned %s, not a subset of eligible cpus %s", addFrom, eligibleCpus)
+	}
+	// Nothing is eligible if delta cannot be satisfied.
+	if _, err := treeA.EligibleFreeCpus(currentCpus, freeCpus, 16); err == nil {
+		t.Errorf("expected error when no package can fit the balloon")
+	}
+}
+
+func TestShrinkReluctance(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 2, 4, 2})
+	allCpus := tree.Cpus()
+	for _, tc := range []struct {
+		name             string
+		shrinkReluctance int
+		delta            int
+		expectReleased   int
+	}{
+		{"no reluctance", 0, -3, 3},
+		{"within reluctance", 2, -2, 0},
+		{"exceeds reluctance", 2, -5, 3},
+		{"grow unaffected", 2, 3, -3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			treeA := tree.NewAllocator(cpuTreeAllocatorOptions{shrinkReluctance: tc.shrinkReluctance})
+			currentCpus, freeCpus, err := treeA.Allocate(cpuset.New(), allCpus, 8)
+			if err != nil {
+				t.Fatalf("Allocate(8) failed: %v", err)
+			}
+			_, removeFromCpus, err := treeA.ResizeCpus(currentCpus, freeCpus, tc.delta)
+			if err != nil {
+				t.Fatalf("ResizeCpus(%d) failed: %v", tc.delta, err)
+			}
+			if tc.delta < 0 && tc.shrinkReluctance > 0 && removeFromCpus.Size() != tc.expectReleased {
+				t.Errorf("expected %d CPUs to release from, got %s", tc.expectReleased, removeFromCpus)
+			}
+			newCpus, newFreeCpus, err := treeA.Allocate(currentCpus, freeCpus, tc.delta)
+			if err != nil {
+				t.Fatalf("Allocate(%d) failed: %v", tc.delta, err)
+			}
+			if released := currentCpus.Size() - newCpus.Size(); released != tc.expectReleased {
+				t.Errorf("expected %d CPUs released, got %d (%s -> %s)", tc.expectReleased, released, currentCpus, newCpus)
+			}
+			if !newCpus.Union(newFreeCpus).Equals(allCpus) {
+				t.Errorf("lost CPUs: current %s, free %s", newCpus, newFreeCpus)
+			}
+		})
+	}
+}
+
+func TestPrewarmDeviceHints(t *testing.T) {
+	sysRoot := t.TempDir()
+	devPath := "/sys/devices/pci0000:00/0000:00:03.0"
+	if err := os.MkdirAll(filepath.Join(sysRoot, devPath), 0755); err != nil {
+		t.Fatalf("failed to create device directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(sysRoot, devPath, "local_cpulist"), []byte("2-3\n"), 0644); err != nil {
+		t.Fatalf("failed to create local_cpulist: %v", err)
+	}
+	topology.SetSysRoot(sysRoot)
+	defer topology.SetSysRoot("")
+
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 2, 2, 2})
+	deviceHints := newDeviceHintCache()
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{deviceHints: deviceHints})
+	done := make(chan struct{})
+	go func() {
+		treeA.PrewarmDeviceHints([]string{devPath, "/sys/devices/nosuch"})
+		close(done)
+	}()
+	// Allocate concurrently with prewarming.
+	treeB := tree.NewAllocator(cpuTreeAllocatorOptions{
+		deviceHints:          deviceHints,
+		preferCloseToDevices: []string{devPath},
+	})
+	cpus, _, err := treeB.Allocate(cpuset.New(), tree.Cpus(), 2)
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	if !cpus.Equals(cpuset.New(2, 3)) {
+		t.Errorf("expected cpus 2-3 close to device, got %s", cpus)
+	}
+	<-done
+
+	// Hints are served from the cache without reading sysfs.
+	topology.SetSysRoot(t.TempDir())
+	treeC := tree.NewAllocator(cpuTreeAllocatorOptions{deviceHints: deviceHints})
+	if hints := treeC.topologyHintCpus(devPath); len(hints) != 1 || !hints[0].Equals(cpuset.New(2, 3)) {
+		t.Errorf("expected prewarmed cpus 2-3 as hint, got %v", hints)
+	}
+	if hints, ok := deviceHints.closeCpuSets["/sys/devices/nosuch"]; !ok || len(hints) != 0 {
+		t.Errorf("expected missing device to be cached without hints, got %v", hints)
+	}
+}
+
+func TestDeviceHintCacheResolvesUnlocked(t *testing.T) {
+	deviceHints := newDeviceHintCache()
+	resolving := make(chan struct{})
+	unblock := make(chan struct{})
+	done := make(chan []cpuset.CPUSet)
+	go func() {
+		done <- deviceHints.get("slow", func(string) []cpuset.CPUSet {
+			close(resolving)
+			<-unblock
+			return []cpuset.CPUSet{cpuset.New(0, 1)}
+		})
+	}()
+	<-resolving
+	// Other devices are resolved while the slow one is.
+	fast := deviceHints.get("fast", func(string) []cpuset.CPUSet {
+		return []cpuset.CPUSet{cpuset.New(2, 3)}
+	})
+	if len(fast) != 1 || !fast[0].Equals(cpuset.New(2, 3)) {
+		t.Errorf("expected cpus 2-3 for fast device, got %v", fast)
+	}
+	// A concurrent result of the slow device is cached first and
+	// wins over the one still being resolved.
+	slow := deviceHints.get("slow", func(string) []cpuset.CPUSet {
+		return []cpuset.CPUSet{cpuset.New(4, 5)}
+	})
+	close(unblock)
+	if late := <-done; len(late) != 1 || !late[0].Equals(cpuset.New(4, 5)) {
+		t.Errorf("expected cached cpus 4-5 for slow device, got %v", late)
+	}
+	if len(slow) != 1 || !slow[0].Equals(cpuset.New(4, 5)) {
+		t.Errorf("expected cpus 4-5 for slow device, got %v", slow)
+	}
+}
+
+func TestPreferNumaNodes(t *testing.T) {
+	tree, csit := newCpuTreeFromInt5([5]int{2, 1, 2, 4, 2})
+	allCpus := tree.Cpus()
+	for _, tc := range []struct {
+		name      string
+		numaNodes []int
+		freeCpus  cpuset.CPUSet
+		count     int
+		expectOn  string
+	}{
+		{"prefer node 2", []int{2}, allCpus, 4, "p1d0n0"},
+		{"prefer node 3", []int{3}, allCpus, 8, "p1d0n1"},
+		{"prefer nodes 1 and 2", []int{1, 2}, allCpus.Difference(cpuset.New(8, 9, 10, 11, 12, 13, 14)), 4, "p1d0n0"},
+		{"fall back when preferred node is full", []int{3}, allCpus.Difference(cpuset.New(24, 25, 26, 27, 28, 29)), 4, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			treeA := tree.NewAllocator(cpuTreeAllocatorOptions{preferNumaNodes: tc.numaNodes})
+			cpus, _, err := treeA.Allocate(cpuset.New(), tc.freeCpus, tc.count)
+			if err != nil {
+				t.Fatalf("Allocate(%d) failed: %v", tc.count, err)
+			}
+			if cpus.Size() != tc.count {
+				t.Errorf("expected %d cpus, got %s", tc.count, cpus)
+			}
+			if tc.expectOn != "" {
+				verifyOn(t, tc.expectOn, cpus, csit)
+			} else {
+				verifyNotOn(t, "p1d0n1", cpus, csit)
+			}
+		})
+	}
+}
+
+func TestPreemptibleCpus(t *testing.T) {
+	tree, csit := newCpuTreeFromInt5([5]int{2, 1, 1, 4, 2})
+	allCpus := tree.Cpus()
+	// p0: cpus 0-7, p1: cpus 8-15. Others hold cpus 0-5 and
+	// 8-15, cpus 6-7 are free.
+	currentCpus := cpuset.New()
+	freeCpus := cpuset.New(6, 7)
+
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{})
+	_, _, err := treeA.ResizeCpus(currentCpus, freeCpus, 4)
+	var perr *cpuPreemptionError
+	if err == nil || errors.As(err, &perr) {
+		t.Fatalf("expected plain allocation error without preemptible cpus, got %v", err)
+	}
+
+	treeA = tree.NewAllocator(cpuTreeAllocatorOptions{
+		preemptibleCpus: allCpus.Difference(cpuset.New(0, 1)),
+	})
+	_, _, err = treeA.ResizeCpus(currentCpus, freeCpus, 4)
+	if !errors.As(err, &perr) {
+		t.Fatalf("expected preemption error, got %v", err)
+	}
+	if perr.preemptCpus.Size() != 2 {
+		t.Errorf("expected 2 cpus to preempt, got %s", perr.preemptCpus)
+	}
+	if perr.preemptCpus.Contains(0) || perr.preemptCpus.Contains(1) {
+		t.Errorf("preempting non-preemptible cpus: %s", perr.preemptCpus)
+	}
+	if !perr.addFromCpus.Contains(6) || !perr.addFromCpus.Contains(7) {
+		t.Errorf("expected free cpus 6-7 among candidates, got %s", perr.addFromCpus)
+	}
+	// Preempting the neighbors of free cpus keeps the
+	// allocation in one package.
+	verifySame(t, "package", perr.preemptCpus.Union(freeCpus), csit)
+
+	// Preemption does not help if there are too few preemptible cpus.
+	treeA = tree.NewAllocator(cpuTreeAllocatorOptions{
+		preemptibleCpus: cpuset.New(8),
+	})
+	_, _, err = treeA.ResizeCpus(currentCpus, freeCpus, 4)
+	if err == nil || errors.As(err, &perr) {
+		t.Errorf("expected plain allocation error with too few preemptible cpus, got %v", err)
+	}
+}
+
+func TestOrphanCpus(t *testing.T) {
+	// cpu3 has no thread sibling information.
+	sys := newFakeSystemFromInt5([5]int{1, 1, 2, 2, 2})
+	sys.cpus[2].threads = cpuset.New(2)
+	sys.cpus[3].threads = cpuset.New()
+	tree, err := newCpuTreeFromSys(sys, nil)
+	if err != nil {
+		t.Fatalf("newCpuTreeFromSys failed: %v", err)
+	}
+	if !tree.Cpus().Equals(cpuset.New(0, 1, 2, 3, 4, 5, 6, 7)) {
+		t.Errorf("expected all cpus in tree, got %s", tree.Cpus())
+	}
+	leaf := tree.FindLeafWithCpu(3)
+	if leaf == nil {
+		t.Fatalf("cpu3 not found in tree")
+	}
+	if leaf.level != CPUTopologyLevelThread || leaf.parent.level != CPUTopologyLevelCore ||
+		leaf.parent.parent.name != "p0d0n0" || !leaf.parent.cpus.Equals(cpuset.New(3)) {
+		t.Errorf("expected cpu3 in a single-thread core in p0d0n0, got:\n%s", tree.PrettyPrint())
+	}
+
+	// An offline CPU without sibling information is not added.
+	sys.cpus[3].online = false
+	if tree, err = newCpuTreeFromSys(sys, nil); err != nil {
+		t.Fatalf("newCpuTreeFromSys failed: %v", err)
+	}
+	if tree.Cpus().Contains(3) {
+		t.Errorf("offline cpu3 in tree")
+	}
+
+	// An online CPU that is in no NUMA node is an error.
+	sys.cpus[8] = &fakeCpu{threads: cpuset.New(8), online: true}
+	if _, err = newCpuTreeFromSys(sys, nil); err == nil || !strings.Contains(err.Error(), "8") {
+		t.Errorf("expected error about orphaned cpu8, got %v", err)
+	}
+}
+
+func TestPreferPartitionable(t *testing.T) {
+	mountDir := cgroups.GetMountDir()
+	defer cgroups.SetMountDir(mountDir)
+	cgroups.SetMountDir(t.TempDir())
+
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 2, 4, 2})
+	allCpus := tree.Cpus()
+
+	// No-op without cgroup v2 and cpuset.cpus.isolated.
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{preferPartitionable: true})
+	if cpus := treeA.PartitionableCpus(); !cpus.IsEmpty() {
+		t.Errorf("expected no partitionable cpus, got %s", cpus)
+	}
+	cpus, _, err := treeA.Allocate(cpuset.New(), allCpus, 2)
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	if !cpus.Equals(cpuset.New(0, 1)) {
+		t.Errorf("expected default allocation 0-1, got %s", cpus)
+	}
+
+	// Partitionable CPUs are discovered only on cgroup v2 hosts,
+	// set them like discovered.
+	partitionableCpus := cpuset.New(10, 11, 12, 13)
+	treeA = tree.NewAllocator(cpuTreeAllocatorOptions{preferPartitionable: true})
+	treeA.partitionableCpus = &partitionableCpus
+	currentCpus, freeCpus, err := treeA.Allocate(cpuset.New(), allCpus, 4)
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	if !currentCpus.Equals(cpuset.New(10, 11, 12, 13)) {
+		t.Errorf("expected partitionable cpus 10-13, got %s", currentCpus)
+	}
+	// Not enough partitionable cpus left, allocate normally.
+	currentCpus, freeCpus, err = treeA.Allocate(currentCpus, freeCpus, 2)
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	if currentCpus.Size() != 6 {
+		t.Errorf("expected 6 cpus, got %s", currentCpus)
+	}
+	// Release non-partitionable cpus first.
+	currentCpus, _, err = treeA.Allocate(currentCpus, freeCpus, -2)
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	if !currentCpus.Equals(cpuset.New(10, 11, 12, 13)) {
+		t.Errorf("expected partitionable cpus 10-13 to be kept, got %s", currentCpus)
+	}
+}
+
+func TestPreferPackSiblings(t *testing.T) {
+	// cores: 0-1, 2-3, 4-5, 6-7 on the first NUMA node
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 2, 4, 2})
+	freeCpus := tree.Cpus().Difference(cpuset.New(0, 2, 3, 4, 8, 9))
+	for _, tc := range []struct {
+		name           string
+		currentCpus    cpuset.CPUSet
+		delta          int
+		expectCurrent  cpuset.CPUSet
+		expectErr      bool
+		spreadOnCores  bool
+		wholeCoresOnly bool
+	}{
+		{
+			name:          "sibling first, then a whole free core",
+			currentCpus:   cpuset.New(0),
+			delta:         3,
+			expectCurrent: cpuset.New(0, 1, 6, 7),
+		},
+		{
+			name:           "new balloon gets whole cores",
+			currentCpus:    cpuset.New(),
+			delta:          4,
+			wholeCoresOnly: true,
+		},
+		{
+			name:          "cannot be used with spreading on physical cores",
+			currentCpus:   cpuset.New(0),
+			delta:         1,
+			spreadOnCores: true,
+			expectErr:     true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			treeA := tree.NewAllocator(cpuTreeAllocatorOptions{
+				preferPackSiblings:          true,
+				preferSpreadOnPhysicalCores: tc.spreadOnCores,
+			})
+			currentCpus, _, err := treeA.Allocate(tc.currentCpus, freeCpus, tc.delta)
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("expected error, got cpus %s", currentCpus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Allocate failed: %v", err)
+			}
+			if tc.wholeCoresOnly {
+				if siblings := treeA.coreSiblingCpus(currentCpus); !siblings.Equals(currentCpus) {
+					t.Errorf("expected whole cores, got cpus %s of cores %s", currentCpus, siblings)
+				}
+				return
+			}
+			if !currentCpus.Equals(tc.expectCurrent) {
+				t.Errorf("expected cpus %s, got %s", tc.expectCurrent, currentCpus)
+			}
+		})
+	}
+}
+
+func TestFragmentationScore(t *testing.T) {
+	// 2 packages, 2 NUMA nodes each, 4 cores per node, 2 threads per core
+	tree, _ := newCpuTreeFromInt5([5]int{2, 1, 2, 4, 2})
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{})
+	allCpus := tree.Cpus()
+	compact := treeA.FragmentationScore(cpuset.New(), allCpus)
+	if compact != 0 {
+		t.Errorf("expected 0 fragmentation for all free cpus, got %f", compact)
+	}
+	if score := treeA.FragmentationScore(cpuset.New(0, 1, 2, 3), allCpus.Difference(cpuset.New(0, 1, 2, 3))); score != 0 {
+		t.Errorf("expected 0 fragmentation for compact allocation, got %f", score)
+	}
+	// Every other core allocated on each NUMA node.
+	scattered := cpuset.New(0, 1, 4, 5, 8, 9, 12, 13, 16, 17, 20, 21, 24, 25, 28, 29)
+	scatteredScore := treeA.FragmentationScore(scattered, allCpus.Difference(scattered))
+	if scatteredScore <= 0 {
+		t.Errorf("expected positive fragmentation for scattered allocation, got %f", scatteredScore)
+	}
+	// Hyperthreads split between allocated and free cpus are
+	// more fragmented than whole cores.
+	split := cpuset.New(0, 2, 4, 6, 8, 10, 12, 14, 16, 18, 20, 22, 24, 26, 28, 30)
+	if splitScore := treeA.FragmentationScore(split, allCpus.Difference(split)); splitScore <= scatteredScore {
+		t.Errorf("expected split threads (%f) to be more fragmented than scattered cores (%f)", splitScore, scatteredScore)
+	}
+}
+
+func TestPreferEmptyWholeNode(t *testing.T) {
+	// NUMA nodes: p0d0n0 0-7, p0d0n1 8-15, p1d0n0 16-23, p1d0n1 24-31
+	tree, csit := newCpuTreeFromInt5([5]int{2, 1, 2, 4, 2})
+	// The balloon has 2 CPUs in each NUMA node. The third node is
+	// used by others only by 2 CPUs, the other nodes are full.
+	currentCpus := cpuset.New(0, 1, 8, 9, 16, 17, 24, 25)
+	freeCpus := cpuset.New(18, 19, 20, 21)
+	for _, tc := range []struct {
+		name                 string
+		preferEmptyWholeNode bool
+		delta                int
+		expectReleased       cpuset.CPUSet
+	}{
+		{
+			name:                 "vacate the node closest to empty",
+			preferEmptyWholeNode: true,
+			delta:                -2,
+			expectReleased:       cpuset.New(16, 17),
+		},
+		{
+			name:                 "vacate a node and continue from another",
+			preferEmptyWholeNode: true,
+			delta:                -3,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			treeA := tree.NewAllocator(cpuTreeAllocatorOptions{preferEmptyWholeNode: tc.preferEmptyWholeNode})
+			newCpus, newFreeCpus, err := treeA.Allocate(currentCpus, freeCpus, tc.delta)
+			if err != nil {
+				t.Fatalf("Allocate failed: %v", err)
+			}
+			released := currentCpus.Difference(newCpus)
+			if released.Size() != -tc.delta {
+				t.Errorf("expected %d cpus released, got %s", -tc.delta, released)
+			}
+			if !tc.expectReleased.IsEmpty() && !released.Equals(tc.expectReleased) {
+				t.Errorf("expected released cpus %s, got %s", tc.expectReleased, released)
+			}
+			if !released.Intersection(cpuset.New(16, 17)).Equals(cpuset.New(16, 17)) {
+				t.Errorf("expected cpus 16-17 to be released, got %s", released)
+			}
+			// Node p1d0n0 is now completely free, except for
+			// the 2 CPUs used by others.
+			verifyOn(t, "p1d0n0", newFreeCpus.Difference(freeCpus).Intersection(cpuset.New(16, 17)), csit)
+			if inUse := cpuset.New(16, 17, 18, 19, 20, 21, 22, 23).Difference(newFreeCpus); !inUse.Equals(cpuset.New(22, 23)) {
+				t.Errorf("expected only cpus 22-23 used in p1d0n0, got %s", inUse)
+			}
+		})
+	}
+}
+
+func TestCpuTreeSnapshot(t *testing.T) {
+	sys := newFakeSystemFromInt5([5]int{2, 2, 2, 2, 2})
+	tree, err := newCpuTreeFromSys(sys, nil)
+	if err != nil {
+		t.Fatalf("newCpuTreeFromSys failed: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "cputree.json")
+	if err := tree.SaveSnapshot(path); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+	loaded, err := LoadCpuTreeSnapshot(path)
+	if err != nil {
+		t.Fatalf("LoadCpuTreeSnapshot failed: %v", err)
+	}
+	if diff := tree.Diff(loaded); len(diff) > 0 {
+		t.Errorf("loaded tree differs from saved:\n%s", strings.Join(diff, "\n"))
+	}
+	loaded.DepthFirstWalk(func(tn *cpuTreeNode) error {
+		orig := tree.Find(func(on *cpuTreeNode) bool { return on.name == tn.name })
+		if orig.id != tn.id || orig.cacheId != tn.cacheId || orig.maxFreqKHz != tn.maxFreqKHz {
+			t.Errorf("node %q attributes differ: %+v != %+v", tn.name, orig, tn)
+		}
+		if orig.parent != nil && (tn.parent == nil || tn.parent.name != orig.parent.name) {
+			t.Errorf("node %q parent differs", tn.name)
+		}
+		return nil
+	})
+	// Allocations on the loaded tree match allocations on the
+	// original tree.
+	for _, delta := range []int{1, 3, 8, 17} {
+		cpus, _, err := tree.NewAllocator(cpuTreeAllocatorOptions{}).Allocate(cpuset.New(), tree.Cpus(), delta)
+		if err != nil {
+			t.Fatalf("Allocate failed: %v", err)
+		}
+		loadedCpus, _, err := loaded.NewAllocator(cpuTreeAllocatorOptions{}).Allocate(cpuset.New(), loaded.Cpus(), delta)
+		if err != nil {
+			t.Fatalf("Allocate on loaded tree failed: %v", err)
+		}
+		if !cpus.Equals(loadedCpus) {
+			t.Errorf("allocating %d CPUs: expected %s, got %s from loaded tree", delta, cpus, loadedCpus)
+		}
+	}
+	if err := os.WriteFile(path, []byte(`{"version":0}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCpuTreeSnapshot(path); err == nil {
+		t.Errorf("expected error loading snapshot with unsupported version")
+	}
+}
+
+func TestDeterministicDeviceHints(t *testing.T) {
+	sysRoot := t.TempDir()
+	dev0 := "/sys/devices/pci0000:00/0000:00:04.0"
+	dev1 := "/sys/devices/pci0000:00/0000:00:05.0"
+	for path, cpus := range map[string]string{
+		dev0: "0-3",
+		dev1: "8-11",
+	} {
+		if err := os.MkdirAll(filepath.Join(sysRoot, path), 0755); err != nil {
+			t.Fatalf("failed to create device directory: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(sysRoot, path, "local_cpulist"), []byte(cpus+"\n"), 0644); err != nil {
+			t.Fatalf("failed to create local_cpulist: %v", err)
+		}
+	}
+	topology.SetSysRoot(sysRoot)
+	defer topology.SetSysRoot("")
+
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 2, 4, 2})
+	for _, tc := range []struct {
+		name    string
+		options cpuTreeAllocatorOptions
+		expect  cpuset.CPUSet
+	}{
+		{
+			// Both devices give equally good, conflicting
+			// hints. The first device in config order wins.
+			name:    "close to devices",
+			options: cpuTreeAllocatorOptions{preferCloseToDevices: []string{dev1, dev0}},
+			expect:  cpuset.New(8, 9),
+		},
+		{
+			name:    "far from devices",
+			options: cpuTreeAllocatorOptions{preferFarFromDevices: []string{dev0, dev1}},
+			expect:  cpuset.New(4, 5),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				// New allocator every round, hints are resolved
+				// again.
+				treeA := tree.NewAllocator(tc.options)
+				cpus, _, err := treeA.Allocate(cpuset.New(), tree.Cpus(), 2)
+				if err != nil {
+					t.Fatalf("Allocate failed: %v", err)
+				}
+				if !cpus.Equals(tc.expect) {
+					t.Fatalf("round %d: expected cpus %s, got %s", i, tc.expect, cpus)
+				}
+			}
+		})
+	}
+
+	// Hints of a device and the devices it depends on are
+	// processed in the same order every time.
+	hints := topology.Hints{}
+	for i := 0; i < 8; i++ {
+		provider := fmt.Sprintf("/sys/devices/pci0000:00/0000:00:%02d.0", 8-i)
+		hints[provider] = topology.Hint{Provider: provider, CPUs: fmt.Sprintf("%d", i)}
+	}
+	expected := orderedTopologyHints(hints)
+	for i := 0; i < 20; i++ {
+		ordered := orderedTopologyHints(hints)
+		for j := range ordered {
+			if ordered[j] != expected[j] {
+				t.Fatalf("round %d: unstable hint order: %v != %v", i, ordered, expected)
+			}
+		}
+	}
+	if expected[0].Provider != "/sys/devices/pci0000:00/0000:00:01.0" {
+		t.Errorf("expected hints in provider order, got %v", expected)
+	}
+}
+
+func TestSizeByCapacity(t *testing.T) {
+	// NUMA node 0: big cores, cpus 0-3. NUMA node 1: little cores
+	// with half of the capacity, cpus 4-7.
+	sys := newFakeSystemFromInt5([5]int{1, 1, 2, 4, 1})
+	for cpu := 0; cpu < 8; cpu++ {
+		sys.cpus[cpu].capacity = 1024
+		if cpu >= 4 {
+			sys.cpus[cpu].capacity = 512
+		}
+	}
+	tree, err := newCpuTreeFromSys(sys, nil)
+	if err != nil {
+		t.Fatalf("newCpuTreeFromSys failed: %v", err)
+	}
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{sizeByCapacity: true})
+	capacity := func(cpus cpuset.CPUSet) int {
+		c := 0
+		for _, cpu := range cpus.List() {
+			c += treeA.cpuCapacity(cpu)
+		}
+		return c
+	}
+	for _, tc := range []struct {
+		name          string
+		currentCpus   cpuset.CPUSet
+		freeCpus      cpuset.CPUSet
+		delta         int
+		expectCpus    int
+		expectCap     int
+		expectFailure bool
+	}{
+		{
+			name:       "two big CPUs",
+			freeCpus:   cpuset.New(0, 1, 2, 3),
+			delta:      2048,
+			expectCpus: 2,
+			expectCap:  2048,
+		},
+		{
+			name:       "four little CPUs for two big",
+			freeCpus:   cpuset.New(4, 5, 6, 7),
+			delta:      2048,
+			expectCpus: 4,
+			expectCap:  2048,
+		},
+		{
+			name:       "round up allocation",
+			freeCpus:   cpuset.New(0, 1, 2, 3),
+			delta:      1500,
+			expectCpus: 2,
+			expectCap:  2048,
+		},
+		{
+			name:          "not enough capacity",
+			freeCpus:      cpuset.New(4, 5, 6, 7),
+			delta:         2049,
+			expectFailure: true,
+		},
+		{
+			name:        "round down release",
+			currentCpus: cpuset.New(0, 1),
+			freeCpus:    cpuset.New(2, 3),
+			delta:       -1500,
+			expectCpus:  1,
+			expectCap:   1024,
+		},
+		{
+			name:        "release little CPUs only",
+			currentCpus: cpuset.New(0, 4),
+			freeCpus:    cpuset.New(5, 6, 7),
+			delta:       -600,
+			expectCpus:  1,
+			expectCap:   1024,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			currentCpus := tc.currentCpus
+			if currentCpus.IsEmpty() {
+				currentCpus = cpuset.New()
+			}
+			newCpus, newFreeCpus, err := treeA.Allocate(currentCpus, tc.freeCpus, tc.delta)
+			if tc.expectFailure {
+				if err == nil {
+					t.Fatalf("expected failure, got %s", newCpus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Allocate failed: %v", err)
+			}
+			if newCpus.Size() != tc.expectCpus || capacity(newCpus) != tc.expectCap {
+				t.Errorf("expected %d CPUs with capacity %d, got %s with capacity %d",
+					tc.expectCpus, tc.expectCap, newCpus, capacity(newCpus))
+			}
+			if !newCpus.Union(newFreeCpus).Equals(currentCpus.Union(tc.freeCpus)) {
+				t.Errorf("lost CPUs: current %s, free %s", newCpus, newFreeCpus)
+			}
+		})
+	}
+}
+
+func TestResizeMany(t *testing.T) {
+	tree, csit := newCpuTreeFromInt5([5]int{2, 1, 2, 4, 2})
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{})
+	// a: cpus in every NUMA node, shrinks to nothing.
+	// b: small allocation. c: takes a whole NUMA node.
+	a := cpuset.New(0, 1, 8, 9, 16, 17, 24, 25)
+	freeCpus := tree.Cpus().Difference(a)
+	results, err := treeA.ResizeMany([]ResizeRequest{
+		{CurrentCpus: cpuset.New(), Delta: 2},
+		{CurrentCpus: a, Delta: -8},
+		{CurrentCpus: cpuset.New(), Delta: 8},
+	}, freeCpus)
+	if err != nil {
+		t.Fatalf("ResizeMany failed: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	if results[0].Cpus.Size() != 2 || !results[0].AddedCpus.Equals(results[0].Cpus) {
+		t.Errorf("unexpected result 0: %+v", results[0])
+	}
+	if !results[1].Cpus.IsEmpty() || !results[1].RemovedCpus.Equals(a) {
+		t.Errorf("unexpected result 1: %+v", results[1])
+	}
+	// The large allocation is done first from CPUs released by
+	// a, and gets a whole NUMA node.
+	if results[2].Cpus.Size() != 8 {
+		t.Errorf("unexpected result 2: %+v", results[2])
+	}
+	verifySame(t, "numa", results[2].Cpus, csit)
+	if !results[0].Cpus.Intersection(results[2].Cpus).IsEmpty() {
+		t.Errorf("cpus assigned twice: %s and %s", results[0].Cpus, results[2].Cpus)
+	}
+
+	// Overlapping requests fail.
+	if _, err := treeA.ResizeMany([]ResizeRequest{
+		{CurrentCpus: cpuset.New(0, 1), Delta: 1},
+		{CurrentCpus: cpuset.New(1, 2), Delta: 1},
+	}, tree.Cpus().Difference(cpuset.New(0, 1, 2))); err == nil {
+		t.Errorf("expected error on overlapping requests")
+	}
+	// Failing request fails all.
+	if results, err := treeA.ResizeMany([]ResizeRequest{
+		{CurrentCpus: cpuset.New(), Delta: 2},
+		{CurrentCpus: cpuset.New(), Delta: 40},
+	}, tree.Cpus()); err == nil {
+		t.Errorf("expected error on too large request, got %v", results)
+	}
+}
+
+func TestResizeManyCommits(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 2, 2, 2})
+	decisions := []Decision{}
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{
+		balloon:     "a",
+		exclusivity: cpuModeExclusive,
+		onCommit: func(d Decision) {
+			decisions = append(decisions, d)
+		},
+	})
+	// A failing request leaves no trace of the others.
+	if _, err := treeA.ResizeMany([]ResizeRequest{
+		{Balloon: "b", CurrentCpus: cpuset.New(), Delta: 2},
+		{Balloon: "c", CurrentCpus: cpuset.New(), Delta: 20},
+	}, tree.Cpus()); err == nil {
+		t.Fatalf("expected error on too large request")
+	}
+	if len(decisions) != 0 {
+		t.Errorf("expected no decisions from failed ResizeMany, got %v", decisions)
+	}
+	if modeCpus := treeA.options.cpuModes.Cpus(cpuModeExclusive); !modeCpus.IsEmpty() {
+		t.Errorf("expected no exclusive cpus after failed ResizeMany, got %s", modeCpus)
+	}
+	// Decisions are committed under the balloons of requests.
+	results, err := treeA.ResizeMany([]ResizeRequest{
+		{Balloon: "b", CurrentCpus: cpuset.New(), Delta: 2},
+		{CurrentCpus: cpuset.New(), Delta: 4},
+	}, tree.Cpus())
+	if err != nil {
+		t.Fatalf("ResizeMany failed: %v", err)
+	}
+	if len(decisions) != 2 {
+		t.Fatalf("expected 2 decisions, got %v", decisions)
+	}
+	// The larger allocation is planned and committed first.
+	if decisions[0].Balloon != "a" || !decisions[0].Cpus.Equals(results[1].Cpus) ||
+		decisions[1].Balloon != "b" || !decisions[1].Cpus.Equals(results[0].Cpus) {
+		t.Errorf("unexpected decisions %v for results %v", decisions, results)
+	}
+	replayed, err := tree.NewAllocator(cpuTreeAllocatorOptions{}).Replay(decisions)
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if !replayed["a"].Equals(results[1].Cpus) || !replayed["b"].Equals(results[0].Cpus) {
+		t.Errorf("unexpected replayed cpus %v for results %v", replayed, results)
+	}
+}
+
+func TestCoreSiblings(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{2, 1, 2, 2, 2})
+	for _, tc := range []struct {
+		cpu    int
+		expect cpuset.CPUSet
+	}{
+		{0, cpuset.New(0, 1)},
+		{1, cpuset.New(0, 1)},
+		{6, cpuset.New(6, 7)},
+		{13, cpuset.New(12, 13)},
+		{16, cpuset.New()},
+	} {
+		if siblings := tree.CoreSiblings(tc.cpu); !siblings.Equals(tc.expect) {
+			t.Errorf("cpu %d: expected core siblings %s, got %s", tc.cpu, tc.expect, siblings)
+		}
+	}
+	// A subtree finds siblings of its own CPUs only.
+	numa := tree.children[1].children[0].children[0]
+	if siblings := numa.CoreSiblings(9); !siblings.Equals(cpuset.New(8, 9)) {
+		t.Errorf("expected core siblings 8-9 in %s, got %s", numa.name, siblings)
+	}
+	if siblings := numa.CoreSiblings(0); !siblings.IsEmpty() {
+		t.Errorf("expected no core siblings for cpu outside %s, got %s", numa.name, siblings)
+	}
+}
+
+func TestCacheGroups(t *testing.T) {
+	tree, csit := newCpuTreeFromInt5([5]int{1, 1, 2, 2, 2})
+	// L2 is shared by the threads of a core, L3 by all CPUs in a
+	// NUMA node.
+	for _, leaf := range tree.Leaves() {
+		cpu := leaf.cpus.List()[0]
+		leaf.cacheIds = map[int]int{
+			1: cpu,
+			2: cpu / 2,
+			3: cpu / 4,
+		}
+	}
+	for _, tc := range []struct {
+		level  int
+		expect []cpuset.CPUSet
+	}{
+		{1, []cpuset.CPUSet{cpuset.New(0), cpuset.New(1), cpuset.New(2), cpuset.New(3),
+			cpuset.New(4), cpuset.New(5), cpuset.New(6), cpuset.New(7)}},
+		{2, []cpuset.CPUSet{cpuset.New(0, 1), cpuset.New(2, 3), cpuset.New(4, 5), cpuset.New(6, 7)}},
+		{3, []cpuset.CPUSet{cpuset.New(0, 1, 2, 3), cpuset.New(4, 5, 6, 7)}},
+		{4, []cpuset.CPUSet{}},
+	} {
+		groups := tree.CacheGroups(tc.level)
+		if len(groups) != len(tc.expect) {
+			t.Errorf("L%d: expected %d groups %v, got %v", tc.level, len(tc.expect), tc.expect, groups)
+			continue
+		}
+		for i := range groups {
+			if !groups[i].Equals(tc.expect[i]) {
+				t.Errorf("L%d: expected groups %v, got %v", tc.level, tc.expect, groups)
+				break
+			}
+		}
+	}
+	for _, cpus := range tree.CacheGroups(3) {
+		verifySame(t, "numa", cpus, csit)
+	}
+	// Subtrees give groups of their own CPUs.
+	numa := tree.children[0].children[0].children[1]
+	if groups := numa.CacheGroups(2); len(groups) != 2 || !groups[0].Equals(cpuset.New(4, 5)) {
+		t.Errorf("expected L2 groups of %s, got %v", numa.name, groups)
+	}
+}
+
+func TestPackedAllocationFillsCores(t *testing.T) {
+	// cores: 0-1, 2-3, 4-5 on NUMA node 0, 6-7, 8-9, 10-11 on NUMA node 1
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 2, 3, 2})
+	for _, tc := range []struct {
+		name              string
+		currentCpus       cpuset.CPUSet
+		topologyBalancing bool
+		expectAddedIn     cpuset.CPUSet
+	}{
+		{
+			name:          "packed allocation stays in the NUMA node with most current CPUs",
+			currentCpus:   cpuset.New(0, 1, 2, 3, 6),
+			expectAddedIn: cpuset.New(4, 5),
+		},
+		{
+			name:              "balanced allocation stays in the NUMA node with most current CPUs",
+			currentCpus:       cpuset.New(0, 1, 2, 3, 6),
+			topologyBalancing: true,
+			expectAddedIn:     cpuset.New(4, 5),
+		},
+		{
+			name:          "packed allocation fills the sibling of a lone thread",
+			currentCpus:   cpuset.New(0, 2, 3),
+			expectAddedIn: cpuset.New(1),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			treeA := tree.NewAllocator(cpuTreeAllocatorOptions{
+				topologyBalancing: tc.topologyBalancing,
+			})
+			freeCpus := tree.Cpus().Difference(tc.currentCpus)
+			newCpus, _, err := treeA.Allocate(tc.currentCpus, freeCpus, 1)
+			if err != nil {
+				t.Fatalf("Allocate failed: %v", err)
+			}
+			added := newCpus.Difference(tc.currentCpus)
+			if added.Size() != 1 || !added.IsSubsetOf(tc.expectAddedIn) {
+				t.Errorf("expected one CPU from %s, got %s", tc.expectAddedIn, added)
+			}
+		})
+	}
+}
+
+func TestPerNodeHeadroom(t *testing.T) {
+	// NUMA nodes: 0-3 and 4-7, cpu 3 is used by someone else
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 2, 2, 2})
+	freeCpus := tree.Cpus().Difference(cpuset.New(3))
+	for _, tc := range []struct {
+		name       string
+		headroom   int
+		delta      int
+		expectCpus cpuset.CPUSet
+		expectIn   cpuset.CPUSet
+	}{
+		{
+			name:       "no headroom packs into the fullest node",
+			delta:      3,
+			expectCpus: cpuset.New(0, 1, 2),
+		},
+		{
+			name:     "headroom exactly left in the other node",
+			headroom: 1,
+			delta:    3,
+			expectIn: cpuset.New(4, 5, 6, 7),
+		},
+		{
+			name:     "headroom kept within the whole system",
+			headroom: 2,
+			delta:    3,
+			expectIn: freeCpus,
+		},
+		{
+			name:       "headroom relaxed when no node can keep it",
+			headroom:   3,
+			delta:      3,
+			expectCpus: cpuset.New(0, 1, 2),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			treeA := tree.NewAllocator(cpuTreeAllocatorOptions{
+				perNodeHeadroom: tc.headroom,
+			})
+			cpus, _, err := treeA.Allocate(cpuset.New(), freeCpus, tc.delta)
+			if err != nil {
+				t.Fatalf("Allocate failed: %v", err)
+			}
+			if cpus.Size() != tc.delta {
+				t.Fatalf("expected %d cpus, got %s", tc.delta, cpus)
+			}
+			if !tc.expectCpus.IsEmpty() && !cpus.Equals(tc.expectCpus) {
+				t.Errorf("expected cpus %s, got %s", tc.expectCpus, cpus)
+			}
+			if !tc.expectIn.IsEmpty() && !cpus.IsSubsetOf(tc.expectIn) {
+				t.Errorf("expected cpus from %s, got %s", tc.expectIn, cpus)
+			}
+		})
+	}
+}
+
+func TestDeviceHintResults(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 2, 4, 2})
+	var results []deviceHintResult
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{
+		preferCloseToDevices: []string{"gpu", "acc", "nic"},
+		virtDevCpusets: map[string][]cpuset.CPUSet{
+			"gpu": {cpuset.MustParse("0-7")},
+			"acc": {cpuset.MustParse("0-3"), cpuset.MustParse("8-11")},
+			"nic": {cpuset.New(0)},
+		},
+		onDeviceHints: func(r []deviceHintResult) {
+			results = r
+		},
+	})
+	cpus, _, err := treeA.Allocate(cpuset.New(), tree.Cpus(), 4)
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	if !cpus.Equals(cpuset.MustParse("0-3")) {
+		t.Errorf("expected cpus 0-3, got %s", cpus)
+	}
+	expected := []struct {
+		devicePath  string
+		status      deviceHintStatus
+		commonFree  int
+		appliedHint int
+	}{
+		{"gpu", deviceHintApplied, 0, 1},
+		{"acc", deviceHintPartiallyApplied, 0, 1},
+		{"nic", deviceHintDropped, 1, 0},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d device hint results, got %v", len(expected), results)
+	}
+	for i, exp := range expected {
+		r := results[i]
+		if r.DevicePath != exp.devicePath || r.Status() != exp.status ||
+			r.DroppedCommonFreeCpus != exp.commonFree || r.AppliedHints != exp.appliedHint ||
+			r.RequestedCpus != 4 {
+			t.Errorf("expected %s: %s with %d common free cpus, got %+v (%s)",
+				exp.devicePath, exp.status, exp.commonFree, r, r)
+		}
+	}
+}
+
+func TestFreeCpusProvider(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 2, 2, 2})
+	external := cpuset.New(4, 5, 6, 7)
+	calls := 0
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{
+		freeCpusProvider: func() cpuset.CPUSet {
+			calls++
+			return external
+		},
+	})
+
+	cpus, freeCpus, err := treeA.Allocate(cpuset.New(), freeCpusFromProvider, 2)
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	if calls != 1 || !cpus.IsSubsetOf(external) || !freeCpus.Equals(external.Difference(cpus)) {
+		t.Errorf("expected cpus from provided %s, got %s with free %s after %d calls", external, cpus, freeCpus, calls)
+	}
+
+	// The provider is queried lazily on every call.
+	external = cpuset.New(0, 1)
+	if addFrom, _, err := treeA.ResizeCpus(cpuset.New(), freeCpusFromProvider, 2); err != nil || !addFrom.Equals(external) {
+		t.Errorf("expected cpus from updated provider %s, got %s, err %v", external, addFrom, err)
+	}
+
+	// An explicit free CPU set takes precedence over the provider.
+	calls = 0
+	if addFrom, _, err := treeA.ResizeCpus(cpuset.New(), cpuset.New(2, 3), 2); err != nil || !addFrom.Equals(cpuset.New(2, 3)) || calls != 0 {
+		t.Errorf("expected explicit free cpus 2-3 without provider calls, got %s, err %v, %d calls", addFrom, err, calls)
+	}
+
+	noProvider := tree.NewAllocator(cpuTreeAllocatorOptions{})
+	if _, _, err := noProvider.ResizeCpus(cpuset.New(), freeCpusFromProvider, 1); err == nil {
+		t.Errorf("expected error without a free CPU provider")
+	}
+}
+
+func TestNodePressure(t *testing.T) {
+	// NUMA nodes: 0-3 and 4-7
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 2, 2, 2})
+	for _, tc := range []struct {
+		name       string
+		pressure   map[int]float64
+		freeCpus   cpuset.CPUSet
+		expectCpus cpuset.CPUSet
+	}{
+		{
+			name:       "no pressure",
+			pressure:   map[int]float64{},
+			freeCpus:   tree.Cpus(),
+			expectCpus: cpuset.New(0, 1),
+		},
+		{
+			name:       "avoid node under pressure",
+			pressure:   map[int]float64{0: 0.8},
+			freeCpus:   tree.Cpus(),
+			expectCpus: cpuset.New(4, 5),
+		},
+		{
+			name:       "pressure at threshold is fine",
+			pressure:   map[int]float64{0: 0.5},
+			freeCpus:   tree.Cpus(),
+			expectCpus: cpuset.New(0, 1),
+		},
+		{
+			name:       "all nodes under pressure",
+			pressure:   map[int]float64{0: 0.8, 1: 0.9},
+			freeCpus:   tree.Cpus(),
+			expectCpus: cpuset.New(0, 1),
+		},
+		{
+			name:       "better node under pressure is still used",
+			pressure:   map[int]float64{0: 0.8},
+			freeCpus:   tree.Cpus().Difference(cpuset.New(2)),
+			expectCpus: cpuset.New(0, 1),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			treeA := tree.NewAllocator(cpuTreeAllocatorOptions{
+				nodePressure: func(nodeID int) float64 {
+					return tc.pressure[nodeID]
+				},
+				nodePressureThreshold: 0.5,
+			})
+			cpus, _, err := treeA.Allocate(cpuset.New(), tc.freeCpus, 2)
+			if err != nil {
+				t.Fatalf("Allocate failed: %v", err)
+			}
+			if !cpus.Equals(tc.expectCpus) {
+				t.Errorf("expected cpus %s, got %s", tc.expectCpus, cpus)
+			}
+		})
+	}
+}
+
+func TestPreferLeastRecentlyUsed(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 1, 4, 2})
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{preferLeastRecentlyUsed: true})
+	// CPUs 0-5 used long ago, 1 most recently of them.
+	past := time.Now().Add(-time.Hour)
+	treeA.SetCpuLastUsed(map[int]time.Time{
+		0: past,
+		1: past.Add(time.Minute),
+		2: past,
+		3: past,
+		4: past,
+		5: past,
+	})
+
+	// All CPUs are equally good, never used CPUs 6 and 7 come first.
+	cpus, _, err := treeA.Allocate(cpuset.New(), tree.Cpus(), 2)
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	if !cpus.Equals(cpuset.New(6, 7)) {
+		t.Errorf("expected never used cpus 6-7, got %s", cpus)
+	}
+	if lastUsed := treeA.CpuLastUsed(); !lastUsed[6].After(past) || !lastUsed[7].After(past) {
+		t.Errorf("expected allocated cpus to be marked used, got %v", lastUsed)
+	}
+
+	// Release and reallocate: least recently used CPUs are rotated in.
+	cpus, _, err = treeA.Allocate(cpus, tree.Cpus().Difference(cpus), -2)
+	if err != nil || !cpus.IsEmpty() {
+		t.Fatalf("release failed: cpus %s, err %v", cpus, err)
+	}
+	cpus, _, err = treeA.Allocate(cpuset.New(), tree.Cpus(), 3)
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	if !cpus.Equals(cpuset.New(0, 2, 3)) {
+		t.Errorf("expected least recently used cpus 0,2,3, got %s", cpus)
+	}
+
+	// Without the option, CPUs are allocated in CPU id order.
+	plainA := tree.NewAllocator(cpuTreeAllocatorOptions{})
+	plainA.SetCpuLastUsed(treeA.CpuLastUsed())
+	if cpus, _, _ := plainA.Allocate(cpuset.New(), tree.Cpus(), 2); !cpus.Equals(cpuset.New(0, 1)) {
+		t.Errorf("expected cpus 0-1 without the option, got %s", cpus)
+	}
+}
+
+func TestValidateDevices(t *testing.T) {
+	sysRoot := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(sysRoot, "sys/class/net/eth0/device"), 0755); err != nil {
+		t.Fatalf("failed to create fake device: %v", err)
+	}
+	topology.SetSysRoot(sysRoot)
+	defer topology.SetSysRoot("")
+
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 2, 4, 2})
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{
+		virtDevCpusets: map[string][]cpuset.CPUSet{
+			"gpu": {cpuset.MustParse("0-7")},
+		},
+	})
+	if err := treeA.ValidateDevices([]string{"gpu", "eth0", "/sys/class/net/eth0/device"}); err != nil {
+		t.Errorf("expected existing devices to be valid, got %v", err)
+	}
+	err := treeA.ValidateDevices([]string{"gpu", "eth1", "/sys/devices/missing"})
+	if err == nil {
+		t.Fatalf("expected error for missing devices")
+	}
+	for _, dev := range []string{"eth1", "/sys/devices/missing"} {
+		if !strings.Contains(err.Error(), fmt.Sprintf("%q", dev)) {
+			t.Errorf("expected missing device %q in error %v", dev, err)
+		}
+	}
+	if strings.Contains(err.Error(), `"gpu"`) {
+		t.Errorf("virtual device reported missing: %v", err)
+	}
+}
+
+func TestKubeletCompatOptions(t *testing.T) {
+	// 2 NUMA nodes, 4 cores with 2 threads each in every node:
+	// NUMA node 0 has CPUs 0-7, node 1 has CPUs 8-15. CPU 0 is
+	// in use, leaving core 0-1 partially free.
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 2, 4, 2})
+	treeA := tree.NewAllocator(KubeletCompatOptions())
+	freeCpus := tree.Cpus().Difference(cpuset.New(0))
+
+	// The kubelet would place each request as expected below:
+	// whole cores only, packed into the lowest NUMA node that
+	// fits the request, and never across NUMA nodes.
+	for _, tc := range []struct {
+		name   string
+		size   int
+		expect string // expected CPUs, or "" if allocation fails
+	}{
+		{"whole free cores of the fuller NUMA node", 4, "2-5"},
+		{"odd number of CPUs", 3, ""},
+		{"next NUMA node when first one is full", 4, "8-11"},
+		{"single core", 2, "6-7"},
+		{"request that does not fit in a NUMA node", 10, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cpus, newFreeCpus, err := treeA.Allocate(cpuset.New(), freeCpus, tc.size)
+			if tc.expect == "" {
+				if err == nil {
+					t.Errorf("expected error, got cpus %s", cpus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Allocate(%d) failed: %v", tc.size, err)
+			}
+			if !cpus.Equals(cpuset.MustParse(tc.expect)) {
+				t.Errorf("expected cpus %s, got %s", tc.expect, cpus)
+			}
+			freeCpus = newFreeCpus
+		})
+	}
+
+	// Shrinking releases whole cores.
+	cpus, _, err := treeA.Allocate(cpuset.MustParse("8-11"), freeCpus, -2)
+	if err != nil {
+		t.Fatalf("Allocate(-2) failed: %v", err)
+	}
+	if !cpus.Equals(cpuset.MustParse("8-9")) && !cpus.Equals(cpuset.MustParse("10-11")) {
+		t.Errorf("expected a whole core to remain, got %s", cpus)
+	}
+	if _, _, err := treeA.Allocate(cpuset.MustParse("8-11"), freeCpus, -1); err == nil {
+		t.Errorf("expected error when releasing a single thread")
+	}
+}
+
+func TestMaxBalloonsOfSize(t *testing.T) {
+	// 2 packages with 16 CPUs, 2 NUMA nodes with 8 CPUs in each.
+	tree, _ := newCpuTreeFromInt5([5]int{2, 1, 2, 4, 2})
+	for _, tc := range []struct {
+		size   int
+		level  CPUTopologyLevel
+		expect int
+	}{
+		{4, CPUTopologyLevelNuma, 8},
+		{6, CPUTopologyLevelNuma, 4},
+		{6, CPUTopologyLevelPackage, 4},
+		{6, CPUTopologyLevelSystem, 5},
+		{9, CPUTopologyLevelNuma, 0},
+		{3, CPUTopologyLevelCore, 0},
+		{1, CPUTopologyLevelThread, 32},
+		{0, CPUTopologyLevelSystem, 0},
+	} {
+		if n := tree.MaxBalloonsOfSize(tc.size, tc.level); n != tc.expect {
+			t.Errorf("expected %d balloons of %d CPUs within %s, got %d", tc.expect, tc.size, tc.level, n)
+		}
+	}
+	// A subtree on or below the level is a single element.
+	pkg := tree.children[0]
+	if n := pkg.MaxBalloonsOfSize(6, CPUTopologyLevelSystem); n != 2 {
+		t.Errorf("expected 2 balloons of 6 CPUs in %s, got %d", pkg.name, n)
+	}
+}
+
+func TestRequestExceedsCapacity(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 2, 4, 2})
+	allCpus := tree.Cpus()
+	for _, tc := range []struct {
+		name        string
+		reserved    cpuset.CPUSet
+		current     cpuset.CPUSet
+		free        cpuset.CPUSet
+		delta       int
+		expectError bool
+		exceeds     bool
+	}{
+		{
+			name:  "fits",
+			free:  allCpus,
+			delta: 16,
+		},
+		{
+			name:        "more than all cpus",
+			free:        allCpus,
+			delta:       17,
+			expectError: true,
+			exceeds:     true,
+		},
+		{
+			name:        "current and delta more than all cpus",
+			current:     cpuset.MustParse("0-9"),
+			free:        cpuset.MustParse("10-15"),
+			delta:       7,
+			expectError: true,
+			exceeds:     true,
+		},
+		{
+			name:        "reserved cpus cannot be allocated",
+			reserved:    cpuset.New(0, 1),
+			free:        allCpus,
+			delta:       15,
+			expectError: true,
+			exceeds:     true,
+		},
+		{
+			name:        "transient shortage",
+			free:        cpuset.MustParse("8-15"),
+			delta:       10,
+			expectError: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			treeA := tree.NewAllocator(cpuTreeAllocatorOptions{reservedCpus: tc.reserved})
+			_, _, err := treeA.ResizeCpus(tc.current, tc.free, tc.delta)
+			if tc.expectError != (err != nil) {
+				t.Fatalf("expected error %v, got %v", tc.expectError, err)
+			}
+			if exceeds := errors.Is(err, ErrRequestExceedsCapacity); exceeds != tc.exceeds {
+				t.Errorf("expected ErrRequestExceedsCapacity %v, got error %v", tc.exceeds, err)
+			}
+		})
+	}
+}
+
+func TestCpuExclusivity(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 2, 4, 2})
+	// CPUs 0-3 are free, but already in a shared pool.
+	modes := newCpuModeMap(map[int]cpuMode{
+		0: cpuModeShared, 1: cpuModeShared, 2: cpuModeShared, 3: cpuModeShared,
+	})
+	exclusiveA := tree.NewAllocator(cpuTreeAllocatorOptions{
+		exclusivity: cpuModeExclusive,
+		cpuModes:    modes,
+	})
+	sharedA := tree.NewAllocator(cpuTreeAllocatorOptions{
+		exclusivity: cpuModeShared,
+		cpuModes:    modes,
+	})
+	freeCpus := tree.Cpus()
+
+	exclusiveCpus, freeCpus, err := exclusiveA.Allocate(cpuset.New(), freeCpus, 6)
+	if err != nil {
+		t.Fatalf("exclusive Allocate failed: %v", err)
+	}
+	if !exclusiveCpus.Intersection(cpuset.New(0, 1, 2, 3)).IsEmpty() {
+		t.Errorf("exclusive cpus %s overlap shared cpus 0-3", exclusiveCpus)
+	}
+	for _, cpu := range exclusiveCpus.List() {
+		if mode := sharedA.CpuMode(cpu); mode != cpuModeExclusive {
+			t.Errorf("expected cpu %d to be exclusive, got %s", cpu, mode)
+		}
+	}
+	if mode := exclusiveA.CpuMode(0); mode != cpuModeShared {
+		t.Errorf("expected cpu 0 to be shared, got %s", mode)
+	}
+
+	// Only 6 CPUs are neither shared nor exclusive.
+	if _, _, err := exclusiveA.Allocate(exclusiveCpus, freeCpus, 7); err == nil {
+		t.Errorf("expected exclusive allocation over shared cpus to fail")
+	}
+
+	// Shared allocations never take exclusive CPUs, even if
+	// they are free from the allocator's point of view.
+	sharedCpus, _, err := sharedA.Allocate(cpuset.New(0, 1, 2, 3), freeCpus.Union(exclusiveCpus), 4)
+	if err != nil {
+		t.Fatalf("shared Allocate failed: %v", err)
+	}
+	if !sharedCpus.Intersection(exclusiveCpus).IsEmpty() {
+		t.Errorf("shared cpus %s overlap exclusive cpus %s", sharedCpus, exclusiveCpus)
+	}
+
+	// Released CPUs lose their mode.
+	remainingCpus, _, err := exclusiveA.Allocate(exclusiveCpus, freeCpus, -2)
+	if err != nil {
+		t.Fatalf("exclusive release failed: %v", err)
+	}
+	for _, cpu := range exclusiveCpus.Difference(remainingCpus).List() {
+		if mode := exclusiveA.CpuMode(cpu); mode != cpuModeNone {
+			t.Errorf("expected released cpu %d to have no mode, got %s", cpu, mode)
+		}
+	}
+}
+
+func TestBootCpu(t *testing.T) {
+	sys := newFakeSystemFromInt5([5]int{1, 1, 2, 2, 2})
+	sys.bootCpu = 5
+	tree, err := newCpuTreeFromSys(sys, nil)
+	if err != nil {
+		t.Fatalf("newCpuTreeFromSys failed: %v", err)
+	}
+	if cpu := tree.BootCpu(); cpu != 5 {
+		t.Errorf("expected boot CPU 5, got %d", cpu)
+	}
+	if cpu := tree.FindLeafWithCpu(5).parent.BootCpu(); cpu != 5 {
+		t.Errorf("expected boot CPU 5 in the core of CPU 5, got %d", cpu)
+	}
+	if cpu := tree.FindLeafWithCpu(0).BootCpu(); cpu != -1 {
+		t.Errorf("expected no boot CPU in CPU 0, got %d", cpu)
+	}
+
+	simTree, _ := newCpuTreeFromInt5([5]int{1, 1, 2, 2, 2})
+	if cpu := simTree.BootCpu(); cpu != -1 {
+		t.Errorf("expected no boot CPU in a tree without a system, got %d", cpu)
+	}
+
+	freeCpus := tree.Cpus()
+	for _, tc := range []struct {
+		name         string
+		options      cpuTreeAllocatorOptions
+		expectedBoot bool
+	}{
+		{
+			name:         "boot CPU avoided",
+			options:      cpuTreeAllocatorOptions{avoidBootCpu: true},
+			expectedBoot: false,
+		},
+		{
+			name:         "exclusive, boot CPU avoided",
+			options:      cpuTreeAllocatorOptions{exclusivity: cpuModeExclusive, avoidBootCpu: true},
+			expectedBoot: false,
+		},
+		{
+			name:         "exclusive",
+			options:      cpuTreeAllocatorOptions{exclusivity: cpuModeExclusive},
+			expectedBoot: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ta := tree.NewAllocator(tc.options)
+			cpus, _, err := ta.ResizeCpusDebug(cpuset.New(), freeCpus, freeCpus.Size()-1)
+			if err != nil {
+				t.Fatalf("ResizeCpus failed: %v", err)
+			}
+			if cpus.Contains(5) != tc.expectedBoot {
+				t.Errorf("boot CPU 5 allocated: %v, expected %v, got cpus %s", cpus.Contains(5), tc.expectedBoot, cpus)
+			}
+			_, _, err = ta.ResizeCpus(cpuset.New(), freeCpus, freeCpus.Size())
+			if tc.expectedBoot && err != nil {
+				t.Errorf("allocating all CPUs failed: %v", err)
+			}
+			if !tc.expectedBoot && err == nil {
+				t.Errorf("expected allocating all CPUs including the boot CPU to fail")
+			}
+		})
+	}
+}
+
+func TestAttributionMap(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 1, 2, 2})
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{reservedCpus: cpuset.New(3)})
+	attribution := treeA.AttributionMap(map[string]cpuset.CPUSet{
+		"a": cpuset.New(0),
+		"b": cpuset.New(1, 2),
+	})
+	lines := strings.Split(attribution, "\n")
+	prettyLines := strings.Split(tree.PrettyPrint(), "\n")
+	if len(lines) != len(prettyLines) {
+		t.Fatalf("expected %d lines, got:\n%s", len(prettyLines), attribution)
+	}
+	expectOwners := map[string]string{
+		"p0d0n0c00t0": "a",
+		"p0d0n0c00t1": "b",
+		"p0d0n0c01t0": "b",
+		"p0d0n0c01t1": "RESERVED",
+	}
+	column := -1
+	for i, line := range lines {
+		if !strings.HasPrefix(line, prettyLines[i]) {
+			t.Errorf("expected line %q to start with %q", line, prettyLines[i])
+		}
+		owner := strings.TrimSpace(strings.TrimPrefix(line, prettyLines[i]))
+		name := ""
+		for leaf := range expectOwners {
+			if strings.Contains(prettyLines[i], `"`+leaf+`"`) {
+				name = leaf
+			}
+		}
+		if name == "" {
+			if owner != "" {
+				t.Errorf("expected no owner on non-leaf line %q", line)
+			}
+			continue
+		}
+		if owner != expectOwners[name] {
+			t.Errorf("expected owner %q of %s, got %q", expectOwners[name], name, owner)
+		}
+		if c := strings.LastIndex(line, " ") + 1; column == -1 {
+			column = c
+		} else if c != column {
+			t.Errorf("expected owner column %d, got %d in line %q", column, c, line)
+		}
+	}
+	if free := tree.NewAllocator(cpuTreeAllocatorOptions{}).AttributionMap(nil); strings.Count(free, "FREE") != 4 {
+		t.Errorf("expected 4 free cpus, got:\n%s", free)
+	}
+}
+
+func TestRequireNohzFull(t *testing.T) {
+	sys := newFakeSystemFromInt5([5]int{1, 1, 2, 4, 2})
+	sys.nohzFull = cpuset.MustParse("4-11")
+	tree, err := newCpuTreeFromSys(sys, nil)
+	if err != nil {
+		t.Fatalf("newCpuTreeFromSys failed: %v", err)
+	}
+	if cpus := tree.NohzFullCpus(); !cpus.Equals(sys.nohzFull) {
+		t.Errorf("expected tickless cpus %s, got %s", sys.nohzFull, cpus)
+	}
+
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{requireNohzFull: true})
+	cpus, freeCpus, err := treeA.Allocate(cpuset.New(), tree.Cpus(), 6)
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	if !cpus.IsSubsetOf(sys.nohzFull) {
+		t.Errorf("expected only tickless cpus, got %s", cpus)
+	}
+	_, _, err = treeA.Allocate(cpus, freeCpus, 4)
+	if err == nil || !strings.Contains(err.Error(), "nohz_full") {
+		t.Errorf("expected error about too few tickless cpus, got %v", err)
+	}
+
+	// Without the option any free CPUs are fine.
+	if _, _, err := tree.NewAllocator(cpuTreeAllocatorOptions{}).Allocate(cpus, freeCpus, 4); err != nil {
+		t.Errorf("Allocate without requireNohzFull failed: %v", err)
+	}
+}
+
+func BenchmarkToAttributedSlice(b *testing.B) {
+	tree, _ := newCpuTreeFromInt5([5]int{4, 2, 2, 16, 2})
+	freeCpus := tree.Cpus()
+	currentCpus := cpuset.New()
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = tree.ToAttributedSlice(currentCpus, freeCpus, nil)
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf := getCpuTreeAttrBuffer()
+			_ = tree.toAttributedSliceBuf(buf, currentCpus, freeCpus, nil)
+			buf.release()
+		}
+	})
+}
+
+func BenchmarkResizeCpusMaxLocalSet(b *testing.B) {
+	tree, _ := newCpuTreeFromInt5([5]int{4, 2, 2, 16, 2})
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{})
+	freeCpus := tree.Cpus()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := treeA.Allocate(cpuset.New(), freeCpus, 4); err != nil {
+			b.Fatalf("Allocate failed: %v", err)
+		}
+	}
+}
+
+func TestPooledAttributedSlice(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{2, 2, 2, 2, 2})
+	freeCpus := tree.Cpus().Difference(cpuset.New(0, 5, 9))
+	currentCpus := cpuset.New(0, 5)
+	want := tree.ToAttributedSlice(currentCpus, freeCpus, nil)
+	// Reuse the same buffer several times, results must not change.
+	for i := 0; i < 3; i++ {
+		buf := getCpuTreeAttrBuffer()
+		got := tree.toAttributedSliceBuf(buf, currentCpus, freeCpus, nil)
+		if len(got) != len(want) {
+			t.Fatalf("round %d: expected %d nodes, got %d", i, len(want), len(got))
+		}
+		for j := range want {
+			w, g := want[j], got[j]
+			if w.t != g.t || !w.currentCpus.Equals(g.currentCpus) || !w.freeCpus.Equals(g.freeCpus) ||
+				!slices.Equal(w.currentCpuCounts, g.currentCpuCounts) ||
+				!slices.Equal(w.freeCpuCounts, g.freeCpuCounts) ||
+				!slices.Equal(w.levels, g.levels) {
+				t.Errorf("round %d: node %d: expected %+v, got %+v", i, j, w, g)
+			}
+		}
+		buf.release()
+	}
+}
+
+func TestPeerCurrentCpus(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 2, 2, 2})
+	peer := cpuset.New(0)
+	freeCpus := tree.Cpus().Difference(peer)
+	peerCore := cpuset.New(0, 1)
+
+	cpus, _, err := tree.NewAllocator(cpuTreeAllocatorOptions{}).Allocate(cpuset.New(), freeCpus, 1)
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	if !cpus.IsSubsetOf(peerCore) {
+		t.Fatalf("expected packing next to peer on cpus %s, got %s", peerCore, cpus)
+	}
+
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{peerCurrentCpus: []cpuset.CPUSet{peer}})
+	cpus, freeCpus, err = treeA.Allocate(cpuset.New(), freeCpus, 1)
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	if cpus.Intersection(peerCore).Size() > 0 {
+		t.Errorf("expected cpus away from peer core %s, got %s", peerCore, cpus)
+	}
+
+	// Growing keeps the balloon local to its own CPUs.
+	more, _, err := treeA.Allocate(cpus, freeCpus, 1)
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	if more.Intersection(peerCore).Size() > 0 {
+		t.Errorf("expected growing away from peer core %s, got %s", peerCore, more)
+	}
+}
+
+func TestDeviceLocalityUnsatisfiable(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 2, 4, 2})
+	devCpusets := map[string][]cpuset.CPUSet{
+		"gpu": {cpuset.MustParse("0-7")},
+		"nic": {cpuset.MustParse("8-15")},
+		"acc": {cpuset.MustParse("4-11")},
+	}
+	tcs := []struct {
+		name            string
+		devices         []string
+		freeCpus        cpuset.CPUSet
+		delta           int
+		expectedDevices []string
+	}{
+		{
+			name:     "satisfiable",
+			devices:  []string{"gpu", "acc"},
+			freeCpus: tree.Cpus(),
+			delta:    4,
+		},
+		{
+			name:            "single device",
+			devices:         []string{"gpu"},
+			freeCpus:        cpuset.MustParse("5-15"),
+			delta:           4,
+			expectedDevices: []string{"gpu"},
+		},
+		{
+			name:            "multiple devices",
+			devices:         []string{"gpu", "nic", "acc"},
+			freeCpus:        cpuset.MustParse("0-3,12-15"),
+			delta:           4,
+			expectedDevices: []string{"nic", "acc"},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			treeA := tree.NewAllocator(cpuTreeAllocatorOptions{
+				preferCloseToDevices:  tc.devices,
+				virtDevCpusets:        devCpusets,
+				requireCloseToDevices: true,
+			})
+			_, _, err := treeA.Allocate(cpuset.New(), tc.freeCpus, tc.delta)
+			if len(tc.expectedDevices) == 0 {
+				if err != nil {
+					t.Fatalf("Allocate failed: %v", err)
+				}
+				return
+			}
+			var dlErr *ErrDeviceLocalityUnsatisfiable
+			if !errors.As(err, &dlErr) {
+				t.Fatalf("expected ErrDeviceLocalityUnsatisfiable, got %v", err)
+			}
+			if !slices.Equal(dlErr.Devices, tc.expectedDevices) || dlErr.RequestedCpus != tc.delta {
+				t.Errorf("expected devices %v and %d cpus, got %v and %d",
+					tc.expectedDevices, tc.delta, dlErr.Devices, dlErr.RequestedCpus)
+			}
+
+			// Without the strict option the allocation succeeds.
+			treeA = tree.NewAllocator(cpuTreeAllocatorOptions{
+				preferCloseToDevices: tc.devices,
+				virtDevCpusets:       devCpusets,
+			})
+			if _, _, err := treeA.Allocate(cpuset.New(), tc.freeCpus, tc.delta); err != nil {
+				t.Errorf("Allocate without requireCloseToDevices failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestPreferIdleSibling(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 1, 4, 2})
+	// Siblings of cpus 0 and 2 are busy, cores 4-5 and 6-7 are idle.
+	freeCpus := cpuset.MustParse("0,2,4-7")
+
+	cpus, _, err := tree.NewAllocator(cpuTreeAllocatorOptions{}).Allocate(cpuset.New(), freeCpus, 1)
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	if !cpus.IsSubsetOf(cpuset.New(0, 2)) {
+		t.Fatalf("expected a thread with a busy sibling without preferIdleSibling, got %s", cpus)
+	}
+
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{preferIdleSibling: true})
+	cpus, _, err = treeA.Allocate(cpuset.New(), freeCpus, 1)
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	if !cpus.IsSubsetOf(cpuset.New(4, 6)) {
+		t.Errorf("expected a thread with an idle sibling, got %s", cpus)
+	}
+
+	cpus, _, err = treeA.Allocate(cpuset.New(), freeCpus, 2)
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	if !cpus.Equals(cpuset.New(4, 6)) {
+		t.Errorf("expected one thread of both idle cores, got %s", cpus)
+	}
+
+	// Partial cores are allocated when there are not enough idle ones.
+	cpus, _, err = treeA.Allocate(cpuset.New(), freeCpus, 3)
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	if cpus.Size() != 3 {
+		t.Errorf("expected 3 cpus, got %s", cpus)
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 2, 2, 2})
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{})
+	tcs := []struct {
+		name        string
+		currentCpus cpuset.CPUSet
+		freeCpus    cpuset.CPUSet
+		expectMoved bool
+	}{
+		{
+			name:        "empty",
+			currentCpus: cpuset.New(),
+			freeCpus:    tree.Cpus(),
+		},
+		{
+			name:        "compact",
+			currentCpus: cpuset.New(0, 1),
+			freeCpus:    cpuset.MustParse("2-7"),
+		},
+		{
+			name:        "split over NUMA nodes",
+			currentCpus: cpuset.New(0, 4),
+			freeCpus:    cpuset.MustParse("1-3,5-7"),
+			expectMoved: true,
+		},
+		{
+			name:        "no free cpus",
+			currentCpus: cpuset.New(0, 4),
+			freeCpus:    cpuset.New(),
+		},
+		{
+			name:        "move partially",
+			currentCpus: cpuset.New(0, 4),
+			freeCpus:    cpuset.New(5),
+			expectMoved: true,
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			newCpus, moved := treeA.Rebalance(tc.currentCpus, tc.freeCpus)
+			if moved != tc.expectMoved {
+				t.Fatalf("expected moved %v, got %v (%s)", tc.expectMoved, moved, newCpus)
+			}
+			if newCpus.Size() != tc.currentCpus.Size() {
+				t.Errorf("expected %d cpus, got %s", tc.currentCpus.Size(), newCpus)
+			}
+			if !newCpus.IsSubsetOf(tc.currentCpus.Union(tc.freeCpus)) {
+				t.Errorf("expected cpus from %s, got %s", tc.currentCpus.Union(tc.freeCpus), newCpus)
+			}
+			if !moved && !newCpus.Equals(tc.currentCpus) {
+				t.Errorf("expected unchanged cpus %s, got %s", tc.currentCpus, newCpus)
+			}
+			if moved && treeA.fragmentation(newCpus) >= treeA.fragmentation(tc.currentCpus) {
+				t.Errorf("expected %s to be less fragmented than %s", newCpus, tc.currentCpus)
+			}
+		})
+	}
+}
+
+func TestCpuVeto(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 2, 2, 2})
+	vetoed := cpuset.New(0, 1, 4)
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{
+		cpuVeto: func(cpu int) bool { return vetoed.Contains(cpu) },
+		verify:  true,
+	})
+
+	for delta := 1; delta <= 5; delta++ {
+		addFromCpus, _, err := treeA.ResizeCpus(cpuset.New(), tree.Cpus(), delta)
+		if err != nil {
+			t.Fatalf("ResizeCpus %d failed: %v", delta, err)
+		}
+		if !addFromCpus.Intersection(vetoed).IsEmpty() {
+			t.Errorf("ResizeCpus %d: vetoed cpus in %s", delta, addFromCpus)
+		}
+	}
+	if _, _, err := treeA.ResizeCpus(cpuset.New(), tree.Cpus(), 6); err == nil {
+		t.Errorf("expected allocating more than non-vetoed cpus to fail")
+	}
+
+	currentCpus := cpuset.New(0, 2, 3, 4)
+	freeCpus := tree.Cpus().Difference(currentCpus)
+	cpus, _, err := treeA.Allocate(currentCpus, freeCpus, -1)
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	if cpus.Size() != 3 || cpus.Intersection(vetoed).Size() != 1 {
+		t.Errorf("expected one vetoed cpu to be released, got %s", cpus)
+	}
+	cpus, _, err = treeA.Allocate(currentCpus, freeCpus, -3)
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	if cpus.Size() != 1 || !cpus.Intersection(vetoed).IsEmpty() {
+		t.Errorf("expected all vetoed cpus to be released, got %s", cpus)
+	}
+}
+
+func TestExplainResize(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 2, 2, 2})
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{
+		preferCloseToDevices: []string{"gpu"},
+		virtDevCpusets: map[string][]cpuset.CPUSet{
+			"gpu": {cpuset.MustParse("0-3")},
+		},
+		reservedCpus: cpuset.New(7),
+	})
+	addFromCpus, _, explanation, err := treeA.ExplainResize(cpuset.New(), tree.Cpus(), 2)
+	if err != nil {
+		t.Fatalf("ExplainResize failed: %v", err)
+	}
+	expectedAddFrom, _, err := treeA.ResizeCpus(cpuset.New(), tree.Cpus(), 2)
+	if err != nil {
+		t.Fatalf("ResizeCpus failed: %v", err)
+	}
+	if !addFromCpus.Equals(expectedAddFrom) {
+		t.Errorf("expected same cpus as ResizeCpus %s, got %s", expectedAddFrom, addFromCpus)
+	}
+	if len(explanation.Stages) == 0 || explanation.Stages[0] != "resizeCpusOnlyIfNecessary" ||
+		explanation.Stages[len(explanation.Stages)-1] != "resizeCpusNow" {
+		t.Errorf("unexpected stages %v", explanation.Stages)
+	}
+	for _, cpu := range []int{4, 5, 6} {
+		if stage := explanation.Excluded[cpu]; stage != "resizeCpusWithDevices" {
+			t.Errorf("expected cpu %d excluded by device hints, got %q", cpu, stage)
+		}
+	}
+	if _, ok := explanation.Excluded[7]; ok {
+		t.Errorf("reserved cpu 7 should not be explained")
+	}
+	for _, cpu := range addFromCpus.List() {
+		if !slices.Contains(explanation.Retained[cpu], "resizeCpusWithDevices") {
+			t.Errorf("expected cpu %d retained by device hints, got %v", cpu, explanation.Retained[cpu])
+		}
+		if _, ok := explanation.Excluded[cpu]; ok {
+			t.Errorf("cpu %d both retained and excluded", cpu)
+		}
+	}
+	for cpu := range explanation.Retained {
+		if !addFromCpus.Contains(cpu) {
+			t.Errorf("cpu %d retained but not in %s", cpu, addFromCpus)
+		}
+	}
+}
+
+func TestResizersOfOptions(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 2, 2, 2})
+	stages := func(options cpuTreeAllocatorOptions) []string {
+		treeA := tree.NewAllocator(options)
+		names := []string{}
+		for _, resizer := range treeA.resizers(treeA.resizeCpusNow) {
+			names = append(names, resizerName(resizer))
+		}
+		return names
+	}
+	always := []string{
+		"resizeCpusOnlyIfNecessary",
+		"resizeCpusWithDevices",
+		"resizeCpusOneAtATime",
+		"resizeCpusMaxLocalSet",
+		"resizeCpusNow",
+	}
+	if got := stages(cpuTreeAllocatorOptions{}); !slices.Equal(got, always) {
+		t.Errorf("expected stages %v without options, got %v", always, got)
+	}
+	expected := []string{
+		"resizeCpusWithVeto",
+		"resizeCpusNohzFull",
+		"resizeCpusWholeCores",
+		"resizeCpusOnlyIfNecessary",
+		"resizeCpusWithDevices",
+		"resizeCpusEmptyWholeNode",
+		"resizeCpusOneAtATime",
+		"resizeCpusMaxLocalSet",
+		"resizeCpusNow",
+	}
+	got := stages(cpuTreeAllocatorOptions{
+		cpuVeto:              func(cpu int) bool { return false },
+		requireNohzFull:      true,
+		requireWholeCores:    true,
+		preferEmptyWholeNode: true,
+	})
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected stages %v, got %v", expected, got)
+	}
+}
+
+func TestNearestFreeCpu(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{2, 1, 2, 4, 2})
+	// L2 is shared by two cores.
+	for _, leaf := range tree.Leaves() {
+		cpu := leaf.cpus.List()[0]
+		leaf.cacheIds = map[int]int{2: cpu / 4}
+	}
+	for _, tc := range []struct {
+		name     string
+		freeCpus cpuset.CPUSet
+		expected int
+	}{
+		{"target", cpuset.MustParse("0-31"), 0},
+		{"thread sibling", cpuset.MustParse("1-31"), 1},
+		{"same L2", cpuset.MustParse("3,5-31"), 3},
+		{"same NUMA node", cpuset.MustParse("7,9-31"), 7},
+		{"same package", cpuset.MustParse("13,17-31"), 13},
+		{"other package", cpuset.MustParse("30"), 30},
+		{"none", cpuset.New(), -1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cpu, ok := tree.NearestFreeCpu(0, tc.freeCpus)
+			if ok != (tc.expected >= 0) || (ok && cpu != tc.expected) {
+				t.Errorf("expected %d, got %d (%v)", tc.expected, cpu, ok)
+			}
+		})
+	}
+	if _, ok := tree.NearestFreeCpu(64, tree.Cpus()); ok {
+		t.Errorf("expected no nearest cpu for a target outside the tree")
+	}
+}
+
+func TestOneAtATimeIterationGuard(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 1, 4, 2})
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{preferSpreadOnPhysicalCores: true})
+
+	// A misbehaving resizer that hands out a new CPU on every
+	// call, whether or not it exists or is free.
+	next := 0
+	misbehaving := func(_ []cpuResizerFunc, currentCpus, freeCpus cpuset.CPUSet, delta int) (cpuset.CPUSet, cpuset.CPUSet, error) {
+		if delta > 1 || delta < -1 {
+			return cpuset.New(), cpuset.New(), nil
+		}
+		next++
+		return cpuset.New(next), cpuset.New(next), nil
+	}
+
+	for _, delta := range []int{100, -100} {
+		next = 0
+		_, _, err := treeA.resizeCpusOneAtATime([]cpuResizerFunc{misbehaving}, tree.Cpus(), tree.Cpus(), delta)
+		if err == nil || !strings.Contains(err.Error(), "exceeded 8 rounds") {
+			t.Errorf("delta %d: expected iteration guard error, got %v", delta, err)
+		}
+		if next != 8 {
+			t.Errorf("delta %d: expected 8 rounds before failing, got %d", delta, next)
+		}
+	}
+}
+
+func TestPreferReleaseOverlapping(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 2, 2, 2})
+	housekeeping := cpuset.New(5, 6)
+	currentCpus := tree.Cpus()
+	for _, tc := range []struct {
+		name      string
+		options   cpuTreeAllocatorOptions
+		delta     int
+		expectIn  cpuset.CPUSet
+		expectAll cpuset.CPUSet
+	}{
+		{
+			name:     "release overlapping",
+			options:  cpuTreeAllocatorOptions{preferReleaseOverlapping: housekeeping},
+			delta:    -1,
+			expectIn: housekeeping,
+		},
+		{
+			name:      "release all overlapping and more",
+			options:   cpuTreeAllocatorOptions{preferReleaseOverlapping: housekeeping},
+			delta:     -3,
+			expectAll: housekeeping,
+		},
+		{
+			name: "overlapping before device hints",
+			options: cpuTreeAllocatorOptions{
+				preferReleaseOverlapping: housekeeping,
+				preferCloseToDevices:     []string{"gpu"},
+				virtDevCpusets: map[string][]cpuset.CPUSet{
+					"gpu": {cpuset.MustParse("4-7")},
+				},
+			},
+			delta:    -1,
+			expectIn: housekeeping,
+		},
+		{
+			name: "vetoed before overlapping",
+			options: cpuTreeAllocatorOptions{
+				preferReleaseOverlapping: housekeeping,
+				cpuVeto:                  func(cpu int) bool { return cpu == 0 },
+			},
+			delta:     -2,
+			expectAll: cpuset.New(0),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			treeA := tree.NewAllocator(tc.options)
+			cpus, _, err := treeA.Allocate(currentCpus, cpuset.New(), tc.delta)
+			if err != nil {
+				t.Fatalf("Allocate failed: %v", err)
+			}
+			released := currentCpus.Difference(cpus)
+			if released.Size() != -tc.delta {
+				t.Fatalf("expected %d cpus released, got %s", -tc.delta, released)
+			}
+			if !tc.expectIn.IsEmpty() && !released.IsSubsetOf(tc.expectIn) {
+				t.Errorf("expected released cpus from %s, got %s", tc.expectIn, released)
+			}
+			if !tc.expectAll.IsEmpty() && !tc.expectAll.IsSubsetOf(released) {
+				t.Errorf("expected %s to be released, got %s", tc.expectAll, released)
+			}
+		})
+	}
+}
+
+func TestSecurityDomains(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 1, 4, 2})
+	// Tenant a has cpu 0, tenant b cpu 2, cpu 4 has no domain.
+	domains := map[int]string{0: "a", 2: "b"}
+	freeCpus := tree.Cpus().Difference(cpuset.New(0, 2, 4))
+
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{
+		securityDomain:     "b",
+		cpuSecurityDomains: domains,
+	})
+	cpus, _, err := treeA.Allocate(cpuset.New(), freeCpus, 4)
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	if cpus.Contains(1) {
+		t.Errorf("expected no sibling of tenant a cpu 0, got %s", cpus)
+	}
+	// Sibling of own cpu 2 and of the untagged cpu 4 are fine.
+	if !cpus.Equals(cpuset.New(3, 5, 6, 7)) {
+		t.Errorf("expected cpus 3,5-7, got %s", cpus)
+	}
+	if _, _, err := treeA.Allocate(cpuset.New(), freeCpus, 5); err == nil ||
+		!strings.Contains(err.Error(), "security domains") {
+		t.Errorf("expected failure to allocate 5 cpus, got %v", err)
+	}
+
+	// Without a domain any free CPUs are fine.
+	if _, _, err := tree.NewAllocator(cpuTreeAllocatorOptions{cpuSecurityDomains: domains}).Allocate(cpuset.New(), freeCpus, 5); err != nil {
+		t.Errorf("Allocate without securityDomain failed: %v", err)
+	}
+}
+
+func TestBranchAllocator(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{2, 1, 2, 2, 2})
+	numas := tree.FindAll(func(tn *cpuTreeNode) bool {
+		return tn.level == CPUTopologyLevelNuma
+	})
+	if len(numas) != 4 {
+		t.Fatalf("expected 4 NUMA nodes, got %d", len(numas))
+	}
+	numa := numas[2]
+	for _, options := range []cpuTreeAllocatorOptions{
+		{},
+		{topologyBalancing: true},
+		{preferSpreadOnPhysicalCores: true},
+	} {
+		treeA := numa.NewAllocator(options)
+		currentCpus, freeCpus := cpuset.New(), tree.Cpus()
+		for currentCpus.Size() < numa.cpus.Size() {
+			var err error
+			currentCpus, freeCpus, err = treeA.Allocate(currentCpus, freeCpus, 1)
+			if err != nil {
+				t.Fatalf("%+v: Allocate failed: %v", options, err)
+			}
+			if !currentCpus.IsSubsetOf(numa.cpus) {
+				t.Fatalf("%+v: expected cpus only from %s, got %s", options, numa.cpus, currentCpus)
+			}
+		}
+		if _, _, err := treeA.Allocate(currentCpus, freeCpus, 1); err == nil {
+			t.Errorf("%+v: expected allocating beyond the NUMA node to fail", options)
+		}
+
+		// CPUs outside the branch are never released either.
+		_, released, err := treeA.ResizeCpus(currentCpus.Union(cpuset.New(0, 1)), freeCpus, -2)
+		if err != nil {
+			t.Fatalf("%+v: ResizeCpus failed: %v", options, err)
+		}
+		if !released.IsSubsetOf(numa.cpus) {
+			t.Errorf("%+v: expected release only from %s, got %s", options, numa.cpus, released)
+		}
+	}
+}
+
+func TestPreferContiguousIds(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 1, 24, 1})
+	tcases := []struct {
+		name        string
+		currentCpus cpuset.CPUSet
+		freeCpus    cpuset.CPUSet
+		delta       int
+		expectCpus  cpuset.CPUSet
+	}{
+		{
+			name:       "contiguous run over scattered lower ids",
+			freeCpus:   cpuset.New(0, 2, 4, 6, 8, 9, 10, 11, 12, 13, 14, 15),
+			delta:      8,
+			expectCpus: cpuset.MustParse("8-15"),
+		},
+		{
+			name:        "extend current cpus to 8-15 over 8,10,12,14",
+			currentCpus: cpuset.MustParse("8-11"),
+			freeCpus:    cpuset.New(0, 2, 4, 6, 12, 13, 14, 15),
+			delta:       4,
+			expectCpus:  cpuset.MustParse("12-15"),
+		},
+		{
+			name:        "fill a hole between current cpus",
+			currentCpus: cpuset.New(8, 10),
+			freeCpus:    cpuset.New(0, 2, 9, 11, 12, 20),
+			delta:       3,
+			expectCpus:  cpuset.New(9, 11, 12),
+		},
+		{
+			name:       "no runs, lowest ids first",
+			freeCpus:   cpuset.New(8, 10, 12, 14),
+			delta:      2,
+			expectCpus: cpuset.New(8, 10),
+		},
+	}
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			treeA := tree.NewAllocator(cpuTreeAllocatorOptions{preferContiguousIds: true})
+			addFrom, _, err := treeA.ResizeCpus(tc.currentCpus, tc.freeCpus, tc.delta)
+			if err != nil {
+				t.Fatalf("ResizeCpus failed: %v", err)
+			}
+			if !addFrom.Equals(tc.expectCpus) {
+				t.Errorf("expected cpus %s, got %s", tc.expectCpus, addFrom)
+			}
+		})
+	}
+
+	// Without the option, CPUs are allocated in CPU id order.
+	plainA := tree.NewAllocator(cpuTreeAllocatorOptions{})
+	if cpus, _, _ := plainA.Allocate(cpuset.New(), tcases[0].freeCpus, 8); !cpus.Equals(cpuset.MustParse("0,2,4,6,8-11")) {
+		t.Errorf("expected cpus 0,2,4,6,8-11 without the option, got %s", cpus)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{1, 1, 2, 4, 2})
+	decisions := []Decision{}
+	onCommit := func(d Decision) {
+		decisions = append(decisions, d)
+	}
+	modes := newCpuModeMap(nil)
+	newAllocators := func(modes *cpuModeMap, onCommit func(Decision)) (*cpuTreeAllocator, *cpuTreeAllocator) {
+		return tree.NewAllocator(cpuTreeAllocatorOptions{
+				balloon:                 "dedicated",
+				exclusivity:             cpuModeExclusive,
+				cpuModes:                modes,
+				preferLeastRecentlyUsed: true,
+				onCommit:                onCommit,
+			}), tree.NewAllocator(cpuTreeAllocatorOptions{
+				balloon:     "shared",
+				exclusivity: cpuModeShared,
+				cpuModes:    modes,
+				onCommit:    onCommit,
+			})
+	}
+	dedicatedA, sharedA := newAllocators(modes, onCommit)
+
+	freeCpus := tree.Cpus()
+	dedicatedCpus, freeCpus, err := dedicatedA.Allocate(cpuset.New(), freeCpus, 4)
+	if err != nil {
+		t.Fatalf("dedicated Allocate failed: %v", err)
+	}
+	sharedCpus, freeCpus, err := sharedA.Allocate(cpuset.New(), freeCpus, 3)
+	if err != nil {
+		t.Fatalf("shared Allocate failed: %v", err)
+	}
+	dedicatedCpus, freeCpus, err = dedicatedA.Allocate(dedicatedCpus, freeCpus, -2)
+	if err != nil {
+		t.Fatalf("dedicated release failed: %v", err)
+	}
+	sharedCpus, _, err = sharedA.Allocate(sharedCpus, freeCpus, 2)
+	if err != nil {
+		t.Fatalf("shared inflate failed: %v", err)
+	}
+	if len(decisions) != 4 {
+		t.Fatalf("expected 4 committed decisions, got %d", len(decisions))
+	}
+	if d := decisions[2]; d.Balloon != "dedicated" || d.Delta != -2 || !d.Cpus.Equals(dedicatedCpus) {
+		t.Errorf("unexpected decision %+v", d)
+	}
+
+	// Replay into fresh allocators.
+	replayModes := newCpuModeMap(nil)
+	replayA, _ := newAllocators(replayModes, func(d Decision) {
+		t.Errorf("unexpected commit of %+v during replay", d)
+	})
+	balloonCpus, err := replayA.Replay(decisions)
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if len(balloonCpus) != 2 || !balloonCpus["dedicated"].Equals(dedicatedCpus) || !balloonCpus["shared"].Equals(sharedCpus) {
+		t.Errorf("expected dedicated %s and shared %s, got %v", dedicatedCpus, sharedCpus, balloonCpus)
+	}
+	for _, cpu := range tree.Cpus().List() {
+		if expected, got := modes.Mode(cpu), replayModes.Mode(cpu); expected != got {
+			t.Errorf("cpu %d: expected mode %s, got %s", cpu, expected, got)
+		}
+	}
+	lastUsed, replayedLastUsed := dedicatedA.CpuLastUsed(), replayA.CpuLastUsed()
+	if len(replayedLastUsed) != len(lastUsed) {
+		t.Errorf("expected last used times of %d cpus, got %v", len(lastUsed), replayedLastUsed)
+	}
+	for cpu, used := range lastUsed {
+		if !replayedLastUsed[cpu].Equal(used) {
+			t.Errorf("cpu %d: expected last used %s, got %s", cpu, used, replayedLastUsed[cpu])
+		}
+	}
+
+	// Decisions giving a CPU to two balloons are rejected.
+	conflicting := append(slices.Clone(decisions), Decision{Balloon: "other", Cpus: sharedCpus})
+	if _, err := replayA.Replay(conflicting); err == nil {
+		t.Errorf("expected Replay of conflicting decisions to fail")
+	}
+}
+
+func TestResizeCpusDebug(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{2, 1, 2, 4, 2})
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{})
+	currentCpus := cpuset.New(0, 1)
+	freeCpus := tree.Cpus().Difference(currentCpus)
+	for _, delta := range []int{3, -1} {
+		addFrom, removeFrom, err := treeA.ResizeCpus(currentCpus, freeCpus, delta)
+		debugAddFrom, debugRemoveFrom, debugErr := treeA.ResizeCpusDebug(currentCpus, freeCpus, delta)
+		if !debugAddFrom.Equals(addFrom) || !debugRemoveFrom.Equals(removeFrom) || (err == nil) != (debugErr == nil) {
+			t.Errorf("delta %d: expected %q, %q, %v, got %q, %q, %v",
+				delta, addFrom, removeFrom, err, debugAddFrom, debugRemoveFrom, debugErr)
+		}
+	}
+	if treeA.debugCall {
+		t.Errorf("expected debugging to be limited to ResizeCpusDebug calls")
+	}
+}
+
+func TestNodeMemoryBytes(t *testing.T) {
+	sys := newFakeSystemFromInt5([5]int{1, 1, 3, 2, 2})
+	sys.nodes[0].memInfo = &system.MemInfo{MemTotal: 4 << 30}
+	sys.nodes[1].memInfo = &system.MemInfo{MemTotal: 8 << 30}
+	// Memory of node 2 is unknown.
+	tree, err := newCpuTreeFromSys(sys, nil)
+	if err != nil {
+		t.Fatalf("newCpuTreeFromSys failed: %v", err)
+	}
+	if mem := tree.NodeMemoryBytes(); mem != 0 {
+		t.Errorf("expected no memory without discovery, got %d", mem)
+	}
+
+	tree.discoverNodeMemory()
+	expected := map[string]uint64{
+		"system":       12 << 30,
+		"p0d0n0":       4 << 30,
+		"p0d0n1":       8 << 30,
+		"p0d0n2":       0,
+		"p0d0n1cpu4":   8 << 30,
+		"p0d0n1cpu4t5": 8 << 30,
+	}
+	_ = tree.DepthFirstWalk(func(tn *cpuTreeNode) error {
+		if mem, ok := expected[tn.name]; ok {
+			if got := tn.NodeMemoryBytes(); got != mem {
+				t.Errorf("%s: expected %d bytes of memory, got %d", tn.name, mem, got)
+			}
+			delete(expected, tn.name)
+		}
+		return nil
+	})
+	if len(expected) > 0 {
+		t.Errorf("nodes %v not found in tree %s", expected, tree.PrettyPrint())
+	}
+}
+
+func TestPrune(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{2, 1, 2, 2, 2})
+	// Mask out package 1 (cpus 8-15), NUMA node 1 (cpus 4-7) of
+	// package 0 and the second thread of core 0.
+	mask := cpuset.New(0, 2, 3)
+	_ = tree.DepthFirstWalk(func(tn *cpuTreeNode) error {
+		tn.cpus = tn.cpus.Intersection(mask)
+		return nil
+	})
+	// Removed nodes: package 1 with its die, 2 NUMA nodes, 4
+	// cores and 8 threads, NUMA node 1 of package 0 with its 2
+	// cores and 4 threads, and thread 1.
+	if removed := tree.Prune(); removed != 1+1+2+4+8+1+2+4+1 {
+		t.Errorf("expected 24 removed nodes, got %d", removed)
+	}
+	nodes := 0
+	_ = tree.DepthFirstWalk(func(tn *cpuTreeNode) error {
+		nodes++
+		if tn.cpus.IsEmpty() {
+			t.Errorf("empty node %s left in tree", tn.name)
+		}
+		for _, child := range tn.children {
+			if child.parent != tn {
+				t.Errorf("node %s: broken parent link of child %s", tn.name, child.name)
+			}
+		}
+		return nil
+	})
+	// Left: system, package 0, die, NUMA node 0, 2 cores and 3 threads.
+	if nodes != 9 {
+		t.Errorf("expected 9 nodes left, got %d:\n%s", nodes, tree.PrettyPrint())
+	}
+	if removed := tree.Prune(); removed != 0 {
+		t.Errorf("expected nothing to prune from a pruned tree, got %d", removed)
+	}
+
+	// The root is never removed.
+	empty := NewCpuTree("empty")
+	empty.AddChild(NewCpuTree("child"))
+	if removed := empty.Prune(); removed != 1 || len(empty.children) != 0 {
+		t.Errorf("expected only the child of an empty root removed, got %d", removed)
+	}
+}
+
+func TestAllocatorPresets(t *testing.T) {
+	tree, _ := newCpuTreeFromInt5([5]int{2, 1, 2, 4, 2})
+	// CPU 0 of NUMA node 0 is in use.
+	freeCpus := tree.Cpus().Difference(cpuset.New(0))
+
+	latencyA := tree.NewAllocator(LatencyOptimizedOptions())
+	cpus, _, err := latencyA.Allocate(cpuset.New(), freeCpus, 4)
+	if err != nil {
+		t.Fatalf("latency optimized Allocate failed: %v", err)
+	}
+	if cpus.Size() != 4 || !cpus.Equals(latencyA.wholeCoreCpus(cpus)) {
+		t.Errorf("expected 4 CPUs of whole cores, got %s", cpus)
+	}
+	if nodes := cpuNodeIds(tree, cpus); len(nodes) != 1 {
+		t.Errorf("expected CPUs in a single NUMA node, got %s in nodes %v", cpus, nodes)
+	}
+	if _, _, err := latencyA.Allocate(cpuset.New(), freeCpus, 3); err == nil {
+		t.Errorf("expected latency optimized allocation of partial cores to fail")
+	}
+
+	throughputA := tree.NewAllocator(ThroughputOptimizedOptions())
+	cpus, _, err = throughputA.Allocate(cpuset.New(), freeCpus, 4)
+	if err != nil {
+		t.Fatalf("throughput optimized Allocate failed: %v", err)
+	}
+	if cpus.Size() != 4 || !cpus.IsSubsetOf(cpuset.MustParse("16-31")) {
+		t.Errorf("expected 4 CPUs in the emptiest package 1, got %s", cpus)
+	}
+	for _, cpu := range cpus.List() {
+		if sibling := cpu ^ 1; cpus.Contains(sibling) {
+			t.Errorf("expected CPUs spread on physical cores, got siblings %d and %d in %s", cpu, sibling, cpus)
+		}
+	}
+}
+
+// cpuNodeIds returns the ids of the NUMA nodes of cpus in a tree.
+func cpuNodeIds(tree *cpuTreeNode, cpus cpuset.CPUSet) []int {
+	ids := []int{}
+	_ = tree.DepthFirstWalk(func(tn *cpuTreeNode) error {
+		if tn.level != CPUTopologyLevelNuma {
+			return nil
+		}
+		if !tn.cpus.Intersection(cpus).IsEmpty() {
+			ids = append(ids, tn.id)
+		}
+		return WalkSkipChildren
+	})
+	return ids
+}
+
+func TestMigrationPlan(t *testing.T) {
+	tcases := []struct {
+		name        string
+		from        map[string]cpuset.CPUSet
+		to          map[string]cpuset.CPUSet
+		expectMoves []Move
+		expectErr   bool
+	}{
+		{
+			name: "swap needs staged moves",
+			from: map[string]cpuset.CPUSet{"a": cpuset.MustParse("0-1"), "b": cpuset.MustParse("2-3")},
+			to:   map[string]cpuset.CPUSet{"a": cpuset.MustParse("2-3"), "b": cpuset.MustParse("0-1")},
+			expectMoves: []Move{
+				{Balloon: "b", Release: cpuset.MustParse("2-3"), Acquire: cpuset.New()},
+				{Balloon: "a", Release: cpuset.MustParse("0-1"), Acquire: cpuset.MustParse("2-3")},
+				{Balloon: "b", Release: cpuset.New(), Acquire: cpuset.MustParse("0-1")},
+			},
+		},
+		{
+			name: "chain releases before acquisitions",
+			from: map[string]cpuset.CPUSet{"a": cpuset.New(0), "b": cpuset.New(1), "c": cpuset.New(2)},
+			to:   map[string]cpuset.CPUSet{"a": cpuset.New(1), "b": cpuset.New(2), "c": cpuset.New(3)},
+			expectMoves: []Move{
+				{Balloon: "c", Release: cpuset.New(2), Acquire: cpuset.New(3)},
+				{Balloon: "b", Release: cpuset.New(1), Acquire: cpuset.New(2)},
+				{Balloon: "a", Release: cpuset.New(0), Acquire: cpuset.New(1)},
+			},
+		},
+		{
+			name: "new, removed and unchanged balloons",
+			from: map[string]cpuset.CPUSet{"old": cpuset.MustParse("0-3"), "same": cpuset.New(4)},
+			to:   map[string]cpuset.CPUSet{"new": cpuset.MustParse("2-5"), "same": cpuset.New(6)},
+			expectMoves: []Move{
+				{Balloon: "old", Release: cpuset.MustParse("0-3"), Acquire: cpuset.New()},
+				{Balloon: "same", Release: cpuset.New(4), Acquire: cpuset.New(6)},
+				{Balloon: "new", Release: cpuset.New(), Acquire: cpuset.MustParse("2-5")},
+			},
+		},
+		{
+			name:      "overlapping target allocation",
+			from:      map[string]cpuset.CPUSet{"a": cpuset.New(0)},
+			to:        map[string]cpuset.CPUSet{"a": cpuset.New(1), "b": cpuset.New(1)},
+			expectErr: true,
+		},
+	}
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			moves, err := MigrationPlan(tc.from, tc.to)
+			if tc.expectErr {
+				if err == nil {
+					t.Fatalf("expected error, got moves %v", moves)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MigrationPlan failed: %v", err)
+			}
+			if len(moves) != len(tc.expectMoves) {
+				t.Fatalf("expected moves %v, got %v", tc.expectMoves, moves)
+			}
+			for i, m := range moves {
+				e := tc.expectMoves[i]
+				if m.Balloon != e.Balloon || !m.Release.Equals(e.Release) || !m.Acquire.Equals(e.Acquire) {
+					t.Errorf("move %d: expected %v, got %v", i, e, m)
+				}
+			}
+			// Applying the moves never gives a CPU to two
+			// balloons, and ends up in the target allocation.
+			owners := map[int]string{}
+			for name, cpus := range tc.from {
+				for _, cpu := range cpus.List() {
+					owners[cpu] = name
+				}
+			}
+			for i, m := range moves {
+				for _, cpu := range m.Release.List() {
+					delete(owners, cpu)
+				}
+				for _, cpu := range m.Acquire.List() {
+					if owner, ok := owners[cpu]; ok {
+						t.Errorf("move %d: %s acquires cpu %d held by %s", i, m.Balloon, cpu, owner)
+					}
+					owners[cpu] = m.Balloon
+				}
+			}
+			for name, cpus := range tc.to {
+				for _, cpu := range cpus.List() {
+					if owners[cpu] != name {
+						t.Errorf("expected cpu %d in %s after moves, got %q", cpu, name, owners[cpu])
+					}
+				}
+			}
+		})
+	}
+}
@@ -22,6 +22,7 @@ import (
 type (
 	BalloonsOptions  = cfgapi.Config
 	BalloonDef       = cfgapi.BalloonDef
+	ReservedShape    = cfgapi.ReservedShape
 	CPUTopologyLevel = cfgapi.CPUTopologyLevel
 )
 
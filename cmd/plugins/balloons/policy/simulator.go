@@ -0,0 +1,126 @@
+// Copyright The NRI Plugins Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package balloons
+
+import (
+	"fmt"
+
+	cfgapi "github.com/containers/nri-plugins/pkg/apis/config/v1alpha1/resmgr/policy/balloons"
+	"github.com/containers/nri-plugins/pkg/cpuallocator"
+	system "github.com/containers/nri-plugins/pkg/sysfs"
+	"github.com/containers/nri-plugins/pkg/utils/cpuset"
+)
+
+// Simulator runs grow and shrink operations of named CPU sets on a
+// simulated CPU topology using the same resizers as the balloons
+// policy. It can be used for reproducible testing and for what-if
+// analysis of allocator options without a real node.
+type Simulator struct {
+	allocator *cpuTreeAllocator
+	freeCpus  cpuset.CPUSet
+	cpus      map[string]cpuset.CPUSet
+}
+
+// NewSimulator returns a simulator for the CPU topology of sys, like
+// a system discovered from a copy of the sysfs of another node. All
+// CPUs of the system are initially free. CPUs are allocated with the
+// options of preset, like in balloon types with the same
+// allocatorPreset, or with default options if preset is PresetNone.
+func NewSimulator(sys system.System, preset cfgapi.AllocatorPreset) (*Simulator, error) {
+	options := cpuTreeAllocatorOptions{}
+	if preset != cfgapi.PresetNone {
+		presetOptions, ok := allocatorPresets[preset]
+		if !ok {
+			return nil, fmt.Errorf("unknown allocator preset %q", preset)
+		}
+		options = presetOptions()
+	}
+	return newSimulator(sys, options)
+}
+
+// newSimulator returns a simulator that allocates CPUs with options.
+// Unless options set another CPU allocator, CPUs are picked among the
+// CPUs chosen by the resizers with the same CPU allocator as the
+// balloons policy uses. Like in the policy, allocatorPriority in
+// options should be the AllocatorPriority value of the simulated
+// balloon type.
+func newSimulator(sys system.System, options cpuTreeAllocatorOptions) (*Simulator, error) {
+	tree, err := newCpuTreeFromSys(sys, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create simulated CPU tree: %w", err)
+	}
+	if options.cpuAllocator == nil {
+		options.cpuAllocator = cpuallocator.NewCPUAllocator(sys)
+	}
+	return &Simulator{
+		allocator: tree.NewAllocator(options),
+		freeCpus:  tree.Cpus(),
+		cpus:      map[string]cpuset.CPUSet{},
+	}, nil
+}
+
+// Grow adds n CPUs to the named CPU set. The set is created if it
+// does not exist.
+func (s *Simulator) Grow(name string, n int) error {
+	if n < 0 {
+		return fmt.Errorf("cannot grow %q by a negative number of CPUs (%d)", name, n)
+	}
+	return s.resize(name, n)
+}
+
+// Shrink removes n CPUs from the named CPU set. The set is removed
+// when it becomes empty.
+func (s *Simulator) Shrink(name string, n int) error {
+	if n < 0 {
+		return fmt.Errorf("cannot shrink %q by a negative number of CPUs (%d)", name, n)
+	}
+	current, ok := s.cpus[name]
+	if !ok {
+		return fmt.Errorf("cannot shrink %q: no such CPU set", name)
+	}
+	if n > current.Size() {
+		return fmt.Errorf("cannot shrink %q by %d CPUs: it has only %d CPUs", name, n, current.Size())
+	}
+	return s.resize(name, -n)
+}
+
+func (s *Simulator) resize(name string, delta int) error {
+	current := s.cpus[name]
+	newCpus, newFreeCpus, err := s.allocator.Allocate(current, s.freeCpus, delta)
+	if err != nil {
+		return fmt.Errorf("failed to resize %q by %d CPUs: %w", name, delta, err)
+	}
+	s.freeCpus = newFreeCpus
+	if newCpus.IsEmpty() {
+		delete(s.cpus, name)
+	} else {
+		s.cpus[name] = newCpus
+	}
+	return nil
+}
+
+// FreeCpus returns the CPUs that are not in any CPU set.
+func (s *Simulator) FreeCpus() cpuset.CPUSet {
+	return s.freeCpus
+}
+
+// Snapshot returns the current CPUs of all CPU sets.
+func (s *Simulator) Snapshot() map[string]cpuset.CPUSet {
+	snapshot := make(map[string]cpuset.CPUSet, len(s.cpus))
+	for name, cpus := range s.cpus {
+		snapshot[name] = cpus
+	}
+	return snapshot
+}
@@ -0,0 +1,187 @@
+// Copyright The NRI Plugins Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package balloons
+
+import (
+	"math/rand"
+	"testing"
+
+	cfgapi "github.com/containers/nri-plugins/pkg/apis/config/v1alpha1/resmgr/policy/balloons"
+	"github.com/containers/nri-plugins/pkg/cpuallocator"
+	"github.com/containers/nri-plugins/pkg/utils/cpuset"
+)
+
+func TestSimulator(t *testing.T) {
+	sys := newFakeSystemFromInt5([5]int{2, 1, 2, 4, 2})
+	sim, err := NewSimulator(sys, cfgapi.PresetNone)
+	if err != nil {
+		t.Fatalf("NewSimulator failed: %v", err)
+	}
+	if sim.FreeCpus().Size() != 32 {
+		t.Fatalf("expected 32 free CPUs, got %s", sim.FreeCpus())
+	}
+	if err := sim.Grow("a", 4); err != nil {
+		t.Fatalf("Grow failed: %v", err)
+	}
+	if err := sim.Grow("b", 6); err != nil {
+		t.Fatalf("Grow failed: %v", err)
+	}
+	if err := sim.Shrink("a", 2); err != nil {
+		t.Fatalf("Shrink failed: %v", err)
+	}
+	snapshot := sim.Snapshot()
+	if snapshot["a"].Size() != 2 || snapshot["b"].Size() != 6 {
+		t.Errorf("unexpected snapshot: %v", snapshot)
+	}
+	if !snapshot["a"].Intersection(snapshot["b"]).IsEmpty() {
+		t.Errorf("overlapping CPU sets: %v", snapshot)
+	}
+	if sim.FreeCpus().Size() != 24 || !sim.FreeCpus().Intersection(snapshot["a"].Union(snapshot["b"])).IsEmpty() {
+		t.Errorf("unexpected free CPUs %s with snapshot %v", sim.FreeCpus(), snapshot)
+	}
+
+	// Compare with the balloons policy that picks the CPUs from
+	// those chosen by the allocator with the CPU allocator of the
+	// system: results must match.
+	tree, _ := newCpuTreeFromSys(sys, nil)
+	treeA := tree.NewAllocator(cpuTreeAllocatorOptions{})
+	ca := cpuallocator.NewCPUAllocator(sys)
+	freeCpus := tree.Cpus()
+	addFromCpus, _, _ := treeA.ResizeCpus(cpuset.New(), freeCpus, 4)
+	a, _ := ca.AllocateCpus(&addFromCpus, 4, cpuallocator.PriorityHigh)
+	freeCpus = freeCpus.Difference(a)
+	addFromCpus, _, _ = treeA.ResizeCpus(cpuset.New(), freeCpus, 6)
+	b, _ := ca.AllocateCpus(&addFromCpus, 6, cpuallocator.PriorityHigh)
+	freeCpus = freeCpus.Difference(b)
+	_, removeFromCpus, _ := treeA.ResizeCpus(a, freeCpus, -2)
+	_, _ = ca.ReleaseCpus(&removeFromCpus, 2, cpuallocator.PriorityHigh)
+	a = a.Difference(removeFromCpus)
+	freeCpus = freeCpus.Union(removeFromCpus)
+	if !a.Equals(snapshot["a"]) || !b.Equals(snapshot["b"]) || !freeCpus.Equals(sim.FreeCpus()) {
+		t.Errorf("simulator result differs from the policy: %v, expected a=%s b=%s", snapshot, a, b)
+	}
+
+	if err := sim.Shrink("a", 2); err != nil {
+		t.Fatalf("Shrink failed: %v", err)
+	}
+	if _, ok := sim.Snapshot()["a"]; ok {
+		t.Errorf("expected empty CPU set to be removed")
+	}
+	if err := sim.Shrink("a", 1); err == nil {
+		t.Errorf("expected error when shrinking a missing CPU set")
+	}
+	if err := sim.Grow("c", 100); err == nil {
+		t.Errorf("expected error when growing beyond free CPUs")
+	}
+}
+
+func TestSimulatorPresets(t *testing.T) {
+	sys := newFakeSystemFromInt5([5]int{2, 1, 2, 4, 2})
+	if _, err := NewSimulator(sys, "fastest"); err == nil {
+		t.Errorf("expected error from unknown preset")
+	}
+	sim, err := NewSimulator(sys, cfgapi.PresetLatencyOptimized)
+	if err != nil {
+		t.Fatalf("NewSimulator failed: %v", err)
+	}
+	// Latency-optimized CPUs are whole cores.
+	if err := sim.Grow("a", 3); err == nil {
+		t.Errorf("expected error when growing by a partial core, got %v", sim.Snapshot())
+	}
+	if err := sim.Grow("a", 4); err != nil {
+		t.Fatalf("Grow failed: %v", err)
+	}
+}
+
+// FuzzSimulator applies random sequences of grows and shrinks to
+// several CPU sets with various allocator options, and checks that
+// CPU sets never overlap, no CPUs are lost or duplicated and sets have
+// the expected sizes. Failures are reproducible with the seed and
+// options of the failing input.
+func FuzzSimulator(f *testing.F) {
+	for seed := int64(0); seed < 16; seed++ {
+		f.Add(seed, uint8(seed))
+	}
+	f.Fuzz(func(t *testing.T, seed int64, optionBits uint8) {
+		options := cpuTreeAllocatorOptions{
+			topologyBalancing:     optionBits&0x01 != 0,
+			preferEmptiestPackage: optionBits&0x04 != 0,
+			preferHighFreq:        optionBits&0x08 != 0,
+			preferEmptyWholeNode:  optionBits&0x10 != 0,
+			verify:                true,
+		}
+		if optionBits&0x02 != 0 {
+			options.preferSpreadOnPhysicalCores = true
+			options.releaseLoneThreadsFirst = optionBits&0x20 != 0
+		} else {
+			options.preferPackSiblings = optionBits&0x20 != 0
+		}
+		if optionBits&0x40 != 0 {
+			options.perNodeHeadroom = 1
+		}
+		sim, err := newSimulator(newFakeSystemFromInt5([5]int{2, 1, 2, 4, 2}), options)
+		if err != nil {
+			t.Fatalf("newSimulator failed: %v", err)
+		}
+		allCpus := sim.FreeCpus()
+		names := []string{"a", "b", "c", "d"}
+		sizes := map[string]int{}
+		rng := rand.New(rand.NewSource(seed))
+		for op := 0; op < 64; op++ {
+			name := names[rng.Intn(len(names))]
+			n := 1 + rng.Intn(8)
+			grow := rng.Intn(2) == 0 || sizes[name] == 0
+			if grow {
+				free := sim.FreeCpus().Size()
+				err = sim.Grow(name, n)
+				if n > free {
+					if err == nil {
+						t.Fatalf("seed %d options %#x op %d: growing %s by %d succeeded with only %d free CPUs",
+							seed, optionBits, op, name, n, free)
+					}
+					continue
+				}
+				sizes[name] += n
+			} else {
+				n = min(n, sizes[name])
+				err = sim.Shrink(name, n)
+				sizes[name] -= n
+			}
+			if err != nil {
+				t.Fatalf("seed %d options %#x op %d: resizing %s by %d failed: %v",
+					seed, optionBits, op, name, n, err)
+			}
+
+			snapshot := sim.Snapshot()
+			used := cpuset.New()
+			for _, name := range names {
+				cpus := snapshot[name]
+				if cpus.Size() != sizes[name] {
+					t.Fatalf("seed %d options %#x op %d: expected %d CPUs in %s, got %s",
+						seed, optionBits, op, sizes[name], name, cpus)
+				}
+				if !used.Intersection(cpus).IsEmpty() {
+					t.Fatalf("seed %d options %#x op %d: CPUs %s of %s overlap with other sets %v",
+						seed, optionBits, op, cpus, name, snapshot)
+				}
+				used = used.Union(cpus)
+			}
+			if !used.Intersection(sim.FreeCpus()).IsEmpty() || !used.Union(sim.FreeCpus()).Equals(allCpus) {
+				t.Fatalf("seed %d options %#x op %d: CPUs not conserved: used %s, free %s, all %s",
+					seed, optionBits, op, used, sim.FreeCpus(), allCpus)
+			}
+		}
+	})
+}
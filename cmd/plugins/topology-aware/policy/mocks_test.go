@@ -201,6 +201,10 @@ func (c *mockCPU) CoreKind() sysfs.CoreKind {
 	return sysfs.PerformanceCore
 }
 
+func (c *mockCPU) Capacity() uint64 {
+	return 0
+}
+
 type mockSystem struct {
 	isolatedCPU  int
 	nodes        []system.Node
@@ -245,6 +249,18 @@ func (fake *mockSystem) OnlineCPUs() cpuset.CPUSet {
 func (fake *mockSystem) IsolatedCPUs() cpuset.CPUSet {
 	return fake.Isolated()
 }
+func (fake *mockSystem) NohzFullCPUs() cpuset.CPUSet {
+	return cpuset.New()
+}
+func (fake *mockSystem) SMTActive() bool {
+	return false
+}
+func (fake *mockSystem) CPUVulnerabilities() map[string]string {
+	return map[string]string{}
+}
+func (fake *mockSystem) BootCPU() idset.ID {
+	return 0
+}
 func (fake *mockSystem) OfflineCPUs() cpuset.CPUSet {
 	return cpuset.New()
 }
@@ -426,6 +442,9 @@ func (m *mockContainer) GetResourceUpdates() (v1.ResourceRequirements, bool) {
 func (m *mockContainer) InsertMount(*cache.Mount) {
 	panic("unimplemented")
 }
+func (m *mockContainer) AddAnnotation(string, string) {
+	panic("unimplemented")
+}
 func (m *mockContainer) GetTopologyHints() topology.Hints {
 	return topology.Hints{}
 }
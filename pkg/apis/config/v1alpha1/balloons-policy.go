@@ -14,6 +14,10 @@
 
 package v1alpha1
 
+import (
+	"errors"
+)
+
 var (
 	_ ResmgrConfig = &BalloonsPolicy{}
 )
@@ -40,5 +44,5 @@ func (c *BalloonsPolicy) Validate() error {
 	if c == nil {
 		return nil
 	}
-	return c.Spec.Config.Validate()
+	return errors.Join(c.Spec.Control.Validate(), c.Spec.Config.Validate())
 }
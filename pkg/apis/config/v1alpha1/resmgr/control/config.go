@@ -15,11 +15,163 @@
 package control
 
 import (
+	"errors"
+	"fmt"
+	"time"
+
 	"github.com/containers/nri-plugins/pkg/apis/config/v1alpha1/resmgr/control/cpu"
+	"github.com/containers/nri-plugins/pkg/apis/config/v1alpha1/resmgr/control/sched"
+	"github.com/containers/nri-plugins/pkg/apis/config/v1alpha1/resmgr/control/thp"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // +k8s:deepcopy-gen=true
 type Config struct {
 	// +optional
-	CPU *cpu.Config `json:"cpu",omitempty"`
+	CPU *cpu.Config `json:"cpu,omitempty"`
+	// +optional
+	Sched *sched.Config `json:"sched,omitempty"`
+	// +optional
+	THP *thp.Config `json:"thp,omitempty"`
+	// ReconcileInterval is the interval between periodically re-asserting
+	// the decisions of controllers for running containers. Reconciliation
+	// is disabled if the interval is unset or zero.
+	// +optional
+	// +kubebuilder:validation:Format="duration"
+	ReconcileInterval metav1.Duration `json:"reconcileInterval,omitempty"`
+	// HookRetry configures retrying container hooks of controllers
+	// which fail with a transient error.
+	// +optional
+	HookRetry *HookRetry `json:"hookRetry,omitempty"`
+	// PostUpdateCoalesceWindow is the time post-update hooks of a
+	// container are delayed to collapse a burst of updates into a
+	// single hook run. Hooks of controllers which can tell the state
+	// they would apply are skipped if it has not changed since it was
+	// last applied. Coalescing is disabled if the window is unset or
+	// zero. It cannot be used with cpu.expandBeforeContract.
+	// +optional
+	// +kubebuilder:validation:Format="duration"
+	PostUpdateCoalesceWindow metav1.Duration `json:"postUpdateCoalesceWindow,omitempty"`
+	// FailFastStart aborts starting controllers at the first controller
+	// that fails to start, and stops the controllers already started,
+	// leaving no controller running. By default all controllers are
+	// started and all failures are reported together.
+	// +optional
+	FailFastStart bool `json:"failFastStart,omitempty"`
+}
+
+// HookRetry configures retrying failed controller hooks.
+// +k8s:deepcopy-gen=true
+type HookRetry struct {
+	// Attempts is the maximum number of times a failed hook is retried.
+	// Retrying is disabled if the number is unset or zero.
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=10
+	Attempts int `json:"attempts,omitempty"`
+	// Backoff is the delay before the first retry. The delay is doubled
+	// for every subsequent retry. Retries are immediate if the delay is
+	// unset or zero.
+	// +optional
+	// +kubebuilder:validation:Format="duration"
+	Backoff metav1.Duration `json:"backoff,omitempty"`
+	// MaxBackoff is the longest delay before a retry. Doubling the
+	// delay stops there. The delay is not capped if it is unset or
+	// zero. The total delay of all retries of a hook must not exceed
+	// 500ms in any case.
+	// +optional
+	// +kubebuilder:validation:Format="duration"
+	MaxBackoff metav1.Duration `json:"maxBackoff,omitempty"`
+	// Controllers are the names of controllers whose hooks are retried.
+	// Hooks of all controllers are retried if the list is empty.
+	// +optional
+	Controllers []string `json:"controllers,omitempty"`
+}
+
+const (
+	// MaxHookRetryAttempts is the maximum number of hook retry attempts.
+	MaxHookRetryAttempts = 10
+	// MaxHookRetryDelay is the maximum total delay of all retries of a
+	// hook. Hooks are run while the runtime waits for a reply to an NRI
+	// request, holding up all other requests, so retrying must end well
+	// before the runtime times out the request, by default in 2 seconds.
+	MaxHookRetryDelay = 500 * time.Millisecond
+)
+
+// Validate checks the number of attempts and the backoff.
+func (r *HookRetry) Validate() error {
+	if r == nil {
+		return nil
+	}
+	errs := []error{}
+	if r.Attempts < 0 || r.Attempts > MaxHookRetryAttempts {
+		errs = append(errs, fmt.Errorf("attempts %d out of range 0-%d", r.Attempts, MaxHookRetryAttempts))
+	}
+	if r.Backoff.Duration < 0 {
+		errs = append(errs, fmt.Errorf("negative backoff %s", r.Backoff.Duration))
+	}
+	if r.MaxBackoff.Duration < 0 {
+		errs = append(errs, fmt.Errorf("negative maxBackoff %s", r.MaxBackoff.Duration))
+	}
+	if len(errs) == 0 {
+		total := time.Duration(0)
+		for _, delay := range r.Delays() {
+			total += delay
+		}
+		if total > MaxHookRetryDelay {
+			errs = append(errs, fmt.Errorf("total delay %s of %d retries exceeds %s",
+				total, r.Attempts, MaxHookRetryDelay))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Delays returns the delays before every retry of a failed hook.
+func (r *HookRetry) Delays() []time.Duration {
+	if r == nil || r.Attempts <= 0 {
+		return nil
+	}
+	delays := make([]time.Duration, 0, min(r.Attempts, MaxHookRetryAttempts))
+	delay := r.Backoff.Duration
+	for range min(r.Attempts, MaxHookRetryAttempts) {
+		if r.MaxBackoff.Duration > 0 {
+			delay = min(delay, r.MaxBackoff.Duration)
+		}
+		delays = append(delays, delay)
+		delay *= 2
+	}
+	return delays
+}
+
+// Validate checks the configuration of all controllers and returns
+// all problems found.
+func (c *Config) Validate() error {
+	if c == nil {
+		return nil
+	}
+	errs := []error{}
+	if err := c.CPU.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid cpu controller configuration: %w", err))
+	}
+	if err := c.Sched.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid sched controller configuration: %w", err))
+	}
+	if err := c.THP.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid thp controller configuration: %w", err))
+	}
+	if c.ReconcileInterval.Duration < 0 {
+		errs = append(errs, fmt.Errorf("invalid reconcileInterval %s: negative interval", c.ReconcileInterval.Duration))
+	}
+	if c.PostUpdateCoalesceWindow.Duration < 0 {
+		errs = append(errs, fmt.Errorf("invalid postUpdateCoalesceWindow %s: negative window", c.PostUpdateCoalesceWindow.Duration))
+	}
+	if c.PostUpdateCoalesceWindow.Duration > 0 && c.CPU != nil && c.CPU.ExpandBeforeContract {
+		// Coalesced post-update hooks run after the runtime has
+		// already set the new CPUs, too late for expanding them.
+		errs = append(errs, fmt.Errorf("invalid postUpdateCoalesceWindow %s: cannot be used with cpu.expandBeforeContract", c.PostUpdateCoalesceWindow.Duration))
+	}
+	if err := c.HookRetry.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid hookRetry: %w", err))
+	}
+	return errors.Join(errs...)
 }
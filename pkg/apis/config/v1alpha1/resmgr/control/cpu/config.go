@@ -14,11 +14,53 @@
 
 package cpu
 
+import (
+	"errors"
+	"fmt"
+)
+
 // +k8s:deepcopy-gen=true
 type Config struct {
 	Classes map[string]Class `json:"classes"`
+	// BindMemory binds the memory of containers to the NUMA nodes
+	// of the CPUs they are pinned to, by setting cpuset.mems of
+	// their cgroup.
+	BindMemory bool `json:"bindMemory,omitempty"`
+	// Partition turns the cpuset cgroup of containers with exclusive
+	// CPUs into a cpuset partition of this type, by setting their
+	// cpuset.cpus.partition. Partitions are reverted to member when
+	// the controller is stopped. Leave empty to disable partitioning.
+	// +kubebuilder:validation:Enum="";root;isolated
+	// +optional
+	Partition string `json:"partition,omitempty"`
+	// ExclusiveCpus claims the CPUs of containers with exclusive CPUs
+	// for the container alone, by setting cpuset.cpus.exclusive of
+	// their cgroup. This is ignored on kernels without support for
+	// cpuset.cpus.exclusive. Exclusive CPUs are released when the
+	// controller is stopped.
+	// +optional
+	ExclusiveCpus bool `json:"exclusiveCpus,omitempty"`
+	// ExpandBeforeContract widens the cpuset.cpus of containers
+	// whose CPUs are about to change to the union of their old
+	// and new CPUs, before the runtime sets the new CPUs. This
+	// way the CPUs of a container are never empty while CPUs are
+	// moved between containers, at the cost of containers briefly
+	// sharing CPUs they are giving up or taking over. Expanding
+	// needs post-update hooks to run before the runtime updates
+	// the container, so this cannot be used with a post-update
+	// coalescing window.
+	// +optional
+	ExpandBeforeContract bool `json:"expandBeforeContract,omitempty"`
 }
 
+const (
+	// PartitionRoot creates scheduling domain root partitions.
+	PartitionRoot = "root"
+	// PartitionIsolated creates isolated partitions, without load
+	// balancing among the partitioned CPUs.
+	PartitionIsolated = "isolated"
+)
+
 type Class struct {
 	// MinFreq is the minimum frequency for this class.
 	MinFreq uint `json:"minFreq"`
@@ -31,3 +73,39 @@ type Class struct {
 	// UncoreMaxFreq is the maximum uncore frequency for this class.
 	UncoreMaxFreq uint `json:"uncoreMaxFreq,omitempty"`
 }
+
+// Validate checks the frequency ranges and energy performance
+// preferences of all classes.
+func (c *Config) Validate() error {
+	if c == nil {
+		return nil
+	}
+	errs := []error{}
+	switch c.Partition {
+	case "", PartitionRoot, PartitionIsolated:
+	default:
+		errs = append(errs, fmt.Errorf("invalid cpuset partition type %q", c.Partition))
+	}
+	for name, class := range c.Classes {
+		if err := class.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("cpu class %q: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Validate checks that minimum frequencies do not exceed maximum
+// frequencies and that the energy performance preference is valid.
+func (c *Class) Validate() error {
+	errs := []error{}
+	if c.MinFreq > 0 && c.MaxFreq > 0 && c.MinFreq > c.MaxFreq {
+		errs = append(errs, fmt.Errorf("minFreq %d greater than maxFreq %d", c.MinFreq, c.MaxFreq))
+	}
+	if c.UncoreMinFreq > 0 && c.UncoreMaxFreq > 0 && c.UncoreMinFreq > c.UncoreMaxFreq {
+		errs = append(errs, fmt.Errorf("uncoreMinFreq %d greater than uncoreMaxFreq %d", c.UncoreMinFreq, c.UncoreMaxFreq))
+	}
+	if c.EnergyPerformancePreference > 255 {
+		errs = append(errs, fmt.Errorf("energyPerformancePreference %d out of range 0-255", c.EnergyPerformancePreference))
+	}
+	return errors.Join(errs...)
+}
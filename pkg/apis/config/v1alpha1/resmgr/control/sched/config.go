@@ -0,0 +1,85 @@
+// Copyright The NRI Plugins Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sched
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Config provides runtime configuration for the scheduling policy controller.
+// +k8s:deepcopy-gen=true
+type Config struct {
+	// Classes define the scheduling classes containers can be assigned to
+	// using the schedclass.resource-policy.nri.io annotation.
+	Classes map[string]Class `json:"classes"`
+}
+
+// Class is a scheduling policy with a priority.
+type Class struct {
+	// Policy is the scheduling policy of the tasks of the container.
+	// +kubebuilder:validation:Enum=fifo;rr;other
+	Policy Policy `json:"policy"`
+	// Priority is the real-time priority of the tasks. It must be
+	// within the range the kernel allows for the policy, 1-99 for
+	// fifo and rr, and 0 for other.
+	// +optional
+	Priority int `json:"priority,omitempty"`
+}
+
+// Policy is a scheduling policy.
+type Policy string
+
+const (
+	// PolicyFIFO is the first-in, first-out real-time policy (SCHED_FIFO).
+	PolicyFIFO Policy = "fifo"
+	// PolicyRR is the round-robin real-time policy (SCHED_RR).
+	PolicyRR Policy = "rr"
+	// PolicyOther is the default time-sharing policy (SCHED_OTHER).
+	PolicyOther Policy = "other"
+)
+
+// Validate checks the policies and priorities of all classes.
+func (c *Config) Validate() error {
+	if c == nil {
+		return nil
+	}
+	errs := []error{}
+	for name, class := range c.Classes {
+		if err := class.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("scheduling class %q: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Validate checks that the policy of a class is known and that its
+// priority is valid for the policy. The controller checks priorities
+// against the range of the running kernel, too.
+func (c *Class) Validate() error {
+	switch c.Policy {
+	case PolicyFIFO, PolicyRR:
+		if c.Priority < 1 || c.Priority > 99 {
+			return fmt.Errorf("priority %d of policy %s out of range 1-99", c.Priority, c.Policy)
+		}
+	case PolicyOther:
+		if c.Priority != 0 {
+			return fmt.Errorf("priority %d of policy %s must be 0", c.Priority, c.Policy)
+		}
+	default:
+		return fmt.Errorf("unknown scheduling policy %q", c.Policy)
+	}
+	return nil
+}
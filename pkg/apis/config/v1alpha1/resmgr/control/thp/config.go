@@ -0,0 +1,72 @@
+// Copyright The NRI Plugins Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package thp
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Config provides runtime configuration for the transparent hugepage
+// controller.
+// +k8s:deepcopy-gen=true
+type Config struct {
+	// Classes define the transparent hugepage classes containers can be
+	// assigned to using the thpclass.resource-policy.nri.io annotation.
+	Classes map[string]Class `json:"classes"`
+}
+
+// Class is a transparent hugepage policy.
+type Class struct {
+	// Mode is the transparent hugepage mode of the container.
+	// +kubebuilder:validation:Enum=always;madvise;never
+	Mode Mode `json:"mode"`
+}
+
+// Mode is a transparent hugepage mode.
+type Mode string
+
+const (
+	// ModeAlways enables transparent hugepages for all memory.
+	ModeAlways Mode = "always"
+	// ModeMadvise enables transparent hugepages only for memory
+	// regions advised with madvise(MADV_HUGEPAGE).
+	ModeMadvise Mode = "madvise"
+	// ModeNever disables transparent hugepages.
+	ModeNever Mode = "never"
+)
+
+// Validate checks the modes of all classes.
+func (c *Config) Validate() error {
+	if c == nil {
+		return nil
+	}
+	errs := []error{}
+	for name, class := range c.Classes {
+		if err := class.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("transparent hugepage class %q: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Validate checks that the mode of a class is known.
+func (c *Class) Validate() error {
+	switch c.Mode {
+	case ModeAlways, ModeMadvise, ModeNever:
+		return nil
+	}
+	return fmt.Errorf("unknown transparent hugepage mode %q", c.Mode)
+}
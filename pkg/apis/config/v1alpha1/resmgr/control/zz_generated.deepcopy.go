@@ -20,6 +20,8 @@ package control
 
 import (
 	"github.com/containers/nri-plugins/pkg/apis/config/v1alpha1/resmgr/control/cpu"
+	"github.com/containers/nri-plugins/pkg/apis/config/v1alpha1/resmgr/control/sched"
+	"github.com/containers/nri-plugins/pkg/apis/config/v1alpha1/resmgr/control/thp"
 )
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
@@ -30,6 +32,23 @@ func (in *Config) DeepCopyInto(out *Config) {
 		*out = new(cpu.Config)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.Sched != nil {
+		in, out := &in.Sched, &out.Sched
+		*out = new(sched.Config)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.THP != nil {
+		in, out := &in.THP, &out.THP
+		*out = new(thp.Config)
+		(*in).DeepCopyInto(*out)
+	}
+	out.ReconcileInterval = in.ReconcileInterval
+	if in.HookRetry != nil {
+		in, out := &in.HookRetry, &out.HookRetry
+		*out = new(HookRetry)
+		(*in).DeepCopyInto(*out)
+	}
+	out.PostUpdateCoalesceWindow = in.PostUpdateCoalesceWindow
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Config.
@@ -41,3 +60,24 @@ func (in *Config) DeepCopy() *Config {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HookRetry) DeepCopyInto(out *HookRetry) {
+	*out = *in
+	out.Backoff = in.Backoff
+	if in.Controllers != nil {
+		in, out := &in.Controllers, &out.Controllers
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HookRetry.
+func (in *HookRetry) DeepCopy() *HookRetry {
+	if in == nil {
+		return nil
+	}
+	out := new(HookRetry)
+	in.DeepCopyInto(out)
+	return out
+}
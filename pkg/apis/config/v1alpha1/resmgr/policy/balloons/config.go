@@ -71,6 +71,28 @@ type Config struct {
 	// overridden with the balloon type specific setting with the same
 	// name.
 	PreferSpreadOnPhysicalCores bool `json:"preferSpreadOnPhysicalCores,omitempty"`
+	// PreferPackSiblings prefers allocating all hyperthreads of a
+	// physical CPU core to the same balloon. Once a thread of a core is
+	// allocated, its siblings are allocated next. This benefits
+	// workloads whose threads cooperate and share L1/L2 caches. This
+	// option cannot be used together with PreferSpreadOnPhysicalCores.
+	// The value set here is the default for all balloon types, but it
+	// can be overridden with the balloon type specific setting with
+	// the same name.
+	PreferPackSiblings bool `json:"preferPackSiblings,omitempty"`
+	// AllowBootCpu allows allocating the boot CPU to balloons other
+	// than the reserved and the default balloon. The default is false:
+	// the boot CPU is left for housekeeping work of the kernel that
+	// cannot be moved elsewhere. The value set here is the default for
+	// all balloon types, but it can be overridden with the balloon type
+	// specific setting with the same name.
+	AllowBootCpu bool `json:"allowBootCPU,omitempty"`
+	// LenientDevices allows devices in preferCloseToDevices and
+	// preferFarFromDevices that do not exist when the configuration
+	// is taken into use. By default missing devices are configuration
+	// errors. If lenient, topology of devices is looked up when
+	// balloons are allocated, so devices may appear later.
+	LenientDevices bool `json:"lenientDevices,omitempty"`
 	// BallonDefs contains balloon type definitions.
 	BalloonDefs []*BalloonDef `json:"balloonTypes,omitempty"`
 	// Available/allowed (CPU) resources to use.
@@ -78,6 +100,35 @@ type Config struct {
 	// Reserved (CPU) resources for kube-system namespace.
 	// +kubebuilder:validation:Required
 	ReservedResources Constraints `json:"reservedResources"`
+	// ReservedShape defines the topology shape of reserved CPUs,
+	// for instance one whole core from every NUMA node. Reserved
+	// CPUs are then chosen from every element of the topology
+	// level instead of from anywhere. ReservedShape cannot be used
+	// together with a ReservedResources cpuset. If
+	// ReservedResources defines the number of CPUs, it must match
+	// the number of CPUs in the shape.
+	// +optional
+	ReservedShape *ReservedShape `json:"reservedShape,omitempty"`
+}
+
+// ReservedShape defines how many reserved CPUs are taken from every
+// element on a topology level.
+// +k8s:deepcopy-gen=true
+type ReservedShape struct {
+	// TopologyLevel is the level of topology elements from which
+	// reserved CPUs are taken.
+	// +kubebuilder:validation:Enum=system;package;die;numa
+	TopologyLevel CPUTopologyLevel `json:"topologyLevel"`
+	// Cores is the number of whole physical cores reserved from
+	// every element.
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	Cores int `json:"cores,omitempty"`
+	// Cpus is the number of CPUs reserved from every element. Only
+	// one of Cores and Cpus can be set.
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	Cpus int `json:"cpus,omitempty"`
 }
 
 type CPUTopologyLevel string
@@ -156,6 +207,12 @@ type BalloonDef struct {
 	// PreferSpreadOnPhysicalCores is the balloon type specific
 	// parameter of the policy level parameter with the same name.
 	PreferSpreadOnPhysicalCores *bool `json:"preferSpreadOnPhysicalCores,omitempty"`
+	// PreferPackSiblings is the balloon type specific
+	// parameter of the policy level parameter with the same name.
+	PreferPackSiblings *bool `json:"preferPackSiblings,omitempty"`
+	// AllowBootCpu is the balloon type specific
+	// parameter of the policy level parameter with the same name.
+	AllowBootCpu *bool `json:"allowBootCPU,omitempty"`
 	// HideHyperthreads allows containers in a balloon use only
 	// one hyperthread from each physical CPU core in the
 	// balloon. For instance, if a balloon contains 16 logical
@@ -209,13 +266,60 @@ type BalloonDef struct {
 	// +kubebuilder:validation:Format:string
 	ShareIdleCpusInSame CPUTopologyLevel `json:"shareIdleCPUsInSame,omitempty"`
 	// PreferCloseToDevices: prefer creating new balloons of this
-	// type close to listed devices.
+	// type close to listed devices. Devices are sysfs paths,
+	// filesystem paths, like mount points, or network interface
+	// names.
 	PreferCloseToDevices []string `json:"preferCloseToDevices,omitempty"`
 	// PreferFarFromDevices: prefer creating new balloons of this
 	// type far from listed devices.
 	// TODO: PreferFarFromDevices is considered too untested for usage. Hence,
 	// for the time being we prevent its usage through CRDs.
 	PreferFarFromDevices []string `json:"-"`
+	// PreferHighFreq: among equally good CPUs, prefer those with
+	// higher maximum frequency.
+	PreferHighFreq *bool `json:"preferHighFreq,omitempty"`
+	// PreferEmptiestPackage: allocate CPUs from the package
+	// with most free CPUs if that package alone can satisfy
+	// the allocation.
+	PreferEmptiestPackage *bool `json:"preferEmptiestPackage,omitempty"`
+	// RequireCacheIds: allocate CPUs of balloons of this type
+	// only from the last-level caches with listed ids. Creating
+	// or inflating a balloon fails if there are not enough free
+	// CPUs in these caches.
+	RequireCacheIds []int `json:"requireCacheIDs,omitempty"`
+	// SinglePackageOnly: CPUs of a balloon never span more
+	// than one package. Inflating a balloon fails rather than
+	// spills over to another package.
+	SinglePackageOnly bool `json:"singlePackageOnly,omitempty"`
+	// SingleNumaOnly: CPUs of a balloon never span more than
+	// one NUMA node. Inflating a balloon fails rather than
+	// spills over to another NUMA node.
+	SingleNumaOnly *bool `json:"singleNumaOnly,omitempty"`
+	// RequireWholeCores: allocate and release CPUs only as whole
+	// physical cores. Balloon sizes are rounded up to whole
+	// cores, and MinCpus and MaxCpus must be multiples of the
+	// number of threads per core.
+	RequireWholeCores *bool `json:"requireWholeCores,omitempty"`
+	// RequireNohzFull: allocate only tickless (nohz_full) CPUs
+	// to balloons of this type.
+	RequireNohzFull bool `json:"requireNohzFull,omitempty"`
+	// PreferIdleSibling: prefer allocating CPUs whose
+	// hyperthread siblings are free, so that the siblings do
+	// not contend with the balloon. Unlike RequireWholeCores,
+	// partial cores are allocated.
+	PreferIdleSibling bool `json:"preferIdleSibling,omitempty"`
+	// PreferContiguousIds: among equally good CPUs, prefer those
+	// that form the longest run of consecutive CPU ids with the
+	// CPUs of the balloon.
+	PreferContiguousIds bool `json:"preferContiguousIDs,omitempty"`
+	// AllocatorPreset selects a named set of CPU allocator
+	// options for balloons of this type. The preset takes
+	// precedence over policy level allocator parameters, and
+	// balloon type specific parameters take precedence over
+	// the preset.
+	// +kubebuilder:validation:Enum="";latency-optimized;throughput-optimized
+	// +kubebuilder:validation:Format:string
+	AllocatorPreset AllocatorPreset `json:"allocatorPreset,omitempty"`
 }
 
 // String stringifies a BalloonDef
@@ -223,6 +327,20 @@ func (bdef BalloonDef) String() string {
 	return bdef.Name
 }
 
+// AllocatorPreset is the name of a set of CPU allocator options.
+type AllocatorPreset string
+
+const (
+	// PresetNone uses only explicitly configured allocator options.
+	PresetNone AllocatorPreset = ""
+	// PresetLatencyOptimized allocates whole physical cores with
+	// high frequency from a single NUMA node.
+	PresetLatencyOptimized AllocatorPreset = "latency-optimized"
+	// PresetThroughputOptimized spreads CPUs over physical cores
+	// in the package with most free CPUs.
+	PresetThroughputOptimized AllocatorPreset = "throughput-optimized"
+)
+
 type CPUPriority string
 
 const (
@@ -43,6 +43,16 @@ func (in *BalloonDef) DeepCopyInto(out *BalloonDef) {
 		*out = new(bool)
 		**out = **in
 	}
+	if in.PreferPackSiblings != nil {
+		in, out := &in.PreferPackSiblings, &out.PreferPackSiblings
+		*out = new(bool)
+		**out = **in
+	}
+	if in.AllowBootCpu != nil {
+		in, out := &in.AllowBootCpu, &out.AllowBootCpu
+		*out = new(bool)
+		**out = **in
+	}
 	if in.HideHyperthreads != nil {
 		in, out := &in.HideHyperthreads, &out.HideHyperthreads
 		*out = new(bool)
@@ -63,6 +73,31 @@ func (in *BalloonDef) DeepCopyInto(out *BalloonDef) {
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.PreferHighFreq != nil {
+		in, out := &in.PreferHighFreq, &out.PreferHighFreq
+		*out = new(bool)
+		**out = **in
+	}
+	if in.PreferEmptiestPackage != nil {
+		in, out := &in.PreferEmptiestPackage, &out.PreferEmptiestPackage
+		*out = new(bool)
+		**out = **in
+	}
+	if in.RequireCacheIds != nil {
+		in, out := &in.RequireCacheIds, &out.RequireCacheIds
+		*out = make([]int, len(*in))
+		copy(*out, *in)
+	}
+	if in.SingleNumaOnly != nil {
+		in, out := &in.SingleNumaOnly, &out.SingleNumaOnly
+		*out = new(bool)
+		**out = **in
+	}
+	if in.RequireWholeCores != nil {
+		in, out := &in.RequireWholeCores, &out.RequireWholeCores
+		*out = new(bool)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BalloonDef.
@@ -118,6 +153,11 @@ func (in *Config) DeepCopyInto(out *Config) {
 			(*out)[key] = val
 		}
 	}
+	if in.ReservedShape != nil {
+		in, out := &in.ReservedShape, &out.ReservedShape
+		*out = new(ReservedShape)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Config.
@@ -129,3 +169,18 @@ func (in *Config) DeepCopy() *Config {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ReservedShape) DeepCopyInto(out *ReservedShape) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ReservedShape.
+func (in *ReservedShape) DeepCopy() *ReservedShape {
+	if in == nil {
+		return nil
+	}
+	out := new(ReservedShape)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -35,3 +35,10 @@ func (c *TemplatePolicy) PolicyConfig() interface{} {
 	}
 	return &c.Spec.Config
 }
+
+func (c *TemplatePolicy) Validate() error {
+	if c == nil {
+		return nil
+	}
+	return c.Spec.Control.Validate()
+}
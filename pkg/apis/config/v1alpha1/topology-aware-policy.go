@@ -35,3 +35,10 @@ func (c *TopologyAwarePolicy) PolicyConfig() interface{} {
 	}
 	return &c.Spec.Config
 }
+
+func (c *TopologyAwarePolicy) Validate() error {
+	if c == nil {
+		return nil
+	}
+	return c.Spec.Control.Validate()
+}
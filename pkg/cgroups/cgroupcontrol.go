@@ -142,6 +142,15 @@ func (g Group) GetProcesses() ([]string, error) {
 	return g.readPids(Procs)
 }
 
+// GetThreads reads the pids of threads currently assigned to the group,
+// using "cgroup.threads" with cgroup v2 and "tasks" with cgroup v1.
+func (g Group) GetThreads() ([]string, error) {
+	if IsV2() {
+		return g.readPids(Threads)
+	}
+	return g.readPids(Tasks)
+}
+
 // AddTasks writes the given thread pids to the group.
 func (g Group) AddTasks(pids ...string) error {
 	return g.writePids(Tasks, pids...)
@@ -157,13 +166,13 @@ func (g Group) Write(entry, format string, args ...interface{}) error {
 	entryPath := path.Join(string(g), entry)
 	f, err := os.OpenFile(entryPath, os.O_WRONLY, 0644)
 	if err != nil {
-		return g.errorf("%q: failed to open: %v", entry, err)
+		return g.errorf("%q: failed to open: %w", entry, err)
 	}
 	defer f.Close()
 
 	data := fmt.Sprintf(format, args...)
 	if _, err := f.Write([]byte(data)); err != nil {
-		return g.errorf("%q: failed to write %q: %v", entry, data, err)
+		return g.errorf("%q: failed to write %q: %w", entry, data, err)
 	}
 
 	return nil
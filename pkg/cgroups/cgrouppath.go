@@ -26,6 +26,8 @@ const (
 	Tasks = "tasks"
 	// Procs is cgroup's "cgroup.procs" entry.
 	Procs = "cgroup.procs"
+	// Threads is cgroup v2 "cgroup.threads" entry.
+	Threads = "cgroup.threads"
 	// CpuShares is the cpu controller's "cpu.shares" entry.
 	CpuShares = "cpu.shares"
 	// CpuPeriod is the cpu controller's "cpu.cfs_period_us" entry.
@@ -36,6 +38,10 @@ const (
 	CpusetCpus = "cpuset.cpus"
 	// CpusetMems is the cpuset controller's cpuset.mems entry.
 	CpusetMems = "cpuset.mems"
+	// CpusetCpusPartition is the cpuset controller's cpuset.cpus.partition entry.
+	CpusetCpusPartition = "cpuset.cpus.partition"
+	// CpusetCpusExclusive is the cpuset controller's cpuset.cpus.exclusive entry.
+	CpusetCpusExclusive = "cpuset.cpus.exclusive"
 )
 
 var (
@@ -75,6 +81,27 @@ func SetV2Dir(dir string) {
 	}
 }
 
+// IsV2 returns true if the host uses cgroup v2 in unified mode, with
+// all controllers under the common mount point.
+func IsV2() bool {
+	return isUnified(mountDir)
+}
+
+// ContainerDir returns the absolute directory of the given cgroup
+// controller for the relative cgroup directory of a container. With
+// cgroup v2 the controller is ignored as all controllers share the
+// same hierarchy.
+func ContainerDir(controller, cgroupDir string) string {
+	return containerDir(IsV2(), controller, cgroupDir)
+}
+
+func containerDir(v2 bool, controller, cgroupDir string) string {
+	if v2 {
+		return path.Join(mountDir, cgroupDir)
+	}
+	return path.Join(mountDir, controller, cgroupDir)
+}
+
 func init() {
 	flag.StringVar(&mountDir, "cgroup-mount", mountDir,
 		"directory under which cgroup v1 controllers are mounted")
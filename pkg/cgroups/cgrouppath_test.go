@@ -0,0 +1,57 @@
+// Copyright The NRI Plugins Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroups
+
+import (
+	"testing"
+
+	"github.com/containers/nri-plugins/pkg/testutils"
+)
+
+func TestContainerDir(t *testing.T) {
+	tcases := []struct {
+		name       string
+		v2         bool
+		controller string
+		cgroupDir  string
+		expected   string
+	}{
+		{
+			name:       "cgroup v1 blkio",
+			controller: "blkio",
+			cgroupDir:  "/kubepods/pod1/ctr1",
+			expected:   "/sys/fs/cgroup/blkio/kubepods/pod1/ctr1",
+		},
+		{
+			name:       "cgroup v1 cpu",
+			controller: "cpu",
+			cgroupDir:  "kubepods.slice/ctr1.scope",
+			expected:   "/sys/fs/cgroup/cpu/kubepods.slice/ctr1.scope",
+		},
+		{
+			name:       "cgroup v2 ignores controller",
+			v2:         true,
+			controller: "blkio",
+			cgroupDir:  "/kubepods/pod1/ctr1",
+			expected:   "/sys/fs/cgroup/kubepods/pod1/ctr1",
+		},
+	}
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := containerDir(tc.v2, tc.controller, tc.cgroupDir)
+			testutils.VerifyDeepEqual(t, "container dir", tc.expected, dir)
+		})
+	}
+}
@@ -17,12 +17,14 @@ package cgroups
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 
 	"github.com/containers/nri-plugins/pkg/sysfs"
+	"github.com/containers/nri-plugins/pkg/utils/cpuset"
 )
 
 // BlkioDeviceBytes contains a single operations line of blkio.throttle.io_service_bytes_recursive file
@@ -287,6 +289,70 @@ func GetCPUSetMemoryMigrate(cgroupPath string) (bool, error) {
 	return false, fmt.Errorf("error parsing file")
 }
 
+// GetCPUSetEffectiveCPUs returns the effective CPUs of a given cgroup.
+func GetCPUSetEffectiveCPUs(cgroupPath string) (cpuset.CPUSet, error) {
+
+	// File looks like this:
+	//
+	// 0-3,8
+
+	var lines []string
+	var err error
+
+	// cgroup v2 and v1 names for the same file.
+	for _, entry := range []string{"cpuset.cpus.effective", "cpuset.effective_cpus"} {
+		lines, err = readCgroupFileLines(path.Join(cgroupPath, entry))
+		if !os.IsNotExist(err) {
+			break
+		}
+	}
+
+	if err != nil {
+		return cpuset.New(), err
+	}
+
+	if len(lines) == 0 {
+		return cpuset.New(), nil
+	}
+
+	return cpuset.Parse(strings.TrimSpace(lines[0]))
+}
+
+// GetCPUSetIsolatedCPUs returns the CPUs in isolated cpuset partitions,
+// read from the cpuset.cpus.isolated entry of the given root cgroup. The
+// entry is missing on kernels without the feature.
+func GetCPUSetIsolatedCPUs(cgroupPath string) (cpuset.CPUSet, error) {
+	lines, err := readCgroupFileLines(path.Join(cgroupPath, "cpuset.cpus.isolated"))
+	if err != nil {
+		return cpuset.New(), err
+	}
+
+	if len(lines) == 0 {
+		return cpuset.New(), nil
+	}
+
+	return cpuset.Parse(strings.TrimSpace(lines[0]))
+}
+
+// GetCPUSetPartitionableCPUs returns the CPUs that can be put into new
+// isolated cpuset partitions, read from the given cgroup v2 root cgroup.
+// These are its effective CPUs that are not already isolated in other
+// partitions. The cpuset.cpus.isolated entry, and isolated partitions,
+// are missing on kernels without the feature.
+func GetCPUSetPartitionableCPUs(cgroupPath string) (cpuset.CPUSet, error) {
+	isolated, err := GetCPUSetIsolatedCPUs(cgroupPath)
+	if err != nil {
+		return cpuset.New(), err
+	}
+
+	effective, err := GetCPUSetEffectiveCPUs(cgroupPath)
+	if err != nil {
+		return cpuset.New(), err
+	}
+
+	return effective.Difference(isolated), nil
+}
+
 // GetHugetlbUsage retrieves huge pages statistics for a given cgroup.
 func GetHugetlbUsage(cgroupPath string) ([]HugetlbUsage, error) {
 	const (
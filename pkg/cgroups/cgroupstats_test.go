@@ -0,0 +1,116 @@
+// Copyright The NRI Plugins Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroups
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/nri-plugins/pkg/utils/cpuset"
+)
+
+func TestGetCPUSetEffectiveCPUs(t *testing.T) {
+	tcases := []struct {
+		name        string
+		entry       string
+		content     string
+		expected    cpuset.CPUSet
+		expectedErr bool
+	}{
+		{
+			name:     "cgroup v2",
+			entry:    "cpuset.cpus.effective",
+			content:  "0-3,8\n",
+			expected: cpuset.New(0, 1, 2, 3, 8),
+		},
+		{
+			name:     "cgroup v1",
+			entry:    "cpuset.effective_cpus",
+			content:  "4-5\n",
+			expected: cpuset.New(4, 5),
+		},
+		{
+			name:     "empty",
+			entry:    "cpuset.cpus.effective",
+			content:  "\n",
+			expected: cpuset.New(),
+		},
+		{
+			name:        "missing",
+			entry:       "cpuset.cpus",
+			content:     "0\n",
+			expectedErr: true,
+		},
+	}
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, tc.entry), []byte(tc.content), 0644); err != nil {
+				t.Fatalf("failed to write %s: %v", tc.entry, err)
+			}
+			cpus, err := GetCPUSetEffectiveCPUs(dir)
+			if tc.expectedErr {
+				if err == nil {
+					t.Errorf("expected error, got cpus %s", cpus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !cpus.Equals(tc.expected) {
+				t.Errorf("expected cpus %s, got %s", tc.expected, cpus)
+			}
+		})
+	}
+}
+
+func TestGetCPUSetIsolatedCPUs(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := GetCPUSetIsolatedCPUs(dir); !os.IsNotExist(err) {
+		t.Errorf("expected not-exist error without the entry, got %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cpuset.cpus.isolated"), []byte("2-3,6\n"), 0644); err != nil {
+		t.Fatalf("failed to write cpuset.cpus.isolated: %v", err)
+	}
+	cpus, err := GetCPUSetIsolatedCPUs(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := cpuset.New(2, 3, 6); !cpus.Equals(expected) {
+		t.Errorf("expected cpus %s, got %s", expected, cpus)
+	}
+}
+
+func TestGetCPUSetPartitionableCPUs(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "cpuset.cpus.effective"), []byte("0-7\n"), 0644); err != nil {
+		t.Fatalf("failed to write cpuset.cpus.effective: %v", err)
+	}
+	if _, err := GetCPUSetPartitionableCPUs(dir); !os.IsNotExist(err) {
+		t.Errorf("expected not-exist error without cpuset.cpus.isolated, got %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cpuset.cpus.isolated"), []byte("2-3,6\n"), 0644); err != nil {
+		t.Fatalf("failed to write cpuset.cpus.isolated: %v", err)
+	}
+	cpus, err := GetCPUSetPartitionableCPUs(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := cpuset.New(0, 1, 4, 5, 7); !cpus.Equals(expected) {
+		t.Errorf("expected cpus %s, got %s", expected, cpus)
+	}
+}
@@ -228,6 +228,10 @@ type Container interface {
 
 	// InsertMount inserts a mount into the container.
 	InsertMount(*Mount)
+	// AddAnnotation adds an annotation to the pending adjustment of the
+	// container. Annotations can only be added before the adjustment for
+	// the creation of the container has been returned to the runtime.
+	AddAnnotation(key, value string)
 
 	// Get any attached topology hints.
 	GetTopologyHints() topology.Hints
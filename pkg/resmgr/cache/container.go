@@ -597,6 +597,18 @@ func (c *container) InsertMount(m *Mount) {
 	c.markPending(NRI)
 }
 
+func (c *container) AddAnnotation(key, value string) {
+	adjust, ok := c.getPendingRequest().(*nri.ContainerAdjustment)
+	if !ok {
+		log.Error("%s: can't add annotation %s=%s, container is not being created",
+			c.PrettyName(), key, value)
+		return
+	}
+
+	adjust.AddAnnotation(key, value)
+	c.markPending(NRI)
+}
+
 func (c *container) ensureLinuxResources() {
 	if c.Ctr.Linux == nil {
 		c.Ctr.Linux = &nri.LinuxContainer{}
@@ -0,0 +1,61 @@
+// Copyright The NRI Plugins Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package control
+
+import (
+	"github.com/containers/nri-plugins/pkg/cgroups"
+	"github.com/containers/nri-plugins/pkg/resmgr/cache"
+	"github.com/containers/nri-plugins/pkg/utils/cpuset"
+)
+
+// CgroupPath returns the absolute path of the cgroup directory of the given
+// controller (for instance "blkio" or "cpu") for a container. It takes care
+// of the differences between cgroup v1 and v2 hierarchies, so controllers
+// should use it instead of constructing cgroup paths themselves.
+func CgroupPath(container cache.Container, controller string) (string, error) {
+	dir := container.GetCgroupDir()
+	if dir == "" {
+		return "", controlError("%s: unknown cgroup directory", container.PrettyName())
+	}
+	return cgroups.ContainerDir(controller, dir), nil
+}
+
+// EffectiveCpusets returns the effective cpusets of created and running
+// containers in the cache, read from their cgroups and keyed by container
+// ID. After a restart policies can use it to reconstruct which CPUs their
+// containers hold, instead of considering all CPUs free. Containers whose
+// cgroup cannot be read are left out.
+func EffectiveCpusets(cch cache.Cache) map[string]cpuset.CPUSet {
+	cpusets := map[string]cpuset.CPUSet{}
+	for _, c := range cch.GetContainers() {
+		switch c.GetState() {
+		case cache.ContainerStateCreated, cache.ContainerStateRunning:
+		default:
+			continue
+		}
+		dir, err := CgroupPath(c, "cpuset")
+		if err != nil {
+			log.Debug("%s: %v", c.PrettyName(), err)
+			continue
+		}
+		cpus, err := cgroups.GetCPUSetEffectiveCPUs(dir)
+		if err != nil {
+			log.Debug("%s: failed to read effective cpuset: %v", c.PrettyName(), err)
+			continue
+		}
+		cpusets[c.GetID()] = cpus
+	}
+	return cpusets
+}
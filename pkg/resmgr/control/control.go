@@ -17,10 +17,16 @@ package control
 import (
 	"errors"
 	"fmt"
+	"maps"
 	"os"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/containers/nri-plugins/pkg/kubernetes"
 	logger "github.com/containers/nri-plugins/pkg/log"
 	"github.com/containers/nri-plugins/pkg/resmgr/cache"
 
@@ -30,6 +36,14 @@ import (
 const (
 	// EnvVarEnableTestAPIs controls if test APIS are enabled (currently e2e test controller).
 	EnvVarEnableTestAPIs = "ENABLE_TEST_APIS"
+
+	// AppliedTagPrefix prefixes container tags of settings applied by
+	// controllers. The full tag is <prefix><controller>.<setting>.
+	AppliedTagPrefix = "applied."
+	// AppliedAnnotationSuffix is the suffix of container annotations of
+	// settings applied by controllers. The full annotation key is
+	// <controller>.<setting>.<suffix>.
+	AppliedAnnotationSuffix = "applied." + kubernetes.ResmgrKeyNamespace
 )
 
 var (
@@ -39,6 +53,11 @@ var (
 // Control is the interface for triggering controller-/domain-specific post-decision actions.
 type Control interface {
 	// StartStopControllers starts/stops all controllers according to configuration.
+	// All running controllers are stopped first. By default every controller
+	// is then started, the ones that start successfully are left running and
+	// all start failures are returned joined together. With FailFastStart in
+	// the configuration starting stops at the first failure, the controllers
+	// started before it are stopped again and no controller is left running.
 	StartStopControllers(*cfgapi.Config) error
 	// PreCreateHooks runs the pre-create hooks of all registered controllers.
 	RunPreCreateHooks(cache.Container) error
@@ -50,14 +69,52 @@ type Control interface {
 	RunPostUpdateHooks(cache.Container) error
 	// RunPostStopHooks runs the post-stop hooks of all registered controllers.
 	RunPostStopHooks(cache.Container) error
+	// RunPendingPostUpdateHooks runs the coalesced post-update hooks of
+	// containers whose coalescing window has passed.
+	RunPendingPostUpdateHooks() error
+	// RunReconcileHooks runs the reconcile hooks of all registered controllers
+	// for all running containers.
+	RunReconcileHooks() error
+	// Controllers returns the current status of all registered controllers.
+	Controllers() []ControllerStatus
+	// Ready returns nil if all enabled controllers are healthy, otherwise
+	// an error describing the unhealthy ones. Controllers which failed to
+	// start with the latest configuration are unhealthy.
+	Ready() error
+}
+
+// ControllerStatus describes the status of a registered controller.
+type ControllerStatus struct {
+	// Name is the name of the controller.
+	Name string `json:"name"`
+	// Description is a short description of the controller.
+	Description string `json:"description"`
+	// Running is true if the controller is enabled and running.
+	Running bool `json:"running"`
+	// Available is false if the controller failed to start.
+	Available bool `json:"available"`
+	// Health is the health of the controller.
+	Health ControllerHealth `json:"health"`
+}
+
+// ControllerHealth describes whether a controller has successfully
+// applied the latest configuration.
+type ControllerHealth struct {
+	// Healthy is true if the controller works as configured.
+	Healthy bool `json:"healthy"`
+	// LastError is the latest error of the controller, if any.
+	LastError string `json:"lastError,omitempty"`
+	// LastApplied is the time the controller last applied its
+	// configuration successfully.
+	LastApplied time.Time `json:"lastApplied,omitempty"`
 }
 
 // Controller is the interface all resource controllers must implement.
 type Controller interface {
 	// Start prepares the controller for resource control/decision enforcement.
 	Start(cache.Cache, *cfgapi.Config) (bool, error)
-	// Stop shuts down the controller.
-	Stop()
+	// Stop shuts down the controller, cleaning up any state it created.
+	Stop() error
 	// PreCreateHook is the controller's pre-create hook.
 	PreCreateHook(cache.Container) error
 	// PreStartHook is the controller's pre-start hook.
@@ -70,19 +127,87 @@ type Controller interface {
 	PostStopHook(cache.Container) error
 }
 
+// PreviousConfigStarter is an optional interface for controllers which
+// need to know how the configuration changed, for instance to clean up
+// after removed classes. Controllers which implement it are started
+// with StartWithPrevious instead of Start.
+type PreviousConfigStarter interface {
+	// StartWithPrevious is like Start, but also gets the previous
+	// configuration, or nil if there is none.
+	StartWithPrevious(cc cache.Cache, prev, cfg *cfgapi.Config) (bool, error)
+}
+
+// HealthReporter is an optional interface for controllers which can tell
+// their own health, for instance after failing to apply configuration
+// outside of Start. Controllers which do not implement it are healthy if
+// they started successfully.
+type HealthReporter interface {
+	// Status returns the health of the controller.
+	Status() ControllerHealth
+}
+
+// Reconciler is an optional interface for controllers which can detect and
+// correct drift between the desired and the actual state of a container.
+// Controllers which do not implement it are not reconciled.
+type Reconciler interface {
+	// Reconcile re-asserts the controller's decisions for a running container.
+	Reconcile(cache.Container) error
+}
+
+// RetryClassifier is an optional interface for controllers which can tell
+// transient hook errors, worth retrying, from permanent ones, like errors
+// caused by bad configuration. Without it, only errors caused by EBUSY,
+// EAGAIN or EINTR are retried.
+type RetryClassifier interface {
+	// IsRetryable returns true if a failed hook should be retried.
+	IsRetryable(error) bool
+}
+
+// Reporter is an optional interface for controllers which can describe the
+// settings they have applied to a container, for auditing and debugging.
+type Reporter interface {
+	// AppliedSettings returns the settings applied to a container, like
+	// {"class": "guaranteed"} or {"cpus": "4-7"}.
+	AppliedSettings(cache.Container) map[string]string
+}
+
+// DesiredStater is an optional interface for controllers which can tell
+// the state they would apply to a container. With post-update coalescing
+// enabled, post-update hooks are skipped if the desired state has not
+// changed since it was last applied.
+type DesiredStater interface {
+	// DesiredState returns the state the controller would apply to a
+	// container, in the same form as AppliedSettings.
+	DesiredState(cache.Container) map[string]string
+}
+
 // control encapsulates our controller-agnostic runtime state.
 type control struct {
-	cache       cache.Cache    // resource manager cache
-	controllers []*controller  // active controllers
-	cfg         *cfgapi.Config // runtime configuration
+	sync.Mutex                            // protects controller state for Controllers()
+	cache       cache.Cache               // resource manager cache
+	controllers []*controller             // active controllers
+	cfg         *cfgapi.Config            // runtime configuration
+	window      time.Duration             // post-update coalescing window
+	pending     map[string]*pendingUpdate // coalesced post-updates by container ID
+}
+
+// pendingUpdate is a coalesced post-update of a container.
+type pendingUpdate struct {
+	container cache.Container // container to run post-update hooks for
+	since     time.Time       // time of the first coalesced update
 }
 
 // controller represents a single registered controller.
 type controller struct {
-	name        string     // controller name
-	description string     // controller description
-	c           Controller // controller interface
-	running     bool       // whether the controller is running
+	name        string                       // controller name
+	description string                       // controller description
+	c           Controller                   // controller interface
+	running     bool                         // whether the controller is running
+	available   bool                         // whether the controller started without errors
+	delays      []time.Duration              // delays before retries of failed hooks
+	applied     map[string]map[string]string // last applied desired state by container ID
+	lastErr     error                        // error of the latest start, if any
+	lastApplied time.Time                    // time of the latest successful start
 }
 
 // our hook names
@@ -92,6 +217,7 @@ const (
 	poststart  = "post-start"
 	postupdate = "post-update"
 	poststop   = "post-stop"
+	reconcile  = "reconcile"
 )
 
 // All registered controllers.
@@ -100,14 +226,49 @@ var controllers = make(map[string]*controller)
 // Our logger instance.
 var log logger.Logger = logger.NewLogger("resource-control")
 
-// NewControl creates a new controller-agnostic instance.
+// NewControl creates a new controller-agnostic instance with all
+// registered controllers.
 func NewControl(cc cache.Cache) (Control, error) {
+	registered := make([]Registration, 0, len(controllers))
+	for _, controller := range controllers {
+		registered = append(registered, Registration{
+			Name:        controller.name,
+			Description: controller.description,
+			Controller:  controller.c,
+		})
+	}
+	return NewControlWith(cc, registered...)
+}
+
+// Registration describes a controller for NewControlWith.
+type Registration struct {
+	// Name is the name of the controller.
+	Name string
+	// Description is a short description of the controller.
+	Description string
+	// Controller is the controller itself.
+	Controller Controller
+}
+
+// NewControlWith creates a new controller-agnostic instance with an
+// explicit set of controllers, instead of the registered ones. The
+// instance does not share state with other instances, which allows
+// testing controllers in isolation.
+func NewControlWith(cc cache.Cache, controllers ...Registration) (Control, error) {
 	c := &control{
-		cache: cc,
+		cache:   cc,
+		pending: make(map[string]*pendingUpdate),
 	}
 
-	for _, controller := range controllers {
-		c.controllers = append(c.controllers, controller)
+	for _, r := range controllers {
+		if slices.ContainsFunc(c.controllers, func(oc *controller) bool { return oc.name == r.Name }) {
+			return nil, controlError("controller %s given more than once", r.Name)
+		}
+		c.controllers = append(c.controllers, &controller{
+			name:        r.Name,
+			description: r.Description,
+			c:           r.Controller,
+		})
 	}
 	sort.Slice(c.controllers,
 		func(i, j int) bool {
@@ -121,6 +282,10 @@ func NewControl(cc cache.Cache) (Control, error) {
 func (c *control) StartStopControllers(cfg *cfgapi.Config) error {
 	var errs []error
 
+	c.Lock()
+	defer c.Unlock()
+
+	prev := c.cfg
 	c.cfg = cfg.DeepCopy()
 
 	log.Info("syncing controllers with configuration...")
@@ -128,16 +293,36 @@ func (c *control) StartStopControllers(cfg *cfgapi.Config) error {
 	for _, controller := range c.controllers {
 		if controller.running {
 			log.Infof("stopping controller %s", controller.name)
-			controller.c.Stop()
+			if err := controller.c.Stop(); err != nil {
+				log.Errorf("controller %s failed to stop: %v", controller.name, err)
+				errs = append(errs, controlError("%s failed to stop: %v", controller.name, err))
+			}
 			controller.running = false
 		}
 	}
 
+	for _, controller := range c.controllers {
+		controller.delays = hookRetryDelays(cfg, controller.name)
+		controller.applied = make(map[string]map[string]string)
+	}
+
+	// Restarted controllers get updates for all containers anyway.
+	c.window = cfg.PostUpdateCoalesceWindow.Duration
+	clear(c.pending)
+
 	for _, controller := range c.controllers {
 		log.Infof("starting controller %s", controller.name)
-		enabled, err := controller.c.Start(c.cache, cfg.DeepCopy())
+		enabled, err := startController(controller, c.cache, prev, cfg)
+		controller.available = err == nil
+		controller.lastErr = err
+		if err == nil {
+			controller.lastApplied = time.Now()
+		}
 		if err != nil {
 			errs = append(errs, controlError("%s failed to start: %v", controller.name, err))
+			if cfg.FailFastStart {
+				return errors.Join(append(errs, c.stopStarted()...)...)
+			}
 		} else {
 			if enabled {
 				log.Infof("controller %s is enabled and running", controller.name)
@@ -151,6 +336,83 @@ func (c *control) StartStopControllers(cfg *cfgapi.Config) error {
 	return errors.Join(errs...)
 }
 
+// stopStarted stops all running controllers after a failed fail-fast
+// start, returning any errors from stopping them.
+func (c *control) stopStarted() []error {
+	var errs []error
+	for _, controller := range c.controllers {
+		if !controller.running {
+			continue
+		}
+		log.Infof("stopping controller %s after failed start", controller.name)
+		if err := controller.c.Stop(); err != nil {
+			log.Errorf("controller %s failed to stop: %v", controller.name, err)
+			errs = append(errs, controlError("%s failed to stop: %v", controller.name, err))
+		}
+		controller.running = false
+	}
+	return errs
+}
+
+// Controllers returns the current status of all registered controllers.
+func (c *control) Controllers() []ControllerStatus {
+	c.Lock()
+	defer c.Unlock()
+
+	status := make([]ControllerStatus, 0, len(c.controllers))
+	for _, controller := range c.controllers {
+		status = append(status, ControllerStatus{
+			Name:        controller.name,
+			Description: controller.description,
+			Running:     controller.running,
+			Available:   controller.available,
+			Health:      controllerHealth(controller),
+		})
+	}
+
+	return status
+}
+
+// Ready returns nil if all enabled controllers are healthy.
+func (c *control) Ready() error {
+	c.Lock()
+	defer c.Unlock()
+
+	var errs []error
+	for _, controller := range c.controllers {
+		if !controller.running && controller.lastErr == nil {
+			continue // disabled
+		}
+		if health := controllerHealth(controller); !health.Healthy {
+			errs = append(errs, controlError("controller %s is not healthy: %s", controller.name, health.LastError))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// controllerHealth returns the health of a controller. Controllers that
+// failed to start are unhealthy, others report their own health if they
+// can.
+func controllerHealth(controller *controller) ControllerHealth {
+	if controller.lastErr != nil {
+		return ControllerHealth{
+			LastError:   controller.lastErr.Error(),
+			LastApplied: controller.lastApplied,
+		}
+	}
+	if r, ok := controller.c.(HealthReporter); ok && controller.running {
+		health := r.Status()
+		if health.LastApplied.IsZero() {
+			health.LastApplied = controller.lastApplied
+		}
+		return health
+	}
+	return ControllerHealth{
+		Healthy:     true,
+		LastApplied: controller.lastApplied,
+	}
+}
+
 // RunPreCreateHooks runs all registered controllers' PreCreate hooks.
 func (c *control) RunPreCreateHooks(container cache.Container) error {
 	for _, controller := range c.controllers {
@@ -182,7 +444,64 @@ func (c *control) RunPostStartHooks(container cache.Container) error {
 }
 
 // RunPostUpdateHooks runs all registered controllers' PostUpdate hooks.
+// With coalescing enabled, the hooks are only queued for running later
+// by RunPendingPostUpdateHooks.
 func (c *control) RunPostUpdateHooks(container cache.Container) error {
+	if c.window > 0 {
+		c.Lock()
+		defer c.Unlock()
+		if p, ok := c.pending[container.GetID()]; ok {
+			log.Debug("coalescing post-update of container %s", container.PrettyName())
+			p.container = container
+		} else {
+			c.pending[container.GetID()] = &pendingUpdate{
+				container: container,
+				since:     time.Now(),
+			}
+		}
+		return nil
+	}
+	return c.runPostUpdateHooks(container)
+}
+
+// RunPendingPostUpdateHooks runs the coalesced PostUpdate hooks of all
+// containers whose coalescing window has passed.
+func (c *control) RunPendingPostUpdateHooks() error {
+	var (
+		errs  []error
+		ready []cache.Container
+		now   = time.Now()
+	)
+
+	c.Lock()
+	for id, p := range c.pending {
+		if now.Sub(p.since) >= c.window {
+			ready = append(ready, p.container)
+			delete(c.pending, id)
+		}
+	}
+	c.Unlock()
+
+	sort.Slice(ready, func(i, j int) bool {
+		return ready[i].GetID() < ready[j].GetID()
+	})
+
+	for _, container := range ready {
+		switch container.GetState() {
+		case cache.ContainerStateRunning, cache.ContainerStateCreated:
+		default:
+			continue
+		}
+		if err := c.runPostUpdateHooks(container); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", container.PrettyName(), err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// runPostUpdateHooks runs all registered controllers' PostUpdate hooks.
+func (c *control) runPostUpdateHooks(container cache.Container) error {
 	for _, controller := range c.controllers {
 		if err := c.runhook(controller, postupdate, container); err != nil {
 			return err
@@ -193,6 +512,11 @@ func (c *control) RunPostUpdateHooks(container cache.Container) error {
 
 // RunPostStopHooks runs all registered controllers' PostStop hooks.
 func (c *control) RunPostStopHooks(container cache.Container) error {
+	if c.window > 0 {
+		c.Lock()
+		delete(c.pending, container.GetID())
+		c.Unlock()
+	}
 	for _, controller := range c.controllers {
 		if err := c.runhook(controller, poststop, container); err != nil {
 			return err
@@ -201,6 +525,26 @@ func (c *control) RunPostStopHooks(container cache.Container) error {
 	return nil
 }
 
+// RunReconcileHooks runs all registered controllers' Reconcile hooks for all
+// running containers.
+func (c *control) RunReconcileHooks() error {
+	var errs []error
+
+	for _, container := range c.cache.GetContainers() {
+		if container.GetState() != cache.ContainerStateRunning {
+			continue
+		}
+		for _, controller := range c.controllers {
+			if err := c.runhook(controller, reconcile, container); err != nil {
+				log.Warn("%v", err)
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
 // runhook executes the given container hook according to the controller settings
 func (c *control) runhook(controller *controller, hook string, container cache.Container) error {
 	if !controller.running {
@@ -220,17 +564,122 @@ func (c *control) runhook(controller *controller, hook string, container cache.C
 		fn = controller.c.PostUpdateHook
 	case poststop:
 		fn = controller.c.PostStopHook
+	case reconcile:
+		r, ok := controller.c.(Reconciler)
+		if !ok {
+			return nil
+		}
+		fn = r.Reconcile
+	}
+
+	var desired map[string]string
+	if c.window > 0 && hook != poststop {
+		if ds, ok := controller.c.(DesiredStater); ok {
+			desired = ds.DesiredState(container)
+			if hook == postupdate && desired != nil &&
+				maps.Equal(desired, controller.applied[container.GetID()]) {
+				log.Debug("skipping %s %s hook for container %s, state unchanged",
+					controller.name, hook, container.PrettyName())
+				return nil
+			}
+		}
 	}
 
 	log.Debug("running %s %s hook for container %s", controller.name, hook, container.PrettyName())
 
-	if err := fn(container); err != nil {
-		return controlError("%s %s hook failed: %v", controller.name, hook, err)
+	err := fn(container)
+	for retry, delay := range controller.delays {
+		if err == nil || !isRetryable(controller, err) {
+			break
+		}
+		log.Warn("%s %s hook failed for container %s, retry %d/%d in %s: %v",
+			controller.name, hook, container.PrettyName(), retry+1, len(controller.delays), delay, err)
+		time.Sleep(delay)
+		err = fn(container)
+	}
+
+	if err != nil {
+		return controlError("%s %s hook failed: %w", controller.name, hook, err)
+	}
+
+	if hook != poststop {
+		if desired != nil {
+			controller.applied[container.GetID()] = desired
+		}
+		recordSettings(controller, container, hook == precreate)
+	} else {
+		delete(controller.applied, container.GetID())
 	}
 
 	return nil
 }
 
+// recordSettings attaches the settings a controller has applied to a
+// container as container tags. Settings applied by pre-create hooks are
+// also added as annotations to the pending adjustment of the container.
+// Annotations cannot be changed once the container has been created, so
+// later changes are only reflected in the tags.
+func recordSettings(controller *controller, container cache.Container, annotate bool) {
+	r, ok := controller.c.(Reporter)
+	if !ok {
+		return
+	}
+	settings := r.AppliedSettings(container)
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name := controller.name + "." + key
+		container.SetTag(AppliedTagPrefix+name, settings[key])
+		if annotate {
+			container.AddAnnotation(name+"."+AppliedAnnotationSuffix, settings[key])
+		}
+	}
+}
+
+// startController starts a controller, passing it the previous
+// configuration if it wants one.
+func startController(controller *controller, cc cache.Cache, prev, cfg *cfgapi.Config) (bool, error) {
+	if s, ok := controller.c.(PreviousConfigStarter); ok {
+		return s.StartWithPrevious(cc, prev.DeepCopy(), cfg.DeepCopy())
+	}
+	return controller.c.Start(cc, cfg.DeepCopy())
+}
+
+// hookRetryDelays returns the delays before retries of failed hooks of
+// the named controller. Hooks run with the resource manager locked, so
+// retries are cut short if their total delay would exceed the maximum,
+// even if the configuration has not been validated.
+func hookRetryDelays(cfg *cfgapi.Config, name string) []time.Duration {
+	if cfg == nil || cfg.HookRetry == nil {
+		return nil
+	}
+	r := cfg.HookRetry
+	if len(r.Controllers) > 0 && !slices.Contains(r.Controllers, name) {
+		return nil
+	}
+	delays := r.Delays()
+	total := time.Duration(0)
+	for i, delay := range delays {
+		if total += delay; total > cfgapi.MaxHookRetryDelay {
+			log.Warn("limiting %s hook retries to %d, total retry delay exceeds %s",
+				name, i, cfgapi.MaxHookRetryDelay)
+			return delays[:i]
+		}
+	}
+	return delays
+}
+
+// isRetryable returns true if a failed hook of the controller should be retried.
+func isRetryable(controller *controller, err error) bool {
+	if rc, ok := controller.c.(RetryClassifier); ok {
+		return rc.IsRetryable(err)
+	}
+	return errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR)
+}
+
 // Register registers a new controller.
 func Register(name, description string, c Controller) error {
 	log.Info("registering controller %s...", name)
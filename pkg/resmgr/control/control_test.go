@@ -0,0 +1,609 @@
+// Copyright The NRI Plugins Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package control
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	nri "github.com/containerd/nri/pkg/api"
+	cfgapi "github.com/containers/nri-plugins/pkg/apis/config/v1alpha1/resmgr/control"
+	cpucfg "github.com/containers/nri-plugins/pkg/apis/config/v1alpha1/resmgr/control/cpu"
+	"github.com/containers/nri-plugins/pkg/cgroups"
+	"github.com/containers/nri-plugins/pkg/resmgr/cache"
+	"github.com/containers/nri-plugins/pkg/utils/cpuset"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakeController struct {
+	started  int
+	failures int   // number of times PostStartHook fails
+	err      error // error returned by failing PostStartHook
+	calls    int   // number of PostStartHook calls
+}
+
+func (f *fakeController) Start(cache.Cache, *cfgapi.Config) (bool, error) {
+	f.started++
+	return true, nil
+}
+
+func (f *fakeController) Stop() error                          { return nil }
+func (f *fakeController) PreCreateHook(cache.Container) error  { return nil }
+func (f *fakeController) PreStartHook(cache.Container) error   { return nil }
+func (f *fakeController) PostUpdateHook(cache.Container) error { return nil }
+func (f *fakeController) PostStopHook(cache.Container) error   { return nil }
+
+func (f *fakeController) PostStartHook(cache.Container) error {
+	f.calls++
+	if f.calls <= f.failures {
+		return f.err
+	}
+	return nil
+}
+
+type reportingController struct {
+	fakeController
+}
+
+func (*reportingController) AppliedSettings(cache.Container) map[string]string {
+	return map[string]string{"class": "guaranteed"}
+}
+
+type statefulController struct {
+	fakeController
+	state   map[string]string // desired state
+	updates int               // number of PostUpdateHook calls
+}
+
+func (s *statefulController) PostUpdateHook(cache.Container) error {
+	s.updates++
+	return nil
+}
+
+func (s *statefulController) DesiredState(cache.Container) map[string]string {
+	return s.state
+}
+
+type diffingController struct {
+	fakeController
+	prev []*cfgapi.Config // previous configurations seen at start
+}
+
+func (d *diffingController) StartWithPrevious(_ cache.Cache, prev, _ *cfgapi.Config) (bool, error) {
+	d.prev = append(d.prev, prev)
+	return true, nil
+}
+
+type fakeContainer struct {
+	cache.Container
+	id    string
+	state cache.ContainerState
+	tags  map[string]string
+}
+
+func (fakeContainer) PrettyName() string {
+	return "fake"
+}
+
+func (f fakeContainer) GetID() string {
+	return f.id
+}
+
+func (f fakeContainer) GetState() cache.ContainerState {
+	return f.state
+}
+
+func (f fakeContainer) SetTag(key, value string) (string, bool) {
+	prev, ok := f.tags[key]
+	f.tags[key] = value
+	return prev, ok
+}
+
+func TestNewControlWith(t *testing.T) {
+	a, b := &fakeController{}, &fakeController{}
+	ctlA, err := NewControlWith(nil, Registration{Name: "fake", Controller: a})
+	if err != nil {
+		t.Fatalf("NewControlWith failed: %v", err)
+	}
+	ctlB, err := NewControlWith(nil, Registration{Name: "fake", Controller: b})
+	if err != nil {
+		t.Fatalf("NewControlWith failed: %v", err)
+	}
+
+	if err := ctlA.StartStopControllers(&cfgapi.Config{}); err != nil {
+		t.Fatalf("StartStopControllers failed: %v", err)
+	}
+	if a.started != 1 || b.started != 0 {
+		t.Errorf("expected only the first controller started, got %d and %d starts", a.started, b.started)
+	}
+	if status := ctlB.Controllers(); len(status) != 1 || status[0].Running {
+		t.Errorf("expected independent, stopped controller, got %+v", status)
+	}
+
+	if _, err := NewControlWith(nil,
+		Registration{Name: "fake", Controller: a},
+		Registration{Name: "fake", Controller: b},
+	); err == nil {
+		t.Errorf("expected error for duplicate controllers")
+	}
+}
+
+func TestHookRetry(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		failures  int
+		err       error
+		attempts  int
+		expectErr bool
+		expectRun int
+	}{
+		{
+			name:      "transient error retried",
+			failures:  2,
+			err:       syscall.EBUSY,
+			attempts:  2,
+			expectRun: 3,
+		},
+		{
+			name:      "too many failures",
+			failures:  3,
+			err:       syscall.EBUSY,
+			attempts:  2,
+			expectErr: true,
+			expectRun: 3,
+		},
+		{
+			name:      "permanent error not retried",
+			failures:  1,
+			err:       syscall.EINVAL,
+			attempts:  2,
+			expectErr: true,
+			expectRun: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := &fakeController{failures: tc.failures, err: tc.err}
+			ctl, err := NewControlWith(nil, Registration{Name: "fake", Controller: f})
+			if err != nil {
+				t.Fatalf("NewControlWith failed: %v", err)
+			}
+			cfg := &cfgapi.Config{HookRetry: &cfgapi.HookRetry{Attempts: tc.attempts}}
+			if err := ctl.StartStopControllers(cfg); err != nil {
+				t.Fatalf("StartStopControllers failed: %v", err)
+			}
+			err = ctl.RunPostStartHooks(fakeContainer{})
+			if tc.expectErr != (err != nil) {
+				t.Errorf("expected error %v, got %v", tc.expectErr, err)
+			}
+			if f.calls != tc.expectRun {
+				t.Errorf("expected %d hook calls, got %d", tc.expectRun, f.calls)
+			}
+		})
+	}
+}
+
+func TestHookRetryDelays(t *testing.T) {
+	ms := func(n int) time.Duration { return time.Duration(n) * time.Millisecond }
+	for _, tc := range []struct {
+		name        string
+		retry       cfgapi.HookRetry
+		expectValid bool
+		expect      []time.Duration
+	}{
+		{
+			name:        "doubling backoff",
+			retry:       cfgapi.HookRetry{Attempts: 3, Backoff: metav1.Duration{Duration: ms(10)}},
+			expectValid: true,
+			expect:      []time.Duration{ms(10), ms(20), ms(40)},
+		},
+		{
+			name: "capped backoff",
+			retry: cfgapi.HookRetry{
+				Attempts:   10,
+				Backoff:    metav1.Duration{Duration: ms(10)},
+				MaxBackoff: metav1.Duration{Duration: ms(50)},
+			},
+			expectValid: true,
+			expect:      []time.Duration{ms(10), ms(20), ms(40), ms(50), ms(50), ms(50), ms(50), ms(50), ms(50), ms(50)},
+		},
+		{
+			name:        "total delay limited",
+			retry:       cfgapi.HookRetry{Attempts: 10, Backoff: metav1.Duration{Duration: ms(100)}},
+			expectValid: false,
+			expect:      []time.Duration{ms(100), ms(200)},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.retry.Validate(); tc.expectValid != (err == nil) {
+				t.Errorf("expected valid %v, got error %v", tc.expectValid, err)
+			}
+			delays := hookRetryDelays(&cfgapi.Config{HookRetry: &tc.retry}, "fake")
+			if !slices.Equal(delays, tc.expect) {
+				t.Errorf("expected delays %v, got %v", tc.expect, delays)
+			}
+		})
+	}
+}
+
+func TestValidateCoalesceWindow(t *testing.T) {
+	window := metav1.Duration{Duration: 100 * time.Millisecond}
+	for _, tc := range []struct {
+		name        string
+		cfg         *cfgapi.Config
+		expectValid bool
+	}{
+		{
+			name:        "coalescing",
+			cfg:         &cfgapi.Config{PostUpdateCoalesceWindow: window},
+			expectValid: true,
+		},
+		{
+			name:        "expanding",
+			cfg:         &cfgapi.Config{CPU: &cpucfg.Config{ExpandBeforeContract: true}},
+			expectValid: true,
+		},
+		{
+			name: "coalescing and expanding",
+			cfg: &cfgapi.Config{
+				PostUpdateCoalesceWindow: window,
+				CPU:                      &cpucfg.Config{ExpandBeforeContract: true},
+			},
+			expectValid: false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.cfg.Validate(); tc.expectValid != (err == nil) {
+				t.Errorf("expected valid %v, got error %v", tc.expectValid, err)
+			}
+		})
+	}
+}
+
+func TestAppliedSettings(t *testing.T) {
+	ctl, err := NewControlWith(nil, Registration{Name: "rdt", Controller: &reportingController{}})
+	if err != nil {
+		t.Fatalf("NewControlWith failed: %v", err)
+	}
+	if err := ctl.StartStopControllers(&cfgapi.Config{}); err != nil {
+		t.Fatalf("StartStopControllers failed: %v", err)
+	}
+
+	cch, err := cache.NewCache(cache.Options{CacheDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewCache failed: %v", err)
+	}
+	if _, err := cch.InsertPod(&nri.PodSandbox{Id: "pod0", Name: "pod0", Uid: "uid0"}); err != nil {
+		t.Fatalf("InsertPod failed: %v", err)
+	}
+	c, err := cch.InsertContainer(&nri.Container{Id: "ctr0", PodSandboxId: "pod0", Name: "ctr0"})
+	if err != nil {
+		t.Fatalf("InsertContainer failed: %v", err)
+	}
+
+	// Go through the same state changes as the NRI CreateContainer
+	// handler: pre-create hooks run after the container is marked
+	// created, but before its adjustment is returned to the runtime.
+	c.UpdateState(cache.ContainerStateCreating)
+	c.InsertMount(&cache.Mount{Destination: "/test", Source: "/test", Type: "bind"})
+	c.UpdateState(cache.ContainerStateCreated)
+	if err := ctl.RunPreCreateHooks(c); err != nil {
+		t.Fatalf("RunPreCreateHooks failed: %v", err)
+	}
+	if v, _ := c.GetTag("applied.rdt.class"); v != "guaranteed" {
+		t.Errorf("expected applied setting in tags, got %q", v)
+	}
+	adjust := c.GetPendingAdjustment()
+	if adjust == nil {
+		t.Fatalf("expected a pending adjustment")
+	}
+	if v := adjust.GetAnnotations()["rdt.class.applied.resource-policy.nri.io"]; v != "guaranteed" {
+		t.Errorf("expected applied setting in annotations, got %v", adjust.GetAnnotations())
+	}
+
+	// Later updates of the running container are only recorded in tags.
+	c.UpdateState(cache.ContainerStateRunning)
+	c.DeleteTag("applied.rdt.class")
+	if err := ctl.RunPostUpdateHooks(c); err != nil {
+		t.Fatalf("RunPostUpdateHooks failed: %v", err)
+	}
+	if v, _ := c.GetTag("applied.rdt.class"); v != "guaranteed" {
+		t.Errorf("expected applied setting in tags, got %q", v)
+	}
+	if update := c.GetPendingUpdate(); update != nil {
+		t.Errorf("expected no pending update, got %v", update)
+	}
+}
+
+func TestPostUpdateCoalescing(t *testing.T) {
+	s := &statefulController{state: map[string]string{"mems": "0"}}
+	ctl, err := NewControlWith(nil, Registration{Name: "stateful", Controller: s})
+	if err != nil {
+		t.Fatalf("NewControlWith failed: %v", err)
+	}
+	cfg := &cfgapi.Config{}
+	cfg.PostUpdateCoalesceWindow.Duration = time.Millisecond
+	if err := ctl.StartStopControllers(cfg); err != nil {
+		t.Fatalf("StartStopControllers failed: %v", err)
+	}
+
+	a := fakeContainer{id: "a", state: cache.ContainerStateRunning, tags: map[string]string{}}
+	b := fakeContainer{id: "b", state: cache.ContainerStateRunning, tags: map[string]string{}}
+	for _, c := range []fakeContainer{a, b, a, a, b} {
+		if err := ctl.RunPostUpdateHooks(c); err != nil {
+			t.Fatalf("RunPostUpdateHooks failed: %v", err)
+		}
+	}
+	if s.updates != 0 {
+		t.Errorf("expected no hook runs within window, got %d", s.updates)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	if err := ctl.RunPendingPostUpdateHooks(); err != nil {
+		t.Fatalf("RunPendingPostUpdateHooks failed: %v", err)
+	}
+	if s.updates != 2 {
+		t.Errorf("expected 2 coalesced hook runs, got %d", s.updates)
+	}
+
+	// Unchanged desired state is not applied again.
+	if err := ctl.RunPostUpdateHooks(a); err != nil {
+		t.Fatalf("RunPostUpdateHooks failed: %v", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if err := ctl.RunPendingPostUpdateHooks(); err != nil {
+		t.Fatalf("RunPendingPostUpdateHooks failed: %v", err)
+	}
+	if s.updates != 2 {
+		t.Errorf("expected unchanged state to be skipped, got %d hook runs", s.updates)
+	}
+
+	s.state = map[string]string{"mems": "1"}
+	if err := ctl.RunPostUpdateHooks(a); err != nil {
+		t.Fatalf("RunPostUpdateHooks failed: %v", err)
+	}
+	if err := ctl.RunPostStopHooks(b); err != nil {
+		t.Fatalf("RunPostStopHooks failed: %v", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if err := ctl.RunPendingPostUpdateHooks(); err != nil {
+		t.Fatalf("RunPendingPostUpdateHooks failed: %v", err)
+	}
+	if s.updates != 3 {
+		t.Errorf("expected changed state to be applied, got %d hook runs", s.updates)
+	}
+}
+
+func TestStartWithPrevious(t *testing.T) {
+	d := &diffingController{}
+	ctl, err := NewControlWith(nil, Registration{Name: "diffing", Controller: d})
+	if err != nil {
+		t.Fatalf("NewControlWith failed: %v", err)
+	}
+
+	first := &cfgapi.Config{}
+	first.ReconcileInterval.Duration = time.Second
+	second := &cfgapi.Config{}
+	second.ReconcileInterval.Duration = time.Minute
+	for _, cfg := range []*cfgapi.Config{first, second} {
+		if err := ctl.StartStopControllers(cfg); err != nil {
+			t.Fatalf("StartStopControllers failed: %v", err)
+		}
+	}
+
+	if d.started != 0 {
+		t.Errorf("expected Start not to be called, got %d calls", d.started)
+	}
+	if len(d.prev) != 2 {
+		t.Fatalf("expected 2 starts with previous configuration, got %d", len(d.prev))
+	}
+	if d.prev[0] != nil {
+		t.Errorf("expected no previous configuration at first start, got %+v", d.prev[0])
+	}
+	if d.prev[1] == nil || d.prev[1].ReconcileInterval.Duration != time.Second {
+		t.Errorf("expected first configuration as previous one, got %+v", d.prev[1])
+	}
+	if d.prev[1] == first {
+		t.Errorf("expected a copy of the previous configuration")
+	}
+}
+
+type failingController struct {
+	fakeController
+}
+
+func (f *failingController) Start(cache.Cache, *cfgapi.Config) (bool, error) {
+	f.started++
+	return false, fmt.Errorf("failed to start")
+}
+
+type stoppingController struct {
+	fakeController
+	stopped int
+}
+
+func (s *stoppingController) Stop() error {
+	s.stopped++
+	return nil
+}
+
+func TestFailFastStart(t *testing.T) {
+	for _, failFast := range []bool{false, true} {
+		// Controllers are started in the order of their names.
+		a := &stoppingController{}
+		b := &failingController{}
+		c := &stoppingController{}
+		ctl, err := NewControlWith(nil,
+			Registration{Name: "a", Controller: a},
+			Registration{Name: "b", Controller: b},
+			Registration{Name: "c", Controller: c},
+		)
+		if err != nil {
+			t.Fatalf("NewControlWith failed: %v", err)
+		}
+
+		err = ctl.StartStopControllers(&cfgapi.Config{FailFastStart: failFast})
+		if err == nil || !strings.Contains(err.Error(), "b failed to start") {
+			t.Fatalf("failFast %v: expected start failure of b, got %v", failFast, err)
+		}
+
+		running := map[string]bool{}
+		for _, status := range ctl.Controllers() {
+			running[status.Name] = status.Running
+		}
+		if failFast {
+			if c.started != 0 {
+				t.Errorf("expected c not to be started after b failed")
+			}
+			if a.stopped != 1 {
+				t.Errorf("expected a to be stopped after b failed, stopped %d times", a.stopped)
+			}
+			if running["a"] || running["b"] || running["c"] {
+				t.Errorf("expected no controllers running, got %v", running)
+			}
+		} else {
+			if a.started != 1 || c.started != 1 {
+				t.Errorf("expected a and c to be started, got %d and %d starts", a.started, c.started)
+			}
+			if a.stopped != 0 {
+				t.Errorf("expected a not to be stopped")
+			}
+			if !running["a"] || running["b"] || !running["c"] {
+				t.Errorf("expected a and c running, got %v", running)
+			}
+		}
+	}
+}
+
+type healthReportingController struct {
+	fakeController
+	health ControllerHealth
+}
+
+func (h *healthReportingController) Status() ControllerHealth {
+	return h.health
+}
+
+func TestReady(t *testing.T) {
+	a := &fakeController{}
+	b := &healthReportingController{health: ControllerHealth{Healthy: true}}
+	ctl, err := NewControlWith(nil,
+		Registration{Name: "a", Controller: a},
+		Registration{Name: "b", Controller: b},
+	)
+	if err != nil {
+		t.Fatalf("NewControlWith failed: %v", err)
+	}
+	if err := ctl.StartStopControllers(&cfgapi.Config{}); err != nil {
+		t.Fatalf("StartStopControllers failed: %v", err)
+	}
+	if err := ctl.Ready(); err != nil {
+		t.Errorf("expected ready, got %v", err)
+	}
+	for _, status := range ctl.Controllers() {
+		if !status.Health.Healthy || status.Health.LastApplied.IsZero() {
+			t.Errorf("expected %s to be healthy with last apply time, got %+v", status.Name, status.Health)
+		}
+	}
+
+	b.health = ControllerHealth{LastError: "failed to apply class"}
+	err = ctl.Ready()
+	if err == nil || !strings.Contains(err.Error(), "b is not healthy: failed to apply class") {
+		t.Errorf("expected b to be unhealthy, got %v", err)
+	}
+
+	// A controller failing to start is unhealthy.
+	c := &failingController{}
+	ctl, err = NewControlWith(nil,
+		Registration{Name: "a", Controller: a},
+		Registration{Name: "c", Controller: c},
+	)
+	if err != nil {
+		t.Fatalf("NewControlWith failed: %v", err)
+	}
+	if err := ctl.StartStopControllers(&cfgapi.Config{}); err == nil {
+		t.Fatalf("expected StartStopControllers to fail")
+	}
+	err = ctl.Ready()
+	if err == nil || !strings.Contains(err.Error(), "c is not healthy: failed to start") {
+		t.Errorf("expected c to be unhealthy, got %v", err)
+	}
+}
+
+func TestEffectiveCpusets(t *testing.T) {
+	mountDir := cgroups.GetMountDir()
+	t.Cleanup(func() { cgroups.SetMountDir(mountDir) })
+	cgroups.SetMountDir(t.TempDir())
+
+	cch, err := cache.NewCache(cache.Options{CacheDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewCache failed: %v", err)
+	}
+	if _, err := cch.InsertPod(&nri.PodSandbox{
+		Id:    "pod0",
+		Name:  "pod0",
+		Uid:   "uid0",
+		Linux: &nri.LinuxPodSandbox{CgroupParent: "/pod0"},
+	}); err != nil {
+		t.Fatalf("InsertPod failed: %v", err)
+	}
+
+	for _, tc := range []struct {
+		id    string
+		state cache.ContainerState
+		cpus  string // effective CPUs, no cgroup if empty
+	}{
+		{id: "running", state: cache.ContainerStateRunning, cpus: "2-3"},
+		{id: "created", state: cache.ContainerStateCreated, cpus: "4"},
+		{id: "exited", state: cache.ContainerStateExited, cpus: "5"},
+		{id: "nocgroup", state: cache.ContainerStateRunning},
+	} {
+		if tc.cpus != "" {
+			dir := cgroups.ContainerDir("cpuset", path.Join("/pod0", tc.id))
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatalf("failed to create cgroup directory: %v", err)
+			}
+			entry := filepath.Join(dir, "cpuset.cpus.effective")
+			if err := os.WriteFile(entry, []byte(tc.cpus+"\n"), 0644); err != nil {
+				t.Fatalf("failed to write %s: %v", entry, err)
+			}
+		}
+		c, err := cch.InsertContainer(&nri.Container{Id: tc.id, PodSandboxId: "pod0", Name: tc.id})
+		if err != nil {
+			t.Fatalf("InsertContainer failed: %v", err)
+		}
+		c.UpdateState(tc.state)
+	}
+
+	expected := map[string]cpuset.CPUSet{
+		"running": cpuset.New(2, 3),
+		"created": cpuset.New(4),
+	}
+	cpusets := EffectiveCpusets(cch)
+	if len(cpusets) != len(expected) {
+		t.Errorf("expected cpusets %v, got %v", expected, cpusets)
+	}
+	for id, cpus := range expected {
+		if !cpusets[id].Equals(cpus) {
+			t.Errorf("expected %s cpus %s, got %s", id, cpus, cpusets[id])
+		}
+	}
+}
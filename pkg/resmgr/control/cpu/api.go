@@ -15,6 +15,8 @@
 package cpu
 
 import (
+	"fmt"
+
 	"github.com/containers/nri-plugins/pkg/resmgr/cache"
 	"github.com/intel/goresctrl/pkg/utils"
 )
@@ -68,3 +70,21 @@ func Assign(c cache.Cache, class string, cpus ...int) error {
 
 	return nil
 }
+
+// VetoError is returned by policies when they allocate resources for a
+// container, if a dry-run allocation shows that the CPUs requested by the
+// container cannot be reserved. The container is not created then.
+type VetoError struct {
+	Container string // pretty name of the vetoed container
+	Reason    error  // why the reservation check failed
+}
+
+// Error implements the error interface.
+func (e *VetoError) Error() string {
+	return fmt.Sprintf("CPU reservation for container %s vetoed: %v", e.Container, e.Reason)
+}
+
+// Unwrap returns the reason for the veto.
+func (e *VetoError) Unwrap() error {
+	return e.Reason
+}
@@ -15,12 +15,17 @@
 package cpu
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/containers/nri-plugins/pkg/utils/cpuset"
 
 	cfgapi "github.com/containers/nri-plugins/pkg/apis/config/v1alpha1/resmgr/control"
 	cfgcpu "github.com/containers/nri-plugins/pkg/apis/config/v1alpha1/resmgr/control/cpu"
+	"github.com/containers/nri-plugins/pkg/cgroups"
 	logger "github.com/containers/nri-plugins/pkg/log"
 	"github.com/containers/nri-plugins/pkg/resmgr/cache"
 	"github.com/containers/nri-plugins/pkg/resmgr/control"
@@ -43,6 +48,13 @@ type cpuctl struct {
 	classes       map[string]Class // configured CPU classes
 	uncoreEnabled bool             // whether we need to care about uncore
 	started       bool
+	bindMemory    bool                     // bind memory to NUMA nodes of pinned CPUs
+	restoreMems   map[string]string        // original cpuset.mems of containers we have bound
+	partition     string                   // cpuset partition type to create, if any
+	partitions    map[string]cpuset.CPUSet // CPUs of containers we have partitioned
+	exclusive     bool                     // set cpuset.cpus.exclusive of exclusive containers
+	exclusives    map[string]cpuset.CPUSet // CPUs of containers we have made exclusive
+	expandFirst   bool                     // expand cpusets before the runtime contracts them
 }
 
 type Class = cfgcpu.Class
@@ -55,18 +67,22 @@ var singleton *cpuctl
 // getCPUController returns the (singleton) CPU controller instance.
 func getCPUController() *cpuctl {
 	if singleton == nil {
-		singleton = &cpuctl{}
+		singleton = &cpuctl{
+			restoreMems: map[string]string{},
+			partitions:  map[string]cpuset.CPUSet{},
+			exclusives:  map[string]cpuset.CPUSet{},
+		}
 	}
 	return singleton
 }
 
 // Check if our configuration is effectively empty.
 func isEmptyConfig(cfg *cfgapi.Config) bool {
-	return cfg == nil || cfg.CPU == nil || len(cfg.CPU.Classes) == 0
+	return cfg == nil || cfg.CPU == nil || (len(cfg.CPU.Classes) == 0 && !cfg.CPU.BindMemory && cfg.CPU.Partition == "" && !cfg.CPU.ExclusiveCpus && !cfg.CPU.ExpandBeforeContract)
 }
 
 // Start initializes the controller for enforcing decisions.
-func (ctl *cpuctl) Start(cache cache.Cache, cfg *cfgapi.Config) (bool, error) {
+func (ctl *cpuctl) Start(cch cache.Cache, cfg *cfgapi.Config) (bool, error) {
 	if isEmptyConfig(cfg) {
 		log.Info("empty configuration, disabling controller")
 		return false, nil
@@ -78,7 +94,7 @@ func (ctl *cpuctl) Start(cache cache.Cache, cfg *cfgapi.Config) (bool, error) {
 	}
 
 	ctl.system = sys
-	ctl.cache = cache
+	ctl.cache = cch
 
 	// DEBUG: dump the class assignments we have stored in the cache
 	log.Debug("retrieved cpu class assignments from cache:\n%s", utils.DumpJSON(getClassAssignments(ctl.cache)))
@@ -88,13 +104,57 @@ func (ctl *cpuctl) Start(cache cache.Cache, cfg *cfgapi.Config) (bool, error) {
 		log.Error("failed apply /cpuinitial configuration: %v", err)
 	}
 
+	// Stop restored the original memory nodes, (re)bind running containers.
+	for _, c := range cch.GetContainers() {
+		if c.GetState() != cache.ContainerStateRunning {
+			continue
+		}
+		if err := ctl.bindMems(c); err != nil {
+			log.Error("%v", err)
+		}
+		if err := ctl.claimCpus(c); err != nil {
+			log.Error("%v", err)
+		}
+		if err := ctl.partitionCpus(c); err != nil {
+			log.Error("%v", err)
+		}
+	}
+
 	ctl.started = true
 
 	return true, nil
 }
 
-// Stop shuts down the controller.
-func (ctl *cpuctl) Stop() {
+// Stop shuts down the controller, restoring the original memory nodes
+// of running containers it has bound, reverting any partitions it has
+// created to members and releasing any CPUs it has made exclusive.
+func (ctl *cpuctl) Stop() error {
+	var errs []error
+	for id := range ctl.partitions {
+		if c, ok := ctl.cache.LookupContainer(id); ok && c.GetState() == cache.ContainerStateRunning {
+			if err := ctl.unpartitionCpus(c); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		delete(ctl.partitions, id)
+	}
+	for id := range ctl.exclusives {
+		if c, ok := ctl.cache.LookupContainer(id); ok && c.GetState() == cache.ContainerStateRunning {
+			if err := ctl.releaseCpus(c); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		delete(ctl.exclusives, id)
+	}
+	for id, mems := range ctl.restoreMems {
+		if c, ok := ctl.cache.LookupContainer(id); ok && c.GetState() == cache.ContainerStateRunning {
+			if err := ctl.setMems(c, mems); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		delete(ctl.restoreMems, id)
+	}
+	return errors.Join(errs...)
 }
 
 // PreCreateHook handler for the CPU controller.
@@ -109,19 +169,409 @@ func (ctl *cpuctl) PreStartHook(c cache.Container) error {
 
 // PostStartHook handler for the CPU controller.
 func (ctl *cpuctl) PostStartHook(c cache.Container) error {
-	return nil
+	return errors.Join(ctl.bindMems(c), ctl.claimCpus(c), ctl.partitionCpus(c))
 }
 
 // PostUpdateHook handler for the CPU controller.
 func (ctl *cpuctl) PostUpdateHook(c cache.Container) error {
-	return nil
+	return errors.Join(ctl.expandCpus(c), ctl.bindMems(c), ctl.claimCpus(c), ctl.partitionCpus(c))
 }
 
 // PostStopHook handler for the CPU controller.
 func (ctl *cpuctl) PostStopHook(c cache.Container) error {
+	// The cgroup goes away with the container, there is nothing to restore.
+	delete(ctl.restoreMems, c.GetID())
+	delete(ctl.partitions, c.GetID())
+	delete(ctl.exclusives, c.GetID())
+	return nil
+}
+
+// AppliedSettings reports the memory nodes a container is bound to, the
+// type of cpuset partition it has been turned into and the CPUs it has
+// been given exclusively.
+func (ctl *cpuctl) AppliedSettings(c cache.Container) map[string]string {
+	settings := map[string]string{}
+	if _, ok := ctl.restoreMems[c.GetID()]; ok {
+		if cpus, err := cpuset.Parse(c.GetCpusetCpus()); err == nil {
+			settings["mems"] = cpuNodes(ctl.system, cpus).String()
+		}
+	}
+	if _, ok := ctl.partitions[c.GetID()]; ok {
+		settings["partition"] = ctl.partition
+	}
+	if cpus, ok := ctl.exclusives[c.GetID()]; ok {
+		settings["exclusive"] = cpus.String()
+	}
+	if len(settings) == 0 {
+		return nil
+	}
+	return settings
+}
+
+// DesiredState reports the memory nodes a container should be bound to.
+// With partitioning or exclusive CPUs enabled the desired state depends
+// on the CPUs of all other containers, and with cpuset expansion on the
+// current CPUs of the container, so no state is reported and hooks
+// always run.
+func (ctl *cpuctl) DesiredState(c cache.Container) map[string]string {
+	if ctl.partition != "" || ctl.exclusive || ctl.expandFirst || !ctl.bindMemory || c.GetCpusetCpus() == "" {
+		return nil
+	}
+	cpus, err := cpuset.Parse(c.GetCpusetCpus())
+	if err != nil {
+		return nil
+	}
+	return map[string]string{"mems": cpuNodes(ctl.system, cpus).String()}
+}
+
+// bindMems binds the memory of a container to the NUMA nodes of the
+// CPUs it is pinned to, if memory binding is enabled.
+func (ctl *cpuctl) bindMems(c cache.Container) error {
+	if !ctl.bindMemory || c.GetCpusetCpus() == "" {
+		return nil
+	}
+
+	cpus, err := cpuset.Parse(c.GetCpusetCpus())
+	if err != nil {
+		return fmt.Errorf("%s: invalid cpuset %q: %w", c.PrettyName(), c.GetCpusetCpus(), err)
+	}
+	mems := cpuNodes(ctl.system, cpus)
+	if mems.IsEmpty() {
+		return nil
+	}
+
+	orig, err := ctl.getMems(c)
+	if err != nil {
+		return err
+	}
+	if orig == mems.String() {
+		return nil
+	}
+
+	log.Debug("%s: binding memory to nodes %s of cpus %s", c.PrettyName(), mems, cpus)
+
+	if err := ctl.setMems(c, mems.String()); err != nil {
+		return err
+	}
+	if _, ok := ctl.restoreMems[c.GetID()]; !ok {
+		ctl.restoreMems[c.GetID()] = orig
+	}
+
+	return nil
+}
+
+// expandCpus widens the cpuset.cpus of a container to the union of its
+// current and new CPUs, if expanding is enabled and new CPUs are about
+// to be added. Post-update hooks of containers run before the runtime
+// applies their pending updates, as the configuration does not allow
+// coalescing them together with expanding. So the runtime contracts
+// the cpuset to the new CPUs only after the CPUs of all updated
+// containers have been expanded. The CPUs of a container are never
+// empty during moves, but until the runtime contracts the cpusets,
+// containers may overlap on the CPUs moving between them. If the
+// runtime fails to apply the update, the container is left with the
+// union of the CPUs.
+func (ctl *cpuctl) expandCpus(c cache.Container) error {
+	if !ctl.expandFirst || c.GetCpusetCpus() == "" {
+		return nil
+	}
+
+	cpus, err := cpuset.Parse(c.GetCpusetCpus())
+	if err != nil {
+		return fmt.Errorf("%s: invalid cpuset %q: %w", c.PrettyName(), c.GetCpusetCpus(), err)
+	}
+
+	orig, err := ctl.getCpus(c)
+	if err != nil {
+		return err
+	}
+	current, err := cpuset.Parse(orig)
+	if err != nil {
+		return fmt.Errorf("%s: invalid cpuset.cpus %q: %w", c.PrettyName(), orig, err)
+	}
+
+	steps := cpusetSteps(current, cpus)
+	if len(steps) < 2 {
+		// Nothing to add, the runtime only contracts the cpuset.
+		return nil
+	}
+
+	log.Debug("%s: expanding cpus %s to %s before contracting to %s", c.PrettyName(), current, steps[0], cpus)
+
+	return ctl.setCpus(c, steps[0].String())
+}
+
+// cpusetSteps returns the cpusets to go through, in order, when changing
+// a cpuset from current to cpus: first adding new CPUs, then removing
+// old ones. Steps that would not change the cpuset are left out.
+func cpusetSteps(current, cpus cpuset.CPUSet) []cpuset.CPUSet {
+	steps := []cpuset.CPUSet{}
+	if union := current.Union(cpus); !union.Equals(current) && !current.IsEmpty() {
+		steps = append(steps, union)
+	}
+	if !cpus.Equals(current) {
+		steps = append(steps, cpus)
+	}
+	return steps
+}
+
+// cpuNodes returns the NUMA nodes of a set of CPUs. CPUs spanning
+// multiple nodes result in all of those nodes.
+func cpuNodes(sys sysfs.System, cpus cpuset.CPUSet) cpuset.CPUSet {
+	nodes := []int{}
+	for _, id := range cpus.List() {
+		if cpu := sys.CPU(id); cpu != nil {
+			nodes = append(nodes, cpu.NodeID())
+		}
+	}
+	return cpuset.New(nodes...)
+}
+
+// getMems returns the current cpuset.mems of a container.
+func (ctl *cpuctl) getMems(c cache.Container) (string, error) {
+	dir, err := control.CgroupPath(c, "cpuset")
+	if err != nil {
+		return "", err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, cgroups.CpusetMems))
+	if err != nil {
+		return "", fmt.Errorf("%s: failed to read memory nodes: %w", c.PrettyName(), err)
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// getCpus returns the current cpuset.cpus of a container.
+func (ctl *cpuctl) getCpus(c cache.Container) (string, error) {
+	dir, err := control.CgroupPath(c, "cpuset")
+	if err != nil {
+		return "", err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, cgroups.CpusetCpus))
+	if err != nil {
+		return "", fmt.Errorf("%s: failed to read cpus: %w", c.PrettyName(), err)
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// setCpus sets the cpuset.cpus of a container.
+func (ctl *cpuctl) setCpus(c cache.Container, cpus string) error {
+	dir, err := control.CgroupPath(c, "cpuset")
+	if err != nil {
+		return err
+	}
+
+	if err := cgroups.AsGroup(dir).Write(cgroups.CpusetCpus, "%s", cpus); err != nil {
+		return fmt.Errorf("%s: failed to set cpus %s: %w", c.PrettyName(), cpus, err)
+	}
+
+	return nil
+}
+
+// setMems sets the cpuset.mems of a container.
+func (ctl *cpuctl) setMems(c cache.Container, mems string) error {
+	dir, err := control.CgroupPath(c, "cpuset")
+	if err != nil {
+		return err
+	}
+
+	if err := cgroups.AsGroup(dir).Write(cgroups.CpusetMems, "%s", mems); err != nil {
+		return fmt.Errorf("%s: failed to set memory nodes %s: %w", c.PrettyName(), mems, err)
+	}
+
 	return nil
 }
 
+// partitionCpus turns the cpuset cgroup of a container into a partition,
+// if partitioning is enabled and the container has exclusive CPUs. If the
+// container no longer has exclusive CPUs, an earlier partition is reverted.
+func (ctl *cpuctl) partitionCpus(c cache.Container) error {
+	if ctl.partition == "" {
+		return nil
+	}
+
+	id := c.GetID()
+	cpus, err := ctl.exclusiveCpus(c)
+	if err != nil {
+		if _, ok := ctl.partitions[id]; ok {
+			log.Info("%s: %v, reverting partition", c.PrettyName(), err)
+			delete(ctl.partitions, id)
+			return ctl.unpartitionCpus(c)
+		}
+		log.Debug("%s: not partitioning: %v", c.PrettyName(), err)
+		return nil
+	}
+
+	if old, ok := ctl.partitions[id]; ok && old.Equals(cpus) {
+		return nil
+	}
+
+	log.Debug("%s: creating %s partition of cpus %s", c.PrettyName(), ctl.partition, cpus)
+
+	if err := ctl.setPartition(c, ctl.partition); err != nil {
+		delete(ctl.partitions, id)
+		return err
+	}
+	ctl.partitions[id] = cpus
+
+	return nil
+}
+
+// exclusiveCpus returns the CPUs of a container if they are eligible for
+// partitioning or exclusive use: not shared with any other container and
+// not part of any other partition or exclusive set we have created.
+func (ctl *cpuctl) exclusiveCpus(c cache.Container) (cpuset.CPUSet, error) {
+	if c.GetCpusetCpus() == "" {
+		return cpuset.New(), fmt.Errorf("no pinned cpus")
+	}
+	cpus, err := cpuset.Parse(c.GetCpusetCpus())
+	if err != nil {
+		return cpuset.New(), fmt.Errorf("invalid cpuset %q: %w", c.GetCpusetCpus(), err)
+	}
+	if cpus.IsEmpty() {
+		return cpuset.New(), fmt.Errorf("no pinned cpus")
+	}
+
+	for _, o := range ctl.cache.GetContainers() {
+		if o.GetID() == c.GetID() {
+			continue
+		}
+		if state := o.GetState(); state != cache.ContainerStateRunning && state != cache.ContainerStateCreated {
+			continue
+		}
+		if shared, err := cpuset.Parse(o.GetCpusetCpus()); err == nil && shared.Intersection(cpus).Size() > 0 {
+			return cpuset.New(), fmt.Errorf("cpus %s shared with %s", shared.Intersection(cpus), o.PrettyName())
+		}
+	}
+
+	for id, part := range ctl.partitions {
+		if id == c.GetID() {
+			continue
+		}
+		if part.Intersection(cpus).Size() > 0 {
+			return cpuset.New(), fmt.Errorf("cpus %s already in another partition", part.Intersection(cpus))
+		}
+	}
+
+	for id, excl := range ctl.exclusives {
+		if id == c.GetID() {
+			continue
+		}
+		if excl.Intersection(cpus).Size() > 0 {
+			return cpuset.New(), fmt.Errorf("cpus %s already exclusive to another container", excl.Intersection(cpus))
+		}
+	}
+
+	return cpus, nil
+}
+
+// unpartitionCpus reverts the cpuset cgroup of a container to a member.
+func (ctl *cpuctl) unpartitionCpus(c cache.Container) error {
+	return ctl.setPartition(c, "member")
+}
+
+// setPartition sets the cpuset.cpus.partition of a container, checking
+// that the kernel has accepted the new partition type. A rejected
+// partition is reverted to a member.
+func (ctl *cpuctl) setPartition(c cache.Container, mode string) error {
+	dir, err := control.CgroupPath(c, "cpuset")
+	if err != nil {
+		return err
+	}
+
+	if err := cgroups.AsGroup(dir).Write(cgroups.CpusetCpusPartition, "%s", mode); err != nil {
+		return fmt.Errorf("%s: failed to set cpuset partition to %s: %w", c.PrettyName(), mode, err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, cgroups.CpusetCpusPartition))
+	if err != nil {
+		return fmt.Errorf("%s: failed to read cpuset partition: %w", c.PrettyName(), err)
+	}
+
+	// The kernel reports an invalid partition as "<mode> invalid (<reason>)".
+	state := strings.TrimSpace(string(data))
+	if strings.Contains(state, "invalid") {
+		err := fmt.Errorf("%s: kernel rejected %s partition: %s", c.PrettyName(), mode, state)
+		if mode != "member" {
+			if revErr := cgroups.AsGroup(dir).Write(cgroups.CpusetCpusPartition, "%s", "member"); revErr != nil {
+				err = errors.Join(err, revErr)
+			}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// claimCpus sets the cpuset.cpus.exclusive of a container to its CPUs,
+// if exclusive CPUs are enabled and the container has exclusive CPUs. If
+// the container no longer has exclusive CPUs, earlier ones are released.
+func (ctl *cpuctl) claimCpus(c cache.Container) error {
+	if !ctl.exclusive {
+		return nil
+	}
+
+	id := c.GetID()
+	cpus, err := ctl.exclusiveCpus(c)
+	if err != nil {
+		if _, ok := ctl.exclusives[id]; ok {
+			log.Info("%s: %v, releasing exclusive cpus", c.PrettyName(), err)
+			delete(ctl.exclusives, id)
+			return ctl.releaseCpus(c)
+		}
+		log.Debug("%s: not claiming exclusive cpus: %v", c.PrettyName(), err)
+		return nil
+	}
+
+	if old, ok := ctl.exclusives[id]; ok && old.Equals(cpus) {
+		return nil
+	}
+
+	log.Debug("%s: claiming exclusive cpus %s", c.PrettyName(), cpus)
+
+	supported, err := ctl.setExclusive(c, cpus.String())
+	if err != nil || !supported {
+		delete(ctl.exclusives, id)
+		return err
+	}
+	ctl.exclusives[id] = cpus
+
+	return nil
+}
+
+// releaseCpus clears the cpuset.cpus.exclusive of a container.
+func (ctl *cpuctl) releaseCpus(c cache.Container) error {
+	_, err := ctl.setExclusive(c, "")
+	return err
+}
+
+// setExclusive sets the cpuset.cpus.exclusive of a container. It reports
+// whether the kernel supports exclusive CPUs. Without support, nothing is
+// written and no error is returned.
+func (ctl *cpuctl) setExclusive(c cache.Container, cpus string) (bool, error) {
+	dir, err := control.CgroupPath(c, "cpuset")
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, cgroups.CpusetCpusExclusive)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			log.Debug("%s: %s not supported, skipping", c.PrettyName(), cgroups.CpusetCpusExclusive)
+			return false, nil
+		}
+		return false, fmt.Errorf("%s: failed to check exclusive cpus: %w", c.PrettyName(), err)
+	}
+
+	if err := cgroups.AsGroup(dir).Write(cgroups.CpusetCpusExclusive, "%s", cpus); err != nil {
+		return true, fmt.Errorf("%s: failed to set exclusive cpus %q: %w", c.PrettyName(), cpus, err)
+	}
+
+	return true, nil
+}
+
 // enforceCpufreq enforces a class-specific cpufreq configuration to a cpuset
 func (ctl *cpuctl) enforceCpufreq(class string, cpus ...int) error {
 	if _, ok := ctl.classes[class]; !ok {
@@ -229,9 +679,17 @@ func idSetIntersects(a, b utils.IDSet) bool {
 func (ctl *cpuctl) configure(cfg *cfgapi.Config) error {
 	ctl.classes = nil
 	ctl.uncoreEnabled = false
+	ctl.bindMemory = false
+	ctl.partition = ""
+	ctl.exclusive = false
+	ctl.expandFirst = false
 
 	if cfg != nil && cfg.CPU != nil {
 		ctl.classes = cfg.CPU.Classes
+		ctl.bindMemory = cfg.CPU.BindMemory
+		ctl.partition = cfg.CPU.Partition
+		ctl.exclusive = cfg.CPU.ExclusiveCpus
+		ctl.expandFirst = cfg.CPU.ExpandBeforeContract
 	}
 
 	// Re-configure CPUs that are assigned to some known class
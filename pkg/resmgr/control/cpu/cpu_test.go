@@ -0,0 +1,179 @@
+// Copyright The NRI Plugins Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpu
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containers/nri-plugins/pkg/cgroups"
+	"github.com/containers/nri-plugins/pkg/resmgr/cache"
+	"github.com/containers/nri-plugins/pkg/utils/cpuset"
+)
+
+type fakeContainer struct {
+	cache.Container
+	id        string
+	cpus      string
+	cgroupDir string
+}
+
+func (f fakeContainer) PrettyName() string {
+	return f.id
+}
+
+func (f fakeContainer) GetID() string {
+	return f.id
+}
+
+func (f fakeContainer) GetCpusetCpus() string {
+	return f.cpus
+}
+
+func (f fakeContainer) GetCgroupDir() string {
+	return f.cgroupDir
+}
+
+func TestCpusetSteps(t *testing.T) {
+	tcs := []struct {
+		name     string
+		current  string
+		cpus     string
+		expected []string
+	}{
+		{
+			name:     "move to disjoint cpus",
+			current:  "0-1",
+			cpus:     "2-3",
+			expected: []string{"0-3", "2-3"},
+		},
+		{
+			name:     "grow and shrink",
+			current:  "0-3",
+			cpus:     "2-5",
+			expected: []string{"0-5", "2-5"},
+		},
+		{
+			name:     "grow only",
+			current:  "0-1",
+			cpus:     "0-3",
+			expected: []string{"0-3", "0-3"},
+		},
+		{
+			name:     "shrink only",
+			current:  "0-3",
+			cpus:     "1-2",
+			expected: []string{"1-2"},
+		},
+		{
+			name:     "no change",
+			current:  "0-3",
+			cpus:     "0-3",
+			expected: []string{},
+		},
+		{
+			name:     "no current cpus",
+			current:  "",
+			cpus:     "0-3",
+			expected: []string{"0-3"},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			steps := cpusetSteps(cpuset.MustParse(tc.current), cpuset.MustParse(tc.cpus))
+			got := []string{}
+			for _, step := range steps {
+				if step.IsEmpty() {
+					t.Errorf("empty cpuset in steps %v", steps)
+				}
+				got = append(got, step.String())
+			}
+			if strings.Join(got, " ") != strings.Join(tc.expected, " ") {
+				t.Errorf("expected steps %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestExpandBeforeContract(t *testing.T) {
+	orig := cgroups.GetMountDir()
+	defer cgroups.SetMountDir(orig)
+	cgroups.SetMountDir(t.TempDir())
+
+	// Two containers swap their CPUs. Post-update hooks of both run
+	// before the runtime applies either update.
+	ctrs := []fakeContainer{
+		{id: "ctr0", cpus: "2-3", cgroupDir: "pod/ctr0"},
+		{id: "ctr1", cpus: "0-1", cgroupDir: "pod/ctr1"},
+	}
+	current := []string{"0-1", "2-3"}
+
+	for i, c := range ctrs {
+		dir := cgroups.ContainerDir("cpuset", c.cgroupDir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("failed to create cgroup dir: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, cgroups.CpusetCpus), []byte(current[i]), 0644); err != nil {
+			t.Fatalf("failed to create %s: %v", cgroups.CpusetCpus, err)
+		}
+	}
+
+	readCpus := func(c fakeContainer) string {
+		data, err := os.ReadFile(filepath.Join(cgroups.ContainerDir("cpuset", c.cgroupDir), cgroups.CpusetCpus))
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", cgroups.CpusetCpus, err)
+		}
+		return strings.TrimSpace(string(data))
+	}
+
+	ctl := &cpuctl{}
+	for _, c := range ctrs {
+		if err := ctl.PostUpdateHook(c); err != nil {
+			t.Fatalf("unexpected error with expansion disabled: %v", err)
+		}
+	}
+	for i, c := range ctrs {
+		if cpus := readCpus(c); cpus != current[i] {
+			t.Errorf("%s: cpus changed to %s with expansion disabled", c.id, cpus)
+		}
+	}
+
+	ctl.expandFirst = true
+	for _, c := range ctrs {
+		if err := ctl.PostUpdateHook(c); err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.id, err)
+		}
+	}
+	for _, c := range ctrs {
+		if cpus := readCpus(c); cpus != "0-3" {
+			t.Errorf("%s: expected cpus expanded to 0-3, got %s", c.id, cpus)
+		}
+	}
+
+	// Once the runtime has contracted the cpusets, hooks leave them alone.
+	for _, c := range ctrs {
+		if err := ctl.setCpus(c, c.cpus); err != nil {
+			t.Fatalf("%s: failed to set cpus: %v", c.id, err)
+		}
+		if err := ctl.PostUpdateHook(c); err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.id, err)
+		}
+		if cpus := readCpus(c); cpus != c.cpus {
+			t.Errorf("%s: expected cpus %s, got %s", c.id, c.cpus, cpus)
+		}
+	}
+}
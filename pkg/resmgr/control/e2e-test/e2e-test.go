@@ -43,6 +43,7 @@ const (
 	postStart       = "PostStart"
 	postUpdate      = "PostUpdate"
 	postStop        = "PostStop"
+	reconcile       = "Reconcile"
 )
 
 var (
@@ -86,9 +87,10 @@ func (ctl *testctl) Start(cache cache.Cache, cfg *cfgapi.Config) (bool, error) {
 }
 
 // Stop shuts down the controller.
-func (ctl *testctl) Stop() {
+func (ctl *testctl) Stop() error {
 	log.Debug("Stop called")
 	ctl.Log[controllerEvent] = append(ctl.Log[controllerEvent], "Stop")
+	return nil
 }
 
 // PreCreateHook handler for the e2e test controller.
@@ -126,6 +128,13 @@ func (ctl *testctl) PostStopHook(c cache.Container) error {
 	return nil
 }
 
+// Reconcile handler for the e2e test controller.
+func (ctl *testctl) Reconcile(c cache.Container) error {
+	log.Debug("Reconcile called for %s", c.GetName())
+	ctl.Log[reconcile] = append(ctl.Log[reconcile], c.GetName())
+	return nil
+}
+
 // dumpE2ETestControllerState prints internal info used by e2e testing script.
 func (ctl *testctl) dumpE2ETestControllerState(w http.ResponseWriter, req *http.Request) {
 	log.Debug("output E2E test controller state...")
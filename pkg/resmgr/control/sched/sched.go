@@ -0,0 +1,261 @@
+// Copyright The NRI Plugins Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sched
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"syscall"
+
+	cfgapi "github.com/containers/nri-plugins/pkg/apis/config/v1alpha1/resmgr/control"
+	cfgsched "github.com/containers/nri-plugins/pkg/apis/config/v1alpha1/resmgr/control/sched"
+	"github.com/containers/nri-plugins/pkg/cgroups"
+	"github.com/containers/nri-plugins/pkg/kubernetes"
+	logger "github.com/containers/nri-plugins/pkg/log"
+	"github.com/containers/nri-plugins/pkg/resmgr/cache"
+	"github.com/containers/nri-plugins/pkg/resmgr/control"
+)
+
+const (
+	// SchedController is the name of the scheduling policy controller.
+	SchedController = "sched"
+
+	// SchedClassKey is the pod annotation key for specifying a container
+	// scheduling class.
+	SchedClassKey = "schedclass." + kubernetes.ResmgrKeyNamespace
+)
+
+type Class = cfgsched.Class
+
+// schedctl encapsulates the runtime state of our scheduling policy controller.
+type schedctl struct {
+	sync.Mutex
+	cache   cache.Cache      // resource manager cache
+	classes map[string]Class // configured scheduling classes
+	applied map[string]bool  // containers with a non-default policy applied
+}
+
+var log logger.Logger = logger.NewLogger(SchedController)
+
+// Controller singleton instance.
+var singleton *schedctl
+
+// getSchedController returns the (singleton) scheduling policy controller instance.
+func getSchedController() *schedctl {
+	if singleton == nil {
+		singleton = &schedctl{
+			applied: map[string]bool{},
+		}
+	}
+	return singleton
+}
+
+// Check if our configuration is effectively empty.
+func isEmptyConfig(cfg *cfgapi.Config) bool {
+	return cfg == nil || cfg.Sched == nil || len(cfg.Sched.Classes) == 0
+}
+
+// Start initializes the controller for enforcing decisions.
+func (ctl *schedctl) Start(cch cache.Cache, cfg *cfgapi.Config) (bool, error) {
+	if isEmptyConfig(cfg) {
+		log.Info("empty configuration, disabling controller")
+		return false, nil
+	}
+
+	for name, class := range cfg.Sched.Classes {
+		if err := validateClass(class); err != nil {
+			return false, fmt.Errorf("invalid scheduling class %q: %w", name, err)
+		}
+	}
+
+	ctl.Lock()
+	defer ctl.Unlock()
+
+	ctl.cache = cch
+	ctl.classes = cfg.Sched.Classes
+
+	// Stop restored the default policy, (re)apply classes to running containers.
+	for _, c := range cch.GetContainers() {
+		if c.GetState() != cache.ContainerStateRunning {
+			continue
+		}
+		if err := ctl.applyClass(c); err != nil {
+			log.Error("%v", err)
+		}
+	}
+
+	return true, nil
+}
+
+// Stop shuts down the controller, restoring the default scheduling policy
+// of the tasks of running containers it has changed.
+func (ctl *schedctl) Stop() error {
+	ctl.Lock()
+	defer ctl.Unlock()
+
+	var errs []error
+	for id := range ctl.applied {
+		if c, ok := ctl.cache.LookupContainer(id); ok && c.GetState() == cache.ContainerStateRunning {
+			if err := ctl.setTaskPolicy(c, Class{Policy: cfgsched.PolicyOther}); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		delete(ctl.applied, id)
+	}
+
+	return errors.Join(errs...)
+}
+
+// PreCreateHook handler for the scheduling policy controller.
+func (ctl *schedctl) PreCreateHook(c cache.Container) error {
+	return nil
+}
+
+// PreStartHook handler for the scheduling policy controller.
+func (ctl *schedctl) PreStartHook(c cache.Container) error {
+	return nil
+}
+
+// PostStartHook handler for the scheduling policy controller.
+func (ctl *schedctl) PostStartHook(c cache.Container) error {
+	ctl.Lock()
+	defer ctl.Unlock()
+
+	return ctl.applyClass(c)
+}
+
+// applyClass applies the annotated scheduling class, if any, to the tasks
+// of a container.
+func (ctl *schedctl) applyClass(c cache.Container) error {
+	name, ok := c.GetEffectiveAnnotation(SchedClassKey)
+	if !ok {
+		return nil
+	}
+
+	class, ok := ctl.classes[name]
+	if !ok {
+		return fmt.Errorf("%s: unknown scheduling class %q", c.PrettyName(), name)
+	}
+
+	log.Debug("%s: applying scheduling class %q (%s, priority %d)",
+		c.PrettyName(), name, class.Policy, class.Priority)
+
+	if err := ctl.setTaskPolicy(c, class); err != nil {
+		return err
+	}
+	if class.Policy != cfgsched.PolicyOther {
+		ctl.applied[c.GetID()] = true
+	}
+
+	return nil
+}
+
+// AppliedSettings reports the scheduling class applied to a container.
+func (ctl *schedctl) AppliedSettings(c cache.Container) map[string]string {
+	ctl.Lock()
+	defer ctl.Unlock()
+
+	if !ctl.applied[c.GetID()] {
+		return nil
+	}
+	name, _ := c.GetEffectiveAnnotation(SchedClassKey)
+	return map[string]string{"class": name}
+}
+
+// PostUpdateHook handler for the scheduling policy controller.
+func (ctl *schedctl) PostUpdateHook(c cache.Container) error {
+	return nil
+}
+
+// PostStopHook handler for the scheduling policy controller.
+func (ctl *schedctl) PostStopHook(c cache.Container) error {
+	ctl.Lock()
+	defer ctl.Unlock()
+
+	if !ctl.applied[c.GetID()] {
+		return nil
+	}
+	delete(ctl.applied, c.GetID())
+
+	// Tasks which are still around get the default policy back.
+	if err := ctl.setTaskPolicy(c, Class{Policy: cfgsched.PolicyOther}); err != nil {
+		log.Debug("%s: failed to restore default scheduling policy: %v", c.PrettyName(), err)
+	}
+
+	return nil
+}
+
+// setTaskPolicy sets the scheduling policy of all tasks of a container.
+func (ctl *schedctl) setTaskPolicy(c cache.Container, class Class) error {
+	dir, err := control.CgroupPath(c, "cpu")
+	if err != nil {
+		return err
+	}
+
+	tids, err := cgroups.AsGroup(dir).GetThreads()
+	if err != nil {
+		return fmt.Errorf("%s: failed to read tasks: %w", c.PrettyName(), err)
+	}
+
+	policy, err := schedPolicy(class.Policy)
+	if err != nil {
+		return err
+	}
+
+	for _, tid := range tids {
+		pid, err := strconv.Atoi(tid)
+		if err != nil {
+			return fmt.Errorf("%s: invalid task id %q: %w", c.PrettyName(), tid, err)
+		}
+		if err := setScheduler(pid, policy, class.Priority); err != nil {
+			switch {
+			case errors.Is(err, syscall.ESRCH):
+				continue
+			case errors.Is(err, syscall.EPERM):
+				return fmt.Errorf("%s: permission denied setting %s scheduling policy of task %d, CAP_SYS_NICE is needed: %w",
+					c.PrettyName(), class.Policy, pid, err)
+			default:
+				return fmt.Errorf("%s: failed to set %s scheduling policy of task %d: %w",
+					c.PrettyName(), class.Policy, pid, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateClass checks that the policy of a class is known and that the
+// priority is within the range the kernel allows for the policy.
+func validateClass(class Class) error {
+	policy, err := schedPolicy(class.Policy)
+	if err != nil {
+		return err
+	}
+	min, max, err := priorityRange(policy)
+	if err != nil {
+		return fmt.Errorf("failed to query priority range of policy %s: %w", class.Policy, err)
+	}
+	if class.Priority < min || class.Priority > max {
+		return fmt.Errorf("priority %d of policy %s out of range %d-%d", class.Priority, class.Policy, min, max)
+	}
+	return nil
+}
+
+// Register us as a controller.
+func init() {
+	control.Register(SchedController, "scheduling policy controller", getSchedController())
+}
@@ -0,0 +1,60 @@
+// Copyright The NRI Plugins Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sched
+
+import (
+	"fmt"
+
+	cfgsched "github.com/containers/nri-plugins/pkg/apis/config/v1alpha1/resmgr/control/sched"
+	"golang.org/x/sys/unix"
+)
+
+// setScheduler sets the scheduling policy and priority of a task. Tests
+// replace it to avoid changing the policies of real tasks.
+var setScheduler = func(pid, policy, priority int) error {
+	attr := &unix.SchedAttr{
+		Size:     unix.SizeofSchedAttr,
+		Policy:   uint32(policy),
+		Priority: uint32(priority),
+	}
+	return unix.SchedSetAttr(pid, attr, 0)
+}
+
+// priorityRange returns the range of priorities the kernel allows for a
+// scheduling policy.
+func priorityRange(policy int) (int, int, error) {
+	min, _, errno := unix.Syscall(unix.SYS_SCHED_GET_PRIORITY_MIN, uintptr(policy), 0, 0)
+	if errno != 0 {
+		return 0, 0, errno
+	}
+	max, _, errno := unix.Syscall(unix.SYS_SCHED_GET_PRIORITY_MAX, uintptr(policy), 0, 0)
+	if errno != 0 {
+		return 0, 0, errno
+	}
+	return int(min), int(max), nil
+}
+
+// schedPolicy returns the kernel scheduling policy for a configured policy.
+func schedPolicy(policy cfgsched.Policy) (int, error) {
+	switch policy {
+	case cfgsched.PolicyFIFO:
+		return unix.SCHED_FIFO, nil
+	case cfgsched.PolicyRR:
+		return unix.SCHED_RR, nil
+	case cfgsched.PolicyOther, "":
+		return unix.SCHED_NORMAL, nil
+	}
+	return 0, fmt.Errorf("unknown scheduling policy %q", policy)
+}
@@ -0,0 +1,36 @@
+//go:build !linux
+// +build !linux
+
+// Copyright The NRI Plugins Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sched
+
+import (
+	"fmt"
+
+	cfgsched "github.com/containers/nri-plugins/pkg/apis/config/v1alpha1/resmgr/control/sched"
+)
+
+var setScheduler = func(pid, policy, priority int) error {
+	return fmt.Errorf("setting scheduling policy not supported")
+}
+
+func priorityRange(policy int) (int, int, error) {
+	return 0, 0, fmt.Errorf("scheduling policies not supported")
+}
+
+func schedPolicy(policy cfgsched.Policy) (int, error) {
+	return 0, fmt.Errorf("scheduling policy %q not supported", policy)
+}
@@ -0,0 +1,213 @@
+// Copyright The NRI Plugins Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sched
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	cfgsched "github.com/containers/nri-plugins/pkg/apis/config/v1alpha1/resmgr/control/sched"
+	"github.com/containers/nri-plugins/pkg/cgroups"
+	"github.com/containers/nri-plugins/pkg/resmgr/cache"
+	"golang.org/x/sys/unix"
+)
+
+type fakeContainer struct {
+	cache.Container
+	id    string
+	class string
+}
+
+func (f *fakeContainer) GetID() string        { return f.id }
+func (f *fakeContainer) PrettyName() string   { return f.id }
+func (f *fakeContainer) GetCgroupDir() string { return "/pod/" + f.id }
+
+func (f *fakeContainer) GetEffectiveAnnotation(key string) (string, bool) {
+	if key != SchedClassKey || f.class == "" {
+		return "", false
+	}
+	return f.class, true
+}
+
+type schedCall struct {
+	pid      int
+	policy   int
+	priority int
+}
+
+// stubScheduler replaces setScheduler for the duration of a test. The
+// stub records its calls and returns err for them.
+func stubScheduler(t *testing.T, err error) *[]schedCall {
+	calls := &[]schedCall{}
+	orig := setScheduler
+	t.Cleanup(func() { setScheduler = orig })
+	setScheduler = func(pid, policy, priority int) error {
+		*calls = append(*calls, schedCall{pid, policy, priority})
+		return err
+	}
+	return calls
+}
+
+// newTestCgroup creates a cpu cgroup with the given tasks for a
+// container under a temporary cgroup mount directory.
+func newTestCgroup(t *testing.T, c *fakeContainer, tasks string) {
+	mountDir := cgroups.GetMountDir()
+	t.Cleanup(func() { cgroups.SetMountDir(mountDir) })
+	cgroups.SetMountDir(t.TempDir())
+
+	dir := cgroups.ContainerDir("cpu", c.GetCgroupDir())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("failed to create cgroup directory: %v", err)
+	}
+	for _, entry := range []string{cgroups.Tasks, cgroups.Threads} {
+		if err := os.WriteFile(filepath.Join(dir, entry), []byte(tasks), 0644); err != nil {
+			t.Fatalf("failed to create %s: %v", entry, err)
+		}
+	}
+}
+
+func newTestController() *schedctl {
+	return &schedctl{
+		classes: map[string]Class{
+			"rt":     {Policy: cfgsched.PolicyFIFO, Priority: 50},
+			"normal": {Policy: cfgsched.PolicyOther},
+		},
+		applied: map[string]bool{},
+	}
+}
+
+func TestSchedPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy   cfgsched.Policy
+		expected int
+		invalid  bool
+	}{
+		{policy: cfgsched.PolicyFIFO, expected: unix.SCHED_FIFO},
+		{policy: cfgsched.PolicyRR, expected: unix.SCHED_RR},
+		{policy: cfgsched.PolicyOther, expected: unix.SCHED_NORMAL},
+		{policy: "", expected: unix.SCHED_NORMAL},
+		{policy: "deadline", invalid: true},
+	} {
+		policy, err := schedPolicy(tc.policy)
+		if tc.invalid {
+			if err == nil {
+				t.Errorf("policy %q: expected error, got %d", tc.policy, policy)
+			}
+			continue
+		}
+		if err != nil || policy != tc.expected {
+			t.Errorf("policy %q: expected %d, got %d, %v", tc.policy, tc.expected, policy, err)
+		}
+	}
+}
+
+func TestValidateClass(t *testing.T) {
+	for _, tc := range []struct {
+		class Class
+		valid bool
+	}{
+		{Class{Policy: cfgsched.PolicyFIFO, Priority: 1}, true},
+		{Class{Policy: cfgsched.PolicyFIFO, Priority: 99}, true},
+		{Class{Policy: cfgsched.PolicyRR, Priority: 50}, true},
+		{Class{Policy: cfgsched.PolicyOther, Priority: 0}, true},
+		{Class{Policy: cfgsched.PolicyFIFO, Priority: 0}, false},
+		{Class{Policy: cfgsched.PolicyRR, Priority: 100}, false},
+		{Class{Policy: cfgsched.PolicyOther, Priority: 1}, false},
+		{Class{Policy: "deadline", Priority: 1}, false},
+	} {
+		if err := validateClass(tc.class); (err == nil) != tc.valid {
+			t.Errorf("class %+v: expected valid %v, got error %v", tc.class, tc.valid, err)
+		}
+	}
+}
+
+func TestApplyClass(t *testing.T) {
+	rt := &fakeContainer{id: "ctr0", class: "rt"}
+	newTestCgroup(t, rt, "10\n11\n")
+	calls := stubScheduler(t, nil)
+
+	ctl := newTestController()
+	if err := ctl.PostStartHook(rt); err != nil {
+		t.Fatalf("PostStartHook failed: %v", err)
+	}
+	expected := []schedCall{{10, unix.SCHED_FIFO, 50}, {11, unix.SCHED_FIFO, 50}}
+	if len(*calls) != 2 || (*calls)[0] != expected[0] || (*calls)[1] != expected[1] {
+		t.Errorf("expected calls %v, got %v", expected, *calls)
+	}
+	if !ctl.applied[rt.id] {
+		t.Errorf("expected class rt to be recorded as applied")
+	}
+	if settings := ctl.AppliedSettings(rt); settings["class"] != "rt" {
+		t.Errorf("unexpected applied settings %v", settings)
+	}
+
+	// The default policy is restored when the container stops.
+	*calls = nil
+	if err := ctl.PostStopHook(rt); err != nil {
+		t.Fatalf("PostStopHook failed: %v", err)
+	}
+	if ctl.applied[rt.id] || len(*calls) != 2 || (*calls)[0].policy != unix.SCHED_NORMAL {
+		t.Errorf("expected default policy restored and container forgotten, got calls %v, applied %v",
+			*calls, ctl.applied)
+	}
+
+	// Stopping a container without an applied class changes nothing.
+	*calls = nil
+	if err := ctl.PostStopHook(rt); err != nil || len(*calls) != 0 {
+		t.Errorf("expected no calls for a forgotten container, got %v, %v", *calls, err)
+	}
+
+	// The default policy is not recorded as applied.
+	normal := &fakeContainer{id: "ctr0", class: "normal"}
+	if err := ctl.PostStartHook(normal); err != nil {
+		t.Fatalf("PostStartHook failed: %v", err)
+	}
+	if ctl.applied[normal.id] || ctl.AppliedSettings(normal) != nil {
+		t.Errorf("expected class normal not to be recorded as applied")
+	}
+
+	// Unknown classes are errors, containers without a class are skipped.
+	if err := ctl.PostStartHook(&fakeContainer{id: "ctr0", class: "unknown"}); err == nil {
+		t.Errorf("expected error for an unknown class")
+	}
+	*calls = nil
+	if err := ctl.PostStartHook(&fakeContainer{id: "ctr0"}); err != nil || len(*calls) != 0 {
+		t.Errorf("expected container without a class to be skipped, got %v, %v", *calls, err)
+	}
+}
+
+func TestApplyClassErrors(t *testing.T) {
+	c := &fakeContainer{id: "ctr0", class: "rt"}
+	newTestCgroup(t, c, "10\n")
+
+	// Tasks which have exited are skipped.
+	stubScheduler(t, syscall.ESRCH)
+	ctl := newTestController()
+	if err := ctl.PostStartHook(c); err != nil {
+		t.Errorf("expected exited tasks to be skipped, got %v", err)
+	}
+
+	// Failures are not recorded as applied.
+	stubScheduler(t, syscall.EPERM)
+	ctl = newTestController()
+	if err := ctl.PostStartHook(c); err == nil {
+		t.Errorf("expected error for permission denied")
+	}
+	if ctl.applied[c.id] {
+		t.Errorf("expected failed class not to be recorded as applied")
+	}
+}
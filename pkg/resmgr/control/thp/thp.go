@@ -0,0 +1,471 @@
+// Copyright The NRI Plugins Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package thp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	cfgapi "github.com/containers/nri-plugins/pkg/apis/config/v1alpha1/resmgr/control"
+	cfgthp "github.com/containers/nri-plugins/pkg/apis/config/v1alpha1/resmgr/control/thp"
+	"github.com/containers/nri-plugins/pkg/cgroups"
+	"github.com/containers/nri-plugins/pkg/kubernetes"
+	logger "github.com/containers/nri-plugins/pkg/log"
+	"github.com/containers/nri-plugins/pkg/resmgr/cache"
+	"github.com/containers/nri-plugins/pkg/resmgr/control"
+)
+
+const (
+	// THPController is the name of the transparent hugepage controller.
+	THPController = "thp"
+
+	// THPClassKey is the pod annotation key for specifying a container
+	// transparent hugepage class.
+	THPClassKey = "thpclass." + kubernetes.ResmgrKeyNamespace
+)
+
+const (
+	// collapseQueueSize is the number of containers that can wait for
+	// their memory to be collapsed. Containers are not queued while the
+	// queue is full, they are queued again when they are reconciled.
+	collapseQueueSize = 16
+	// collapseBatch is the maximum number of memory regions of a
+	// container collapsed at a time. The rest are collapsed when the
+	// container is reconciled again.
+	collapseBatch = 64
+)
+
+type Class = cfgthp.Class
+
+// thpctl encapsulates the runtime state of our transparent hugepage controller.
+type thpctl struct {
+	sync.Mutex
+	cache       cache.Cache                        // resource manager cache
+	classes     map[string]Class                   // configured transparent hugepage classes
+	restore     map[string]string                  // original modes of containers we have changed
+	collapse    map[string]string                  // classes of containers whose memory we collapse
+	collapsed   map[string]map[procRegion]struct{} // memory regions collapsed per container
+	queue       chan collapseRequest               // containers waiting for collapsing
+	unsupported bool                               // per-cgroup control found missing
+}
+
+// region is a memory region of a process. Its layout is the same as
+// that of struct iovec, which process_madvise(2) takes.
+type region struct {
+	base   uintptr
+	length uintptr
+}
+
+// procRegion is a memory region of a given process.
+type procRegion struct {
+	pid int
+	region
+}
+
+// collapseRequest asks for collapsing the memory of a container.
+type collapseRequest struct {
+	id   string // container ID
+	name string // pretty name of the container
+	dir  string // memory cgroup directory of the container
+}
+
+// collapseProcessRegions collapses memory regions of a process. It is
+// replaced in tests.
+var collapseProcessRegions = collapseRegions
+
+var log logger.Logger = logger.NewLogger(THPController)
+
+// Controller singleton instance.
+var singleton *thpctl
+
+const (
+	// sysfs entry for system-wide transparent hugepage mode.
+	thpSysfsEnabled = "/sys/kernel/mm/transparent_hugepage/enabled"
+	// memory cgroup entry for per-cgroup transparent hugepage mode.
+	// Mainline kernels do not provide one, so it is only used if the
+	// kernel does. Otherwise classes are applied to the tasks of
+	// containers, see applyTaskClass.
+	thpCgroupEnabled = "memory.thp_enabled"
+)
+
+// getTHPController returns the (singleton) transparent hugepage controller instance.
+func getTHPController() *thpctl {
+	if singleton == nil {
+		singleton = &thpctl{
+			restore:   map[string]string{},
+			collapse:  map[string]string{},
+			collapsed: map[string]map[procRegion]struct{}{},
+		}
+	}
+	return singleton
+}
+
+// Check if our configuration is effectively empty.
+func isEmptyConfig(cfg *cfgapi.Config) bool {
+	return cfg == nil || cfg.THP == nil || len(cfg.THP.Classes) == 0
+}
+
+// Start initializes the controller for enforcing decisions.
+func (ctl *thpctl) Start(cch cache.Cache, cfg *cfgapi.Config) (bool, error) {
+	if isEmptyConfig(cfg) {
+		log.Info("empty configuration, disabling controller")
+		return false, nil
+	}
+
+	for name, class := range cfg.THP.Classes {
+		if err := class.Validate(); err != nil {
+			return false, fmt.Errorf("invalid transparent hugepage class %q: %w", name, err)
+		}
+	}
+
+	if _, err := os.Stat(thpSysfsEnabled); err != nil {
+		log.Warn("transparent hugepages not supported by the kernel, disabling controller: %v", err)
+		return false, nil
+	}
+
+	ctl.Lock()
+	defer ctl.Unlock()
+
+	ctl.cache = cch
+	ctl.classes = cfg.THP.Classes
+	ctl.unsupported = false
+	if ctl.queue == nil {
+		ctl.queue = make(chan collapseRequest, collapseQueueSize)
+		go ctl.collapser(ctl.queue)
+	}
+
+	// Stop restored the original modes, (re)apply classes to running containers.
+	for _, c := range cch.GetContainers() {
+		if c.GetState() != cache.ContainerStateRunning {
+			continue
+		}
+		if err := ctl.applyClass(c); err != nil {
+			log.Error("%v", err)
+		}
+	}
+
+	return true, nil
+}
+
+// Stop shuts down the controller, restoring the original transparent
+// hugepage mode of running containers it has changed.
+func (ctl *thpctl) Stop() error {
+	ctl.Lock()
+	defer ctl.Unlock()
+
+	var errs []error
+	for id, mode := range ctl.restore {
+		if c, ok := ctl.cache.LookupContainer(id); ok && c.GetState() == cache.ContainerStateRunning {
+			if err := ctl.setMode(c, mode); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		delete(ctl.restore, id)
+	}
+	clear(ctl.collapse)
+	clear(ctl.collapsed)
+	if ctl.queue != nil {
+		close(ctl.queue)
+		ctl.queue = nil
+	}
+
+	return errors.Join(errs...)
+}
+
+// PreCreateHook handler for the transparent hugepage controller.
+func (ctl *thpctl) PreCreateHook(c cache.Container) error {
+	return nil
+}
+
+// PreStartHook handler for the transparent hugepage controller.
+func (ctl *thpctl) PreStartHook(c cache.Container) error {
+	ctl.Lock()
+	defer ctl.Unlock()
+
+	return ctl.applyClass(c)
+}
+
+// PostStartHook handler for the transparent hugepage controller.
+func (ctl *thpctl) PostStartHook(c cache.Container) error {
+	ctl.Lock()
+	defer ctl.Unlock()
+
+	if _, ok := ctl.collapse[c.GetID()]; !ok {
+		return nil
+	}
+	return ctl.queueCollapse(c)
+}
+
+// PostUpdateHook handler for the transparent hugepage controller.
+func (ctl *thpctl) PostUpdateHook(c cache.Container) error {
+	return nil
+}
+
+// PostStopHook handler for the transparent hugepage controller.
+func (ctl *thpctl) PostStopHook(c cache.Container) error {
+	ctl.Lock()
+	defer ctl.Unlock()
+
+	// The cgroup goes away with the container, there is nothing to restore.
+	delete(ctl.restore, c.GetID())
+	delete(ctl.collapse, c.GetID())
+	delete(ctl.collapsed, c.GetID())
+
+	return nil
+}
+
+// Reconcile queues collapsing the memory of a container into hugepages
+// again, if its class is applied to its tasks. This covers memory the
+// tasks have allocated since the container was started. Only regions
+// which have not been collapsed yet are collapsed.
+func (ctl *thpctl) Reconcile(c cache.Container) error {
+	ctl.Lock()
+	defer ctl.Unlock()
+
+	if _, ok := ctl.collapse[c.GetID()]; !ok {
+		return nil
+	}
+	return ctl.queueCollapse(c)
+}
+
+// AppliedSettings reports the transparent hugepage class applied to a
+// container.
+func (ctl *thpctl) AppliedSettings(c cache.Container) map[string]string {
+	ctl.Lock()
+	defer ctl.Unlock()
+
+	if name, ok := ctl.collapse[c.GetID()]; ok {
+		return map[string]string{"class": name}
+	}
+	if _, ok := ctl.restore[c.GetID()]; !ok {
+		return nil
+	}
+	name, _ := c.GetEffectiveAnnotation(THPClassKey)
+	return map[string]string{"class": name}
+}
+
+// applyClass applies the annotated transparent hugepage class, if any,
+// to the memory cgroup of a container, or to its tasks if the kernel
+// has no per-cgroup transparent hugepage control.
+func (ctl *thpctl) applyClass(c cache.Container) error {
+	name, ok := c.GetEffectiveAnnotation(THPClassKey)
+	if !ok {
+		return nil
+	}
+
+	class, ok := ctl.classes[name]
+	if !ok {
+		return fmt.Errorf("%s: unknown transparent hugepage class %q", c.PrettyName(), name)
+	}
+
+	if ctl.unsupported {
+		return ctl.applyTaskClass(c, name, class)
+	}
+
+	mode, err := ctl.getMode(c)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			log.Warn("kernel does not expose per-cgroup transparent hugepage control (%s), "+
+				"applying transparent hugepage classes to tasks", thpCgroupEnabled)
+			ctl.unsupported = true
+			return ctl.applyTaskClass(c, name, class)
+		}
+		return err
+	}
+
+	log.Debug("%s: applying transparent hugepage class %q (%s)", c.PrettyName(), name, class.Mode)
+
+	if err := ctl.setMode(c, string(class.Mode)); err != nil {
+		return err
+	}
+	if _, ok := ctl.restore[c.GetID()]; !ok {
+		ctl.restore[c.GetID()] = mode
+	}
+
+	return nil
+}
+
+// applyTaskClass applies a transparent hugepage class to the tasks of a
+// container. Tasks can only disable hugepages for themselves, with
+// prctl(PR_SET_THP_DISABLE), so only "always" classes can be applied:
+// the memory of the tasks is collapsed into hugepages in the background
+// when the container is started and reconciled.
+func (ctl *thpctl) applyTaskClass(c cache.Container, name string, class Class) error {
+	if class.Mode != cfgthp.ModeAlways {
+		log.Warn("%s: transparent hugepage class %q (%s) cannot be applied without per-cgroup control",
+			c.PrettyName(), name, class.Mode)
+		return nil
+	}
+
+	log.Debug("%s: applying transparent hugepage class %q (%s) to tasks", c.PrettyName(), name, class.Mode)
+
+	ctl.collapse[c.GetID()] = name
+	return ctl.queueCollapse(c)
+}
+
+// queueCollapse queues collapsing the memory of a container, unless the
+// queue is full. Collapsing is slow, so it is done in the background
+// without holding the lock of the controller or the resource manager.
+func (ctl *thpctl) queueCollapse(c cache.Container) error {
+	if ctl.queue == nil {
+		return nil
+	}
+
+	dir, err := control.CgroupPath(c, "memory")
+	if err != nil {
+		return err
+	}
+
+	select {
+	case ctl.queue <- collapseRequest{id: c.GetID(), name: c.PrettyName(), dir: dir}:
+	default:
+		log.Debug("%s: too many containers waiting for collapsing, skipping", c.PrettyName())
+	}
+
+	return nil
+}
+
+// collapser collapses the memory of queued containers until the queue
+// is closed.
+func (ctl *thpctl) collapser(queue <-chan collapseRequest) {
+	for req := range queue {
+		ctl.Lock()
+		_, ok := ctl.collapse[req.id]
+		done := ctl.collapsed[req.id]
+		ctl.Unlock()
+		if !ok {
+			continue
+		}
+
+		collapsed, err := collapseMemory(req.name, req.dir, done)
+		if err != nil {
+			log.Warn("%v", err)
+		}
+
+		ctl.Lock()
+		if _, ok := ctl.collapse[req.id]; ok {
+			ctl.collapsed[req.id] = collapsed
+		}
+		ctl.Unlock()
+	}
+}
+
+// collapseMemory collapses the memory of the processes in a memory
+// cgroup into hugepages. Regions in done are not collapsed again, and
+// at most collapseBatch other regions are collapsed. It returns the
+// existing regions which are collapsed, or cannot be collapsed at all.
+func collapseMemory(name, dir string, done map[procRegion]struct{}) (map[procRegion]struct{}, error) {
+	collapsed := map[procRegion]struct{}{}
+
+	pids, err := cgroups.AsGroup(dir).GetProcesses()
+	if err != nil {
+		return collapsed, fmt.Errorf("%s: failed to read processes: %w", name, err)
+	}
+
+	var errs []error
+	budget := collapseBatch
+	for _, pid := range pids {
+		id, err := strconv.Atoi(pid)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid process ID %q", name, pid))
+			continue
+		}
+
+		regions, err := anonRegions(id)
+		if err != nil {
+			if !errors.Is(err, syscall.ESRCH) {
+				errs = append(errs, fmt.Errorf("%s: failed to read memory regions of process %d: %w",
+					name, id, err))
+			}
+			continue
+		}
+
+		var todo []region
+		for _, r := range regions {
+			if _, ok := done[procRegion{id, r}]; ok {
+				collapsed[procRegion{id, r}] = struct{}{}
+			} else if budget > 0 {
+				todo = append(todo, r)
+				budget--
+			}
+		}
+		if len(todo) == 0 {
+			continue
+		}
+
+		handled, err := collapseProcessRegions(id, todo)
+		for _, r := range handled {
+			collapsed[procRegion{id, r}] = struct{}{}
+		}
+		if err != nil && !errors.Is(err, syscall.ESRCH) {
+			errs = append(errs, fmt.Errorf("%s: failed to collapse memory of process %d: %w",
+				name, id, err))
+		}
+	}
+
+	return collapsed, errors.Join(errs...)
+}
+
+// getMode returns the current transparent hugepage mode of a container.
+func (ctl *thpctl) getMode(c cache.Container) (string, error) {
+	dir, err := control.CgroupPath(c, "memory")
+	if err != nil {
+		return "", err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, thpCgroupEnabled))
+	if err != nil {
+		return "", fmt.Errorf("%s: failed to read transparent hugepage mode: %w", c.PrettyName(), err)
+	}
+
+	return parseMode(string(data)), nil
+}
+
+// setMode sets the transparent hugepage mode of a container.
+func (ctl *thpctl) setMode(c cache.Container, mode string) error {
+	dir, err := control.CgroupPath(c, "memory")
+	if err != nil {
+		return err
+	}
+
+	if err := cgroups.AsGroup(dir).Write(thpCgroupEnabled, "%s", mode); err != nil {
+		return fmt.Errorf("%s: failed to set transparent hugepage mode %s: %w", c.PrettyName(), mode, err)
+	}
+
+	return nil
+}
+
+// parseMode returns the selected mode from the content of a transparent
+// hugepage entry, either a plain mode or a list of modes with the selected
+// one in brackets, like "always [madvise] never".
+func parseMode(data string) string {
+	for _, mode := range strings.Fields(data) {
+		if strings.HasPrefix(mode, "[") && strings.HasSuffix(mode, "]") {
+			return strings.Trim(mode, "[]")
+		}
+	}
+	return strings.TrimSpace(data)
+}
+
+// Register us as a controller.
+func init() {
+	control.Register(THPController, "transparent hugepage controller", getTHPController())
+}
@@ -0,0 +1,97 @@
+// Copyright The NRI Plugins Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package thp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// collapseRegions collapses memory regions of a process into hugepages
+// with process_madvise(2) MADV_COLLAPSE. It returns the regions which
+// are collapsed or cannot be collapsed at all, for instance because
+// they are too small. Regions which cannot be collapsed now, because
+// hugepages are not available, are left for later.
+func collapseRegions(pid int, regions []region) ([]region, error) {
+	pidfd, err := unix.PidfdOpen(pid, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(pidfd)
+
+	var handled []region
+	for _, r := range regions {
+		_, _, errno := unix.Syscall6(unix.SYS_PROCESS_MADVISE, uintptr(pidfd),
+			uintptr(unsafe.Pointer(&r)), 1, unix.MADV_COLLAPSE, 0, 0)
+		switch {
+		case errno == 0, errors.Is(errno, unix.EINVAL):
+			handled = append(handled, r)
+		case errors.Is(errno, unix.EAGAIN), errors.Is(errno, unix.ENOMEM):
+			// Region not collapsible now, try the others.
+		default:
+			return handled, errno
+		}
+	}
+
+	return handled, nil
+}
+
+// anonRegions returns the private writable anonymous memory regions of a
+// process, parsed from /proc/<pid>/maps lines like
+// "7f2c4a000000-7f2c4a400000 rw-p 00000000 00:00 0".
+func anonRegions(pid int) ([]region, error) {
+	f, err := os.Open("/proc/" + strconv.Itoa(pid) + "/maps")
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, unix.ESRCH
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var regions []region
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || fields[4] != "0" || !strings.HasPrefix(fields[1], "rw") || fields[1][3] != 'p' {
+			continue
+		}
+		if len(fields) > 5 && fields[5] != "[heap]" {
+			continue
+		}
+		start, end, ok := strings.Cut(fields[0], "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid memory region %q", fields[0])
+		}
+		addr, err := strconv.ParseUint(start, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid memory region %q: %w", fields[0], err)
+		}
+		limit, err := strconv.ParseUint(end, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid memory region %q: %w", fields[0], err)
+		}
+		regions = append(regions, region{base: uintptr(addr), length: uintptr(limit - addr)})
+	}
+
+	return regions, scanner.Err()
+}
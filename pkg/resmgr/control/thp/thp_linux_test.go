@@ -0,0 +1,68 @@
+// Copyright The NRI Plugins Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package thp
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/containers/nri-plugins/pkg/cgroups"
+)
+
+func TestCollapseMemory(t *testing.T) {
+	c := &fakeContainer{id: "ctr0", class: "huge"}
+	dir := newTestCgroup(t, c)
+	pid := os.Getpid()
+	if err := os.WriteFile(filepath.Join(dir, cgroups.Procs), []byte(strconv.Itoa(pid)+"\n"), 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", cgroups.Procs, err)
+	}
+	regions, err := anonRegions(pid)
+	if err != nil || len(regions) == 0 {
+		t.Skipf("no memory regions to collapse: %v", err)
+	}
+
+	orig := collapseProcessRegions
+	t.Cleanup(func() { collapseProcessRegions = orig })
+	seen := map[region]int{}
+	collapseProcessRegions = func(pid int, regions []region) ([]region, error) {
+		for _, r := range regions {
+			seen[r]++
+		}
+		return regions, nil
+	}
+
+	// Already collapsed regions are not collapsed again, and regions
+	// are collapsed in batches.
+	var done map[procRegion]struct{}
+	for i := 0; i < len(regions)/collapseBatch+1; i++ {
+		done, err = collapseMemory(c.id, dir, done)
+		if err != nil {
+			t.Fatalf("collapseMemory failed: %v", err)
+		}
+		if n := min(len(regions), (i+1)*collapseBatch); len(seen) < n {
+			t.Errorf("expected at least %d regions collapsed after round %d, got %d", n, i, len(seen))
+		}
+	}
+	for r, count := range seen {
+		if count != 1 {
+			t.Errorf("region %+v collapsed %d times", r, count)
+		}
+	}
+	if len(done) == 0 {
+		t.Errorf("expected collapsed regions to be tracked")
+	}
+}
@@ -0,0 +1,30 @@
+//go:build !linux
+// +build !linux
+
+// Copyright The NRI Plugins Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package thp
+
+import (
+	"fmt"
+)
+
+func collapseRegions(pid int, regions []region) ([]region, error) {
+	return nil, fmt.Errorf("collapsing memory into hugepages not supported")
+}
+
+func anonRegions(pid int) ([]region, error) {
+	return nil, fmt.Errorf("reading memory regions not supported")
+}
@@ -0,0 +1,216 @@
+// Copyright The NRI Plugins Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package thp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cfgthp "github.com/containers/nri-plugins/pkg/apis/config/v1alpha1/resmgr/control/thp"
+	"github.com/containers/nri-plugins/pkg/cgroups"
+	"github.com/containers/nri-plugins/pkg/resmgr/cache"
+)
+
+type fakeContainer struct {
+	cache.Container
+	id    string
+	class string
+}
+
+func (f *fakeContainer) GetID() string        { return f.id }
+func (f *fakeContainer) PrettyName() string   { return f.id }
+func (f *fakeContainer) GetCgroupDir() string { return "/pod/" + f.id }
+
+func (f *fakeContainer) GetEffectiveAnnotation(key string) (string, bool) {
+	if key != THPClassKey || f.class == "" {
+		return "", false
+	}
+	return f.class, true
+}
+
+// newTestCgroup creates an empty memory cgroup directory for a container
+// under a temporary cgroup mount directory, and returns its path.
+func newTestCgroup(t *testing.T, c *fakeContainer) string {
+	mountDir := cgroups.GetMountDir()
+	t.Cleanup(func() { cgroups.SetMountDir(mountDir) })
+	cgroups.SetMountDir(t.TempDir())
+
+	dir := cgroups.ContainerDir("memory", c.GetCgroupDir())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("failed to create cgroup directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, cgroups.Procs), nil, 0644); err != nil {
+		t.Fatalf("failed to create %s: %v", cgroups.Procs, err)
+	}
+	return dir
+}
+
+func newTestController() *thpctl {
+	return &thpctl{
+		classes: map[string]Class{
+			"huge":   {Mode: cfgthp.ModeAlways},
+			"nohuge": {Mode: cfgthp.ModeNever},
+		},
+		restore:   map[string]string{},
+		collapse:  map[string]string{},
+		collapsed: map[string]map[procRegion]struct{}{},
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	for _, tc := range []struct {
+		data     string
+		expected string
+	}{
+		{"always [madvise] never\n", "madvise"},
+		{"[always] madvise never", "always"},
+		{"always madvise [never]\n", "never"},
+		{"never\n", "never"},
+		{"", ""},
+	} {
+		if mode := parseMode(tc.data); mode != tc.expected {
+			t.Errorf("parseMode(%q): expected %q, got %q", tc.data, tc.expected, mode)
+		}
+	}
+}
+
+func TestClassValidate(t *testing.T) {
+	for _, tc := range []struct {
+		mode  cfgthp.Mode
+		valid bool
+	}{
+		{cfgthp.ModeAlways, true},
+		{cfgthp.ModeMadvise, true},
+		{cfgthp.ModeNever, true},
+		{"", false},
+		{"sometimes", false},
+	} {
+		class := Class{Mode: tc.mode}
+		if err := class.Validate(); (err == nil) != tc.valid {
+			t.Errorf("mode %q: expected valid %v, got error %v", tc.mode, tc.valid, err)
+		}
+	}
+
+	cfg := &cfgthp.Config{Classes: map[string]Class{"bad": {Mode: "sometimes"}}}
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("expected error for invalid class in configuration")
+	}
+}
+
+func TestApplyCgroupClass(t *testing.T) {
+	c := &fakeContainer{id: "ctr0", class: "nohuge"}
+	dir := newTestCgroup(t, c)
+	entry := filepath.Join(dir, thpCgroupEnabled)
+	if err := os.WriteFile(entry, []byte("always [madvise] never\n"), 0644); err != nil {
+		t.Fatalf("failed to create %s: %v", thpCgroupEnabled, err)
+	}
+
+	ctl := newTestController()
+	if err := ctl.PreStartHook(c); err != nil {
+		t.Fatalf("PreStartHook failed: %v", err)
+	}
+	// Like in cgroupfs, writing does not truncate the test file.
+	if data, _ := os.ReadFile(entry); !strings.HasPrefix(string(data), "never") {
+		t.Errorf("expected mode never, got %q", data)
+	}
+	if mode := ctl.restore[c.id]; mode != "madvise" {
+		t.Errorf("expected original mode madvise to be restored, got %q", mode)
+	}
+	if settings := ctl.AppliedSettings(c); settings["class"] != "nohuge" {
+		t.Errorf("unexpected applied settings %v", settings)
+	}
+
+	if err := ctl.PostStopHook(c); err != nil {
+		t.Fatalf("PostStopHook failed: %v", err)
+	}
+	if len(ctl.restore) != 0 || ctl.AppliedSettings(c) != nil {
+		t.Errorf("expected stopped container to be forgotten, got %v", ctl.restore)
+	}
+}
+
+func TestApplyTaskClass(t *testing.T) {
+	huge := &fakeContainer{id: "ctr0", class: "huge"}
+	nohuge := &fakeContainer{id: "ctr1", class: "nohuge"}
+	newTestCgroup(t, huge)
+	dir := cgroups.ContainerDir("memory", nohuge.GetCgroupDir())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("failed to create cgroup directory: %v", err)
+	}
+
+	ctl := newTestController()
+	if err := ctl.PreStartHook(huge); err != nil {
+		t.Fatalf("PreStartHook failed: %v", err)
+	}
+	if !ctl.unsupported {
+		t.Errorf("expected missing %s to be detected", thpCgroupEnabled)
+	}
+	if _, err := os.Stat(filepath.Join(dir, thpCgroupEnabled)); err == nil {
+		t.Errorf("unexpected %s created", thpCgroupEnabled)
+	}
+	if name := ctl.collapse[huge.id]; name != "huge" {
+		t.Errorf("expected class huge to be applied to tasks, got %q", name)
+	}
+	if err := ctl.PostStartHook(huge); err != nil {
+		t.Errorf("PostStartHook failed: %v", err)
+	}
+	if err := ctl.Reconcile(huge); err != nil {
+		t.Errorf("Reconcile failed: %v", err)
+	}
+
+	// Classes other than always cannot be applied to tasks.
+	if err := ctl.PreStartHook(nohuge); err != nil {
+		t.Fatalf("PreStartHook failed: %v", err)
+	}
+	if _, ok := ctl.collapse[nohuge.id]; ok || ctl.AppliedSettings(nohuge) != nil {
+		t.Errorf("expected class nohuge not to be applied")
+	}
+
+	if err := ctl.PostStopHook(huge); err != nil {
+		t.Fatalf("PostStopHook failed: %v", err)
+	}
+	if len(ctl.collapse) != 0 {
+		t.Errorf("expected stopped container to be forgotten, got %v", ctl.collapse)
+	}
+}
+
+func TestReconcileQueuesCollapse(t *testing.T) {
+	huge := &fakeContainer{id: "ctr0", class: "huge"}
+	other := &fakeContainer{id: "ctr1", class: "huge"}
+	newTestCgroup(t, huge)
+
+	ctl := newTestController()
+	ctl.unsupported = true
+	ctl.queue = make(chan collapseRequest, 1)
+	if err := ctl.PreStartHook(huge); err != nil {
+		t.Fatalf("PreStartHook failed: %v", err)
+	}
+	ctl.collapse[other.id] = "huge"
+
+	// Reconciling does not block on a full queue.
+	for _, c := range []*fakeContainer{huge, other} {
+		if err := ctl.Reconcile(c); err != nil {
+			t.Errorf("Reconcile failed: %v", err)
+		}
+	}
+	if len(ctl.queue) != 1 {
+		t.Fatalf("expected 1 queued container, got %d", len(ctl.queue))
+	}
+	req := <-ctl.queue
+	if req.id != huge.id || req.dir != cgroups.ContainerDir("memory", huge.GetCgroupDir()) {
+		t.Errorf("unexpected collapse request %+v", req)
+	}
+}
@@ -18,4 +18,6 @@ import (
 	// List of controllers to pull in.
 	_ "github.com/containers/nri-plugins/pkg/resmgr/control/cpu"
 	_ "github.com/containers/nri-plugins/pkg/resmgr/control/e2e-test"
+	_ "github.com/containers/nri-plugins/pkg/resmgr/control/sched"
+	_ "github.com/containers/nri-plugins/pkg/resmgr/control/thp"
 )
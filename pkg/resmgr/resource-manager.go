@@ -15,10 +15,11 @@
 package resmgr
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"sync"
-
-	//	"time"
+	"time"
 
 	"github.com/containers/nri-plugins/pkg/agent"
 	"github.com/containers/nri-plugins/pkg/healthz"
@@ -66,6 +67,9 @@ type resmgr struct {
 	stop    chan interface{} // channel for signalling shutdown to goroutines
 	nri     *nriPlugin       // NRI plugins, if we're running as such
 	running bool
+
+	reconcileStop chan interface{} // channel for stopping controller reconciliation
+	coalesceStop  chan interface{} // channel for stopping coalesced post-update hooks
 }
 
 const (
@@ -210,6 +214,8 @@ func (m *resmgr) Stop() {
 	m.Lock()
 	defer m.Unlock()
 
+	m.stopReconcile()
+	m.stopCoalesce()
 	m.nri.stop()
 }
 
@@ -256,9 +262,36 @@ func (m *resmgr) setupControllers() error {
 		return resmgrError("failed to create resource controller: %v", err)
 	}
 
+	mux := instrumentation.HTTPServer().GetMux()
+	mux.HandleFunc("/controllers", m.serveControllerStatus)
+
+	healthz.RegisterHealthChecker("resource-control", m.checkControllerHealth)
+
 	return nil
 }
 
+// checkControllerHealth reports resource controllers degraded if any
+// enabled controller is unhealthy.
+func (m *resmgr) checkControllerHealth() (healthz.Status, error) {
+	if err := m.control.Ready(); err != nil {
+		return healthz.Degraded, err
+	}
+	return healthz.Healthy, nil
+}
+
+// serveControllerStatus serves the status of resource controllers.
+func (m *resmgr) serveControllerStatus(w http.ResponseWriter, _ *http.Request) {
+	data, err := json.Marshal(m.control.Controllers())
+	if err != nil {
+		m.Errorf("failed to marshal controller status: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s\r\n", data)
+}
+
 // startControllers start the resource controllers.
 func (m *resmgr) startControllers() error {
 	cfg := m.cfg.CommonConfig()
@@ -266,9 +299,102 @@ func (m *resmgr) startControllers() error {
 		return resmgrError("failed to start resource controllers: %v", err)
 	}
 
+	m.startReconcile(cfg.Control.ReconcileInterval.Duration)
+	m.startCoalesce(cfg.Control.PostUpdateCoalesceWindow.Duration)
+
 	return nil
 }
 
+// startReconcile (re)starts periodic reconciliation of controller decisions.
+func (m *resmgr) startReconcile(interval time.Duration) {
+	m.stopReconcile()
+
+	if interval <= 0 {
+		return
+	}
+
+	m.Info("reconciling controller decisions every %s", interval)
+
+	stop := make(chan interface{})
+	m.reconcileStop = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case _ = <-stop:
+				return
+			case _ = <-ticker.C:
+				m.Lock()
+				select {
+				case _ = <-stop:
+					// stopped while we were waiting for the lock
+					m.Unlock()
+					return
+				default:
+				}
+				if err := m.control.RunReconcileHooks(); err != nil {
+					m.Warn("controller reconciliation detected unresolved drift: %v", err)
+				}
+				m.Unlock()
+			}
+		}
+	}()
+}
+
+// stopReconcile stops periodic reconciliation of controller decisions.
+func (m *resmgr) stopReconcile() {
+	if m.reconcileStop != nil {
+		close(m.reconcileStop)
+		m.reconcileStop = nil
+	}
+}
+
+// startCoalesce (re)starts running coalesced post-update hooks.
+func (m *resmgr) startCoalesce(window time.Duration) {
+	m.stopCoalesce()
+
+	if window <= 0 {
+		return
+	}
+
+	m.Info("coalescing post-update hooks within %s", window)
+
+	stop := make(chan interface{})
+	m.coalesceStop = stop
+	go func() {
+		ticker := time.NewTicker(window)
+		defer ticker.Stop()
+		for {
+			select {
+			case _ = <-stop:
+				return
+			case _ = <-ticker.C:
+				m.Lock()
+				select {
+				case _ = <-stop:
+					// stopped while we were waiting for the lock
+					m.Unlock()
+					return
+				default:
+				}
+				if err := m.control.RunPendingPostUpdateHooks(); err != nil {
+					m.Warn("coalesced post-update hooks failed: %v", err)
+				}
+				m.Unlock()
+			}
+		}
+	}()
+}
+
+// stopCoalesce stops running coalesced post-update hooks.
+func (m *resmgr) stopCoalesce() {
+	if m.coalesceStop != nil {
+		close(m.coalesceStop)
+		m.coalesceStop = nil
+	}
+}
+
 // updateTopologyZones updates the 'topology zone' CRDs.
 func (m *resmgr) updateTopologyZones() {
 	if zones := m.policy.GetTopologyZones(); len(zones) != 0 {
@@ -297,6 +423,8 @@ func (m *resmgr) reconfigure(cfg cfgapi.ResmgrConfig) error {
 		log.Configure(&mCfg.Log)
 		instrumentation.Reconfigure(&mCfg.Instrumentation)
 		m.control.StartStopControllers(&mCfg.Control)
+		m.startReconcile(mCfg.Control.ReconcileInterval.Duration)
+		m.startCoalesce(mCfg.Control.PostUpdateCoalesceWindow.Duration)
 
 		err := m.policy.Reconfigure(cfg.PolicyConfig())
 		if err != nil {
@@ -18,6 +18,7 @@ import (
 	"errors"
 	"fmt"
 	"io/fs"
+	"maps"
 	"os"
 	"path/filepath"
 	"sort"
@@ -113,6 +114,10 @@ type System interface {
 	PresentCPUs() cpuset.CPUSet
 	OnlineCPUs() cpuset.CPUSet
 	IsolatedCPUs() cpuset.CPUSet
+	NohzFullCPUs() cpuset.CPUSet
+	SMTActive() bool
+	CPUVulnerabilities() map[string]string
+	BootCPU() idset.ID
 	OfflineCPUs() cpuset.CPUSet
 	CoreKindCPUs(CoreKind) cpuset.CPUSet
 	CoreKinds() []CoreKind
@@ -136,6 +141,10 @@ type system struct {
 	presentCPUs   idset.IDSet                          // set of present CPUs
 	onlineCPUs    idset.IDSet                          // set of online CPUs
 	isolatedCPUs  idset.IDSet                          // set of isolated CPUs
+	nohzFullCPUs  idset.IDSet                          // set of tickless (nohz_full) CPUs
+	smtActive     bool                                 // whether SMT (hyperthreading) is active
+	vulns         map[string]string                    // CPU vulnerabilities and their mitigation state
+	bootCPU       idset.ID                             // CPU the kernel booted on, -1 if unknown
 	coreKindCPUs  map[CoreKind]idset.IDSet             // CPU cores by kind (P-/E-cores)
 	minThreads    int                                  // min. hyperthreads per core
 	maxThreads    int                                  // max. hyperthreads per core
@@ -215,6 +224,7 @@ type CPU interface {
 	GetLastLevelCaches() []*Cache
 	GetLastLevelCacheCPUSet() cpuset.CPUSet
 	CoreKind() CoreKind
+	Capacity() uint64
 }
 
 type cpu struct {
@@ -234,6 +244,7 @@ type cpu struct {
 	sstClos  int         // SST-CP CLOS the CPU is associated with
 	caches   []*Cache    // caches for this CPU
 	coreKind CoreKind    // P- or E-core
+	capacity uint64      // compute capacity, 0 if unknown
 }
 
 // CPUFreq is a CPU frequency scaling range
@@ -342,8 +353,9 @@ func DiscoverSystemAt(path string, args ...DiscoveryFlag) (System, error) {
 	}
 
 	sys := &system{
-		Logger: log,
-		path:   path,
+		Logger:  log,
+		path:    path,
+		bootCPU: -1,
 	}
 
 	if err := sys.Discover(flags); err != nil {
@@ -410,6 +422,11 @@ func (sys *system) Discover(flags DiscoveryFlag) error {
 		sys.Debug("  -   online: %s", sys.OnlineCPUs())
 		sys.Debug("  -  offline: %s", sys.OfflineCPUs())
 		sys.Debug("  - isolated: %s", sys.IsolatedCPUs())
+		sys.Debug("  - nohzfull: %s", sys.NohzFullCPUs())
+		sys.Debug("  - smt active: %v", sys.SMTActive())
+		for name, state := range sys.CPUVulnerabilities() {
+			sys.Debug("  - vulnerability %s: %s", name, state)
+		}
 
 		for kind, name := range coreKindNames {
 			if cpus := sys.CoreKindCPUs(kind); !cpus.IsEmpty() {
@@ -458,6 +475,7 @@ func (sys *system) Discover(flags DiscoveryFlag) error {
 			sys.Debug("  base freq: %d", cpu.baseFreq)
 			sys.Debug("       freq: %d - %d", cpu.freq.min, cpu.freq.max)
 			sys.Debug("        epp: %d", cpu.epp)
+			sys.Debug("   capacity: %d", cpu.capacity)
 
 			for idx, c := range cpu.caches {
 				sys.Debug("    cache #%d:", idx)
@@ -662,6 +680,47 @@ func (sys *system) IsolatedCPUs() cpuset.CPUSet {
 	return CPUSetFromIDSet(sys.isolatedCPUs)
 }
 
+// NohzFullCPUs gets the set of tickless (nohz_full) CPUs.
+func (sys *system) NohzFullCPUs() cpuset.CPUSet {
+	return CPUSetFromIDSet(sys.nohzFullCPUs)
+}
+
+// SMTActive returns true if SMT (hyperthreading) is active, so that
+// threads of the same core may run concurrently.
+func (sys *system) SMTActive() bool {
+	return sys.smtActive
+}
+
+// CPUVulnerabilities returns the CPU vulnerabilities known to the
+// kernel and their mitigation state, like "Not affected" or
+// "Mitigation: Clear CPU buffers; SMT vulnerable", by vulnerability
+// name.
+func (sys *system) CPUVulnerabilities() map[string]string {
+	return maps.Clone(sys.vulns)
+}
+
+// BootCPU returns the CPU the kernel booted on, or -1 if it is unknown.
+// The boot CPU often runs housekeeping work that cannot be moved to
+// other CPUs.
+func (sys *system) BootCPU() idset.ID {
+	return sys.bootCPU
+}
+
+// SMTVulnerable returns true if SMT is active and the mitigation state
+// of any CPU vulnerability tells that threads of the same core are not
+// protected from each other.
+func SMTVulnerable(sys System) bool {
+	if !sys.SMTActive() {
+		return false
+	}
+	for _, state := range sys.CPUVulnerabilities() {
+		if strings.Contains(state, "SMT vulnerable") {
+			return true
+		}
+	}
+	return false
+}
+
 // OfflineCPUs gets the set of offline CPUs.
 func (sys *system) OfflineCPUs() cpuset.CPUSet {
 	offline := sys.presentCPUs.Clone()
@@ -722,6 +781,75 @@ func (sys *system) Isolated() cpuset.CPUSet {
 	return sys.IsolatedCPUs()
 }
 
+// discoverNohzFullCPUs discovers tickless (nohz_full) CPUs from sysfs,
+// or from the kernel command line if the sysfs entry is missing, as it
+// is on kernels without CONFIG_NO_HZ_FULL.
+func (sys *system) discoverNohzFullCPUs(base string) idset.IDSet {
+	var cpus string
+
+	buf, err := readSysfsEntry(base, "nohz_full", nil)
+	if err == nil {
+		cpus = strings.TrimSpace(buf)
+	} else {
+		cmdline := filepath.Join(filepath.Dir(sys.path), "proc", "cmdline")
+		blob, cerr := os.ReadFile(cmdline)
+		if cerr != nil {
+			sys.Debug("no tickless cpus: %v, %v", err, cerr)
+			return idset.NewIDSet()
+		}
+		for _, arg := range strings.Fields(string(blob)) {
+			if value, ok := strings.CutPrefix(arg, "nohz_full="); ok {
+				cpus = value
+			}
+		}
+	}
+
+	// The kernel reports "(null)" if no CPUs are tickless.
+	if cpus == "" || cpus == "(null)" {
+		return idset.NewIDSet()
+	}
+
+	cset, err := cpuset.Parse(cpus)
+	if err != nil {
+		sys.Error("failed to parse tickless cpus %q: %v", cpus, err)
+		return idset.NewIDSet()
+	}
+
+	return idset.NewIDSet(cset.UnsortedList()...)
+}
+
+// discoverSMTAndVulnerabilities discovers if SMT is active and the
+// mitigation state of CPU vulnerabilities. Missing entries, like on
+// older kernels, are taken as inactive SMT and no vulnerabilities.
+func (sys *system) discoverSMTAndVulnerabilities(base string) (bool, map[string]string) {
+	active := false
+	if buf, err := readSysfsEntry(base, "smt/active", nil); err == nil {
+		active = strings.TrimSpace(buf) == "1"
+	} else {
+		sys.Debug("unknown SMT state: %v", err)
+	}
+
+	vulns := map[string]string{}
+	entries, err := os.ReadDir(filepath.Join(base, "vulnerabilities"))
+	if err != nil {
+		sys.Debug("unknown CPU vulnerabilities: %v", err)
+		return active, vulns
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		buf, err := readSysfsEntry(filepath.Join(base, "vulnerabilities"), entry.Name(), nil)
+		if err != nil {
+			sys.Debug("failed to read CPU vulnerability %s: %v", entry.Name(), err)
+			continue
+		}
+		vulns[entry.Name()] = strings.TrimSpace(buf)
+	}
+
+	return active, vulns
+}
+
 // Discover Cpus present in the system.
 func (sys *system) discoverCPUs() error {
 	if sys.cpus != nil {
@@ -751,6 +879,10 @@ func (sys *system) discoverCPUs() error {
 		sys.Error("failed to get set of isolated cpus: %v", err)
 	}
 
+	sys.nohzFullCPUs = sys.discoverNohzFullCPUs(base)
+	sys.smtActive, sys.vulns = sys.discoverSMTAndVulnerabilities(base)
+	sys.bootCPU = sys.discoverBootCPU(base)
+
 	sys.coreKindCPUs = make(map[CoreKind]idset.IDSet)
 
 	for kind, name := range coreKindEnvOverrides {
@@ -796,6 +928,24 @@ func (sys *system) discoverCPUs() error {
 	return nil
 }
 
+// discoverBootCPU returns the CPU the kernel booted on. The kernel does
+// not let the boot CPU go offline, so unlike other CPUs it usually has
+// no online entry. If every online CPU has one, the boot CPU is assumed
+// to be the first online CPU.
+func (sys *system) discoverBootCPU(base string) idset.ID {
+	online := sys.onlineCPUs.SortedMembers()
+	if len(online) == 0 {
+		return -1
+	}
+	for _, id := range online {
+		entry := filepath.Join(base, "cpu"+strconv.Itoa(int(id)), "online")
+		if _, err := os.Stat(entry); errors.Is(err, os.ErrNotExist) {
+			return id
+		}
+	}
+	return online[0]
+}
+
 // Perform a basic sanity checks of hybrid cores.
 func (sys *system) checkCoreKinds() error {
 	switch len(sys.coreKindCPUs) {
@@ -909,11 +1059,16 @@ func (sys *system) discoverCPU(path string) error {
 		cpu.freq.min = 0
 	}
 	if _, err := readSysfsEntry(path, "cpufreq/cpuinfo_max_freq", &cpu.freq.max); err != nil {
-		cpu.freq.max = 0
+		if _, err := readSysfsEntry(path, "cpufreq/scaling_max_freq", &cpu.freq.max); err != nil {
+			cpu.freq.max = 0
+		}
 	}
 	if _, err := readSysfsEntry(path, "cpufreq/energy_performance_preference", &cpu.epp); err != nil {
 		cpu.epp = EPPUnknown
 	}
+	if _, err := readSysfsEntry(path, "cpu_capacity", &cpu.capacity); err != nil {
+		cpu.capacity = 0
+	}
 	if node, _ := filepath.Glob(filepath.Join(path, "node[0-9]*")); len(node) == 1 {
 		cpu.node = getEnumeratedID(node[0])
 	} else {
@@ -988,6 +1143,16 @@ func (c *cpu) FrequencyRange() CPUFreq {
 	return c.freq
 }
 
+// Min returns the minimum frequency (kHz) of a frequency range, 0 if unknown.
+func (f CPUFreq) Min() uint64 {
+	return f.min
+}
+
+// Max returns the maximum frequency (kHz) of a frequency range, 0 if unknown.
+func (f CPUFreq) Max() uint64 {
+	return f.max
+}
+
 // EPP returns the energy performance profile of this CPU.
 func (c *cpu) EPP() EPP {
 	return c.epp
@@ -1124,6 +1289,14 @@ func (c *cpu) CoreKind() CoreKind {
 	return c.coreKind
 }
 
+// Capacity returns the compute capacity of this CPU relative to the
+// most capable CPU in the system, which has capacity 1024. Capacity is
+// only available on systems with asymmetric CPUs, like ARM big.LITTLE.
+// Returns 0 if unknown.
+func (c *cpu) Capacity() uint64 {
+	return c.capacity
+}
+
 func (c *Cache) ID() int {
 	if c == nil {
 		return 0
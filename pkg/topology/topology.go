@@ -15,7 +15,9 @@
 package topology
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -280,6 +282,65 @@ func findSysFsDevice(devType string, major, minor int64) (string, error) {
 	return realDevPath, nil
 }
 
+// findMountSource returns the filesystem type and the source of the
+// mount with the given device numbers in mountinfo.
+func findMountSource(mountinfo io.Reader, major, minor uint32) (string, string, error) {
+	devNum := fmt.Sprintf("%d:%d", major, minor)
+	scanner := bufio.NewScanner(mountinfo)
+	for scanner.Scan() {
+		// mount-id parent-id major:minor root mount-point options
+		// [optional fields...] - fstype source super-options
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[2] != devNum {
+			continue
+		}
+		for i, field := range fields {
+			if field == "-" && i+2 < len(fields) {
+				return fields[i+1], fields[i+2], nil
+			}
+		}
+		return "", "", fmt.Errorf("malformed mountinfo entry %q", scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", fmt.Errorf("failed to read mountinfo: %w", err)
+	}
+	return "", "", fmt.Errorf("no mount found for device %s", devNum)
+}
+
+// btrfsDevices returns the sysfs paths of all devices of the btrfs
+// filesystem that uses the device at devPath. If the device is in no
+// btrfs filesystem, only devPath is returned.
+func btrfsDevices(devPath string) ([]string, error) {
+	fsDirs, err := filepath.Glob(filepath.Join(sysRoot, "/sys/fs/btrfs/*/devices"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find btrfs filesystems: %w", err)
+	}
+	for _, fsDir := range fsDirs {
+		entries, err := os.ReadDir(fsDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read btrfs devices %s: %w", fsDir, err)
+		}
+		devs := []string{}
+		found := false
+		for _, entry := range entries {
+			realDev, err := filepath.EvalSymlinks(filepath.Join(fsDir, entry.Name()))
+			if err != nil {
+				return nil, fmt.Errorf("failed to get real path for %s: %w", entry.Name(), err)
+			}
+			if sysRoot != "" {
+				realDev = strings.TrimPrefix(realDev, sysRoot)
+			}
+			devs = append(devs, realDev)
+			found = found || realDev == devPath
+		}
+		if found {
+			log.Debugf("devices of btrfs filesystem %s: %s", filepath.Dir(fsDir), strings.Join(devs, ","))
+			return devs, nil
+		}
+	}
+	return []string{devPath}, nil
+}
+
 // readFilesInDirectory small helper to fill struct with content from sysfs entry.
 func readFilesInDirectory(fileMap map[string]*string, dir string) error {
 	for k, v := range fileMap {
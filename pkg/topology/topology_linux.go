@@ -8,6 +8,9 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+// mountInfoPath is the mountinfo file used to find the sources of mounts.
+var mountInfoPath = "/proc/self/mountinfo"
+
 // FindSysFsDevice for given argument returns physical device where it is linked to.
 // For device nodes it will return path for device itself. For regular files or directories
 // this function returns physical device where this inode resides (storage device).
@@ -44,3 +47,52 @@ func FindSysFsDevice(dev string) (string, error) {
 
 	return realDevPath, nil
 }
+
+// FindBlockDevices returns the sysfs paths of the block devices that back
+// the filesystem of a path, like a mount point. For device nodes the
+// device itself is returned. Most filesystems have a single backing
+// device, but for a multi-device btrfs filesystem all of its devices are
+// returned. Device-mapper (like LVM) and md devices are returned as is,
+// NewTopologyHints resolves them to the devices they depend on.
+func FindBlockDevices(path string) ([]string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get stat for %s: %w", path, err)
+	}
+
+	dev := fi.Sys().(*syscall.Stat_t).Dev
+	if fi.Mode()&os.ModeDevice != 0 || unix.Major(dev) != 0 {
+		devPath, err := FindSysFsDevice(path)
+		if err != nil {
+			return nil, err
+		}
+		return []string{devPath}, nil
+	}
+
+	// Filesystems like btrfs have an anonymous device number, find
+	// the backing device from the source of the mount.
+	f, err := os.Open(mountInfoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", mountInfoPath, err)
+	}
+	defer f.Close()
+
+	fsType, source, err := findMountSource(f, unix.Major(dev), unix.Minor(dev))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find mount of %s: %w", path, err)
+	}
+	if fsType != "btrfs" {
+		return nil, fmt.Errorf("%s is on a virtual %s filesystem", path, fsType)
+	}
+
+	devPath, err := FindSysFsDevice(source)
+	if err != nil {
+		return nil, err
+	}
+	if devPath == "" {
+		return nil, fmt.Errorf("source device %s of %s not found", source, path)
+	}
+	log.Debugf("%s: on btrfs filesystem on %s (%s)", path, source, devPath)
+
+	return btrfsDevices(devPath)
+}
@@ -13,3 +13,9 @@ import "errors"
 func FindSysFsDevice(dev string) (string, error) {
 	return "", errors.New("not implemented")
 }
+
+// FindBlockDevices returns the sysfs paths of the block devices that back
+// the filesystem of a path, like a mount point.
+func FindBlockDevices(path string) ([]string, error) {
+	return nil, errors.New("not implemented")
+}
@@ -20,6 +20,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"sort"
+	"strings"
 
 	"testing"
 )
@@ -326,6 +327,112 @@ func TestMergeTopologyHints(t *testing.T) {
 	}
 }
 
+func TestFindMountSource(t *testing.T) {
+	mountinfo := `22 28 0:22 / /proc rw,relatime - proc proc rw
+28 1 259:2 / / rw,relatime shared:1 - ext4 /dev/nvme0n1p2 rw
+45 28 0:45 / /data rw,relatime shared:25 master:3 - btrfs /dev/nvme1n1 rw,space_cache=v2
+46 28 0:46 / /broken rw,relatime
+`
+	cases := []struct {
+		name           string
+		major, minor   uint32
+		expectedFsType string
+		expectedSource string
+		expectedErr    bool
+	}{
+		{
+			name:           "root",
+			major:          259,
+			minor:          2,
+			expectedFsType: "ext4",
+			expectedSource: "/dev/nvme0n1p2",
+		},
+		{
+			name:           "optional fields",
+			major:          0,
+			minor:          45,
+			expectedFsType: "btrfs",
+			expectedSource: "/dev/nvme1n1",
+		},
+		{
+			name:        "malformed",
+			major:       0,
+			minor:       46,
+			expectedErr: true,
+		},
+		{
+			name:        "not found",
+			major:       8,
+			minor:       1,
+			expectedErr: true,
+		},
+	}
+	for _, tc := range cases {
+		test := tc
+		t.Run(test.name, func(t *testing.T) {
+			fsType, source, err := findMountSource(strings.NewReader(mountinfo), test.major, test.minor)
+			if test.expectedErr {
+				if err == nil {
+					t.Fatalf("expected error, got %q, %q", fsType, source)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if fsType != test.expectedFsType || source != test.expectedSource {
+				t.Fatalf("expected %q, %q, got %q, %q", test.expectedFsType, test.expectedSource, fsType, source)
+			}
+		})
+	}
+}
+
+func TestBtrfsDevices(t *testing.T) {
+	root := t.TempDir()
+	devices := []string{
+		"/sys/devices/pci0000:00/0000:00:01.0/nvme/nvme0/nvme0n1",
+		"/sys/devices/pci0000:80/0000:80:01.0/nvme/nvme1/nvme1n1",
+		"/sys/devices/pci0000:80/0000:80:02.0/nvme/nvme2/nvme2n1",
+	}
+	for _, dev := range devices {
+		if err := os.MkdirAll(filepath.Join(root, dev), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// nvme0n1 and nvme1n1 are devices of the same filesystem.
+	fsDevices := filepath.Join(root, "/sys/fs/btrfs/1234/devices")
+	if err := os.MkdirAll(fsDevices, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, dev := range devices[:2] {
+		if err := os.Symlink(filepath.Join(root, dev), filepath.Join(fsDevices, filepath.Base(dev))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if path, err := filepath.EvalSymlinks(root); err == nil {
+		root = path
+	}
+	SetSysRoot(root)
+	defer SetSysRoot("")
+
+	devs, err := btrfsDevices(devices[1])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sort.Strings(devs)
+	if !reflect.DeepEqual(devs, devices[:2]) {
+		t.Errorf("expected devices %v, got %v", devices[:2], devs)
+	}
+
+	devs, err = btrfsDevices(devices[2])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(devs, devices[2:]) {
+		t.Errorf("expected only device %v, got %v", devices[2:], devs)
+	}
+}
+
 func TestNewTopologyHints(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping test in short mode.")